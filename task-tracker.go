@@ -1,153 +1,9308 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"hash/fnv"
+	"io"
+	"maps"
+	mathrand "math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Task represents a single task
 type Task struct {
+	ID             int            `json:"id"`
+	Title          string         `json:"title"`
+	Status         string         `json:"status"`
+	CreatedAt      string         `json:"created_at"`
+	IdempotencyKey string         `json:"idempotency_key,omitempty"`
+	DueDate        string         `json:"due_date,omitempty"`
+	CompletedAt    string         `json:"completed_at,omitempty"`
+	Recurrence     string         `json:"recurrence,omitempty"`
+	Anchor         string         `json:"anchor,omitempty"`
+	RecurDay       int            `json:"recur_day,omitempty"`
+	Project        string         `json:"project,omitempty"`
+	Tags           []string       `json:"tags,omitempty"`
+	Priority       Priority       `json:"priority,omitempty"`
+	RecurFrom      int            `json:"recur_from,omitempty"`
+	Pinned         bool           `json:"pinned,omitempty"`
+	BlockedBy      []int          `json:"blocked_by,omitempty"`
+	Links          []int          `json:"links,omitempty"` // related tasks, see link --scan
+	Waiting        *WaitingOn     `json:"waiting,omitempty"`
+	Attachments    []string       `json:"attachments,omitempty"` // absolute paths
+	Comments       []Comment      `json:"comments,omitempty"`
+	TimeLog        []TimeEntry    `json:"time_log,omitempty"`
+	History        []HistoryEvent `json:"history,omitempty"`
+}
+
+// WaitingOn records who a task is waiting on and when to follow up
+type WaitingOn struct {
+	Person string `json:"person"`
+	Since  string `json:"since"`
+	Until  string `json:"until,omitempty"`
+}
+
+// String describes the wait for history entries, e.g. "Alice until 2024-07-05"
+func (w *WaitingOn) String() string {
+	if w == nil {
+		return ""
+	}
+	if w.Until == "" {
+		return w.Person
+	}
+	return w.Person + " until " + w.Until
+}
+
+// Comment is a note added to a task, such as the reason it was completed late
+type Comment struct {
+	At   string   `json:"at"`
+	Text string   `json:"text"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+// TimeEntry is a span of time tracked on a task; End is empty while the
+// timer runs
+type TimeEntry struct {
+	Start string `json:"start"`
+	End   string `json:"end,omitempty"`
+}
+
+// lateTag marks the comment giving the reason a task was completed late
+const lateTag = "late"
+
+// HistoryEvent records one change to a task field
+type HistoryEvent struct {
+	At    string `json:"at"`
+	Field string `json:"field"`
+	From  string `json:"from,omitempty"`
+	To    string `json:"to,omitempty"`
+	Note  string `json:"note,omitempty"`
+}
+
+// recordChange appends a history event to task when a field changes value
+func recordChange(task *Task, at time.Time, field, from, to string) {
+	if from == to {
+		return
+	}
+	task.History = append(task.History, HistoryEvent{
+		At:    at.Format(timeLayout),
+		Field: field,
+		From:  from,
+		To:    to,
+	})
+}
+
+// Priority is a task priority stored as a canonical level; the zero value means none
+type Priority int
+
+// Priority levels, from most to least important
+const (
+	PriorityNone Priority = iota
+	PriorityHigh
+	PriorityMedium
+	PriorityLow
+)
+
+// priorityNames lists the accepted spellings of each level: words, letters
+// (todo.txt), numbers and taskwarrior's H/M/L
+var priorityNames = map[string]Priority{
+	"high": PriorityHigh, "h": PriorityHigh, "a": PriorityHigh, "1": PriorityHigh,
+	"medium": PriorityMedium, "med": PriorityMedium, "m": PriorityMedium, "b": PriorityMedium, "2": PriorityMedium,
+	"low": PriorityLow, "l": PriorityLow, "c": PriorityLow, "3": PriorityLow,
+	"none": PriorityNone, "": PriorityNone,
+}
+
+// parsePriority parses any common spelling of a priority, e.g. high, B, (A), 3 or M
+func parsePriority(value string) (Priority, error) {
+	key := strings.ToLower(strings.TrimSpace(value))
+	key = strings.TrimSuffix(strings.TrimPrefix(key, "("), ")")
+	if p, ok := priorityNames[key]; ok {
+		return p, nil
+	}
+	return PriorityNone, fmt.Errorf("invalid priority %q (use high/medium/low, A/B/C or 1/2/3)", value)
+}
+
+// Format renders the priority as a word, letter or number
+func (p Priority) Format(style string) string {
+	if p < PriorityHigh || p > PriorityLow {
+		return ""
+	}
+	switch style {
+	case "letter":
+		return string(rune('A' + int(p) - 1))
+	case "number":
+		return strconv.Itoa(int(p))
+	}
+	return [...]string{"", "high", "medium", "low"}[p]
+}
+
+// String renders the priority in the configured style
+func (p Priority) String() string {
+	return p.Format(config.PriorityDisplay)
+}
+
+// rank orders priorities for sorting: high first, tasks without a priority last
+func (p Priority) rank() int {
+	if p == PriorityNone {
+		return int(PriorityLow) + 1
+	}
+	return int(p)
+}
+
+// MarshalJSON stores the priority as its canonical word
+func (p Priority) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.Format("word"))
+}
+
+// UnmarshalJSON accepts any spelling parsePriority does, as a string or a number
+func (p *Priority) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		var number json.Number
+		if err := json.Unmarshal(data, &number); err != nil {
+			return fmt.Errorf("invalid priority %s", data)
+		}
+		value = number.String()
+	}
+
+	parsed, err := parsePriority(value)
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+// Colors for terminal output; disableColors empties them for --plain
+var (
+	ColorReset  = "\033[0m"
+	ColorBright = "\033[1m"
+	ColorDim    = "\033[2m"
+	ColorRed    = "\033[31m"
+	ColorGreen  = "\033[32m"
+	ColorYellow = "\033[33m"
+	ColorBlue   = "\033[34m"
+	ColorCyan   = "\033[36m"
+	ColorWhite  = "\033[37m"
+)
+
+// themes are the palettes the theme setting and --theme choose from. A theme
+// only changes hues: every status and severity also has an emoji, marker or
+// word, so nothing is told by color alone in any theme or with --plain.
+var themes = map[string]func(){
+	"default": func() {},
+	// blue for good and orange for bad, told apart with red-green color blindness
+	"colorblind": func() {
+		ColorRed = "\033[38;5;208m"
+		ColorGreen = "\033[38;5;33m"
+		ColorYellow = "\033[38;5;220m"
+		ColorBlue = "\033[38;5;117m"
+	},
+}
+
+// disableColors turns off all color output
+func disableColors() {
+	ColorReset, ColorBright, ColorDim, ColorRed, ColorGreen = "", "", "", "", ""
+	ColorYellow, ColorBlue, ColorCyan, ColorWhite = "", "", "", ""
+}
+
+// dataFile is the task store in use. It is tasks.json in the current
+// directory unless resolveDataFile finds or is given another one before
+// the command runs.
+var dataFile = defaultDataFile
+
+// defaultDataFile is the store used when no other is found or given
+const defaultDataFile = "tasks.json"
+
+// localDataFile is the name of a per-directory store. Like git finds .git,
+// commands look for one in the current directory and each parent.
+const localDataFile = ".tasks.json"
+
+// dataFileEnv names a store explicitly, like --file
+const dataFileEnv = "TASK_TRACKER_FILE"
+
+// dataFileSource says how dataFile was chosen, for doctor and --verbose
+var dataFileSource = "default"
+
+// resolveDataFile picks the task store: --file, then TASK_TRACKER_FILE,
+// then the nearest .tasks.json walking up from the current directory, then
+// tasks.json in the current directory. --global skips the search; an
+// explicit path is never replaced by a discovered one.
+func resolveDataFile() error {
+	if globals.File != "" && globals.Global {
+		return newError(ErrUsage, "choose one of --file and --global")
+	}
+	switch {
+	case globals.File != "":
+		useDataFile(globals.File, "--file")
+	case os.Getenv(dataFileEnv) != "":
+		useDataFile(os.Getenv(dataFileEnv), dataFileEnv)
+	case globals.Global:
+		useDataFile(defaultDataFile, "--global")
+	default:
+		if path := findLocalDataFile(); path != "" {
+			useDataFile(path, "found "+localDataFile)
+		}
+	}
+	if globals.Verbose {
+		path, err := filepath.Abs(dataFile)
+		if err != nil {
+			path = dataFile
+		}
+		fmt.Fprintf(os.Stderr, "%s📂 Using %s (%s)%s\n", ColorDim, path, dataFileSource, ColorReset)
+	}
+	return nil
+}
+
+// findLocalDataFile returns the nearest .tasks.json in the current
+// directory or a parent, or "" when there is none
+func findLocalDataFile() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		path := filepath.Join(dir, localDataFile)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// useDataFile makes path the task store, with its side files next to it
+func useDataFile(path string, source string) {
+	dataFile, dataFileSource = path, source
+	viewFile = path + ".view"
+	spoolFile = path + ".spool"
+	stateFile = path + ".state"
+	captureFile = path + ".inbox.jsonl"
+	if path == defaultDataFile {
+		captureFile = defaultCaptureFile
+	}
+	drainingFile = captureFile + ".draining"
+	conflictFile = path + ".conflicts.jsonl"
+	if path == defaultDataFile {
+		conflictFile = defaultConflictFile
+	}
+}
+
+// contextName names the task store in use: "global" for tasks.json in the
+// current directory, the directory holding a .tasks.json, or the file name
+// of a store given with --file or TASK_TRACKER_FILE
+func contextName() string {
+	path, err := filepath.Abs(dataFile)
+	if err != nil {
+		path = dataFile
+	}
+	switch {
+	case filepath.Base(path) == localDataFile:
+		return filepath.Base(filepath.Dir(path))
+	case dataFile == defaultDataFile:
+		return "global"
+	}
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
+
+// mutatingCommands are the commands that change tasks, and so are announced
+// in the confirm_context store
+var mutatingCommands = map[string]bool{
+	"add": true, "capture": true, "done": true, "oops": true, "reopen": true, "set": true,
+	"wait": true, "attach": true, "track": true, "import": true, "merge": true,
+	"maintain": true, "compact": true, "link": true, "conflicts": true,
+}
+
+// guardContext warns when --context names another store than the one in
+// use, and announces a change to the confirm_context store with its name.
+// --force skips both.
+func guardContext(command string) {
+	if globals.Force {
+		return
+	}
+	name := contextName()
+	if globals.Context != "" && !strings.EqualFold(globals.Context, name) {
+		fmt.Fprintf(os.Stderr, "%s⚠️  --context %s, but the task store in use is %s (%s)%s\n",
+			ColorYellow, globals.Context, name, dataFile, ColorReset)
+	}
+	if mutatingCommands[command] && config.ConfirmContext != "" && strings.EqualFold(config.ConfirmContext, name) {
+		fmt.Fprintf(os.Stderr, "%s%s[%s]%s\n", ColorBright, ColorYellow, name, ColorReset)
+	}
+}
+
+// confirmBatch asks for the store's name to be typed before n tasks are
+// written at once to the confirm_context store, when n is over
+// confirm_batch. Without a terminal it refuses unless --force is given.
+func confirmBatch(n int) error {
+	name := contextName()
+	if globals.Force || config.ConfirmContext == "" || !strings.EqualFold(config.ConfirmContext, name) || n <= config.ConfirmBatch {
+		return nil
+	}
+	if !isTerminal(os.Stdin) {
+		return newError(ErrUsage, "writing %s to %s needs confirmation; run it on a terminal or pass --force", plural(n, "task"), name)
+	}
+	fmt.Fprintf(os.Stderr, "%s⚠️  This writes %s to %s%s%s.%s\nType %s to continue: ",
+		ColorYellow, plural(n, "task"), ColorBright, name, ColorYellow, ColorReset, name)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return wrapError(ErrIO, err, "could not read the confirmation")
+	}
+	if strings.TrimSpace(line) != name {
+		return newError(ErrCanceled, "not confirmed; nothing was written to %s", name)
+	}
+	return nil
+}
+
+// initDataFile creates an empty store: .tasks.json in the current directory
+// with local, so commands run here or below use it, or else the store in use
+func initDataFile(local bool) error {
+	path := dataFile
+	if local {
+		path = localDataFile
+	}
+	if _, err := os.Stat(path); err == nil {
+		return newError(ErrInvalid, "%s already exists", path)
+	}
+	if err := os.WriteFile(path, []byte("[]\n"), 0644); isReadOnlyError(err) {
+		return readOnlyError(path)
+	} else if err != nil {
+		return wrapError(ErrIO, err, "could not create %s", path)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	fmt.Printf("%s📂 Created %s%s\n", ColorGreen, abs, ColorReset)
+	return nil
+}
+
+const configFile = "config.json"
+
+// timeLayout is the format used for timestamps stored in the data file
+const timeLayout = "2006-01-02 15:04:05"
+
+// dateLayout is the format used for due dates
+const dateLayout = "2006-01-02"
+
+// Clock tells the current time. Commands read "now" from clock rather than
+// time.Now, so a fixed clock makes ages, due dates and recurrence repeatable.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the system clock
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// fixedClock always reports the same instant
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+// clock is the clock used by every command. It is a package variable like
+// config and globals rather than a parameter of each handler: with the tool
+// in one file and one command per process, start sets it once and tests swap
+// it for a fixedClock, which buys the repeatability without threading it
+// through every function that asks for the time.
+var clock Clock = realClock{}
+
+// clockEnv names the environment variable that fixes the clock, for
+// checking time-dependent output without waiting for the dates to come
+const clockEnv = "TASK_TRACKER_NOW"
+
+// clockFromEnv returns a fixed clock when clockEnv holds a timestamp or
+// date, and the system clock otherwise
+func clockFromEnv() (Clock, error) {
+	value := os.Getenv(clockEnv)
+	if value == "" {
+		return realClock{}, nil
+	}
+	for _, layout := range []string{timeLayout, dateLayout} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return fixedClock(t), nil
+		}
+	}
+	return nil, newError(ErrUsage, "invalid %s %q (use YYYY-MM-DD or YYYY-MM-DD HH:MM:SS)", clockEnv, value)
+}
+
+// Recurrence anchors: the next occurrence is scheduled from the due date or the completion date
+const (
+	AnchorDue  = "due"
+	AnchorDone = "done"
+)
+
+// Config holds user preferences loaded from config.json
+type Config struct {
+	WeekStart       string                `json:"week_start"`
+	DailyAddLimit   int                   `json:"daily_add_limit,omitempty"`
+	InboxLimit      int                   `json:"inbox_limit,omitempty"`
+	PriorityDisplay string                `json:"priority_display,omitempty"`
+	Theme           string                `json:"theme,omitempty"`
+	ConfirmContext  string                `json:"confirm_context,omitempty"`
+	ConfirmBatch    int                   `json:"confirm_batch,omitempty"`
+	UndoWindow      string                `json:"undo_window,omitempty"`
+	LateReasonAfter string                `json:"require_late_reason,omitempty"`
+	DoneSummary     bool                  `json:"done_summary"`
+	DefaultSort     string                `json:"default_sort,omitempty"`
+	IDDisplay       string                `json:"id_display,omitempty"`
+	IDAllocation    string                `json:"id_allocation,omitempty"`
+	Actor           string                `json:"actor,omitempty"`
+	ActorSlot       int                   `json:"actor_slot,omitempty"`
+	Urgency         UrgencyWeights        `json:"urgency_weights"`
+	ShareKey        string                `json:"share_key,omitempty"`
+	DateLayouts     []string              `json:"date_layouts,omitempty"`
+	CSVMappings     map[string]CSVMapping `json:"csv_mappings,omitempty"`
+	OverdueDays     OverdueThresholds     `json:"overdue_days"`
+	Retention       RetentionConfig       `json:"retention"`
+	Schema          Schema                `json:"schema"`
+	NormalizeTitles bool                  `json:"normalize_titles,omitempty"`
+	ServeQueueLimit int                   `json:"serve_queue_limit,omitempty"`
+	WebhookURL      string                `json:"webhook_url,omitempty"`
+	DigestCron      string                `json:"digest_cron,omitempty"`
+	Budgets         map[string]Budget     `json:"budgets,omitempty"`
+	APITokens       map[string]APIToken   `json:"api_tokens,omitempty"`
+}
+
+// APIToken lets a client use serve. Only the SHA-256 of the secret is kept;
+// Filter, when set, limits the tasks the token sees and may add.
+type APIToken struct {
+	Hash   string `json:"hash"`
+	Scope  string `json:"scope"`
+	Filter string `json:"filter,omitempty"`
+}
+
+// Budget caps a project's open tasks and the hours tracked on it per week
+// (from week_start); zero leaves that part uncapped
+type Budget struct {
+	OpenTasks   int     `json:"open_tasks,omitempty"`
+	WeeklyHours float64 `json:"weekly_hours,omitempty"`
+}
+
+// Schema holds conventions every open task must follow, for task lists
+// shared by a team. It is empty by default, which checks nothing.
+type Schema struct {
+	Required []string `json:"required,omitempty"` // any of project, priority, due and tags
+	Projects []string `json:"projects,omitempty"` // the only projects allowed
+	Tags     []string `json:"tags,omitempty"`     // the only tags allowed
+}
+
+// schemaFields are the fields a schema can require
+var schemaFields = []string{"project", "priority", "due", "tags"}
+
+// RetentionConfig controls how much per-task detail compact keeps;
+// zero keeps everything
+type RetentionConfig struct {
+	HistoryDays  int `json:"history_days"`
+	TimeLogDays  int `json:"time_log_days"` // older time entries become daily totals
+	MaxComments  int `json:"max_comments"`  // newest comments kept per task
+	ConflictDays int `json:"conflict_days"` // conflict records kept by maintain --prune-conflicts
+}
+
+// OverdueThresholds are the days late at which an overdue task moves from
+// the recent to the late bucket, and from late to severe
+type OverdueThresholds struct {
+	Late     int `json:"late"`
+	VeryLate int `json:"very_late"`
+}
+
+// CSVMapping describes how the columns of a CSV file map onto task fields.
+// Columns maps a task field (Title, Status, ...) to a CSV column name and
+// Status maps CSV status values to todo, in-progress or done.
+type CSVMapping struct {
+	Columns map[string]string `json:"columns"`
+	Status  map[string]string `json:"status,omitempty"`
+}
+
+// UrgencyWeights are the coefficients of each urgency component
+type UrgencyWeights struct {
+	Priority float64 `json:"priority"`
+	Due      float64 `json:"due"`
+	Age      float64 `json:"age"`
+	Pinned   float64 `json:"pinned"`
+	Blocked  float64 `json:"blocked"`
+}
+
+// config is the active configuration, loaded once at startup
+var config = defaultConfig()
+
+// defaultConfig returns the settings used when no config file exists
+func defaultConfig() Config {
+	return Config{
+		WeekStart:       "monday",
+		PriorityDisplay: "word",
+		UndoWindow:      "10m",
+		DoneSummary:     true,
+		DefaultSort:     "id",
+		IDDisplay:       "decimal",
+		IDAllocation:    "sequential",
+		Urgency: UrgencyWeights{
+			Priority: 6.0,
+			Due:      12.0,
+			Age:      2.0,
+			Pinned:   5.0,
+			Blocked:  -5.0,
+		},
+		OverdueDays:     OverdueThresholds{Late: 3, VeryLate: 14},
+		Retention:       RetentionConfig{HistoryDays: 180, TimeLogDays: 90, MaxComments: 50, ConflictDays: 90},
+		ServeQueueLimit: 100,
+		ConfirmBatch:    10,
+	}
+}
+
+// loadConfig loads settings from the config file, keeping defaults for missing keys
+func loadConfig() Config {
+	cfg := defaultConfig()
+
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return cfg
+	}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "%s⚠️  Ignoring invalid %s: %v%s\n", ColorYellow, configFile, err, ColorReset)
+		return defaultConfig()
+	}
+	if cfg.IDAllocation != "sequential" && cfg.IDAllocation != "actor" {
+		fmt.Fprintf(os.Stderr, "%s⚠️  Ignoring invalid id_allocation %q in %s (use sequential or actor)%s\n",
+			ColorYellow, cfg.IDAllocation, configFile, ColorReset)
+		cfg.IDAllocation = "sequential"
+	}
+	if _, ok := themes[cfg.Theme]; !ok && cfg.Theme != "" {
+		fmt.Fprintf(os.Stderr, "%s⚠️  Ignoring unknown theme %q in %s (use default or colorblind)%s\n",
+			ColorYellow, cfg.Theme, configFile, ColorReset)
+		cfg.Theme = ""
+	}
+	if cfg.ActorSlot < 0 || cfg.ActorSlot > actorSlots {
+		fmt.Fprintf(os.Stderr, "%s⚠️  Ignoring invalid actor_slot %d in %s (use 1-%d)%s\n",
+			ColorYellow, cfg.ActorSlot, configFile, actorSlots, ColorReset)
+		cfg.ActorSlot = 0
+	}
+	required := cfg.Schema.Required[:0]
+	for _, field := range cfg.Schema.Required {
+		if !slices.Contains(schemaFields, field) {
+			fmt.Fprintf(os.Stderr, "%s⚠️  Ignoring unknown required field %q in the schema of %s (use %s)%s\n",
+				ColorYellow, field, configFile, strings.Join(schemaFields, ", "), ColorReset)
+			continue
+		}
+		required = append(required, field)
+	}
+	cfg.Schema.Required = required
+	if cfg.LateReasonAfter != "" {
+		if _, err := parseInterval(cfg.LateReasonAfter); err != nil {
+			fmt.Fprintf(os.Stderr, "%s⚠️  Ignoring require_late_reason in %s: %v%s\n", ColorYellow, configFile, err, ColorReset)
+			cfg.LateReasonAfter = ""
+		}
+	}
+
+	return cfg
+}
+
+// weekStartDay returns the configured first day of the week
+func weekStartDay() time.Weekday {
+	if strings.EqualFold(config.WeekStart, "sunday") {
+		return time.Sunday
+	}
+	return time.Monday
+}
+
+// startOfWeek returns local midnight on the first day of the week containing t.
+// Every feature that groups tasks by week must bucket through this helper.
+func startOfWeek(t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := (int(day.Weekday()) - int(weekStartDay()) + 7) % 7
+	return day.AddDate(0, 0, -offset)
+}
+
+// parseTimestamp parses a timestamp stored in the data file as local time
+func parseTimestamp(value string) (time.Time, error) {
+	return time.ParseInLocation(timeLayout, value, time.Local)
+}
+
+// startOfDay returns local midnight on the day of t
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// parseDate parses a due date given as YYYY-MM-DD, today, tomorrow,
+// a weekday name (the next such day after today), an offset like +3d or a
+// number of working days like +3wd, which skips weekends and holidays
+func parseDate(value string, now time.Time) (time.Time, error) {
+	today := startOfDay(now)
+	lower := strings.ToLower(strings.TrimSpace(value))
+
+	switch lower {
+	case "today":
+		return today, nil
+	case "tomorrow":
+		return today.AddDate(0, 0, 1), nil
+	}
+
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		name := strings.ToLower(day.String())
+		if lower == name || lower == name[:3] {
+			ahead := (int(day) - int(today.Weekday()) + 7) % 7
+			if ahead == 0 {
+				ahead = 7
+			}
+			return today.AddDate(0, 0, ahead), nil
+		}
+	}
+
+	if days, ok := strings.CutSuffix(strings.TrimPrefix(lower, "+"), "wd"); ok && lower[0] == '+' {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 || n > maxIntervalDays {
+			return time.Time{}, fmt.Errorf("invalid working days %q (use e.g. +3wd)", value)
+		}
+		return workingCalendar().addWorkingDays(today, n), nil
+	}
+	if strings.HasPrefix(lower, "+") {
+		iv, err := parseInterval(lower[1:])
+		if err != nil {
+			return time.Time{}, err
+		}
+		return iv.addTo(today), nil
+	}
+
+	date, err := parseLayoutDate(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q (use YYYY-MM-DD, today, tomorrow, a weekday, +3d or +3wd)", value)
+	}
+	return date, nil
+}
+
+// parseLayoutDate parses an absolute date as YYYY-MM-DD or any of the
+// date_layouts from the config, tried in order
+func parseLayoutDate(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	var err error
+	for _, layout := range append([]string{dateLayout}, config.DateLayouts...) {
+		var date time.Time
+		if date, err = time.ParseInLocation(layout, value, time.Local); err == nil {
+			return startOfDay(date), nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// interval is a recurrence period such as 3d, 2w, 1mo or 1y
+type interval struct {
+	count int
+	unit  string
+}
+
+// maxIntervalDays bounds intervals and working-day offsets to a century,
+// so every date they produce still has a four-digit year
+const maxIntervalDays = 100 * 366
+
+// unitDays is the longest a unit of an interval can be, in days
+var unitDays = map[string]int{"d": 1, "w": 7, "mo": 31, "y": 366}
+
+// parseInterval parses periods written as <count><unit> with unit d, w, mo or y
+func parseInterval(value string) (interval, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	for _, unit := range []string{"mo", "d", "w", "y"} {
+		if !strings.HasSuffix(value, unit) {
+			continue
+		}
+		count, err := strconv.Atoi(strings.TrimSuffix(value, unit))
+		if err != nil || count <= 0 {
+			break
+		}
+		if count > maxIntervalDays/unitDays[unit] {
+			return interval{}, fmt.Errorf("interval %q is longer than 100 years", value)
+		}
+		return interval{count: count, unit: unit}, nil
+	}
+	return interval{}, fmt.Errorf("invalid interval %q (use e.g. 3d, 2w, 1mo or 1y)", value)
+}
+
+// addTo returns t moved forward by the interval. Month and year steps clamp
+// to the last day of shorter months, so Jan 31 + 1mo is Feb 28 (or 29).
+func (iv interval) addTo(t time.Time) time.Time {
+	switch iv.unit {
+	case "d":
+		return t.AddDate(0, 0, iv.count)
+	case "w":
+		return t.AddDate(0, 0, 7*iv.count)
+	case "mo":
+		return addMonths(t, iv.count)
+	case "y":
+		return addMonths(t, 12*iv.count)
+	}
+	return t
+}
+
+// String formats the interval the way it is written on the command line
+func (iv interval) String() string {
+	return fmt.Sprintf("%d%s", iv.count, iv.unit)
+}
+
+// addMonths adds n calendar months to t without overflowing into the next month
+func addMonths(t time.Time, n int) time.Time {
+	year, month, _ := t.Date()
+	first := time.Date(year, month+time.Month(n), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	return withDayOfMonth(first, t.Day())
+}
+
+// withDayOfMonth moves t to the given day of its month, clamped to the month's last day
+func withDayOfMonth(t time.Time, day int) time.Time {
+	first := t.AddDate(0, 0, 1-t.Day())
+	lastDay := first.AddDate(0, 1, -1).Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// nextDueDate computes the due date of the occurrence following a recurring task
+// completed at doneAt. Due-anchored monthly and yearly series return to their
+// original day (RecurDay) after a clamped short month.
+func nextDueDate(task Task, doneAt time.Time) (time.Time, error) {
+	iv, err := parseInterval(task.Recurrence)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	base := startOfDay(doneAt)
+	if task.Anchor == AnchorDue && task.DueDate != "" {
+		due, err := time.ParseInLocation(dateLayout, task.DueDate, time.Local)
+		if err != nil {
+			return time.Time{}, err
+		}
+		base = due
+	}
+
+	next := iv.addTo(base)
+	if task.Anchor == AnchorDue && task.RecurDay > 0 && (iv.unit == "mo" || iv.unit == "y") {
+		next = withDayOfMonth(next, task.RecurDay)
+	}
+	return next, nil
+}
+
+// urgencyComponent is one weighted term of a task's urgency score
+type urgencyComponent struct {
+	Name   string
+	Factor float64
+	Weight float64
+}
+
+// Value returns the contribution of the component to the score
+func (c urgencyComponent) Value() float64 {
+	if c.Factor == 0 {
+		return 0
+	}
+	return c.Factor * c.Weight
+}
+
+// urgency scores how pressing an open task is from its priority, days until
+// due (overdue counts more), age, pinned and blocked state. It returns the
+// total and its components so the score can be explained.
+func urgency(task Task, now time.Time, blocked bool, w UrgencyWeights) (float64, []urgencyComponent) {
+	priorityFactor := [...]float64{0, 1.0, 0.65, 0.3}[task.Priority]
+
+	// Ramp from 0.2 two weeks out to 1.0 a week overdue
+	dueFactor := 0.0
+	if due, err := time.ParseInLocation(dateLayout, task.DueDate, time.Local); err == nil {
+		days := due.Sub(startOfDay(now)).Hours() / 24
+		switch {
+		case days <= -7:
+			dueFactor = 1.0
+		case days >= 14:
+			dueFactor = 0.2
+		default:
+			dueFactor = 1.0 - (days+7)*0.8/21
+		}
+	}
+
+	ageFactor := 0.0
+	if created, err := parseTimestamp(task.CreatedAt); err == nil {
+		ageFactor = now.Sub(created).Hours() / 24 / 365
+		if ageFactor > 1 {
+			ageFactor = 1
+		}
+		if ageFactor < 0 {
+			ageFactor = 0
+		}
+	}
+
+	pinnedFactor, blockedFactor := 0.0, 0.0
+	if task.Pinned {
+		pinnedFactor = 1
+	}
+	if blocked {
+		blockedFactor = 1
+	}
+
+	components := []urgencyComponent{
+		{"priority", priorityFactor, w.Priority},
+		{"due", dueFactor, w.Due},
+		{"age", ageFactor, w.Age},
+		{"pinned", pinnedFactor, w.Pinned},
+		{"blocked", blockedFactor, w.Blocked},
+	}
+	total := 0.0
+	for _, c := range components {
+		total += c.Value()
+	}
+	return total, components
+}
+
+// isBlocked reports whether any task blocking task is still open
+func isBlocked(task Task, tasks []Task) bool {
+	for _, blockerID := range task.BlockedBy {
+		if i := findTaskByID(tasks, blockerID); i >= 0 && tasks[i].Status != "done" {
+			return true
+		}
+	}
+	return false
+}
+
+// isWaiting reports whether task is waiting on someone and its follow-up
+// date, if any, has not arrived yet
+func isWaiting(task Task, now time.Time) bool {
+	return task.Waiting != nil && task.Status != "done" &&
+		(task.Waiting.Until == "" || task.Waiting.Until > now.Format(dateLayout))
+}
+
+// needsFollowUp reports whether a waiting task has reached its follow-up date
+func needsFollowUp(task Task, now time.Time) bool {
+	return task.Waiting != nil && task.Status != "done" &&
+		task.Waiting.Until != "" && task.Waiting.Until <= now.Format(dateLayout)
+}
+
+// datePart returns the YYYY-MM-DD part of a stored timestamp
+func datePart(value string) string {
+	if len(value) > len(dateLayout) {
+		return value[:len(dateLayout)]
+	}
+	return value
+}
+
+// shortDate formats a YYYY-MM-DD date as a weekday name when it is within
+// a week of now, and as e.g. "Jul 5" otherwise; timestamps use their date
+func shortDate(value string, now time.Time) string {
+	value = datePart(value)
+	date, err := time.ParseInLocation(dateLayout, value, time.Local)
+	if err != nil {
+		return value
+	}
+	days := date.Sub(startOfDay(now)).Hours() / 24
+	if days > -7 && days < 7 {
+		return date.Format("Mon")
+	}
+	return date.Format("Jan 2")
+}
+
+// urgencyScores returns the urgency of every open task by ID
+func urgencyScores(tasks []Task, now time.Time) map[int]float64 {
+	scores := make(map[int]float64, len(tasks))
+	for _, task := range tasks {
+		if task.Status != "done" {
+			scores[task.ID], _ = urgency(task, now, isBlocked(task, tasks), config.Urgency)
+		}
+	}
+	return scores
+}
+
+// formatIDList formats task IDs as a comma-separated list like #3,#7
+func formatIDList(ids []int) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = formatID(id)
+	}
+	return strings.Join(parts, ",")
+}
+
+// displayID renders a task ID in the configured id_display base. In base36
+// an ID whose base36 form would be all digits is shown in decimal, so what
+// is shown always parses back to the same task.
+func displayID(id int) string {
+	if config.IDDisplay == "base36" {
+		short := strconv.FormatInt(int64(id), 36)
+		if strings.IndexFunc(short, unicode.IsLetter) >= 0 {
+			return short
+		}
+	}
+	return strconv.Itoa(id)
+}
+
+// formatID renders a task ID for display, e.g. #42 or #7pz
+func formatID(id int) string {
+	return "#" + displayID(id)
+}
+
+// idHelp describes how task IDs are written in the active id_display mode
+func idHelp() string {
+	if config.IDDisplay == "base36" {
+		return "base36, e.g. 7pz; all-digit IDs are read as decimal"
+	}
+	return "decimal, e.g. 42; set id_display to base36 for shorter IDs"
+}
+
+// parseID parses a task ID given on the command line, with an optional
+// leading #. All-digit IDs are decimal; with id_display set to base36, IDs
+// containing letters are base36. Recency references such as @last are
+// resolved against the tasks on disk.
+func parseID(value string) (int, error) {
+	if ref, ok := strings.CutPrefix(value, "@"); ok {
+		return resolveRecent(ref)
+	}
+	digits := strings.ToLower(strings.TrimPrefix(value, "#"))
+	base := 10
+	if config.IDDisplay == "base36" && strings.IndexFunc(digits, unicode.IsLetter) >= 0 {
+		base = 36
+	}
+	id, err := strconv.ParseInt(digits, base, 0)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid task ID %q (IDs are %s)", value, idHelp())
+	}
+	return int(id), nil
+}
+
+// resolveRecent returns the ID of the task named by a recency reference
+// without its @: last (the newest task), prev (the one before) or n for the
+// n-th newest. Tasks are ordered by CreatedAt, and tasks created in the
+// same second by ID, so a reference always names one task.
+func resolveRecent(ref string) (int, error) {
+	n := 0
+	switch ref {
+	case "last":
+		n = 1
+	case "prev":
+		n = 2
+	default:
+		parsed, err := strconv.Atoi(ref)
+		if err != nil || parsed < 1 {
+			return 0, fmt.Errorf("invalid task reference @%s (use @last, @prev or @1, @2, ...)", ref)
+		}
+		n = parsed
+	}
+
+	tasks, err := loadTasks(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	if n > len(tasks) {
+		return 0, fmt.Errorf("@%s needs at least %s, but there %s", ref, plural(n, "task"), pluralIs(len(tasks), "task"))
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		if tasks[i].CreatedAt != tasks[j].CreatedAt {
+			return tasks[i].CreatedAt > tasks[j].CreatedAt
+		}
+		return tasks[i].ID > tasks[j].ID
+	})
+	return tasks[n-1].ID, nil
+}
+
+// pluralIs formats a count with its verb, e.g. "is 1 task" or "are 3 tasks"
+func pluralIs(n int, noun string) string {
+	if n == 1 {
+		return "is " + plural(n, noun)
+	}
+	return "are " + plural(n, noun)
+}
+
+// findTaskByID returns the index of the task with the given ID, or -1
+func findTaskByID(tasks []Task, id int) int {
+	for i, task := range tasks {
+		if task.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Error kinds. Every command failure wraps one of these so scripts can tell
+// failures apart by exit code or, with --errors json, by the "code" field.
+var (
+	ErrIO       = errors.New("io")
+	ErrUsage    = errors.New("usage")
+	ErrReadOnly = errors.New("read_only")
+	ErrInvalid  = errors.New("invalid")
+	ErrNotFound = errors.New("not_found")
+	ErrLocked   = errors.New("locked")
+	ErrCorrupt  = errors.New("corrupt")
+	ErrLimit    = errors.New("limit")
+	ErrStale    = errors.New("stale")
+	ErrReason   = errors.New("reason_required")
+	ErrCanceled = errors.New("canceled")
+)
+
+// errorKinds lists every error kind with its documented exit code
+var errorKinds = []struct {
+	kind     error
+	exitCode int
+}{
+	{ErrIO, 1},
+	{ErrUsage, 2},
+	{ErrInvalid, 2},
+	{ErrReadOnly, 3},
+	{ErrNotFound, 4},
+	{ErrLocked, 5},
+	{ErrCorrupt, 6},
+	{ErrLimit, 7},
+	{ErrStale, 8},
+	{ErrReason, 9},
+	{ErrCanceled, 130},
+}
+
+// TaskError is a command failure of a given kind; errors.Is(err, ErrNotFound)
+// and friends match on its Kind
+type TaskError struct {
+	Kind    error
+	Message string
+	ID      int
+	Err     error
+}
+
+func (e *TaskError) Error() string {
+	return e.Message
+}
+
+// Is reports whether target is the kind of this error
+func (e *TaskError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Unwrap returns the underlying cause, if any
+func (e *TaskError) Unwrap() error {
+	return e.Err
+}
+
+// newError returns a TaskError of the given kind with a formatted message
+func newError(kind error, format string, args ...interface{}) *TaskError {
+	return &TaskError{Kind: kind, Message: fmt.Sprintf(format, args...)}
+}
+
+// wrapError returns a TaskError of the given kind caused by err
+func wrapError(kind error, err error, format string, args ...interface{}) *TaskError {
+	return &TaskError{Kind: kind, Message: fmt.Sprintf(format, args...) + ": " + err.Error(), Err: err}
+}
+
+// notFoundError reports that no task has the given ID
+func notFoundError(id int) error {
+	return &TaskError{Kind: ErrNotFound, Message: fmt.Sprintf("no task with id %s", displayID(id)), ID: id}
+}
+
+// errorKind returns the kind of err, treating unclassified errors as I/O failures
+func errorKind(err error) error {
+	for _, entry := range errorKinds[1:] {
+		if errors.Is(err, entry.kind) {
+			return entry.kind
+		}
+	}
+	return ErrIO
+}
+
+// exitCode returns the documented exit code for err
+func exitCode(err error) int {
+	kind := errorKind(err)
+	for _, entry := range errorKinds {
+		if entry.kind == kind {
+			return entry.exitCode
+		}
+	}
+	return 1
+}
+
+// errorPayload is the JSON form of a failure, used by --errors json and the HTTP API
+type errorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	ID      int    `json:"id,omitempty"`
+}
+
+// newErrorPayload describes err for JSON output
+func newErrorPayload(err error) errorPayload {
+	payload := errorPayload{Code: errorKind(err).Error(), Message: err.Error()}
+	var taskErr *TaskError
+	if errors.As(err, &taskErr) {
+		payload.ID = taskErr.ID
+	}
+	return payload
+}
+
+// reportError prints err to stderr, as a single JSON object with --errors json
+func reportError(err error) {
+	if globals.ErrorFormat == "json" {
+		data, _ := json.Marshal(newErrorPayload(err))
+		fmt.Fprintln(os.Stderr, string(data))
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "%s❌ %v%s\n", ColorRed, err, ColorReset)
+}
+
+// canceledError reports that ctx ended before an operation could finish; the
+// data file is never written once this is returned
+func canceledError(ctx context.Context) error {
+	return wrapError(ErrCanceled, ctx.Err(), "canceled, %s was left unchanged", dataFile)
+}
+
+// readOnlyBanner prints the view-only notice once per run
+var readOnlyBanner sync.Once
+
+// dataFileWritable reports whether the data file can be written, by opening
+// it for writing without changing it; a missing file counts as writable.
+// The caller holds dataFileCache.mu.
+func dataFileWritable() bool {
+	f, err := os.OpenFile(dataFile, os.O_WRONLY, 0)
+	if err == nil {
+		dataFileCache.opens++
+		f.Close()
+		return true
+	}
+	return !isReadOnlyError(err)
+}
+
+// isReadOnlyError reports whether err means a file may not be written
+func isReadOnlyError(err error) bool {
+	return os.IsPermission(err) || errors.Is(err, syscall.EROFS)
+}
+
+// fileOwner returns the name of the user owning the file described by info,
+// or "" where the platform does not report owners
+func fileOwner(info os.FileInfo) string {
+	sys := reflect.ValueOf(info.Sys())
+	if sys.Kind() == reflect.Pointer {
+		sys = sys.Elem()
+	}
+	if sys.Kind() != reflect.Struct {
+		return ""
+	}
+	uid := sys.FieldByName("Uid")
+	if !uid.IsValid() || !uid.CanUint() {
+		return ""
+	}
+	id := strconv.FormatUint(uid.Uint(), 10)
+	if u, err := user.LookupId(id); err == nil {
+		return u.Username
+	}
+	return "uid " + id
+}
+
+// readOnlyError reports that path cannot be written, naming its owner and
+// permissions, and switches the run to view-only mode
+func readOnlyError(path string) error {
+	dataFileCache.mu.Lock()
+	globals.ReadOnly = true
+	dataFileCache.mu.Unlock()
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	detail := ""
+	if info, err := os.Stat(path); err == nil {
+		detail = "mode " + info.Mode().Perm().String()
+		if owner := fileOwner(info); owner != "" {
+			detail = "owned by " + owner + ", " + detail
+		}
+		detail = " (" + detail + ")"
+	}
+	return newError(ErrReadOnly, "%s is read-only%s; view-only mode allows no changes", abs, detail)
+}
+
+// loadTasks loads tasks from JSON file. A missing file is an empty task list;
+// a file that cannot be parsed is reported as corrupt rather than discarded.
+func loadTasks(ctx context.Context) ([]Task, error) {
+	if ctx.Err() != nil {
+		return nil, canceledError(ctx)
+	}
+	data, err := readDataFile()
+	if os.IsNotExist(err) {
+		return []Task{}, nil
+	}
+	if err != nil {
+		return nil, wrapError(ErrIO, err, "could not read %s", dataFile)
+	}
+	if readOnly() {
+		readOnlyBanner.Do(func() {
+			fmt.Fprintf(os.Stderr, "%s[read-only] %s cannot be written; showing it view-only%s\n", ColorDim, dataFile, ColorReset)
+		})
+	}
+
+	var tasks []Task
+	if err := json.Unmarshal(data, &tasks); err != nil {
+		return nil, wrapError(ErrCorrupt, err, "%s is not valid task data", dataFile)
+	}
+
+	return tasks, nil
+}
+
+// dataFileCache is the content of the data file as this process last read
+// or wrote it, with the stamp the file had then. However many helpers of a
+// command load the tasks, the file is read once and then decoded from here
+// for as long as its stamp stays the same.
+var dataFileCache struct {
+	// mu also guards globals.ReadOnly: serve loads tasks in its request
+	// handlers while its write queue saves them
+	mu    sync.Mutex
+	data  []byte
+	stamp fileStamp
+	// opens, reads and writes count what this run did to the data file
+	opens, reads, writes int
+}
+
+// readDataFile returns the content of the data file, reading it only when
+// its stamp differs from the cached one. The file is opened for writing as
+// well, which finds out whether it is read-only without a second open.
+func readDataFile() ([]byte, error) {
+	dataFileCache.mu.Lock()
+	defer dataFileCache.mu.Unlock()
+
+	info, err := os.Stat(dataFile)
+	if err != nil {
+		return nil, err
+	}
+	// stamped before reading, so a write racing the read forces a reread
+	stamp := fileStamp{modTime: info.ModTime(), size: info.Size()}
+	if dataFileCache.data != nil && stamp == dataFileCache.stamp {
+		return dataFileCache.data, nil
+	}
+
+	f, err := os.OpenFile(dataFile, os.O_RDWR, 0)
+	if isReadOnlyError(err) {
+		globals.ReadOnly, globals.readOnlyKnown = true, true
+		f, err = os.Open(dataFile)
+	} else if err == nil {
+		globals.readOnlyKnown = true
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dataFileCache.opens++
+	data, err := io.ReadAll(f)
+	dataFileCache.reads++
+	if err != nil {
+		return nil, err
+	}
+	dataFileCache.data, dataFileCache.stamp = data, stamp
+	return data, nil
+}
+
+// readOnly reports whether the data file cannot be written. The first read
+// of the data file finds out; commands that ask before reading it open it
+// for writing once, and commands that never touch it never open it.
+func readOnly() bool {
+	dataFileCache.mu.Lock()
+	defer dataFileCache.mu.Unlock()
+	if !globals.readOnlyKnown {
+		globals.ReadOnly = globals.ReadOnly || !dataFileWritable()
+		globals.readOnlyKnown = true
+	}
+	return globals.ReadOnly
+}
+
+// lockDataFile creates the lock file that keeps concurrent commands from
+// overwriting each other's changes and returns a function releasing it
+func lockDataFile() (func(), error) {
+	if readOnly() {
+		return nil, readOnlyError(dataFile)
+	}
+	lockPath := dataFile + ".lock"
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if os.IsExist(err) {
+		return nil, newError(ErrLocked, "%s is locked by another command (delete %s if none is running)", dataFile, lockPath)
+	}
+	if isReadOnlyError(err) {
+		return nil, readOnlyError(filepath.Dir(lockPath))
+	}
+	if err != nil {
+		return nil, wrapError(ErrIO, err, "could not lock %s", dataFile)
+	}
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	f.Close()
+
+	return func() { os.Remove(lockPath) }, nil
+}
+
+// updateTasks locks the data file, applies fn to the loaded tasks and saves
+// the result. If ctx is canceled before the save, nothing is written.
+func updateTasks(ctx context.Context, fn func(tasks []Task) ([]Task, error)) error {
+	unlock, err := lockDataFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+
+	tasks, err = fn(tasks)
+	if err != nil {
+		return err
+	}
+	return saveTasks(ctx, tasks)
+}
+
+// fileStamp identifies a version of the data file on disk
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// dataFileStamp returns the stamp of the data file; a missing file has the
+// zero stamp
+func dataFileStamp() fileStamp {
+	info, err := os.Stat(dataFile)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}
+}
+
+// taskStore keeps the tasks in memory for long-running commands such as
+// serve. The stored slice is an immutable snapshot: writers build the next
+// version from the data file under its lock and swap it in, and readers
+// get their own copy, so a render never sees tasks being changed. Changes
+// made by other commands are picked up from the file's stamp.
+type taskStore struct {
+	mu       sync.Mutex
+	snapshot []Task // never modified once stored
+	stamp    fileStamp
+	loaded   bool
+}
+
+// tasks returns a copy of the current tasks, reloading them if the data
+// file changed since they were read. The copy may be sorted or appended to;
+// the slices inside each task are shared and must not be modified.
+func (s *taskStore) tasks(ctx context.Context) ([]Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// stamped before reading, so a write racing the read forces a reload
+	if stamp := dataFileStamp(); !s.loaded || stamp != s.stamp {
+		tasks, err := loadTasks(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.snapshot, s.stamp, s.loaded = tasks, stamp, true
+	}
+	return append([]Task(nil), s.snapshot...), nil
+}
+
+// update works like updateTasks and then makes the saved tasks the current
+// snapshot
+func (s *taskStore) update(ctx context.Context, fn func(tasks []Task) ([]Task, error)) error {
+	unlock, err := lockDataFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+	tasks, err = fn(tasks)
+	if err != nil {
+		return err
+	}
+	if err := saveTasks(ctx, tasks); err != nil {
+		return err
+	}
+
+	// still holding the file lock, so the stamp is that of this save
+	s.mu.Lock()
+	s.snapshot, s.stamp, s.loaded = tasks, dataFileStamp(), true
+	s.mu.Unlock()
+	return nil
+}
+
+// validateTasks checks invariants that must hold before tasks are written
+func validateTasks(tasks []Task) error {
+	keys := map[string]int{}
+	for _, task := range tasks {
+		if task.IdempotencyKey == "" {
+			continue
+		}
+		if otherID, exists := keys[task.IdempotencyKey]; exists {
+			return newError(ErrInvalid, "tasks %s and %s share the key %q", formatID(otherID), formatID(task.ID), task.IdempotencyKey)
+		}
+		keys[task.IdempotencyKey] = task.ID
+	}
+	return nil
+}
+
+// saveTasks saves tasks to JSON file unless ctx has been canceled
+func saveTasks(ctx context.Context, tasks []Task) error {
+	if err := validateTasks(tasks); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(tasks, "", "  ")
+	if err != nil {
+		return wrapError(ErrIO, err, "could not encode tasks")
+	}
+
+	// Write a temporary file, flushed to disk, and rename it over the data
+	// file, so a crash never leaves a half-written tasks.json behind. A
+	// symlinked tasks.json is replaced where it points, and the file keeps
+	// its permissions.
+	target := dataFile
+	if resolved, err := filepath.EvalSymlinks(dataFile); err == nil {
+		target = resolved
+	}
+	tmpFile := target + ".tmp"
+	if err := writeFileSynced(tmpFile, data, fileMode(target)); err != nil {
+		os.Remove(tmpFile)
+		return wrapError(ErrIO, err, "could not write %s", dataFile)
+	}
+	if ctx.Err() != nil {
+		os.Remove(tmpFile)
+		return canceledError(ctx)
+	}
+	if err := os.Rename(tmpFile, target); err != nil {
+		os.Remove(tmpFile)
+		return wrapError(ErrIO, err, "could not write %s", dataFile)
+	}
+	// what was written is what the next load of this command reads
+	dataFileCache.mu.Lock()
+	dataFileCache.writes++
+	if info, err := os.Stat(dataFile); err == nil {
+		dataFileCache.data, dataFileCache.stamp = data, fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+	dataFileCache.mu.Unlock()
+	invalidateSearchIndex()
+	return nil
+}
+
+// fileMode returns the permissions of path, or 0644 for a file that does not
+// exist yet
+func fileMode(path string) os.FileMode {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0644
+	}
+	return info.Mode().Perm()
+}
+
+// writeFileSynced writes data to path with exactly mode, whatever the umask,
+// and flushes it to disk before returning
+func writeFileSynced(path string, data []byte, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// With id_allocation set to actor, each writer takes new IDs from its own
+// blocks of actorRangeSize: slot 1 uses 1001-1999, slot 2 2001-2999 and so
+// on, moving to block slot+actorSlots (e.g. 101001) once a block is used up.
+// Stores that add tasks independently in different slots therefore never
+// pick the same ID, and merging them never renumbers. Only actor_slot makes
+// slots distinct: two hashed slots are the same about one time in 99.
+const (
+	actorRangeSize = 1000
+	actorSlots     = 99
+)
+
+// actorSlot returns the ID block slot of this writer: actor_slot, or else a
+// hash of actor (default: the host name). It is 0 for sequential IDs.
+func actorSlot() int {
+	if config.IDAllocation != "actor" {
+		return 0
+	}
+	if config.ActorSlot > 0 {
+		return config.ActorSlot
+	}
+	h := fnv.New32a()
+	h.Write([]byte(actorName()))
+	return int(h.Sum32()%actorSlots) + 1
+}
+
+// actorName returns actor, or the host name when it is not set
+func actorName() string {
+	if config.Actor != "" {
+		return config.Actor
+	}
+	name, _ := os.Hostname()
+	return name
+}
+
+// slotOfID returns the actor slot whose blocks contain id, or 0 for IDs
+// below the first block
+func slotOfID(id int) int {
+	block := id / actorRangeSize
+	if block == 0 {
+		return 0
+	}
+	return (block-1)%actorSlots + 1
+}
+
+// idAllocator hands out the IDs of new tasks, following id_allocation
+type idAllocator struct {
+	slot int
+	last int
+	used map[int]bool
+}
+
+// newIDAllocator returns an allocator for tasks added to tasks. IDs keep
+// growing, so the IDs of deleted tasks are not handed out again.
+func newIDAllocator(tasks []Task) *idAllocator {
+	a := &idAllocator{slot: actorSlot()}
+	if a.slot != 0 {
+		a.used = make(map[int]bool, len(tasks))
+	}
+	for _, task := range tasks {
+		if a.slot == 0 || slotOfID(task.ID) == a.slot {
+			a.last = max(a.last, task.ID)
+		}
+		if a.used != nil {
+			a.used[task.ID] = true
+		}
+	}
+	return a
+}
+
+// next returns a new ID
+func (a *idAllocator) next() int {
+	if a.slot == 0 {
+		a.last++
+		return a.last
+	}
+	if a.last < a.slot*actorRangeSize && config.ActorSlot == 0 {
+		// the first ID this machine takes in the store
+		fmt.Fprintf(os.Stderr, "%s⚠️  Taking IDs from slot %d, a hash of actor %q. Two machines share a hashed slot about 1 time in %d; set a distinct actor_slot (1-%d) on each machine that merges.%s\n",
+			ColorYellow, a.slot, actorName(), actorSlots, actorSlots, ColorReset)
+	}
+	for {
+		switch {
+		case a.last < a.slot*actorRangeSize:
+			a.last = a.slot*actorRangeSize + 1
+		case (a.last+1)%actorRangeSize == 0:
+			a.last = (a.last/actorRangeSize+actorSlots)*actorRangeSize + 1
+		default:
+			a.last++
+		}
+		// IDs taken before switching to actor allocation are skipped
+		if !a.used[a.last] {
+			a.used[a.last] = true
+			return a.last
+		}
+	}
+}
+
+// getNextID returns the next available ID
+func getNextID(tasks []Task) int {
+	return newIDAllocator(tasks).next()
+}
+
+// addOptions holds the optional flags accepted by the add command
+type addOptions struct {
+	Key      string
+	Update   bool
+	Quiet    bool
+	Due      string
+	Every    string
+	Anchor   string
+	Project  string
+	Tags     []string
+	Strict   bool
+	Priority string
+	// StrictBudget refuses to add a task to a project over its budget
+	StrictBudget bool
+}
+
+// stringList is a repeatable string flag such as --tag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set appends a value, accepting comma-separated lists
+func (l *stringList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// isInbox reports whether an open task still needs triage (no tags and no project)
+func isInbox(task Task) bool {
+	return task.Status != "done" && task.Project == "" && len(task.Tags) == 0
+}
+
+// countAddedOn returns how many tasks were created on the local day of t
+func countAddedOn(tasks []Task, t time.Time) int {
+	day := startOfDay(t)
+	count := 0
+	for _, task := range tasks {
+		created, err := parseTimestamp(task.CreatedAt)
+		if err == nil && startOfDay(created).Equal(day) {
+			count++
+		}
+	}
+	return count
+}
+
+// countCompletedOn returns how many tasks were completed on the local day of t
+func countCompletedOn(tasks []Task, t time.Time) int {
+	day := startOfDay(t)
+	count := 0
+	for _, task := range tasks {
+		if task.Status != "done" {
+			continue
+		}
+		completed, err := parseTimestamp(task.CompletedAt)
+		if err == nil && startOfDay(completed).Equal(day) {
+			count++
+		}
+	}
+	return count
+}
+
+// hasTag reports whether task carries tag, ignoring case
+func hasTag(task Task, tag string) bool {
+	for _, t := range task.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// doneSummary describes the day's progress after task was completed, e.g.
+// "That's 4 done today — 2 todo left for @work". Open tasks are counted in
+// the task's first tag, or else its project, or else across all tasks.
+func doneSummary(tasks []Task, task Task, now time.Time) string {
+	scope, inScope := "", func(Task) bool { return true }
+	switch {
+	case len(task.Tags) > 0:
+		tag := task.Tags[0]
+		scope, inScope = " for @"+tag, func(t Task) bool { return hasTag(t, tag) }
+	case task.Project != "":
+		scope, inScope = " for +"+task.Project, func(t Task) bool { return t.Project == task.Project }
+	}
+
+	left := 0
+	for _, t := range tasks {
+		if t.Status != "done" && inScope(t) {
+			left++
+		}
+	}
+	done := countCompletedOn(tasks, now)
+	if left == 0 {
+		return fmt.Sprintf("That's %d done today — nothing left%s 🎉", done, scope)
+	}
+	return fmt.Sprintf("That's %d done today — %d todo left%s", done, left, scope)
+}
+
+// countInbox returns the number of open tasks that have no tags and no project
+func countInbox(tasks []Task) int {
+	count := 0
+	for _, task := range tasks {
+		if isInbox(task) {
+			count++
+		}
+	}
+	return count
+}
+
+// findTaskByKey returns the index of the task with the given idempotency key, or -1
+func findTaskByKey(tasks []Task, key string) int {
+	for i, task := range tasks {
+		if task.IdempotencyKey == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// schemaViolations lists how task breaks the schema in config.json, as
+// "missing project" or "tag \"x\" is not allowed (use a, b)". Done tasks
+// are not checked, so adopting a schema leaves finished work alone.
+func schemaViolations(task Task) []string {
+	schema := config.Schema
+	if task.Status == "done" {
+		return nil
+	}
+	var problems []string
+	for _, field := range schema.Required {
+		missing := false
+		switch field {
+		case "project":
+			missing = task.Project == ""
+		case "priority":
+			missing = task.Priority == PriorityNone
+		case "due":
+			missing = task.DueDate == ""
+		case "tags":
+			missing = len(task.Tags) == 0
+		}
+		if missing && field == "due" {
+			problems = append(problems, "missing due date")
+		} else if missing {
+			problems = append(problems, "missing "+field)
+		}
+	}
+	if len(schema.Projects) > 0 && task.Project != "" && !slices.Contains(schema.Projects, task.Project) {
+		problems = append(problems, fmt.Sprintf("project %q is not allowed (use %s)", task.Project, strings.Join(schema.Projects, ", ")))
+	}
+	if len(schema.Tags) > 0 {
+		for _, tag := range task.Tags {
+			if !slices.Contains(schema.Tags, tag) {
+				problems = append(problems, fmt.Sprintf("tag %q is not allowed (use %s)", tag, strings.Join(schema.Tags, ", ")))
+			}
+		}
+	}
+	return problems
+}
+
+// checkSchema returns an ErrInvalid error naming every way task breaks
+// the schema other than those in known; what names the task in the message
+func checkSchema(task Task, what string, known ...string) error {
+	var problems []string
+	for _, problem := range schemaViolations(task) {
+		if !slices.Contains(known, problem) {
+			problems = append(problems, problem)
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return &TaskError{Kind: ErrInvalid, ID: task.ID, Message: fmt.Sprintf(
+		"%s breaks the schema in %s: %s", what, configFile, strings.Join(problems, "; "))}
+}
+
+// checkImportSchema checks tasks about to be imported from path, naming
+// the first one that breaks the schema and how many do
+func checkImportSchema(tasks []Task, path string) error {
+	var first error
+	broken := 0
+	for n, task := range tasks {
+		if err := checkSchema(task, fmt.Sprintf("task %d of %s (%q)", n+1, path, task.Title)); err != nil {
+			if first == nil {
+				first = err
+			}
+			broken++
+		}
+	}
+	if broken > 1 {
+		return wrapError(ErrInvalid, first, "%s of %d break the schema; nothing imported. First", plural(broken, "task"), len(tasks))
+	}
+	return first
+}
+
+// addTask adds a new task, or reuses the existing task when opts.Key is already taken
+func addTask(ctx context.Context, title string, opts addOptions) error {
+	now := clock.Now()
+	task, err := newTaskFromOptions(title, opts, now)
+	if err != nil {
+		return err
+	}
+	if opts.Update && opts.Key == "" {
+		return newError(ErrUsage, "--update needs --key to find the task to update")
+	}
+	// with --update the task may already exist, and then only the flags
+	// given change it; insertTask checks the schema for that case
+	if !opts.Update {
+		if err := checkSchema(task, "the new task"); err != nil {
+			return err
+		}
+	}
+
+	var result Task
+	var warnings []string
+	existed := false
+	err = updateTasks(ctx, func(tasks []Task) ([]Task, error) {
+		if opts.Update && findTaskByKey(tasks, opts.Key) < 0 {
+			if err := checkSchema(task, "the new task"); err != nil {
+				return nil, err
+			}
+		}
+		var err error
+		tasks, result, existed, warnings, err = insertTask(tasks, task, opts, now)
+		return tasks, err
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case opts.Quiet:
+		fmt.Println(displayID(result.ID))
+	case existed && opts.Update:
+		fmt.Printf("%s🔁 Updated existing task %s for key %s: %s%s%s\n",
+			ColorYellow, formatID(result.ID), opts.Key, ColorBright, result.Title, ColorReset)
+	case existed:
+		fmt.Printf("%s🔁 Task %s already exists for key %s: %s%s%s\n",
+			ColorYellow, formatID(result.ID), opts.Key, ColorBright, result.Title, ColorReset)
+	default:
+		fmt.Printf("%s✅ Added task %s: %s%s%s\n",
+			ColorGreen, formatID(result.ID), ColorBright, title, ColorReset)
+	}
+
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "%s⚠️  %s%s\n", ColorYellow, warning, ColorReset)
+	}
+	return nil
+}
+
+// newTaskFromOptions validates the add options and returns the task they
+// describe, without an ID
+func newTaskFromOptions(title string, opts addOptions, now time.Time) (Task, error) {
+	if strings.TrimSpace(title) == "" {
+		return Task{}, newError(ErrUsage, "please provide a task description")
+	}
+
+	dueDate := ""
+	if opts.Due != "" {
+		due, err := parseDate(opts.Due, now)
+		if err != nil {
+			return Task{}, newError(ErrInvalid, "%v", err)
+		}
+		dueDate = due.Format(dateLayout)
+	}
+
+	recurrence, anchor, recurDay := "", "", 0
+	if opts.Every != "" {
+		iv, err := parseInterval(opts.Every)
+		if err != nil {
+			return Task{}, newError(ErrInvalid, "%v", err)
+		}
+		recurrence, anchor = iv.String(), opts.Anchor
+		if anchor == "" {
+			anchor = AnchorDone
+		}
+		if anchor != AnchorDue && anchor != AnchorDone {
+			return Task{}, newError(ErrInvalid, "invalid anchor %q (use due or done)", anchor)
+		}
+		if anchor == AnchorDue && dueDate != "" && (iv.unit == "mo" || iv.unit == "y") {
+			recurDay, _ = strconv.Atoi(dueDate[8:])
+		}
+	} else if opts.Anchor != "" {
+		return Task{}, newError(ErrUsage, "--anchor requires --every")
+	}
+
+	priority, err := parsePriority(opts.Priority)
+	if err != nil {
+		return Task{}, newError(ErrInvalid, "%v", err)
+	}
+
+	return Task{
+		Title:          title,
+		Status:         "todo",
+		CreatedAt:      now.Format(timeLayout),
+		IdempotencyKey: opts.Key,
+		DueDate:        dueDate,
+		Recurrence:     recurrence,
+		Anchor:         anchor,
+		RecurDay:       recurDay,
+		Project:        opts.Project,
+		Tags:           opts.Tags,
+		Priority:       priority,
+	}, nil
+}
+
+// insertTask appends task with the next free ID unless its idempotency key
+// already names a task, returning the stored task, whether it existed, and
+// any warnings from the daily and inbox limits. With opts.Update the flags
+// given are applied to the existing task instead.
+func insertTask(tasks []Task, task Task, opts addOptions, now time.Time) ([]Task, Task, bool, []string, error) {
+	if opts.Key != "" {
+		if i := findTaskByKey(tasks, opts.Key); i >= 0 {
+			if opts.Update {
+				if err := updateFromOptions(&tasks[i], task, opts, now); err != nil {
+					return nil, tasks[i], true, nil, err
+				}
+			}
+			return tasks, tasks[i], true, nil, nil
+		}
+	}
+
+	var warnings []string
+	if limit := config.DailyAddLimit; limit > 0 {
+		if addedToday := countAddedOn(tasks, now) + 1; addedToday > limit {
+			if opts.Strict {
+				return nil, task, false, nil, newError(ErrLimit, "daily add limit reached: %d tasks already added today (daily_add_limit is %d)", addedToday-1, limit)
+			}
+			warnings = append(warnings, fmt.Sprintf("That's %d tasks added today, over your daily limit of %d", addedToday, limit))
+		}
+	}
+
+	task.ID = getNextID(tasks)
+	tasks = append(tasks, task)
+
+	if limit := config.InboxLimit; limit > 0 {
+		if inbox := countInbox(tasks); inbox > limit {
+			warnings = append(warnings, fmt.Sprintf("%d untriaged tasks have no tags or project (inbox_limit is %d)", inbox, limit))
+		}
+	}
+	if over := budgetUsageOf(tasks, task.Project, now).overruns(false); len(over) > 0 {
+		if opts.StrictBudget {
+			return nil, task, false, nil, newError(ErrLimit, "%s", over[0])
+		}
+		warnings = append(warnings, over...)
+	}
+	return tasks, task, false, warnings, nil
+}
+
+// updateFromOptions applies add --update to the existing task t: the new
+// title, and each of --due, --every, --anchor, --project, --tag and
+// --priority that was given, as parsed into task by newTaskFromOptions.
+// Every change is recorded in history, and the result may not break the
+// schema in a way t did not already.
+func updateFromOptions(t *Task, task Task, opts addOptions, now time.Time) error {
+	known := schemaViolations(*t)
+	recordChange(t, now, "title", t.Title, task.Title)
+	t.Title = task.Title
+	if opts.Due != "" {
+		recordChange(t, now, "due", t.DueDate, task.DueDate)
+		t.DueDate = task.DueDate
+	}
+	if opts.Every != "" {
+		anchor := task.Anchor
+		if opts.Anchor == "" && t.Anchor != "" {
+			// a new interval keeps the series' anchor unless --anchor is given
+			anchor = t.Anchor
+		}
+		recordChange(t, now, "recurrence", t.Recurrence, task.Recurrence)
+		recordChange(t, now, "anchor", t.Anchor, anchor)
+		t.Recurrence, t.Anchor = task.Recurrence, anchor
+	}
+	if opts.Due != "" || opts.Every != "" {
+		t.RecurDay = 0
+		if iv, err := parseInterval(t.Recurrence); err == nil && t.Anchor == AnchorDue && t.DueDate != "" && (iv.unit == "mo" || iv.unit == "y") {
+			t.RecurDay, _ = strconv.Atoi(t.DueDate[8:])
+		}
+	}
+	if opts.Project != "" {
+		recordChange(t, now, "project", t.Project, task.Project)
+		t.Project = task.Project
+	}
+	if len(opts.Tags) > 0 {
+		recordChange(t, now, "tags", strings.Join(t.Tags, ","), strings.Join(task.Tags, ","))
+		t.Tags = task.Tags
+	}
+	if opts.Priority != "" {
+		recordChange(t, now, "priority", t.Priority.Format("word"), task.Priority.Format("word"))
+		t.Priority = task.Priority
+	}
+	return checkSchema(*t, "task "+formatID(t.ID), known...)
+}
+
+// markDone completes tasks[i], clearing any wait, and schedules the next
+// occurrence of a recurring task, which is returned
+func markDone(tasks []Task, i int, now time.Time, reason string) ([]Task, *Task, error) {
+	late := daysLate(tasks[i], now)
+	if reason == "" && lateReasonRequired(tasks[i], now) {
+		return nil, nil, &TaskError{Kind: ErrReason, ID: tasks[i].ID, Message: fmt.Sprintf(
+			"task %s is %s overdue; require_late_reason (%s) asks for a reason (pass --reason)",
+			formatID(tasks[i].ID), plural(late, "day"), config.LateReasonAfter)}
+	}
+	if reason != "" {
+		comment := Comment{At: now.Format(timeLayout), Text: reason}
+		if late > 0 {
+			comment.Tags = []string{lateTag}
+		}
+		tasks[i].Comments = append(tasks[i].Comments, comment)
+	}
+
+	recordChange(&tasks[i], now, "status", tasks[i].Status, "done")
+	tasks[i].Status = "done"
+	tasks[i].CompletedAt = now.Format(timeLayout)
+	if tasks[i].Waiting != nil {
+		recordChange(&tasks[i], now, "waiting", tasks[i].Waiting.String(), "")
+		tasks[i].Waiting = nil
+	}
+	task := tasks[i]
+	if task.Recurrence == "" {
+		return tasks, nil, nil
+	}
+
+	due, err := nextDueDate(task, now)
+	if err != nil {
+		return nil, nil, wrapError(ErrCorrupt, err, "could not schedule the next occurrence of %s", formatID(task.ID))
+	}
+	next := Task{
+		ID:         getNextID(tasks),
+		Title:      task.Title,
+		Status:     "todo",
+		CreatedAt:  now.Format(timeLayout),
+		DueDate:    due.Format(dateLayout),
+		Recurrence: task.Recurrence,
+		Anchor:     task.Anchor,
+		RecurDay:   task.RecurDay,
+		Project:    task.Project,
+		Tags:       task.Tags,
+		Priority:   task.Priority,
+		RecurFrom:  task.ID,
+	}
+	return append(tasks, next), &next, nil
+}
+
+// daysLate returns how many whole days after its due date a task is
+// completed at t, or 0 when it is on time or undated
+func daysLate(task Task, t time.Time) int {
+	if task.DueDate == "" {
+		return 0
+	}
+	due, err := time.ParseInLocation(dateLayout, task.DueDate, time.Local)
+	if err != nil {
+		return 0
+	}
+	return max(0, int(startOfDay(t).Sub(due).Hours()/24+0.5))
+}
+
+// lateReasonRequired reports whether completing task at now needs a reason,
+// because it is more than require_late_reason past its due date
+func lateReasonRequired(task Task, now time.Time) bool {
+	if config.LateReasonAfter == "" || task.DueDate == "" {
+		return false
+	}
+	iv, err := parseInterval(config.LateReasonAfter)
+	if err != nil {
+		return false
+	}
+	due, err := time.ParseInLocation(dateLayout, task.DueDate, time.Local)
+	if err != nil {
+		return false
+	}
+	return startOfDay(now).After(iv.addTo(due))
+}
+
+// lateReason returns the latest reason given for completing task late
+func lateReason(task Task) string {
+	for i := len(task.Comments) - 1; i >= 0; i-- {
+		for _, tag := range task.Comments[i].Tags {
+			if tag == lateTag {
+				return task.Comments[i].Text
+			}
+		}
+	}
+	return ""
+}
+
+// promptLateReason asks on the terminal for the reason that err requires,
+// returning err itself when none is given
+func promptLateReason(err error) (string, error) {
+	fmt.Fprintf(os.Stderr, "%s⏰ %v%s\nReason: ", ColorYellow, err, ColorReset)
+	line, readErr := bufio.NewReader(os.Stdin).ReadString('\n')
+	if reason := strings.TrimSpace(line); reason != "" {
+		return reason, nil
+	}
+	if readErr != nil && readErr != io.EOF {
+		return "", wrapError(ErrIO, readErr, "could not read the reason")
+	}
+	return "", err
+}
+
+// completeTask marks a task as done, creating the next occurrence of recurring tasks.
+// With quiet nothing is printed, and with asJSON only the completed task and
+// its next occurrence are. reason is stored as a comment; a task completed
+// too late (see require_late_reason) needs one, which is asked for on a terminal.
+func completeTask(ctx context.Context, idArg string, quiet bool, asJSON bool, reason string) error {
+	id, err := parseID(idArg)
+	if err != nil {
+		return newError(ErrInvalid, "%v", err)
+	}
+
+	now := clock.Now()
+	var task Task
+	var next *Task
+	alreadyDone := false
+	summary := ""
+
+	complete := func(tasks []Task) ([]Task, error) {
+		i := findTaskByID(tasks, id)
+		if i < 0 {
+			return nil, notFoundError(id)
+		}
+		if tasks[i].Status == "done" {
+			alreadyDone, task = true, tasks[i]
+			return tasks, nil
+		}
+
+		var err error
+		tasks, next, err = markDone(tasks, i, now, reason)
+		if err != nil {
+			return nil, err
+		}
+		task = tasks[i]
+		if config.DoneSummary {
+			// counted from the tasks being saved, so no second read is needed
+			summary = doneSummary(tasks, task, now)
+		}
+		return tasks, nil
+	}
+	err = updateTasks(ctx, complete)
+	if errors.Is(err, ErrReason) && reason == "" && isTerminal(os.Stdin) {
+		// asked for outside updateTasks so the data file is not locked while waiting
+		if reason, err = promptLateReason(err); err == nil {
+			err = updateTasks(ctx, complete)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case quiet:
+		return nil
+	case asJSON:
+		data, err := json.MarshalIndent(struct {
+			Task        Task  `json:"task"`
+			Next        *Task `json:"next,omitempty"`
+			AlreadyDone bool  `json:"already_done,omitempty"`
+		}{task, next, alreadyDone}, "", "  ")
+		if err != nil {
+			return wrapError(ErrIO, err, "could not encode task")
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	if alreadyDone {
+		fmt.Printf("%s⚠️  Task %s is already done%s\n", ColorYellow, formatID(id), ColorReset)
+		return nil
+	}
+	fmt.Printf("%s✅ Completed task %s: %s%s%s\n", ColorGreen, formatID(task.ID), ColorBright, task.Title, ColorReset)
+	if next != nil {
+		fmt.Printf("%s🔁 Next occurrence %s due %s%s\n", ColorCyan, formatID(next.ID), next.DueDate, ColorReset)
+	}
+	if summary != "" {
+		fmt.Printf("%s%s%s\n", ColorCyan, summary, ColorReset)
+	}
+	return nil
+}
+
+// lastCompletion finds the most recent done transition that is still in effect,
+// returning the task index and the history event, or -1 when there is none
+func lastCompletion(tasks []Task) (int, HistoryEvent) {
+	index, latest := -1, HistoryEvent{}
+	for i, task := range tasks {
+		if task.Status != "done" {
+			continue
+		}
+		for j := len(task.History) - 1; j >= 0; j-- {
+			event := task.History[j]
+			if event.Field != "status" {
+				continue
+			}
+			if event.To == "done" && event.At > latest.At {
+				index, latest = i, event
+			}
+			break
+		}
+	}
+	return index, latest
+}
+
+// undoLastCompletion reverts the most recent done transition if it happened
+// within the configured undo window, retracting any spawned next occurrence
+func undoLastCompletion(ctx context.Context) error {
+	window, err := time.ParseDuration(config.UndoWindow)
+	if err != nil {
+		return newError(ErrInvalid, "invalid undo_window %q in %s: %v", config.UndoWindow, configFile, err)
+	}
+
+	now := clock.Now()
+	var task Task
+	var retracted []int
+
+	err = updateTasks(ctx, func(tasks []Task) ([]Task, error) {
+		i, event := lastCompletion(tasks)
+		if i < 0 {
+			return nil, newError(ErrNotFound, "no completed task to undo")
+		}
+
+		completedAt, err := parseTimestamp(event.At)
+		if err != nil {
+			return nil, wrapError(ErrCorrupt, err, "task %s has an invalid history timestamp", formatID(tasks[i].ID))
+		}
+		if age := now.Sub(completedAt); age > window {
+			return nil, &TaskError{
+				Kind: ErrInvalid,
+				ID:   tasks[i].ID,
+				Message: fmt.Sprintf("task %s was completed %s ago, outside the %s undo window; use `reopen %s` instead",
+					formatID(tasks[i].ID), age.Round(time.Second), window, displayID(tasks[i].ID)),
+			}
+		}
+
+		previous := event.From
+		if previous == "" {
+			previous = "todo"
+		}
+		recordChange(&tasks[i], now, "status", "done", previous)
+		tasks[i].History[len(tasks[i].History)-1].Note = "undo"
+		tasks[i].Status = previous
+		tasks[i].CompletedAt = ""
+		// completing cleared the wait and added the reason given; both
+		// carry the completion's timestamp
+		if waiting := clearedWaiting(tasks[i], event.At); waiting != nil {
+			recordChange(&tasks[i], now, "waiting", "", waiting.String())
+			tasks[i].History[len(tasks[i].History)-1].Note = "undo"
+			tasks[i].Waiting = waiting
+		}
+		if n := len(tasks[i].Comments); n > 0 && tasks[i].Comments[n-1].At == event.At {
+			tasks[i].Comments = tasks[i].Comments[:n-1]
+			if n == 1 {
+				tasks[i].Comments = nil
+			}
+		}
+		task = tasks[i]
+
+		kept := tasks[:0]
+		for _, other := range tasks {
+			if other.RecurFrom == task.ID && other.Status != "done" {
+				retracted = append(retracted, other.ID)
+				continue
+			}
+			kept = append(kept, other)
+		}
+		return kept, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s↩️  Undid completion of task %s: %s%s%s %s(back to %s)%s\n",
+		ColorYellow, formatID(task.ID), ColorBright, task.Title, ColorReset, ColorYellow, task.Status, ColorReset)
+	for _, id := range retracted {
+		fmt.Printf("%s🗑️  Removed next occurrence %s%s\n", ColorYellow, formatID(id), ColorReset)
+	}
+	return nil
+}
+
+// clearedWaiting rebuilds the wait that completing task at at cleared, from
+// the history events recording it, or returns nil when there was none
+func clearedWaiting(task Task, at string) *WaitingOn {
+	cleared := ""
+	for j := len(task.History) - 1; j >= 0; j-- {
+		if event := task.History[j]; event.Field == "waiting" && event.At == at && event.To == "" {
+			cleared = event.From
+			break
+		}
+	}
+	if cleared == "" {
+		return nil
+	}
+
+	waiting := &WaitingOn{Person: cleared, Since: at}
+	if k := strings.LastIndex(cleared, " until "); k >= 0 {
+		if _, err := time.ParseInLocation(dateLayout, cleared[k+len(" until "):], time.Local); err == nil {
+			waiting.Person, waiting.Until = cleared[:k], cleared[k+len(" until "):]
+		}
+	}
+	// Since is when the wait was set; compacted history falls back to the
+	// completion
+	for _, event := range task.History {
+		if event.Field == "waiting" && event.To == cleared && event.At < at {
+			waiting.Since = event.At
+		}
+	}
+	return waiting
+}
+
+// reopenTask moves a done task back to todo
+func reopenTask(ctx context.Context, idArg string) error {
+	id, err := parseID(idArg)
+	if err != nil {
+		return newError(ErrInvalid, "%v", err)
+	}
+
+	var task Task
+	wasDone := true
+	err = updateTasks(ctx, func(tasks []Task) ([]Task, error) {
+		i := findTaskByID(tasks, id)
+		if i < 0 {
+			return nil, notFoundError(id)
+		}
+		if tasks[i].Status != "done" {
+			wasDone = false
+			task = tasks[i]
+			return tasks, nil
+		}
+
+		recordChange(&tasks[i], clock.Now(), "status", "done", "todo")
+		tasks[i].Status = "todo"
+		tasks[i].CompletedAt = ""
+		task = tasks[i]
+		return tasks, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !wasDone {
+		fmt.Printf("%s⚠️  Task %s is not done (%s)%s\n", ColorYellow, formatID(id), task.Status, ColorReset)
+		return nil
+	}
+	fmt.Printf("%s🔄 Reopened task %s: %s%s%s\n", ColorYellow, formatID(task.ID), ColorBright, task.Title, ColorReset)
+	return nil
+}
+
+// waitTask marks a task as waiting on person until the follow-up date, or
+// clears the wait when person is empty
+func waitTask(ctx context.Context, idArg string, person string, until string) error {
+	id, err := parseID(idArg)
+	if err != nil {
+		return newError(ErrInvalid, "%v", err)
+	}
+
+	now := clock.Now()
+	var waiting *WaitingOn
+	if person != "" {
+		waiting = &WaitingOn{Person: person, Since: now.Format(timeLayout)}
+		if until != "" {
+			date, err := parseDate(until, now)
+			if err != nil {
+				return newError(ErrInvalid, "%v", err)
+			}
+			waiting.Until = date.Format(dateLayout)
+		}
+	} else if until != "" {
+		return newError(ErrUsage, "--until needs --on <person>")
+	}
+
+	var task Task
+	err = updateTasks(ctx, func(tasks []Task) ([]Task, error) {
+		i := findTaskByID(tasks, id)
+		if i < 0 {
+			return nil, notFoundError(id)
+		}
+		if tasks[i].Status == "done" && waiting != nil {
+			return nil, &TaskError{Kind: ErrInvalid, ID: id, Message: fmt.Sprintf("task %s is already done", formatID(id))}
+		}
+		recordChange(&tasks[i], now, "waiting", tasks[i].Waiting.String(), waiting.String())
+		tasks[i].Waiting = waiting
+		task = tasks[i]
+		return tasks, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if waiting == nil {
+		fmt.Printf("%s▶️  Task %s is no longer waiting: %s%s%s\n", ColorGreen, formatID(task.ID), ColorBright, task.Title, ColorReset)
+		return nil
+	}
+	fmt.Printf("%s⏸  Task %s is waiting on %s", ColorBlue, formatID(task.ID), waiting.Person)
+	if waiting.Until != "" {
+		fmt.Printf(" until %s", shortDate(waiting.Until, now))
+	}
+	fmt.Printf(": %s%s%s\n", ColorBright, task.Title, ColorReset)
+	return nil
+}
+
+// setOptions holds the fields changed by the set command; empty values are left alone
+type setOptions struct {
+	Title     string
+	Priority  string
+	Due       string
+	Project   string
+	Tags      []string
+	Pinned    bool
+	BlockedBy []string
+	Because   string // why the due date changed, kept in history
+	changed   map[string]bool
+}
+
+// setTask edits the given fields of an existing task
+func setTask(ctx context.Context, idArg string, opts setOptions) error {
+	id, err := parseID(idArg)
+	if err != nil {
+		return newError(ErrInvalid, "%v", err)
+	}
+	if len(opts.changed) == 0 {
+		return newError(ErrUsage, "nothing to change (use --title, --priority, --due, --project, --tag, --pinned or --blocked-by)")
+	}
+	if opts.changed["because"] && !opts.changed["due"] {
+		return newError(ErrUsage, "--because explains a --due change")
+	}
+
+	var blockers []int
+	if !(len(opts.BlockedBy) == 1 && opts.BlockedBy[0] == "none") {
+		for _, value := range opts.BlockedBy {
+			blockerID, err := parseID(value)
+			if err != nil {
+				return newError(ErrInvalid, "%v", err)
+			}
+			if blockerID == id {
+				return newError(ErrInvalid, "task %s cannot block itself", formatID(id))
+			}
+			blockers = append(blockers, blockerID)
+		}
+	}
+
+	priority, err := parsePriority(opts.Priority)
+	if err != nil {
+		return newError(ErrInvalid, "%v", err)
+	}
+	dueDate := ""
+	if opts.Due != "" && opts.Due != "none" {
+		due, err := parseDate(opts.Due, clock.Now())
+		if err != nil {
+			return newError(ErrInvalid, "%v", err)
+		}
+		dueDate = due.Format(dateLayout)
+	}
+
+	now := clock.Now()
+	var task Task
+	err = updateTasks(ctx, func(tasks []Task) ([]Task, error) {
+		i := findTaskByID(tasks, id)
+		if i < 0 {
+			return nil, notFoundError(id)
+		}
+		t := &tasks[i]
+		// a task that broke the schema before may still be edited one field
+		// at a time, as long as the edit adds no new problem
+		known := schemaViolations(*t)
+		if opts.changed["title"] {
+			recordChange(t, now, "title", t.Title, opts.Title)
+			t.Title = opts.Title
+		}
+		if opts.changed["priority"] {
+			recordChange(t, now, "priority", t.Priority.Format("word"), priority.Format("word"))
+			t.Priority = priority
+		}
+		if opts.changed["due"] {
+			if t.DueDate != dueDate {
+				recordChange(t, now, "due", t.DueDate, dueDate)
+				t.History[len(t.History)-1].Note = strings.TrimSpace(opts.Because)
+			}
+			t.DueDate = dueDate
+		}
+		if opts.changed["project"] {
+			recordChange(t, now, "project", t.Project, opts.Project)
+			t.Project = opts.Project
+		}
+		if opts.changed["tag"] {
+			recordChange(t, now, "tags", strings.Join(t.Tags, ","), strings.Join(opts.Tags, ","))
+			t.Tags = opts.Tags
+		}
+		if opts.changed["pinned"] {
+			recordChange(t, now, "pinned", strconv.FormatBool(t.Pinned), strconv.FormatBool(opts.Pinned))
+			t.Pinned = opts.Pinned
+		}
+		if opts.changed["blocked-by"] {
+			for _, blockerID := range blockers {
+				if findTaskByID(tasks, blockerID) < 0 {
+					return nil, notFoundError(blockerID)
+				}
+			}
+			recordChange(t, now, "blocked_by", formatIDList(t.BlockedBy), formatIDList(blockers))
+			t.BlockedBy = blockers
+		}
+		if err := checkSchema(*t, "task "+formatID(id), known...); err != nil {
+			return nil, err
+		}
+		task = tasks[i]
+		return tasks, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s✏️  Updated task %s: %s%s%s%s\n",
+		ColorGreen, formatID(task.ID), ColorBright, task.Title, ColorReset, taskSuffix(task))
+	return nil
+}
+
+// absolutePath resolves a path given on the command line, including a
+// leading ~ the shell did not expand
+func absolutePath(path string) (string, error) {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(home, path[1:])
+	}
+	return filepath.Abs(path)
+}
+
+// abbreviateHome shows path with the home directory as ~
+func abbreviateHome(path string) string {
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		return path
+	}
+	if path == home {
+		return "~"
+	}
+	if rest, ok := strings.CutPrefix(path, home+string(filepath.Separator)); ok {
+		return "~" + string(filepath.Separator) + rest
+	}
+	return path
+}
+
+// fileExists reports whether path names an existing file or directory
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// attachFile adds a local file to a task's attachments. Files that do not
+// exist here are only accepted with allowMissing, since they may live on
+// another machine.
+func attachFile(ctx context.Context, idArg string, path string, allowMissing bool) error {
+	id, err := parseID(idArg)
+	if err != nil {
+		return newError(ErrInvalid, "%v", err)
+	}
+	abs, err := absolutePath(path)
+	if err != nil {
+		return newError(ErrInvalid, "invalid path %q: %v", path, err)
+	}
+	missing := !fileExists(abs)
+	if missing && !allowMissing {
+		return newError(ErrNotFound, "%s does not exist (use --allow-missing if it is on another machine)", abbreviateHome(abs))
+	}
+
+	now := clock.Now()
+	var task Task
+	added := false
+	err = updateTasks(ctx, func(tasks []Task) ([]Task, error) {
+		i := findTaskByID(tasks, id)
+		if i < 0 {
+			return nil, notFoundError(id)
+		}
+		t := &tasks[i]
+		task = *t
+		for _, existing := range t.Attachments {
+			if existing == abs {
+				return tasks, nil
+			}
+		}
+		recordChange(t, now, "attachments", "", abs)
+		t.Attachments = append(t.Attachments, abs)
+		task, added = *t, true
+		return tasks, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !added {
+		fmt.Printf("%s📎 %s is already attached to task %s%s\n", ColorYellow, abbreviateHome(abs), formatID(task.ID), ColorReset)
+		return nil
+	}
+	if missing {
+		fmt.Fprintf(os.Stderr, "%s⚠️  %s does not exist here; attached anyway%s\n", ColorYellow, abbreviateHome(abs), ColorReset)
+	}
+	fmt.Printf("%s📎 Attached %s to task %s: %s%s%s\n",
+		ColorGreen, abbreviateHome(abs), formatID(task.ID), ColorBright, task.Title, ColorReset)
+	return nil
+}
+
+// openAttachment opens the n-th (from 1) attachment of a task with the
+// platform's default application
+func openAttachment(ctx context.Context, idArg string, nArg string) error {
+	id, err := parseID(idArg)
+	if err != nil {
+		return newError(ErrInvalid, "%v", err)
+	}
+	n, err := strconv.Atoi(nArg)
+	if err != nil || n < 1 {
+		return newError(ErrInvalid, "invalid attachment number %q", nArg)
+	}
+
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+	i := findTaskByID(tasks, id)
+	if i < 0 {
+		return notFoundError(id)
+	}
+	task := tasks[i]
+	if n > len(task.Attachments) {
+		return &TaskError{Kind: ErrNotFound, ID: id, Message: fmt.Sprintf("task %s has %s",
+			formatID(id), plural(len(task.Attachments), "attachment"))}
+	}
+	path := task.Attachments[n-1]
+	if !fileExists(path) {
+		return newError(ErrNotFound, "%s no longer exists", abbreviateHome(path))
+	}
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", path)
+	case "windows":
+		cmd = exec.Command("cmd", "/c", "start", "", path)
+	default:
+		cmd = exec.Command("xdg-open", path)
+	}
+	if err := cmd.Start(); err != nil {
+		return wrapError(ErrIO, err, "could not open %s", abbreviateHome(path))
+	}
+	go cmd.Wait()
+	fmt.Printf("%s📂 Opening %s%s\n", ColorGreen, abbreviateHome(path), ColorReset)
+	return nil
+}
+
+// runningTimer returns the task index and time log entry of the running
+// timer, or -1 when none runs
+func runningTimer(tasks []Task) (int, int) {
+	for i, task := range tasks {
+		for j, entry := range task.TimeLog {
+			if entry.End == "" {
+				return i, j
+			}
+		}
+	}
+	return -1, -1
+}
+
+// startTimer starts tracking time on a task, stopping the timer running on
+// another task first
+func startTimer(ctx context.Context, idArg string) error {
+	id, err := parseID(idArg)
+	if err != nil {
+		return newError(ErrInvalid, "%v", err)
+	}
+
+	now := clock.Now()
+	var task Task
+	var stopped *Task
+	err = updateTasks(ctx, func(tasks []Task) ([]Task, error) {
+		i := findTaskByID(tasks, id)
+		if i < 0 {
+			return nil, notFoundError(id)
+		}
+		if tasks[i].Status == "done" {
+			return nil, &TaskError{Kind: ErrInvalid, ID: id, Message: fmt.Sprintf("task %s is already done", formatID(id))}
+		}
+		if r, e := runningTimer(tasks); r >= 0 {
+			if r == i {
+				return nil, &TaskError{Kind: ErrInvalid, ID: id, Message: fmt.Sprintf("already tracking task %s", formatID(id))}
+			}
+			tasks[r].TimeLog[e].End = now.Format(timeLayout)
+			stopped = &tasks[r]
+		}
+		tasks[i].TimeLog = append(tasks[i].TimeLog, TimeEntry{Start: now.Format(timeLayout)})
+		task = tasks[i]
+		return tasks, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if stopped != nil {
+		fmt.Printf("%s⏹  Stopped tracking task %s: %s%s%s\n", ColorYellow, formatID(stopped.ID), ColorBright, stopped.Title, ColorReset)
+	}
+	fmt.Printf("%s⏱  Tracking task %s: %s%s%s\n", ColorGreen, formatID(task.ID), ColorBright, task.Title, ColorReset)
+	return nil
+}
+
+// stopTimer stops the running timer and checks the budget of its task's
+// project; with strictBudget a stop that goes over the weekly hours is
+// refused and the timer keeps running
+func stopTimer(ctx context.Context, strictBudget bool) error {
+	now := clock.Now()
+	var task Task
+	var spent time.Duration
+	var over []string
+	err := updateTasks(ctx, func(tasks []Task) ([]Task, error) {
+		i, e := runningTimer(tasks)
+		if i < 0 {
+			return nil, newError(ErrInvalid, "no timer is running (start one with track start <id>)")
+		}
+		entry := &tasks[i].TimeLog[e]
+		entry.End = now.Format(timeLayout)
+		if start, err := parseTimestamp(entry.Start); err == nil {
+			spent = now.Sub(start)
+		}
+		over = budgetUsageOf(tasks, tasks[i].Project, now).overruns(true)
+		if strictBudget && len(over) > 0 {
+			return nil, newError(ErrLimit, "%s (timer still running; stop without --strict-budget to record it)", over[0])
+		}
+		task = tasks[i]
+		return tasks, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s⏹  Tracked %s on task %s: %s%s%s\n",
+		ColorGreen, formatHours(spent.Hours()), formatID(task.ID), ColorBright, task.Title, ColorReset)
+	for _, warning := range over {
+		fmt.Fprintf(os.Stderr, "%s⚠️  %s%s\n", ColorYellow, warning, ColorReset)
+	}
+	return nil
+}
+
+// taskRef is a "#<id>" reference to another task written in a title or
+// comment. Relation comes from the words just before it: RefBlocks for
+// "blocks #7", RefBlockedBy for "blocked by #7", "depends on #7" and the
+// like, and RefLink for anything else, such as "see #12".
+type taskRef struct {
+	ID         int
+	Start, End int // byte offsets of "#<id>" in the text
+	Relation   string
+}
+
+// Relations a task reference can express
+const (
+	RefLink      = "link"
+	RefBlocks    = "blocks"
+	RefBlockedBy = "blocked-by"
+)
+
+// scanRefs finds the task references in text. A reference is "#" and an ID
+// as parseID reads it, without leading zeros, standing on its own: it
+// starts the text or follows a space or one of ( [ { " ', and is not
+// followed by a letter, digit or underscore. An ID of a task in tasks is
+// always a reference. Otherwise base36 IDs (#fff, #todo) are not, nor are
+// all-digit ones isDigitColor reads as hex colors, so only decimal IDs can
+// refer to missing tasks. URL fragments (page#12), HTML entities (&#38;),
+// markdown headings ("## 12", "# Plan") and anything inside `code` are
+// never references.
+func scanRefs(text string, tasks []Task) []taskRef {
+	var refs []taskRef
+	inCode := false
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == '`':
+			inCode = !inCode
+			continue
+		case c != '#' || inCode:
+			continue
+		}
+		if i > 0 && !strings.ContainsRune(" \t\n([{\"'", rune(text[i-1])) {
+			continue
+		}
+		end := i + 1
+		for end < len(text) && text[end] < utf8.RuneSelf && (unicode.IsLetter(rune(text[end])) || unicode.IsDigit(rune(text[end]))) {
+			end++
+		}
+		if end == i+1 || text[i+1] == '0' {
+			continue
+		}
+		if end < len(text) {
+			next := rune(text[end])
+			if next == '_' || next >= utf8.RuneSelf {
+				continue
+			}
+		}
+		id, err := parseID(text[i:end])
+		if err != nil {
+			continue
+		}
+		if findTaskByID(tasks, id) < 0 {
+			digits := text[i+1 : end]
+			if strings.IndexFunc(digits, unicode.IsLetter) >= 0 || isDigitColor(text[:i], digits, text[end:]) {
+				continue
+			}
+		}
+		refs = append(refs, taskRef{ID: id, Start: i, End: end, Relation: refRelation(text[:i])})
+		i = end - 1
+	}
+	return refs
+}
+
+// colorWords are the words that make a "#333" just after them a color
+var colorWords = map[string]bool{
+	"color": true, "colour": true, "colors": true, "colours": true, "background": true,
+	"bg": true, "fg": true, "foreground": true, "hex": true, "fill": true, "stroke": true,
+	"border": true, "shade": true, "palette": true, "theme": true,
+}
+
+// isDigitColor reports whether a "#" and all-digit digits naming no task
+// read as a hex color rather than a reference to a missing task. Six or
+// eight digits always do; three or four do after a color word ("text color
+// #333") or when a CSS declaration ends right after them.
+func isDigitColor(before, digits, after string) bool {
+	switch len(digits) {
+	case 6, 8:
+		return true
+	case 3, 4:
+	default:
+		return false
+	}
+	if strings.HasPrefix(after, ";") {
+		return true
+	}
+	words := strings.FieldsFunc(strings.ToLower(before), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return len(words) > 0 && colorWords[words[len(words)-1]]
+}
+
+// refRelation reads the relation of a reference from the words before it
+func refRelation(before string) string {
+	words := strings.FieldsFunc(strings.ToLower(before), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '-'
+	})
+	last := func(n int) string {
+		if len(words) < n {
+			return ""
+		}
+		return strings.Join(words[len(words)-n:], " ")
+	}
+	switch {
+	case last(1) == "blocks" || last(1) == "blocking":
+		return RefBlocks
+	case last(2) == "blocked by" || last(2) == "depends on" || last(2) == "waits on" ||
+		last(2) == "waiting on" || last(1) == "after" || last(1) == "needs" || last(1) == "requires":
+		return RefBlockedBy
+	}
+	return RefLink
+}
+
+// renderRefs highlights the task references in text and adds the title of
+// each referenced task; style is the color to return to after each one
+func renderRefs(text string, tasks []Task, style string) string {
+	var b strings.Builder
+	last := 0
+	for _, ref := range scanRefs(text, tasks) {
+		b.WriteString(text[last:ref.Start])
+		if i := findTaskByID(tasks, ref.ID); i >= 0 {
+			fmt.Fprintf(&b, "%s%s%s%s (%s)%s%s", ColorCyan, text[ref.Start:ref.End], ColorReset, ColorDim, tasks[i].Title, ColorReset, style)
+		} else {
+			fmt.Fprintf(&b, "%s%s%s%s (no such task)%s%s", ColorRed, text[ref.Start:ref.End], ColorReset, ColorDim, ColorReset, style)
+		}
+		last = ref.End
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// refLink is a relation link --scan found written in a task: Task gets
+// Other added to its BlockedBy or Links. Source is the task whose text
+// holds the reference, Missing is set when Other does not exist.
+type refLink struct {
+	Task, Other int
+	Relation    string
+	Source      int
+	Missing     bool
+}
+
+// scanTaskRefs collects the references in the titles and comments of tasks
+// that are not already relations
+func scanTaskRefs(tasks []Task) []refLink {
+	var links []refLink
+	seen := map[refLink]bool{}
+	for _, task := range tasks {
+		texts := []string{task.Title}
+		for _, comment := range task.Comments {
+			texts = append(texts, comment.Text)
+		}
+		for _, text := range texts {
+			for _, ref := range scanRefs(text, tasks) {
+				if ref.ID == task.ID {
+					continue
+				}
+				link := refLink{Task: task.ID, Other: ref.ID, Relation: ref.Relation, Source: task.ID}
+				if ref.Relation == RefBlocks {
+					link.Task, link.Other, link.Relation = ref.ID, task.ID, RefBlockedBy
+				}
+				i := findTaskByID(tasks, link.Task)
+				if findTaskByID(tasks, ref.ID) < 0 {
+					link.Missing = true
+				} else if link.Relation == RefBlockedBy && slices.Contains(tasks[i].BlockedBy, link.Other) ||
+					link.Relation == RefLink && slices.Contains(tasks[i].Links, link.Other) {
+					continue
+				}
+				if !seen[link] {
+					seen[link] = true
+					links = append(links, link)
+				}
+			}
+		}
+	}
+	return links
+}
+
+// scanLinks turns "#<id>" references in titles and comments into BlockedBy
+// and Links relations. Without yes it only lists them.
+func scanLinks(ctx context.Context, yes bool) error {
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+	var found, missing []refLink
+	for _, link := range scanTaskRefs(tasks) {
+		if link.Missing {
+			missing = append(missing, link)
+		} else {
+			found = append(found, link)
+		}
+	}
+
+	for _, link := range missing {
+		// "blocks #<id>" in Source points at Task rather than Other
+		target := link.Other
+		if link.Task != link.Source {
+			target = link.Task
+		}
+		fmt.Printf("%s⚠️  %s refers to %s, which does not exist%s\n", ColorYellow, formatID(link.Source), formatID(target), ColorReset)
+	}
+	if len(found) == 0 {
+		fmt.Printf("%s🔗 No new task references found%s\n", ColorGreen, ColorReset)
+		return nil
+	}
+	fmt.Printf("%s🔗 %s written in titles and comments:%s\n", ColorCyan, plural(len(found), "reference"), ColorReset)
+	for _, link := range found {
+		verb := "blocked by"
+		if link.Relation == RefLink {
+			verb = "links to"
+		}
+		fmt.Printf("  %s %s %s %s(from %s)%s\n", formatID(link.Task), verb, formatID(link.Other), ColorDim, formatID(link.Source), ColorReset)
+	}
+	if !yes {
+		fmt.Printf("%sNothing written. Re-run with --yes to add these relations.%s\n", ColorYellow, ColorReset)
+		return nil
+	}
+
+	now := clock.Now()
+	added := 0
+	err = updateTasks(ctx, func(tasks []Task) ([]Task, error) {
+		added = 0
+		for _, link := range scanTaskRefs(tasks) {
+			if link.Missing {
+				continue
+			}
+			t := &tasks[findTaskByID(tasks, link.Task)]
+			if link.Relation == RefBlockedBy {
+				blockers := append(slices.Clone(t.BlockedBy), link.Other)
+				recordChange(t, now, "blocked_by", formatIDList(t.BlockedBy), formatIDList(blockers))
+				t.BlockedBy = blockers
+			} else {
+				links := append(slices.Clone(t.Links), link.Other)
+				recordChange(t, now, "links", formatIDList(t.Links), formatIDList(links))
+				t.Links = links
+			}
+			added++
+		}
+		return tasks, nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s🔗 Added %s%s\n", ColorGreen, plural(added, "relation"), ColorReset)
+	return nil
+}
+
+// showTask prints every field of a single task
+func showTask(ctx context.Context, idArg string) error {
+	id, err := parseID(idArg)
+	if err != nil {
+		return newError(ErrInvalid, "%v", err)
+	}
+
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+	i := findTaskByID(tasks, id)
+	if i < 0 {
+		return notFoundError(id)
+	}
+	task := tasks[i]
+	emoji, statusColor := statusStyle(task.Status)
+	blocked := isBlocked(task, tasks)
+
+	fmt.Printf("%s%s: %s%s%s\n", ColorWhite, formatID(task.ID), ColorBright, renderRefs(task.Title, tasks, ColorBright), ColorReset)
+	fmt.Printf("  Status:     %s %s%s%s\n", emoji, statusColor, task.Status, ColorReset)
+	fmt.Printf("  Created:    %s\n", task.CreatedAt)
+	if task.Priority != PriorityNone {
+		fmt.Printf("  Priority:   %s\n", task.Priority)
+	}
+	if task.DueDate != "" {
+		fmt.Printf("  Due:        %s", task.DueDate)
+		if moves := dueSlipOf(task).Moves; moves > 0 {
+			fmt.Printf(" (moved %d×)", moves)
+		}
+		if due, err := time.ParseInLocation(dateLayout, task.DueDate, time.Local); err == nil && task.Status != "done" && due.After(clock.Now()) {
+			fmt.Printf(" (%s left)", plural(workingCalendar().workingDaysBetween(clock.Now(), due), "working day"))
+		}
+		fmt.Println()
+	}
+	if task.CompletedAt != "" {
+		fmt.Printf("  Completed:  %s\n", task.CompletedAt)
+	}
+	if task.Recurrence != "" {
+		anchor := "completion date"
+		if task.Anchor == AnchorDue {
+			anchor = "due date"
+		}
+		fmt.Printf("  Repeats:    every %s (anchored to %s)\n", task.Recurrence, anchor)
+	}
+	if task.Project != "" {
+		fmt.Printf("  Project:    %s\n", task.Project)
+	}
+	if len(task.Tags) > 0 {
+		fmt.Printf("  Tags:       %s\n", strings.Join(task.Tags, ", "))
+	}
+	if task.IdempotencyKey != "" {
+		fmt.Printf("  Key:        %s\n", task.IdempotencyKey)
+	}
+	if task.RecurFrom != 0 {
+		fmt.Printf("  Follows:    %s\n", formatID(task.RecurFrom))
+	}
+	if task.Pinned {
+		fmt.Printf("  Pinned:     📌 yes\n")
+	}
+	if task.Waiting != nil {
+		fmt.Printf("  Waiting on: %s since %s", task.Waiting.Person, task.Waiting.Since)
+		if task.Waiting.Until != "" {
+			fmt.Printf(", follow up %s", task.Waiting.Until)
+		}
+		fmt.Println()
+	}
+	if len(task.BlockedBy) > 0 {
+		state := "all done"
+		if blocked {
+			state = "still open"
+		}
+		fmt.Printf("  Blocked by: %s (%s)\n", formatIDList(task.BlockedBy), state)
+	}
+	if len(task.Links) > 0 {
+		fmt.Printf("  Links:      %s\n", formatIDList(task.Links))
+	}
+	if len(task.TimeLog) > 0 {
+		all := period{End: clock.Now()}
+		fmt.Printf("  Tracked:    %s", formatHours(trackedHours(task, all, clock.Now())))
+		if last := task.TimeLog[len(task.TimeLog)-1]; last.End == "" {
+			fmt.Printf(" (running since %s)", last.Start)
+		}
+		fmt.Println()
+	}
+	if len(task.Comments) > 0 {
+		fmt.Printf("  Comments:\n")
+		for _, comment := range task.Comments {
+			tags := ""
+			for _, tag := range comment.Tags {
+				tags += " [" + tag + "]"
+			}
+			fmt.Printf("    %s%s  %s\n", comment.At, tags, renderRefs(comment.Text, tasks, ""))
+		}
+	}
+	if len(task.Attachments) > 0 {
+		fmt.Printf("  Attachments:\n")
+		for n, path := range task.Attachments {
+			mark := ColorGreen + "✓"
+			if !fileExists(path) {
+				mark = ColorRed + "✗"
+			}
+			fmt.Printf("    %d. %s%s %s\n", n+1, mark, ColorReset, abbreviateHome(path))
+		}
+	}
+	if task.Status != "done" {
+		score, components := urgency(task, clock.Now(), blocked, config.Urgency)
+		fmt.Printf("  Urgency:    %.1f\n", score)
+		for _, c := range components {
+			fmt.Printf("    %-9s %5.2f × %5.1f = %5.2f\n", c.Name, c.Factor, c.Weight, c.Value())
+		}
+	}
+	if len(task.History) > 0 {
+		fmt.Printf("  History:\n")
+		for _, event := range task.History {
+			if event.Field == compactedField {
+				fmt.Printf("    %s  %s\n", event.At, event.Note)
+				continue
+			}
+			note := ""
+			if event.Note != "" {
+				note = " (" + event.Note + ")"
+			}
+			fmt.Printf("    %s  %s: %q → %q%s\n", event.At, event.Field, event.From, event.To, note)
+		}
+	}
+	return nil
+}
+
+// statusStyle returns the emoji and color used to display a status
+func statusStyle(status string) (string, string) {
+	switch status {
+	case "todo":
+		return "⏳", ColorYellow
+	case "in-progress":
+		return "🔄", ColorBlue
+	case "done":
+		return "✅", ColorGreen
+	}
+	return "❓", ColorWhite
+}
+
+// taskSuffix returns the project, tag, due date and recurrence markers shown after a task in lists
+func taskSuffix(task Task) string {
+	suffix := ""
+	if task.Priority != PriorityNone {
+		suffix += " [" + task.Priority.String() + "]"
+	}
+	if task.Pinned {
+		suffix += " 📌"
+	}
+	if len(task.BlockedBy) > 0 && task.Status != "done" {
+		suffix += " 🚫 " + formatIDList(task.BlockedBy)
+	}
+	if task.Waiting != nil && task.Status != "done" {
+		now := clock.Now()
+		switch {
+		case needsFollowUp(task, now):
+			suffix += fmt.Sprintf(" %s⏰ follow up with %s (since %s)%s",
+				ColorYellow, task.Waiting.Person, shortDate(task.Waiting.Until, now), ColorReset)
+		case task.Waiting.Until != "":
+			suffix += fmt.Sprintf(" ⏸ waiting on %s until %s", task.Waiting.Person, shortDate(task.Waiting.Until, now))
+		default:
+			suffix += fmt.Sprintf(" ⏸ waiting on %s", task.Waiting.Person)
+		}
+	}
+	if task.Project != "" {
+		suffix += " +" + task.Project
+	}
+	for _, tag := range task.Tags {
+		suffix += " @" + tag
+	}
+	if task.DueDate != "" && task.Status != "done" {
+		level, days := overdueBucket(task, clock.Now())
+		if level == NotOverdue {
+			suffix += fmt.Sprintf(" 📅 %s", task.DueDate)
+		} else {
+			color, marker := overdueStyle(level)
+			if marker != "" {
+				marker = " " + marker
+			}
+			suffix += fmt.Sprintf(" %s📅 %s (%s late)%s%s", color, task.DueDate, plural(days, "day"), marker, ColorReset)
+		}
+	}
+	if task.Recurrence != "" {
+		suffix += fmt.Sprintf(" 🔁 %s", task.Recurrence)
+	}
+	return suffix
+}
+
+// overdueLevel buckets how late an open task is
+type overdueLevel int
+
+const (
+	NotOverdue    overdueLevel = iota
+	OverdueRecent              // fewer than overdue_days.late days late
+	OverdueLate                // fewer than overdue_days.very_late days late
+	OverdueSevere
+)
+
+// overdueBucket returns how late an open task is at now and by how many
+// whole days; tasks due today or later, undated or done are NotOverdue
+func overdueBucket(task Task, now time.Time) (overdueLevel, int) {
+	if task.DueDate == "" || task.Status == "done" {
+		return NotOverdue, 0
+	}
+	due, err := time.ParseInLocation(dateLayout, task.DueDate, time.Local)
+	if err != nil {
+		return NotOverdue, 0
+	}
+
+	days := int(startOfDay(now).Sub(due).Hours()/24 + 0.5)
+	switch {
+	case days <= 0:
+		return NotOverdue, 0
+	case days < config.OverdueDays.Late:
+		return OverdueRecent, days
+	case days < config.OverdueDays.VeryLate:
+		return OverdueLate, days
+	}
+	return OverdueSevere, days
+}
+
+// overdueStyle returns the color and marker for an overdue bucket. Plain
+// output has no color, so it marks the buckets with !, !! and !!!.
+func overdueStyle(level overdueLevel) (string, string) {
+	// the marker repeats what the color says, for --plain and for readers
+	// who cannot tell the colors apart
+	marker := strings.Repeat("!", int(level))
+	switch level {
+	case OverdueRecent:
+		return ColorYellow, marker
+	case OverdueLate:
+		return ColorRed, marker
+	case OverdueSevere:
+		return ColorBright + ColorRed, marker
+	}
+	return "", ""
+}
+
+// sortTasks orders tasks by the given key (id, priority, due, created or
+// urgency, highest first), breaking ties by ID
+func sortTasks(tasks []Task, key string, scores map[int]float64) error {
+	var less func(a, b Task) bool
+	switch key {
+	case "", "id":
+		less = func(a, b Task) bool { return false }
+	case "urgency":
+		less = func(a, b Task) bool { return scores[a.ID] > scores[b.ID] }
+	case "priority":
+		less = func(a, b Task) bool { return a.Priority.rank() < b.Priority.rank() }
+	case "due":
+		less = func(a, b Task) bool {
+			if (a.DueDate == "") != (b.DueDate == "") {
+				return b.DueDate == ""
+			}
+			return a.DueDate < b.DueDate
+		}
+	case "created":
+		less = func(a, b Task) bool { return a.CreatedAt < b.CreatedAt }
+	default:
+		return newError(ErrUsage, "unknown sort key %q (use id, priority, due, created or urgency)", key)
+	}
+
+	sort.SliceStable(tasks, func(i, j int) bool {
+		if less(tasks[i], tasks[j]) {
+			return true
+		}
+		if less(tasks[j], tasks[i]) {
+			return false
+		}
+		return tasks[i].ID < tasks[j].ID
+	})
+	return nil
+}
+
+// filterTerm is one condition of a filter expression, e.g. tag:work or -status:done
+type filterTerm struct {
+	field    string
+	value    string
+	negate   bool
+	priority Priority
+}
+
+// taskFilter matches tasks that satisfy every term of a filter expression
+type taskFilter []filterTerm
+
+// parseFilter parses a space-separated filter expression. Terms are
+// status:, tag:, project:, priority:, due-before: and due-after: (dates in
+// any form parseDate accepts); other words match the title. A leading -
+// negates a term.
+func parseFilter(expr string, now time.Time) (taskFilter, error) {
+	var filter taskFilter
+	for _, word := range strings.Fields(expr) {
+		term, err := parseFilterTerm(word, now)
+		if err != nil {
+			return nil, err
+		}
+		filter = append(filter, term)
+	}
+	return filter, nil
+}
+
+// parseFilterTerm parses one term of a filter expression, e.g. -tag:work
+func parseFilterTerm(word string, now time.Time) (filterTerm, error) {
+	term := filterTerm{}
+	if strings.HasPrefix(word, "-") && len(word) > 1 {
+		term.negate = true
+		word = word[1:]
+	}
+
+	field, value, hasField := strings.Cut(word, ":")
+	if !hasField {
+		term.field, term.value = "text", strings.ToLower(word)
+		return term, nil
+	}
+	if value == "" {
+		return term, fmt.Errorf("invalid filter term %q: missing value after %q", word, field+":")
+	}
+
+	term.field, term.value = strings.ToLower(field), value
+	switch term.field {
+	case "status", "tag", "project":
+	case "priority":
+		p, err := parsePriority(value)
+		if err != nil {
+			return term, fmt.Errorf("invalid filter term %q: %v", word, err)
+		}
+		term.priority = p
+	case "due-before", "due-after":
+		date, err := parseDate(value, now)
+		if err != nil {
+			return term, fmt.Errorf("invalid filter term %q: %v", word, err)
+		}
+		term.value = date.Format(dateLayout)
+	default:
+		return term, fmt.Errorf("invalid filter term %q: unknown field %q (use status, tag, project, priority, due-before or due-after)", word, field)
+	}
+	return term, nil
+}
+
+// matches reports whether task satisfies every term of the filter
+func (f taskFilter) matches(task Task) bool {
+	for _, term := range f {
+		if term.matches(task) == term.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// matches reports whether task satisfies the term, ignoring negation
+func (term filterTerm) matches(task Task) bool {
+	switch term.field {
+	case "text":
+		return strings.Contains(strings.ToLower(task.Title), term.value)
+	case "status":
+		return task.Status == term.value
+	case "project":
+		return strings.EqualFold(task.Project, term.value)
+	case "tag":
+		for _, tag := range task.Tags {
+			if strings.EqualFold(tag, term.value) {
+				return true
+			}
+		}
+		return false
+	case "priority":
+		return task.Priority == term.priority
+	case "due-before":
+		return task.DueDate != "" && task.DueDate < term.value
+	case "due-after":
+		return task.DueDate != "" && task.DueDate > term.value
+	}
+	return false
+}
+
+// filterTasks returns the tasks matching filter
+func filterTasks(tasks []Task, filter taskFilter) []Task {
+	var matched []Task
+	for _, task := range tasks {
+		if filter.matches(task) {
+			matched = append(matched, task)
+		}
+	}
+	return matched
+}
+
+// listOptions holds the arguments of the list command
+type listOptions struct {
+	Status  string
+	Sort    string
+	Filter  string
+	Waiting bool
+	View    string // the remembered view in effect, shown in the header
+}
+
+// emptyState is what a command prints when it has nothing to show: a
+// one-line message and the command worth running next
+type emptyState struct {
+	emoji   string
+	color   string // "yellow" or "green"; colors are looked up when printing
+	message string // formatted with the arguments given to printEmpty
+	next    string // suggested command line, without the program name
+}
+
+// printEmpty prints the empty state registered in commandHelps for key: a
+// command name, with a ":variant" suffix where the message depends on the
+// filters in use. Nothing is printed with --quiet, and the suggested command
+// is only shown on a terminal, so scripts reading the output get the message
+// alone. A key without an empty state prints a plain message rather than
+// failing.
+func printEmpty(key string, args ...any) {
+	if globals.Quiet {
+		return
+	}
+	state, ok := lookupEmptyState(key)
+	if !ok {
+		fmt.Println("Nothing to show")
+		return
+	}
+	color := map[string]string{"yellow": ColorYellow, "green": ColorGreen}[state.color]
+	fmt.Printf("%s%s %s", color, state.emoji, fmt.Sprintf(state.message, args...))
+	if state.next != "" && isTerminal(os.Stdout) {
+		fmt.Printf(" — try %s`go run task-tracker.go %s`%s", ColorBright, state.next, ColorReset)
+	}
+	fmt.Printf("%s\n", ColorReset)
+}
+
+// lookupEmptyState returns the empty state registered for key
+func lookupEmptyState(key string) (emptyState, bool) {
+	name, variant, _ := strings.Cut(key, ":")
+	for _, command := range commandHelps {
+		if state, ok := command.empty[variant]; ok && command.name == name {
+			return state, true
+		}
+	}
+	return emptyState{}, false
+}
+
+// listTasks lists all tasks, optionally filtered by status or a filter
+// expression and sorted by the given key
+func listTasks(ctx context.Context, opts listOptions) error {
+	filter, err := parseFilter(opts.Filter, clock.Now())
+	if err != nil {
+		return newError(ErrInvalid, "%v", err)
+	}
+
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Sort tasks by ID (or the requested key) for consistent display
+	scores := urgencyScores(tasks, clock.Now())
+	if err := sortTasks(tasks, opts.Sort, scores); err != nil {
+		return err
+	}
+
+	if len(tasks) == 0 {
+		printEmpty("list")
+		return nil
+	}
+
+	viewNote := ""
+	if opts.View != "" {
+		viewNote = fmt.Sprintf(" %s(view: %s)", ColorDim, opts.View)
+	}
+
+	if opts.Waiting {
+		if viewNote != "" {
+			fmt.Printf("%s%s\n", strings.TrimSpace(viewNote), ColorReset)
+		}
+		listWaiting(filterTasks(tasks, filter), scores)
+		return nil
+	}
+
+	// Filter tasks if status or a filter expression is specified
+	statusFilter := opts.Status
+	if statusFilter != "" {
+		filter = append(filter, filterTerm{field: "status", value: statusFilter})
+	}
+	if len(filter) > 0 {
+		tasks = filterTasks(tasks, filter)
+
+		label := statusFilter
+		if opts.Filter != "" {
+			label = strings.TrimSpace(statusFilter + " " + opts.Filter)
+		}
+		if len(tasks) == 0 {
+			switch {
+			case opts.View != "":
+				printEmpty("list:view", label, opts.View)
+			case opts.Filter != "":
+				printEmpty("list:filter", label)
+			case statusFilter == "done":
+				printEmpty("list:done")
+			default:
+				printEmpty("list:status", label)
+			}
+			return nil
+		}
+		fmt.Printf("%s📋 Your %s tasks:%s%s\n", ColorCyan, label, viewNote, ColorReset)
+	} else {
+		fmt.Printf("%s📋 Your tasks:%s%s\n", ColorCyan, viewNote, ColorReset)
+	}
+
+	for _, task := range tasks {
+		printTaskLine(task, scores)
+	}
+	printLegendHint(tasks, scores)
+	return nil
+}
+
+// viewFile remembers the sort, filter and grouping last chosen for list,
+// one view per status argument
+var viewFile = dataFile + ".view"
+
+// listView is the view remembered for one status argument of list
+type listView struct {
+	Sort    string `json:"sort,omitempty"`
+	Filter  string `json:"filter,omitempty"`
+	Waiting bool   `json:"waiting,omitempty"`
+}
+
+// describe summarizes the view for the list header, e.g. "sort=due, waiting";
+// it is empty for a view that changes nothing
+func (v listView) describe() string {
+	var parts []string
+	if v.Sort != "" {
+		parts = append(parts, "sort="+v.Sort)
+	}
+	if v.Filter != "" {
+		parts = append(parts, "filter="+v.Filter)
+	}
+	if v.Waiting {
+		parts = append(parts, "waiting")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// merge combines the view with the list options: the flags named in set
+// replace the remembered values, and the others are taken from the view.
+// It returns the view to remember.
+func (v listView) merge(opts *listOptions, set map[string]bool) listView {
+	if set["sort"] {
+		v.Sort = opts.Sort
+	} else if v.Sort != "" {
+		opts.Sort = v.Sort
+	}
+	if set["filter"] {
+		v.Filter = opts.Filter
+	} else {
+		opts.Filter = v.Filter
+	}
+	if set["waiting"] {
+		v.Waiting = opts.Waiting
+	} else {
+		opts.Waiting = v.Waiting
+	}
+	return v
+}
+
+// loadViews reads the view file; a missing file has no views
+func loadViews() (map[string]listView, error) {
+	views := map[string]listView{}
+	data, err := os.ReadFile(viewFile)
+	if os.IsNotExist(err) {
+		return views, nil
+	}
+	if err != nil {
+		return views, wrapError(ErrIO, err, "could not read %s", viewFile)
+	}
+	if err := json.Unmarshal(data, &views); err != nil {
+		return map[string]listView{}, wrapError(ErrCorrupt, err, "%s is not a valid view file", viewFile)
+	}
+	return views, nil
+}
+
+// saveViews writes the view file atomically
+func saveViews(views map[string]listView) error {
+	data, err := json.MarshalIndent(views, "", "  ")
+	if err != nil {
+		return wrapError(ErrIO, err, "could not encode views")
+	}
+	tmpFile := viewFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		os.Remove(tmpFile)
+		return wrapError(ErrIO, err, "could not write %s", viewFile)
+	}
+	if err := os.Rename(tmpFile, viewFile); err != nil {
+		os.Remove(tmpFile)
+		return wrapError(ErrIO, err, "could not write %s", viewFile)
+	}
+	return nil
+}
+
+// listWithView lists tasks with the view remembered for opts.Status. The
+// flags named in set replace the remembered values, and are remembered
+// once the list succeeds; reset forgets the view. Views only apply when
+// stdout is a terminal, so scripts reading list always get the defaults.
+func listWithView(ctx context.Context, opts listOptions, set map[string]bool, reset bool) error {
+	if !isTerminal(os.Stdout) {
+		return listTasks(ctx, opts)
+	}
+	views, err := loadViews()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s⚠️  %v; ignoring remembered views%s\n", ColorYellow, err, ColorReset)
+	}
+
+	view := listView{}
+	if !reset {
+		view = views[opts.Status].merge(&opts, set)
+		opts.View = view.describe()
+	}
+	if err := listTasks(ctx, opts); err != nil {
+		return err
+	}
+
+	if (!reset && len(set) == 0) || readOnly() {
+		return nil
+	}
+	if view.describe() == "" {
+		if _, exists := views[opts.Status]; !exists {
+			return nil
+		}
+		delete(views, opts.Status)
+	} else {
+		views[opts.Status] = view
+	}
+	if err := saveViews(views); err != nil {
+		fmt.Fprintf(os.Stderr, "%s⚠️  %v; the view is not remembered%s\n", ColorYellow, err, ColorReset)
+	}
+	return nil
+}
+
+// legendEntry is one symbol of the legend: what it means and a command
+// that makes a task show it
+type legendEntry struct {
+	key     string // recorded in the state file once shown
+	symbol  string
+	meaning string
+	command string
+}
+
+// statusLegend explains every status. No command moves a task to
+// in-progress; only imports set it.
+var statusLegend = []legendEntry{
+	{"status:todo", "todo", "Not started yet", "add, reopen"},
+	{"status:in-progress", "in-progress", "Being worked on", "import csv with a status column"},
+	{"status:done", "done", "Completed", "done"},
+}
+
+// badgeLegend explains the markers taskSuffix can add to a list line, in
+// the order they appear
+var badgeLegend = []legendEntry{
+	{"urgency", "9.7", "Urgency score, shown before the ID", "show <id> explains it"},
+	{"priority", "[high]", "Priority, shown as priority_display sets", "set <id> --priority high"},
+	{"pinned", "📌", "Pinned: ranks higher in urgency", "set <id> --pinned"},
+	{"blocked", "🚫 #3", "Blocked by these open tasks", "set <id> --blocked-by 3"},
+	{"follow-up", "⏰", "Waiting, and the follow-up date has passed", "wait <id> --on <person> --until <date>"},
+	{"waiting", "⏸", "Waiting on someone", "wait <id> --on <person>"},
+	{"project", "+name", "Project", "set <id> --project <name>"},
+	{"tag", "@name", "Tag", "set <id> --tag <tag>"},
+	{"due", "📅", "Due date", "set <id> --due <date>"},
+	{"overdue", "! !! !!!", "Overdue: see overdue_days for the steps", "agenda"},
+	{"recurring", "🔁", "Repeats after completion or from the due date", "add --every 1w"},
+}
+
+// legendKeys returns the keys of the symbols the list line of task shows,
+// following taskSuffix
+func legendKeys(task Task, scores map[int]float64) []string {
+	keys := []string{"status:" + task.Status}
+	if _, ok := scores[task.ID]; ok {
+		keys = append(keys, "urgency")
+	}
+	if task.Priority != PriorityNone {
+		keys = append(keys, "priority")
+	}
+	if task.Pinned {
+		keys = append(keys, "pinned")
+	}
+	open := task.Status != "done"
+	if len(task.BlockedBy) > 0 && open {
+		keys = append(keys, "blocked")
+	}
+	if task.Waiting != nil && open {
+		if needsFollowUp(task, clock.Now()) {
+			keys = append(keys, "follow-up")
+		} else {
+			keys = append(keys, "waiting")
+		}
+	}
+	if task.Project != "" {
+		keys = append(keys, "project")
+	}
+	if len(task.Tags) > 0 {
+		keys = append(keys, "tag")
+	}
+	if task.DueDate != "" && open {
+		keys = append(keys, "due")
+		if level, _ := overdueBucket(task, clock.Now()); level != NotOverdue {
+			keys = append(keys, "overdue")
+		}
+	}
+	if task.Recurrence != "" {
+		keys = append(keys, "recurring")
+	}
+	return keys
+}
+
+// showLegend prints what every status and list marker means, and records
+// them all as shown
+func showLegend() {
+	fmt.Printf("%s📖 Statuses:%s\n", ColorCyan, ColorReset)
+	for _, entry := range statusLegend {
+		emoji, color := statusStyle(entry.symbol)
+		swatch := ""
+		if color != "" {
+			swatch = " " + color + "██" + ColorReset
+		}
+		fmt.Printf("  %s%s %s%s%s: %s — %s%s%s\n", emoji, swatch, ColorBright, entry.symbol, ColorReset, entry.meaning, ColorDim, entry.command, ColorReset)
+	}
+	fmt.Printf("%s📖 Markers in list lines:%s\n", ColorCyan, ColorReset)
+	for _, entry := range badgeLegend {
+		fmt.Printf("  %s  %s — %s%s%s\n", entry.symbol, entry.meaning, ColorDim, entry.command, ColorReset)
+	}
+
+	var keys []string
+	for _, entry := range append(append([]legendEntry{}, statusLegend...), badgeLegend...) {
+		keys = append(keys, entry.key)
+	}
+	markLegendSeen(keys)
+}
+
+// markLegendSeen records symbols as explained in the state file and reports
+// whether any of them was new
+func markLegendSeen(keys []string) bool {
+	if readOnly() {
+		return false
+	}
+	state, err := loadState()
+	if err != nil {
+		return false
+	}
+	seen := map[string]bool{}
+	for _, key := range state.SeenSymbols {
+		seen[key] = true
+	}
+	added := false
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			state.SeenSymbols = append(state.SeenSymbols, key)
+			added = true
+		}
+	}
+	if added {
+		sort.Strings(state.SeenSymbols)
+		if saveState(state) != nil {
+			return false
+		}
+	}
+	return added
+}
+
+// printLegendHint points to legend the first time list shows a symbol, on
+// a terminal only so scripts are not affected
+func printLegendHint(tasks []Task, scores map[int]float64) {
+	if !isTerminal(os.Stdout) {
+		return
+	}
+	var keys []string
+	for _, task := range tasks {
+		keys = append(keys, legendKeys(task, scores)...)
+	}
+	if markLegendSeen(keys) {
+		fmt.Printf("%s💡 Run `go run task-tracker.go legend` to see what the symbols mean%s\n", ColorDim, ColorReset)
+	}
+}
+
+// listWaiting lists open waiting tasks grouped by the person they wait on,
+// so follow-ups to one person can be batched
+func listWaiting(tasks []Task, scores map[int]float64) {
+	groups := map[string][]Task{}
+	var people []string
+	for _, task := range tasks {
+		if task.Waiting == nil || task.Status == "done" {
+			continue
+		}
+		key := strings.ToLower(task.Waiting.Person)
+		if _, ok := groups[key]; !ok {
+			people = append(people, key)
+		}
+		groups[key] = append(groups[key], task)
+	}
+
+	if len(people) == 0 {
+		printEmpty("list:waiting")
+		return
+	}
+	sort.Strings(people)
+	for _, key := range people {
+		group := groups[key]
+		fmt.Printf("%s⏸  Waiting on %s (%d):%s\n", ColorBlue, group[0].Waiting.Person, len(group), ColorReset)
+		for _, task := range group {
+			printTaskLine(task, scores)
+		}
+	}
+}
+
+// printAttention prints a block of nudges for tasks that need action now,
+// such as waiting tasks whose follow-up date has passed
+func printAttention(tasks []Task) {
+	now := clock.Now()
+	var nudges []string
+	for _, task := range tasks {
+		if needsFollowUp(task, now) {
+			nudges = append(nudges, fmt.Sprintf("follow up with %s on %s %s (waiting since %s)",
+				task.Waiting.Person, formatID(task.ID), task.Title, shortDate(task.Waiting.Since, now)))
+		}
+	}
+	if len(nudges) == 0 {
+		return
+	}
+
+	fmt.Printf("%s🔔 Needs attention:%s\n", ColorYellow, ColorReset)
+	for _, nudge := range nudges {
+		fmt.Printf("  • %s\n", nudge)
+	}
+	fmt.Println()
+}
+
+// showNext lists the most urgent open tasks that can be worked on now,
+// skipping blocked tasks and tasks waiting on someone
+func showNext(ctx context.Context, count int) error {
+	if count < 1 {
+		return newError(ErrInvalid, "--count must be at least 1")
+	}
+
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := clock.Now()
+	printAttention(tasks)
+
+	scores := urgencyScores(tasks, now)
+	var actionable []Task
+	for _, task := range tasks {
+		if task.Status != "done" && !isBlocked(task, tasks) && !isWaiting(task, now) {
+			actionable = append(actionable, task)
+		}
+	}
+	if len(actionable) == 0 {
+		printEmpty("next")
+		return nil
+	}
+
+	sortTasks(actionable, "urgency", scores)
+	if len(actionable) > count {
+		actionable = actionable[:count]
+	}
+	fmt.Printf("%s👉 Next up:%s\n", ColorCyan, ColorReset)
+	for _, task := range actionable {
+		printTaskLine(task, scores)
+	}
+	return nil
+}
+
+// printTaskLine prints a task as a single list entry, with its urgency
+// score in a small column for open tasks
+func printTaskLine(task Task, scores map[int]float64) {
+	emoji, statusColor := statusStyle(task.Status)
+
+	score := "    "
+	if value, ok := scores[task.ID]; ok {
+		score = fmt.Sprintf("%4.1f", value)
+	}
+
+	fmt.Printf("  %s %s %s%s: %s%s%s %s(%s)%s%s\n",
+		emoji, score, ColorWhite, formatID(task.ID), ColorBright, task.Title, ColorReset,
+		statusColor, task.Status, ColorReset, taskSuffix(task))
+}
+
+// showAgenda lists open tasks that are overdue (most late first), due today
+// and due within the next days
+func showAgenda(ctx context.Context, days int) error {
+	if days < 0 {
+		return newError(ErrInvalid, "--days must not be negative")
+	}
+
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+
+	printAttention(tasks)
+
+	now := clock.Now()
+	today := now.Format(dateLayout)
+	horizon := startOfDay(now).AddDate(0, 0, days).Format(dateLayout)
+	scores := urgencyScores(tasks, now)
+	sortTasks(tasks, "due", scores)
+
+	var overdue, dueToday, upcoming []Task
+	for _, task := range tasks {
+		if task.Status == "done" || task.DueDate == "" {
+			continue
+		}
+		switch {
+		case task.DueDate < today:
+			overdue = append(overdue, task)
+		case task.DueDate == today:
+			dueToday = append(dueToday, task)
+		case task.DueDate <= horizon:
+			upcoming = append(upcoming, task)
+		}
+	}
+
+	// Most late first: by bucket, then by days late within a bucket
+	sort.SliceStable(overdue, func(i, j int) bool {
+		li, di := overdueBucket(overdue[i], now)
+		lj, dj := overdueBucket(overdue[j], now)
+		if li != lj {
+			return li > lj
+		}
+		return di > dj
+	})
+
+	if len(overdue)+len(dueToday)+len(upcoming) == 0 {
+		printEmpty("agenda", plural(days, "day"))
+		return nil
+	}
+
+	working := workingCalendar().workingDaysBetween(now, startOfDay(now).AddDate(0, 0, days))
+	sections := []struct {
+		title string
+		color string
+		tasks []Task
+	}{
+		{"Overdue", ColorRed, overdue},
+		{"Today", ColorYellow, dueToday},
+		{fmt.Sprintf("Next %s, %s", plural(days, "day"), plural(working, "working day")), ColorCyan, upcoming},
+	}
+	for _, section := range sections {
+		if len(section.tasks) == 0 {
+			continue
+		}
+		fmt.Printf("%s📆 %s (%d):%s\n", section.color, section.title, len(section.tasks), ColorReset)
+		for _, task := range section.tasks {
+			printTaskLine(task, scores)
+		}
+	}
+	return nil
+}
+
+// searchIndex is an inverted index from lowercase tokens to task IDs, built
+// from the data file as it was at stamp
+type searchIndex struct {
+	file     string
+	stamp    fileStamp
+	tokens   []string
+	postings map[string][]int
+}
+
+var (
+	searchMu     sync.Mutex
+	cachedSearch *searchIndex
+)
+
+// invalidateSearchIndex drops the cached index; every write must call it
+func invalidateSearchIndex() {
+	searchMu.Lock()
+	cachedSearch = nil
+	searchMu.Unlock()
+}
+
+// getSearchIndex returns the index for tasks, loaded from the data file
+// when it had stamp. The cached index is reused while the data file and its
+// stamp stay the same, so another command's write is picked up as well.
+func getSearchIndex(tasks []Task, stamp fileStamp) *searchIndex {
+	searchMu.Lock()
+	defer searchMu.Unlock()
+	if cachedSearch == nil || cachedSearch.file != dataFile || cachedSearch.stamp != stamp {
+		cachedSearch = buildSearchIndex(tasks)
+		cachedSearch.file, cachedSearch.stamp = dataFile, stamp
+	}
+	return cachedSearch
+}
+
+// searchFields returns the free-text fields of a task that search covers
+func searchFields(task Task) []string {
+	fields := append([]string{task.Title, task.Project}, task.Tags...)
+	for _, comment := range task.Comments {
+		fields = append(fields, comment.Text)
+	}
+	return fields
+}
+
+// tokenize splits text into lowercase words at unicode word boundaries
+func tokenize(text string) []string {
+	var tokens []string
+	eachToken(text, func(token string) { tokens = append(tokens, token) })
+	return tokens
+}
+
+// eachToken calls fn with each word of text, lowercased, in order. Only one
+// word is copied at a time, however long text is.
+func eachToken(text string, fn func(token string)) {
+	start := -1
+	for i, r := range text {
+		inWord := unicode.IsLetter(r) || unicode.IsNumber(r)
+		switch {
+		case inWord && start < 0:
+			start = i
+		case !inWord && start >= 0:
+			fn(strings.ToLower(text[start:i]))
+			start = -1
+		}
+	}
+	if start >= 0 {
+		fn(strings.ToLower(text[start:]))
+	}
+}
+
+// buildSearchIndex tokenizes every searchable field of tasks
+func buildSearchIndex(tasks []Task) *searchIndex {
+	index := &searchIndex{postings: map[string][]int{}}
+
+	for _, task := range tasks {
+		seen := map[string]bool{}
+		for _, field := range searchFields(task) {
+			eachToken(field, func(token string) {
+				if seen[token] {
+					return
+				}
+				if _, known := index.postings[token]; !known {
+					// a copy, so the index does not keep the field alive
+					token = strings.Clone(token)
+				}
+				seen[token] = true
+				index.postings[token] = append(index.postings[token], task.ID)
+			})
+		}
+	}
+
+	index.tokens = make([]string, 0, len(index.postings))
+	for token := range index.postings {
+		index.tokens = append(index.tokens, token)
+	}
+	sort.Strings(index.tokens)
+	return index
+}
+
+// lookup returns the IDs of tasks containing a word starting with prefix
+func (index *searchIndex) lookup(prefix string) map[int]bool {
+	ids := map[int]bool{}
+	start := sort.SearchStrings(index.tokens, prefix)
+	for _, token := range index.tokens[start:] {
+		if !strings.HasPrefix(token, prefix) {
+			break
+		}
+		for _, id := range index.postings[token] {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// search returns the IDs of tasks matching every word of query by prefix
+func (index *searchIndex) search(query string) map[int]bool {
+	var matches map[int]bool
+	for _, word := range tokenize(query) {
+		found := index.lookup(word)
+		if matches == nil {
+			matches = found
+			continue
+		}
+		for id := range matches {
+			if !found[id] {
+				delete(matches, id)
+			}
+		}
+	}
+	return matches
+}
+
+// searchTasks lists tasks whose title, project, tags or comments contain
+// words starting with every word of the query, so "data" finds "database"
+func searchTasks(ctx context.Context, query string) error {
+	if len(tokenize(query)) == 0 {
+		return newError(ErrUsage, "please provide words to search for")
+	}
+
+	// stamped before loading, so a write in between only forces a rebuild
+	stamp := dataFileStamp()
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+
+	matches := getSearchIndex(tasks, stamp).search(query)
+	var results []Task
+	for _, task := range tasks {
+		if matches[task.ID] {
+			results = append(results, task)
+		}
+	}
+
+	if len(results) == 0 {
+		printEmpty("search", query)
+		return nil
+	}
+	scores := urgencyScores(tasks, clock.Now())
+	sortTasks(results, "id", scores)
+
+	fmt.Printf("%s🔍 %s match %q:%s\n", ColorCyan, plural(len(results), "task"), query, ColorReset)
+	for _, task := range results {
+		printTaskLine(task, scores)
+	}
+	return nil
+}
+
+// statsJSON is the stats --json output
+type statsJSON struct {
+	Total         int            `json:"total"`
+	ByStatus      map[string]int `json:"by_status"`
+	WeekStart     string         `json:"week_start"`
+	WeekAdded     int            `json:"week_added"`
+	WeekCompleted int            `json:"week_completed"`
+	AddedToday    int            `json:"added_today"`
+	Inbox         int            `json:"inbox"`
+	Budgets       []budgetUsage  `json:"budgets"`
+}
+
+// showStats prints task counts by status and for the current week, and how
+// much of each project budget is used
+func showStats(ctx context.Context, asJSON bool) error {
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+
+	counts := map[string]int{}
+	for _, task := range tasks {
+		counts[task.Status]++
+	}
+	now := clock.Now()
+	week := weekPeriod(now)
+	summary := summarize(tasks, week, now)
+	budgets := budgetUsages(tasks, now)
+
+	if asJSON {
+		data, err := json.MarshalIndent(statsJSON{
+			Total:         len(tasks),
+			ByStatus:      counts,
+			WeekStart:     week.Start.Format(dateLayout),
+			WeekAdded:     summary.Created,
+			WeekCompleted: summary.Completed,
+			AddedToday:    countAddedOn(tasks, now),
+			Inbox:         countInbox(tasks),
+			Budgets:       budgets,
+		}, "", "  ")
+		if err != nil {
+			return wrapError(ErrIO, err, "could not encode stats")
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	fmt.Printf("%s📊 Task stats:%s\n", ColorCyan, ColorReset)
+	fmt.Printf("  %sTotal: %d%s\n", ColorBright, len(tasks), ColorReset)
+	for _, status := range []string{"todo", "in-progress", "done"} {
+		emoji, statusColor := statusStyle(status)
+		fmt.Printf("  %s %s%s: %d%s\n", emoji, statusColor, status, counts[status], ColorReset)
+	}
+	fmt.Printf("  📅 This week (since %s): %d added, %d completed\n",
+		week.Start.Format("Mon Jan 2"), summary.Created, summary.Completed)
+
+	if limit := config.DailyAddLimit; limit > 0 {
+		fmt.Printf("  ➕ Added today: %d / %d\n", countAddedOn(tasks, clock.Now()), limit)
+	}
+	if limit := config.InboxLimit; limit > 0 {
+		fmt.Printf("  📥 Inbox (no tags or project): %d / %d\n", countInbox(tasks), limit)
+	}
+	for _, usage := range budgets {
+		fmt.Printf("  💰 +%s: %.0f%% of budget used\n", usage.Project, usage.Utilization*100)
+	}
+	return nil
+}
+
+// trackedHours returns the hours tracked on task within p, counting a
+// running timer up to now
+func trackedHours(task Task, p period, now time.Time) float64 {
+	total := time.Duration(0)
+	for _, entry := range task.TimeLog {
+		if start, end, ok := entry.within(p, now); ok {
+			total += end.Sub(start)
+		}
+	}
+	return total.Hours()
+}
+
+// within returns the part of the entry inside p, counting a running timer
+// up to now; ok is false when nothing of it is inside
+func (e TimeEntry) within(p period, now time.Time) (time.Time, time.Time, bool) {
+	start, err := parseTimestamp(e.Start)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	end := now
+	if e.End != "" {
+		if end, err = parseTimestamp(e.End); err != nil {
+			return time.Time{}, time.Time{}, false
+		}
+	}
+	start, end = maxTime(start, p.Start), minTime(end, p.End)
+	return start, end, end.After(start)
+}
+
+// daySpan is the part of a time interval that falls on one local day
+type daySpan struct {
+	Day      string // YYYY-MM-DD
+	Duration time.Duration
+}
+
+// splitByDay splits [start, end) at each local midnight, so a session worked
+// past midnight counts toward both days. Days are calendar days in start's
+// location: a day with a DST change holds 23 or 25 hours, never 24. Every
+// per-day aggregation of tracked time must go through this helper.
+func splitByDay(start, end time.Time) []daySpan {
+	var spans []daySpan
+	for start.Before(end) {
+		year, month, day := start.Date()
+		midnight := time.Date(year, month, day+1, 0, 0, 0, 0, start.Location())
+		stop := minTime(midnight, end)
+		spans = append(spans, daySpan{Day: start.Format(dateLayout), Duration: stop.Sub(start)})
+		start = stop
+	}
+	return spans
+}
+
+// maxTime returns the later of a and b
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// minTime returns the earlier of a and b
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// budgetUsage is how much of a project's budget is used this week
+type budgetUsage struct {
+	Project     string  `json:"project"`
+	OpenTasks   int     `json:"open_tasks"`
+	OpenLimit   int     `json:"open_tasks_limit,omitempty"`
+	Hours       float64 `json:"weekly_hours"`
+	HoursLimit  float64 `json:"weekly_hours_limit,omitempty"`
+	Utilization float64 `json:"utilization"` // the larger used/limit ratio
+}
+
+// budgetUsageOf measures project against its budget in the week of now; a
+// project without a budget has zero limits
+func budgetUsageOf(tasks []Task, project string, now time.Time) budgetUsage {
+	usage := budgetUsage{Project: project}
+	budget, ok := config.Budgets[project]
+	if project == "" || !ok {
+		return usage
+	}
+	usage.OpenLimit, usage.HoursLimit = budget.OpenTasks, budget.WeeklyHours
+
+	week := weekPeriod(now)
+	for _, task := range tasks {
+		if task.Project != project {
+			continue
+		}
+		if task.Status != "done" {
+			usage.OpenTasks++
+		}
+		usage.Hours += trackedHours(task, week, now)
+	}
+	if usage.OpenLimit > 0 {
+		usage.Utilization = float64(usage.OpenTasks) / float64(usage.OpenLimit)
+	}
+	if usage.HoursLimit > 0 {
+		usage.Utilization = max(usage.Utilization, usage.Hours/usage.HoursLimit)
+	}
+	return usage
+}
+
+// overruns describes each part of the budget that is exceeded; with
+// hoursOnly the open task count is not checked
+func (u budgetUsage) overruns(hoursOnly bool) []string {
+	var over []string
+	if u.OpenLimit > 0 && u.OpenTasks > u.OpenLimit && !hoursOnly {
+		over = append(over, fmt.Sprintf("+%s is over budget: %d open tasks, budget %d", u.Project, u.OpenTasks, u.OpenLimit))
+	}
+	if u.HoursLimit > 0 && u.Hours > u.HoursLimit {
+		over = append(over, fmt.Sprintf("+%s is over budget: %s tracked this week, budget %gh", u.Project, formatHours(u.Hours), u.HoursLimit))
+	}
+	return over
+}
+
+// formatHours renders hours as e.g. "45m", "2h" or "1h30m"
+func formatHours(hours float64) string {
+	minutes := int(hours*60 + 0.5)
+	switch {
+	case minutes < 60:
+		return fmt.Sprintf("%dm", minutes)
+	case minutes%60 == 0:
+		return fmt.Sprintf("%dh", minutes/60)
+	}
+	return fmt.Sprintf("%dh%02dm", minutes/60, minutes%60)
+}
+
+// budgetUsages measures every project with a budget, by name
+func budgetUsages(tasks []Task, now time.Time) []budgetUsage {
+	usages := []budgetUsage{}
+	for project := range config.Budgets {
+		usages = append(usages, budgetUsageOf(tasks, project, now))
+	}
+	sort.Slice(usages, func(i, j int) bool { return usages[i].Project < usages[j].Project })
+	return usages
+}
+
+// budgetBar renders used out of limit as a bar, e.g. "████████░░ 8/10";
+// it is red once over the limit
+func budgetBar(used, limit float64, label string) string {
+	const width = 10
+	filled := int(used/limit*width + 0.5)
+	filled = min(max(filled, 0), width)
+	color := ColorGreen
+	if used > limit {
+		color, label = ColorRed, label+" over"
+	}
+	return color + strings.Repeat("█", filled) + strings.Repeat("░", width-filled) + ColorReset + " " + label
+}
+
+// showProjects lists each project with its open and done tasks, the hours
+// tracked this week and, for projects with a budget, how much of it is used
+func showProjects(ctx context.Context) error {
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+	now := clock.Now()
+
+	open, done := map[string]int{}, map[string]int{}
+	var names []string
+	for _, task := range tasks {
+		if task.Project == "" {
+			continue
+		}
+		if open[task.Project]+done[task.Project] == 0 {
+			names = append(names, task.Project)
+		}
+		if task.Status == "done" {
+			done[task.Project]++
+		} else {
+			open[task.Project]++
+		}
+	}
+	for project := range config.Budgets {
+		if open[project]+done[project] == 0 {
+			names = append(names, project)
+		}
+	}
+	if len(names) == 0 {
+		printEmpty("projects")
+		return nil
+	}
+	sort.Strings(names)
+
+	fmt.Printf("%s📁 Projects:%s\n", ColorCyan, ColorReset)
+	for _, name := range names {
+		usage := budgetUsageOf(tasks, name, now)
+		fmt.Printf("  %s+%s%s  %d open, %d done\n", ColorBright, name, ColorReset, open[name], done[name])
+		if usage.OpenLimit > 0 {
+			fmt.Printf("    open tasks  %s\n", budgetBar(float64(usage.OpenTasks), float64(usage.OpenLimit),
+				fmt.Sprintf("%d/%d", usage.OpenTasks, usage.OpenLimit)))
+		}
+		if usage.HoursLimit > 0 {
+			fmt.Printf("    this week   %s\n", budgetBar(usage.Hours, usage.HoursLimit,
+				fmt.Sprintf("%s/%gh", formatHours(usage.Hours), usage.HoursLimit)))
+		}
+	}
+	return nil
+}
+
+// period is the local time range [Start, End) covered by a report
+type period struct {
+	Label string
+	Start time.Time
+	End   time.Time
+}
+
+// weekPeriod returns the week containing t, bucketed through startOfWeek
+func weekPeriod(t time.Time) period {
+	start := startOfWeek(t)
+	return period{Label: "week of " + start.Format("Mon Jan 2 2006"), Start: start, End: start.AddDate(0, 0, 7)}
+}
+
+// monthPeriod returns the calendar month given as YYYY-MM, or the current month
+func monthPeriod(value string, now time.Time) (period, error) {
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	if value != "" {
+		parsed, err := time.ParseInLocation("2006-01", value, time.Local)
+		if err != nil {
+			return period{}, fmt.Errorf("invalid month %q (use YYYY-MM)", value)
+		}
+		start = parsed
+	}
+	return period{Label: start.Format("January 2006"), Start: start, End: start.AddDate(0, 1, 0)}, nil
+}
+
+// quarterPeriod returns the calendar quarter given as YYYY-Q1..Q4, or the
+// current quarter
+func quarterPeriod(value string, now time.Time) (period, error) {
+	year, quarter := now.Year(), (int(now.Month())-1)/3+1
+	if value != "" {
+		if _, err := fmt.Sscanf(strings.ToUpper(value), "%d-Q%d", &year, &quarter); err != nil || quarter < 1 || quarter > 4 {
+			return period{}, fmt.Errorf("invalid quarter %q (use YYYY-Q1 to YYYY-Q4)", value)
+		}
+	}
+	start := time.Date(year, time.Month((quarter-1)*3+1), 1, 0, 0, 0, 0, time.Local)
+	return period{Label: fmt.Sprintf("%d-Q%d", year, quarter), Start: start, End: start.AddDate(0, 3, 0)}, nil
+}
+
+// contains reports whether the stored timestamp value falls within p
+func (p period) contains(value string) bool {
+	t, err := parseTimestamp(value)
+	return err == nil && !t.Before(p.Start) && t.Before(p.End)
+}
+
+// countEntry is a name with a count, e.g. a tag and its completed tasks
+type countEntry struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// openTaskEntry is one of the oldest open tasks listed in a report
+type openTaskEntry struct {
 	ID        int    `json:"id"`
 	Title     string `json:"title"`
-	Status    string `json:"status"`
 	CreatedAt string `json:"created_at"`
+	AgeDays   int    `json:"age_days"`
+}
+
+// periodSummary aggregates task activity over a period. stats and report
+// both read their numbers from it so they never disagree.
+type periodSummary struct {
+	Period               string          `json:"period"`
+	Start                string          `json:"start"`
+	End                  string          `json:"end"`
+	Created              int             `json:"created"`
+	Completed            int             `json:"completed"`
+	CreatedAndCompleted  int             `json:"created_and_completed"`
+	CompletionRate       float64         `json:"completion_rate"`
+	MedianDaysToComplete float64         `json:"median_days_to_complete"`
+	TopTags              []countEntry    `json:"top_tags"`
+	TopProjects          []countEntry    `json:"top_projects"`
+	OldestOpen           []openTaskEntry `json:"oldest_open"`
+}
+
+// topCounts returns the five largest counts, highest first, ties by name
+func topCounts(counts map[string]int) []countEntry {
+	entries := []countEntry{}
+	for name, count := range counts {
+		entries = append(entries, countEntry{Name: name, Count: count})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	if len(entries) > 5 {
+		entries = entries[:5]
+	}
+	return entries
+}
+
+// median returns the median of values, or 0 when there are none
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	mid := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[mid-1] + values[mid]) / 2
+	}
+	return values[mid]
+}
+
+// summarize aggregates the tasks created and completed within p. The
+// completion rate is the share of tasks created in p that were completed
+// by its end; the oldest open tasks are those created before its end that
+// are still open now. Like every report it counts all tasks and buckets
+// them by their own timestamps, so working on a task today never changes
+// the numbers of a past period.
+func summarize(tasks []Task, p period, now time.Time) periodSummary {
+	summary := periodSummary{
+		Period:      p.Label,
+		Start:       p.Start.Format(dateLayout),
+		End:         p.End.AddDate(0, 0, -1).Format(dateLayout),
+		TopTags:     []countEntry{},
+		TopProjects: []countEntry{},
+		OldestOpen:  []openTaskEntry{},
+	}
+
+	tags, projects := map[string]int{}, map[string]int{}
+	var durations []float64
+	var open []Task
+	for _, task := range tasks {
+		if p.contains(task.CreatedAt) {
+			summary.Created++
+			if task.CompletedAt != "" && task.CompletedAt < p.End.Format(timeLayout) {
+				summary.CreatedAndCompleted++
+			}
+		}
+		if p.contains(task.CompletedAt) {
+			summary.Completed++
+			for _, tag := range task.Tags {
+				tags[tag]++
+			}
+			if task.Project != "" {
+				projects[task.Project]++
+			}
+			created, err1 := parseTimestamp(task.CreatedAt)
+			completed, err2 := parseTimestamp(task.CompletedAt)
+			if err1 == nil && err2 == nil {
+				durations = append(durations, completed.Sub(created).Hours()/24)
+			}
+		}
+		if task.Status != "done" && task.CreatedAt < p.End.Format(timeLayout) {
+			open = append(open, task)
+		}
+	}
+
+	if summary.Created > 0 {
+		summary.CompletionRate = float64(summary.CreatedAndCompleted) / float64(summary.Created)
+	}
+	summary.MedianDaysToComplete = median(durations)
+	summary.TopTags = topCounts(tags)
+	summary.TopProjects = topCounts(projects)
+
+	sort.SliceStable(open, func(i, j int) bool { return open[i].CreatedAt < open[j].CreatedAt })
+	if len(open) > 5 {
+		open = open[:5]
+	}
+	for _, task := range open {
+		entry := openTaskEntry{ID: task.ID, Title: task.Title, CreatedAt: task.CreatedAt}
+		if created, err := parseTimestamp(task.CreatedAt); err == nil {
+			entry.AgeDays = int(now.Sub(created).Hours() / 24)
+		}
+		summary.OldestOpen = append(summary.OldestOpen, entry)
+	}
+	return summary
+}
+
+// formatCounts renders count entries as e.g. "@work 4, @home 2", or "none"
+func formatCounts(entries []countEntry, prefix string) string {
+	if len(entries) == 0 {
+		return "none"
+	}
+	parts := make([]string, len(entries))
+	for i, entry := range entries {
+		parts[i] = fmt.Sprintf("%s%s %d", prefix, entry.Name, entry.Count)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// reportPeriod returns the week, month or quarter a report covers: the one
+// named by value, or the current one
+func reportPeriod(kind string, value string, now time.Time) (period, error) {
+	var p period
+	var err error
+	switch kind {
+	case "week":
+		day := now
+		if value != "" {
+			day, err = parseDate(value, now)
+		}
+		p = weekPeriod(day)
+	case "month":
+		p, err = monthPeriod(value, now)
+	case "quarter":
+		p, err = quarterPeriod(value, now)
+	default:
+		return period{}, newError(ErrUsage, "unknown report period %q (use week, month or quarter)", kind)
+	}
+	if err != nil {
+		return period{}, newError(ErrInvalid, "%v", err)
+	}
+	return p, nil
+}
+
+// timeDay is the time tracked on one day in the time report
+type timeDay struct {
+	Date  string  `json:"date"`
+	Hours float64 `json:"hours"`
+}
+
+// timeProject is the time tracked on one project in the time report
+type timeProject struct {
+	Name  string  `json:"name"`
+	Hours float64 `json:"hours"`
+}
+
+// timeSummary is the time report: the hours tracked on each day of the
+// period, split at midnight, and on each project
+type timeSummary struct {
+	Period     string        `json:"period"`
+	Start      string        `json:"start"`
+	End        string        `json:"end"`
+	TotalHours float64       `json:"total_hours"`
+	Days       []timeDay     `json:"days"`
+	Projects   []timeProject `json:"projects"`
+}
+
+// summarizeTime totals the time tracked on tasks within p per local day and
+// per project
+func summarizeTime(tasks []Task, p period, now time.Time) timeSummary {
+	byDay := map[string]time.Duration{}
+	byProject := map[string]time.Duration{}
+	total := time.Duration(0)
+	for _, task := range tasks {
+		for _, entry := range task.TimeLog {
+			start, end, ok := entry.within(p, now)
+			if !ok {
+				continue
+			}
+			for _, span := range splitByDay(start, end) {
+				byDay[span.Day] += span.Duration
+			}
+			byProject[task.Project] += end.Sub(start)
+			total += end.Sub(start)
+		}
+	}
+
+	summary := timeSummary{
+		Period:     p.Label,
+		Start:      p.Start.Format(dateLayout),
+		End:        p.End.AddDate(0, 0, -1).Format(dateLayout),
+		TotalHours: total.Hours(),
+		Days:       []timeDay{},
+		Projects:   []timeProject{},
+	}
+	for day := p.Start; day.Before(p.End); day = day.AddDate(0, 0, 1) {
+		date := day.Format(dateLayout)
+		summary.Days = append(summary.Days, timeDay{Date: date, Hours: byDay[date].Hours()})
+	}
+	for name, d := range byProject {
+		summary.Projects = append(summary.Projects, timeProject{Name: name, Hours: d.Hours()})
+	}
+	sort.Slice(summary.Projects, func(i, j int) bool {
+		if summary.Projects[i].Hours != summary.Projects[j].Hours {
+			return summary.Projects[i].Hours > summary.Projects[j].Hours
+		}
+		return summary.Projects[i].Name < summary.Projects[j].Name
+	})
+	return summary
+}
+
+// showTimeReport prints the time tracked in a week, month or quarter as a
+// heatmap of hours per day, with totals per project
+func showTimeReport(ctx context.Context, kind string, value string, asJSON bool) error {
+	now := clock.Now()
+	p, err := reportPeriod(kind, value, now)
+	if err != nil {
+		return err
+	}
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+	summary := summarizeTime(tasks, p, now)
+
+	if asJSON {
+		data, err := json.MarshalIndent(summary, "", "  ")
+		if err != nil {
+			return wrapError(ErrIO, err, "could not encode report")
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	fmt.Printf("%s⏱  Time tracked, %s (%s – %s)%s\n", ColorCyan, summary.Period, summary.Start, summary.End, ColorReset)
+	printTimeHeatmap(summary.Days)
+	fmt.Printf("  Total: %s\n", formatHours(summary.TotalHours))
+	for _, project := range summary.Projects {
+		name := "+" + project.Name
+		if project.Name == "" {
+			name = "(no project)"
+		}
+		fmt.Printf("    %-14s %s\n", name, formatHours(project.Hours))
+	}
+	return nil
+}
+
+// printTimeHeatmap prints hours per day as a grid with a row per week,
+// starting on week_start; busier days are brighter
+func printTimeHeatmap(days []timeDay) {
+	if len(days) == 0 {
+		return
+	}
+	busiest := 0.0
+	for _, day := range days {
+		busiest = max(busiest, day.Hours)
+	}
+
+	first, _ := time.ParseInLocation(dateLayout, days[0].Date, time.Local)
+	rowStart := startOfWeek(first)
+	fmt.Printf("  %-7s", "")
+	for i := 0; i < 7; i++ {
+		fmt.Printf("%7s", rowStart.AddDate(0, 0, i).Format("Mon"))
+	}
+	fmt.Println()
+
+	byDate := map[string]float64{}
+	for _, day := range days {
+		byDate[day.Date] = day.Hours
+	}
+	last := days[len(days)-1].Date
+	for ; rowStart.Format(dateLayout) <= last; rowStart = rowStart.AddDate(0, 0, 7) {
+		fmt.Printf("  %-7s", rowStart.Format("Jan 2"))
+		for i := 0; i < 7; i++ {
+			date := rowStart.AddDate(0, 0, i).Format(dateLayout)
+			hours, inPeriod := byDate[date]
+			switch {
+			case !inPeriod:
+				fmt.Printf("%7s", "")
+			case hours == 0:
+				fmt.Printf("%s%7s%s", ColorDim, "·", ColorReset)
+			case hours >= busiest*0.75:
+				fmt.Printf("%s%s%7s%s", ColorBright, ColorGreen, formatHours(hours), ColorReset)
+			default:
+				fmt.Printf("%s%7s%s", ColorGreen, formatHours(hours), ColorReset)
+			}
+		}
+		fmt.Println()
+	}
+}
+
+// showReport prints the summary of a week, month or quarter as text,
+// Markdown or JSON
+func showReport(ctx context.Context, kind string, value string, format string) error {
+	now := clock.Now()
+	p, err := reportPeriod(kind, value, now)
+	if err != nil {
+		return err
+	}
+
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+	summary := summarize(tasks, p, now)
+
+	switch format {
+	case "json":
+		data, err := json.MarshalIndent(summary, "", "  ")
+		if err != nil {
+			return wrapError(ErrIO, err, "could not encode report")
+		}
+		fmt.Println(string(data))
+	case "md":
+		printReportMarkdown(summary)
+	default:
+		printReportText(summary)
+	}
+	return nil
+}
+
+// lateCompletion is a task completed after its due date, listed in the late report
+type lateCompletion struct {
+	ID          int    `json:"id"`
+	Title       string `json:"title"`
+	DueDate     string `json:"due_date"`
+	CompletedAt string `json:"completed_at"`
+	DaysLate    int    `json:"days_late"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// lateAverage is the average lateness of the late completions of a tag or project
+type lateAverage struct {
+	Name        string  `json:"name"`
+	Count       int     `json:"count"`
+	AverageDays float64 `json:"average_days"`
+}
+
+// lateSummary is the late report: every late completion, most late first,
+// and average lateness by tag and by project
+type lateSummary struct {
+	Completions []lateCompletion `json:"completions"`
+	ByTag       []lateAverage    `json:"by_tag"`
+	ByProject   []lateAverage    `json:"by_project"`
+}
+
+// summarizeLate builds the late report from the done tasks
+func summarizeLate(tasks []Task) lateSummary {
+	summary := lateSummary{Completions: []lateCompletion{}}
+	tagDays, projectDays := map[string][]int{}, map[string][]int{}
+	for _, task := range tasks {
+		if task.Status != "done" {
+			continue
+		}
+		completed, err := parseTimestamp(task.CompletedAt)
+		if err != nil {
+			continue
+		}
+		days := daysLate(task, completed)
+		if days == 0 {
+			continue
+		}
+		summary.Completions = append(summary.Completions, lateCompletion{
+			ID: task.ID, Title: task.Title, DueDate: task.DueDate, CompletedAt: task.CompletedAt,
+			DaysLate: days, Reason: lateReason(task),
+		})
+		for _, tag := range task.Tags {
+			tagDays[tag] = append(tagDays[tag], days)
+		}
+		if task.Project != "" {
+			projectDays[task.Project] = append(projectDays[task.Project], days)
+		}
+	}
+	sort.SliceStable(summary.Completions, func(i, j int) bool {
+		return summary.Completions[i].DaysLate > summary.Completions[j].DaysLate
+	})
+	summary.ByTag, summary.ByProject = averageLateness(tagDays), averageLateness(projectDays)
+	return summary
+}
+
+// averageLateness averages the days late per name, most late first
+func averageLateness(days map[string][]int) []lateAverage {
+	averages := []lateAverage{}
+	for name, values := range days {
+		total := 0
+		for _, v := range values {
+			total += v
+		}
+		averages = append(averages, lateAverage{Name: name, Count: len(values), AverageDays: float64(total) / float64(len(values))})
+	}
+	sort.Slice(averages, func(i, j int) bool {
+		if averages[i].AverageDays != averages[j].AverageDays {
+			return averages[i].AverageDays > averages[j].AverageDays
+		}
+		return averages[i].Name < averages[j].Name
+	})
+	return averages
+}
+
+// dueSlip is how often a task's due date moved and how far it slipped.
+// Setting a first due date or removing one is not a move; moving a date
+// earlier is a move that does not reduce the slip.
+type dueSlip struct {
+	ID         int    `json:"id"`
+	Title      string `json:"title"`
+	DueDate    string `json:"due_date,omitempty"`
+	Moves      int    `json:"moves"`
+	SlipDays   int    `json:"slip_days"`
+	LastReason string `json:"last_reason,omitempty"`
+}
+
+// dueSlipOf reads the due date moves of task from its history
+func dueSlipOf(task Task) dueSlip {
+	slip := dueSlip{ID: task.ID, Title: task.Title, DueDate: task.DueDate}
+	for _, event := range task.History {
+		if event.Field != "due" || event.From == "" || event.To == "" {
+			continue
+		}
+		from, err := time.ParseInLocation(dateLayout, event.From, time.Local)
+		if err != nil {
+			continue
+		}
+		to, err := time.ParseInLocation(dateLayout, event.To, time.Local)
+		if err != nil {
+			continue
+		}
+		slip.Moves++
+		slip.SlipDays += max(0, int(to.Sub(from).Hours()/24+0.5))
+		if event.Note != "" {
+			slip.LastReason = event.Note
+		}
+	}
+	return slip
+}
+
+// summarizeSlippage lists the tasks whose due date moved, the worst
+// slipped first
+func summarizeSlippage(tasks []Task) []dueSlip {
+	slips := []dueSlip{}
+	for _, task := range tasks {
+		if slip := dueSlipOf(task); slip.Moves > 0 {
+			slips = append(slips, slip)
+		}
+	}
+	sort.Slice(slips, func(i, j int) bool {
+		if slips[i].SlipDays != slips[j].SlipDays {
+			return slips[i].SlipDays > slips[j].SlipDays
+		}
+		if slips[i].Moves != slips[j].Moves {
+			return slips[i].Moves > slips[j].Moves
+		}
+		return slips[i].ID < slips[j].ID
+	})
+	return slips
+}
+
+// showSlippageReport prints the tasks whose due date moved, how often and
+// by how many days in total, with the last reason given
+func showSlippageReport(ctx context.Context, asJSON bool) error {
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+	slips := summarizeSlippage(tasks)
+
+	if asJSON {
+		data, err := json.MarshalIndent(slips, "", "  ")
+		if err != nil {
+			return wrapError(ErrIO, err, "could not encode report")
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	if len(slips) == 0 {
+		printEmpty("report slippage")
+		return nil
+	}
+	fmt.Printf("%s📊 Due date slippage%s\n", ColorCyan, ColorReset)
+	for _, s := range slips {
+		due := "no due date"
+		if s.DueDate != "" {
+			due = "due " + s.DueDate
+		}
+		fmt.Printf("  %s%s%s %s (%s): moved %d×, %s later in total", ColorWhite, formatID(s.ID), ColorReset,
+			s.Title, due, s.Moves, plural(s.SlipDays, "day"))
+		if s.LastReason != "" {
+			fmt.Printf(" — %s", s.LastReason)
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+// showLateReport prints the tasks completed after their due date with the
+// reasons given, and the average lateness per tag and project
+func showLateReport(ctx context.Context, asJSON bool) error {
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+	summary := summarizeLate(tasks)
+
+	if asJSON {
+		data, err := json.MarshalIndent(summary, "", "  ")
+		if err != nil {
+			return wrapError(ErrIO, err, "could not encode report")
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	if len(summary.Completions) == 0 {
+		printEmpty("report late")
+		return nil
+	}
+	fmt.Printf("%s📊 Late completions%s\n", ColorCyan, ColorReset)
+	for _, c := range summary.Completions {
+		reason := ColorYellow + "no reason given" + ColorReset
+		if c.Reason != "" {
+			reason = c.Reason
+		}
+		fmt.Printf("  %s%s%s %s (due %s, done %s: %s late) — %s\n", ColorWhite, formatID(c.ID), ColorReset,
+			c.Title, c.DueDate, datePart(c.CompletedAt), plural(c.DaysLate, "day"), reason)
+	}
+	for _, section := range []struct {
+		title    string
+		prefix   string
+		averages []lateAverage
+	}{
+		{"By tag", "@", summary.ByTag},
+		{"By project", "+", summary.ByProject},
+	} {
+		if len(section.averages) == 0 {
+			continue
+		}
+		fmt.Printf("  %s:\n", section.title)
+		for _, a := range section.averages {
+			fmt.Printf("    %s%-12s %5.1f days late on average (%d)\n", section.prefix, a.Name, a.AverageDays, a.Count)
+		}
+	}
+	return nil
+}
+
+// printReportText prints a report summary for the terminal
+func printReportText(r periodSummary) {
+	fmt.Printf("%s📊 Report for %s (%s – %s)%s\n", ColorCyan, r.Period, r.Start, r.End, ColorReset)
+	fmt.Printf("  Created:            %d\n", r.Created)
+	fmt.Printf("  Completed:          %d\n", r.Completed)
+	fmt.Printf("  Completion rate:    %.0f%% (%d of %d created)\n", r.CompletionRate*100, r.CreatedAndCompleted, r.Created)
+	fmt.Printf("  Median to complete: %.1f days\n", r.MedianDaysToComplete)
+	fmt.Printf("  Top tags:           %s\n", formatCounts(r.TopTags, "@"))
+	fmt.Printf("  Top projects:       %s\n", formatCounts(r.TopProjects, "+"))
+	fmt.Printf("  Oldest open tasks:")
+	if len(r.OldestOpen) == 0 {
+		fmt.Printf("  none\n")
+		return
+	}
+	fmt.Println()
+	for _, task := range r.OldestOpen {
+		fmt.Printf("    %s%s%s %s (created %s, %s ago)\n",
+			ColorWhite, formatID(task.ID), ColorReset, task.Title, datePart(task.CreatedAt), plural(task.AgeDays, "day"))
+	}
+}
+
+// printReportMarkdown prints a report summary as a Markdown document
+func printReportMarkdown(r periodSummary) {
+	fmt.Printf("# Report: %s\n\n", r.Period)
+	fmt.Printf("_%s – %s_\n\n", r.Start, r.End)
+	fmt.Printf("| Metric | Value |\n|---|---|\n")
+	fmt.Printf("| Created | %d |\n", r.Created)
+	fmt.Printf("| Completed | %d |\n", r.Completed)
+	fmt.Printf("| Completion rate | %.0f%% (%d of %d created) |\n", r.CompletionRate*100, r.CreatedAndCompleted, r.Created)
+	fmt.Printf("| Median to complete | %.1f days |\n", r.MedianDaysToComplete)
+
+	for _, section := range []struct {
+		title   string
+		prefix  string
+		entries []countEntry
+	}{
+		{"Top tags", "@", r.TopTags},
+		{"Top projects", "+", r.TopProjects},
+	} {
+		fmt.Printf("\n## %s\n\n", section.title)
+		if len(section.entries) == 0 {
+			fmt.Println("None.")
+		}
+		for _, entry := range section.entries {
+			fmt.Printf("- %s%s: %d\n", section.prefix, entry.Name, entry.Count)
+		}
+	}
+
+	fmt.Printf("\n## Oldest open tasks\n\n")
+	if len(r.OldestOpen) == 0 {
+		fmt.Println("None.")
+	}
+	for i, task := range r.OldestOpen {
+		fmt.Printf("%d. %s %s (created %s, %s ago)\n",
+			i+1, formatID(task.ID), task.Title, datePart(task.CreatedAt), plural(task.AgeDays, "day"))
+	}
+}
+
+// newRedactKey returns the random key of one redacted export. Placeholders
+// repeat within the export but cannot be matched across exports, nor
+// reversed by hashing guessed values.
+func newRedactKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, wrapError(ErrIO, err, "could not generate a redaction key")
+	}
+	return key, nil
+}
+
+// redactValue replaces value with a one-way placeholder of the same length,
+// e.g. "title-7f3a9c" for a twelve character title, that is the same for the
+// same value under the same key
+func redactValue(key []byte, kind, value string) string {
+	length := len([]rune(value))
+	if length == 0 {
+		return value
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(kind + "\x00" + value))
+	digest := hex.EncodeToString(mac.Sum(nil))
+	for len(digest) < length {
+		digest += digest
+	}
+
+	placeholder := kind + "-" + digest
+	if length < len(kind)+5 {
+		placeholder = digest
+	}
+	return placeholder[:length]
+}
+
+// redactTask returns a copy of task for a bug report. It is an allow-list:
+// IDs, statuses, dates, priorities, recurrence and relations are kept, free
+// text is replaced by placeholders, and any field not named here is left
+// out, so a field added to Task never leaks until it is redacted here.
+func redactTask(task Task, key []byte, keepTags bool) Task {
+	redacted := Task{
+		ID:             task.ID,
+		Title:          redactValue(key, "title", task.Title),
+		Status:         task.Status,
+		CreatedAt:      task.CreatedAt,
+		IdempotencyKey: redactValue(key, "key", task.IdempotencyKey),
+		DueDate:        task.DueDate,
+		CompletedAt:    task.CompletedAt,
+		Recurrence:     task.Recurrence,
+		Anchor:         task.Anchor,
+		RecurDay:       task.RecurDay,
+		Project:        task.Project,
+		Tags:           task.Tags,
+		Priority:       task.Priority,
+		RecurFrom:      task.RecurFrom,
+		Pinned:         task.Pinned,
+		BlockedBy:      task.BlockedBy,
+		Links:          task.Links,
+		TimeLog:        task.TimeLog,
+		Comments:       redactComments(task.Comments, key, keepTags),
+		History:        redactHistory(task.History, key, keepTags),
+	}
+	for _, path := range task.Attachments {
+		// paths name the user's home directory and files
+		redacted.Attachments = append(redacted.Attachments, redactValue(key, "attachment", path))
+	}
+	if task.Waiting != nil {
+		// the same person gets the same placeholder, so grouping by person works
+		redacted.Waiting = &WaitingOn{
+			Person: redactValue(key, "person", task.Waiting.Person),
+			Since:  task.Waiting.Since,
+			Until:  task.Waiting.Until,
+		}
+	}
+	if !keepTags {
+		redacted.Project = redactValue(key, "project", task.Project)
+		redacted.Tags = redactTags(task.Tags, key)
+	}
+	return redacted
+}
+
+// redactComments returns a copy of comments with their text replaced by
+// placeholders. The late tag marking reasons for late completions is kept
+// so report late still works on the export, and so are compaction markers.
+func redactComments(comments []Comment, key []byte, keepTags bool) []Comment {
+	if comments == nil {
+		return nil
+	}
+	redacted := make([]Comment, len(comments))
+	for i, comment := range comments {
+		if slices.Contains(comment.Tags, compactedField) {
+			redacted[i] = comment
+			continue
+		}
+		comment.Text = redactValue(key, "comment", comment.Text)
+		if !keepTags && !slices.Equal(comment.Tags, []string{lateTag}) {
+			comment.Tags = redactTags(comment.Tags, key)
+		}
+		redacted[i] = comment
+	}
+	return redacted
+}
+
+// historyKeptByRedact names the history fields whose values are IDs,
+// statuses, dates or priorities; redactTask keeps their values as they are
+var historyKeptByRedact = map[string]bool{
+	"status": true, "due": true, "priority": true, "pinned": true,
+	"blocked_by": true, "links": true, compactedField: true,
+}
+
+// redactHistory returns a copy of history with the values of every other
+// field, such as old titles, and all notes but compaction counts replaced
+// by placeholders
+func redactHistory(history []HistoryEvent, key []byte, keepTags bool) []HistoryEvent {
+	if history == nil {
+		return nil
+	}
+	redacted := make([]HistoryEvent, len(history))
+	for i, event := range history {
+		keep := historyKeptByRedact[event.Field] || keepTags && (event.Field == "project" || event.Field == "tags")
+		if !keep {
+			event.From = redactValue(key, event.Field, event.From)
+			event.To = redactValue(key, event.Field, event.To)
+		}
+		if event.Field != compactedField {
+			event.Note = redactValue(key, "note", event.Note)
+		}
+		redacted[i] = event
+	}
+	return redacted
+}
+
+// redactTags replaces each tag with a placeholder
+func redactTags(tags []string, key []byte) []string {
+	if tags == nil {
+		return nil
+	}
+	redacted := make([]string, len(tags))
+	for i, tag := range tags {
+		redacted[i] = redactValue(key, "tag", tag)
+	}
+	return redacted
+}
+
+// exportTasks writes all tasks to stdout in the given format
+func exportTasks(ctx context.Context, format string, redact bool, keepTags bool) error {
+	if format != "json" {
+		return newError(ErrUsage, "unknown export format: %s (supported: json, review, share)", format)
+	}
+
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+	if redact {
+		key, err := newRedactKey()
+		if err != nil {
+			return err
+		}
+		for i := range tasks {
+			tasks[i] = redactTask(tasks[i], key, keepTags)
+		}
+	}
+
+	data, err := json.MarshalIndent(tasks, "", "  ")
+	if err != nil {
+		return wrapError(ErrIO, err, "could not export tasks")
+	}
+	fmt.Println(string(data))
+
+	if redact && !keepTags {
+		fmt.Fprintf(os.Stderr, "%sℹ️  Tags and projects are redacted too; pass --keep-tags to keep them.%s\n",
+			ColorYellow, ColorReset)
+	}
+	return nil
+}
+
+// reviewHeader starts every review file. The review format is meant for
+// diffs: one block per task in ID order, one line per field in name order
+// and one line per list item, each value written as JSON. Parsing a review
+// file gives back exactly the tasks it was written from.
+const reviewHeader = `# task-tracker review v1: one [task <id>] block per task, ordered by ID.
+# Fields are sorted by name and hold JSON values; "name[] = ..." lines are
+# the items of a list, in order.
+`
+
+// reviewValue encodes v as single-line JSON with object keys sorted and
+// without HTML escaping
+func reviewValue(v any) (string, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// writeReview writes tasks in the review format
+func writeReview(w io.Writer, tasks []Task) error {
+	tasks = append([]Task(nil), tasks...)
+	sort.SliceStable(tasks, func(i, j int) bool { return tasks[i].ID < tasks[j].ID })
+
+	var buf strings.Builder
+	buf.WriteString(reviewHeader)
+	for _, task := range tasks {
+		data, err := json.Marshal(task)
+		if err != nil {
+			return err
+		}
+		// decoded generically so fields sort by name and numbers keep their digits
+		var fields map[string]any
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&fields); err != nil {
+			return err
+		}
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fmt.Fprintf(&buf, "\n[task %d]\n", task.ID)
+		for _, name := range names {
+			items, isList := fields[name].([]any)
+			if !isList {
+				items = []any{fields[name]}
+			}
+			for _, item := range items {
+				value, err := reviewValue(item)
+				if err != nil {
+					return err
+				}
+				if isList {
+					fmt.Fprintf(&buf, "%s[] = %s\n", name, value)
+				} else {
+					fmt.Fprintf(&buf, "%s = %s\n", name, value)
+				}
+			}
+		}
+	}
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+// parseReview reads tasks written by writeReview
+func parseReview(r io.Reader, name string) ([]Task, error) {
+	var tasks []Task
+	var fields map[string]any
+	blockLine := 0
+	finish := func() error {
+		if fields == nil {
+			return nil
+		}
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		var task Task
+		if err := decoder.Decode(&task); err != nil {
+			return newError(ErrInvalid, "%s line %d: invalid task: %v", name, blockLine, err)
+		}
+		tasks = append(tasks, task)
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "[task ") && strings.HasSuffix(line, "]"):
+			if err := finish(); err != nil {
+				return nil, err
+			}
+			fields, blockLine = map[string]any{}, n
+			continue
+		case fields == nil:
+			return nil, newError(ErrInvalid, "%s line %d: expected a [task <id>] line", name, n)
+		}
+
+		field, raw, ok := strings.Cut(line, " = ")
+		if !ok {
+			return nil, newError(ErrInvalid, "%s line %d: expected name = value", name, n)
+		}
+		decoder := json.NewDecoder(strings.NewReader(raw))
+		decoder.UseNumber()
+		var value any
+		if err := decoder.Decode(&value); err != nil || decoder.More() {
+			return nil, newError(ErrInvalid, "%s line %d: invalid value for %s: %s", name, n, field, raw)
+		}
+		if list, isList := strings.CutSuffix(field, "[]"); isList {
+			items, _ := fields[list].([]any)
+			fields[list] = append(items, value)
+			continue
+		}
+		if _, exists := fields[field]; exists {
+			return nil, newError(ErrInvalid, "%s line %d: %s is set twice", name, n, field)
+		}
+		fields[field] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, wrapError(ErrIO, err, "could not read %s", name)
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+
+	seen := map[int]bool{}
+	for _, task := range tasks {
+		if task.ID <= 0 || seen[task.ID] {
+			return nil, newError(ErrInvalid, "%s: task IDs must be positive and unique (%d)", name, task.ID)
+		}
+		seen[task.ID] = true
+	}
+	return tasks, validateTasks(tasks)
+}
+
+// readReviewTasks reads a review file
+func readReviewTasks(path string) ([]Task, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, wrapError(ErrIO, err, "could not open %s", path)
+	}
+	defer f.Close()
+	return parseReview(f, path)
+}
+
+// exportReview prints the tasks, or those of the JSON file at path, in the
+// review format
+func exportReview(ctx context.Context, path string) error {
+	var tasks []Task
+	var err error
+	if path == "" {
+		tasks, err = loadTasks(ctx)
+	} else {
+		tasks, err = readJSONTasks(path)
+	}
+	if err != nil {
+		return err
+	}
+	if err := writeReview(os.Stdout, tasks); err != nil {
+		return wrapError(ErrIO, err, "could not export tasks")
+	}
+	return nil
+}
+
+// restoreReview replaces every task with those of a review file, keeping
+// their IDs; with preview only the differences are counted
+func restoreReview(ctx context.Context, path string, incoming []Task, preview bool) error {
+	added, changed, removed := 0, 0, 0
+	compare := func(tasks []Task) {
+		current := make(map[int][]byte, len(tasks))
+		for _, task := range tasks {
+			current[task.ID], _ = json.Marshal(task)
+		}
+		for _, task := range incoming {
+			data, _ := json.Marshal(task)
+			before, exists := current[task.ID]
+			switch {
+			case !exists:
+				added++
+			case !bytes.Equal(before, data):
+				changed++
+			}
+			delete(current, task.ID)
+		}
+		removed = len(current)
+	}
+
+	if preview {
+		tasks, err := loadTasks(ctx)
+		if err != nil {
+			return err
+		}
+		compare(tasks)
+		fmt.Printf("%s👀 Restoring %s would add %d, change %d and remove %d; nothing written%s\n",
+			ColorCyan, path, added, changed, removed, ColorReset)
+		return nil
+	}
+
+	err := updateTasks(ctx, func(tasks []Task) ([]Task, error) {
+		compare(tasks)
+		return incoming, nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s📥 Restored %s from %s: %d added, %d changed, %d removed%s\n",
+		ColorGreen, plural(len(incoming), "task"), path, added, changed, removed, ColorReset)
+	return nil
+}
+
+// sharedTask is the subset of task fields published in a share export
+type sharedTask struct {
+	ID       int      `json:"id"`
+	Title    string   `json:"title"`
+	Status   string   `json:"status"`
+	DueDate  string   `json:"due_date,omitempty"`
+	Priority Priority `json:"priority,omitempty"`
+	Project  string   `json:"project,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// sharePayload is the signed content of a share export
+type sharePayload struct {
+	GeneratedAt string       `json:"generated_at"`
+	Filter      string       `json:"filter"`
+	Tasks       []sharedTask `json:"tasks"`
+}
+
+// shareFile is the share.json written next to index.html; Signature is the
+// hex HMAC-SHA256 of the exact Payload bytes keyed by share_key
+type shareFile struct {
+	Payload   json.RawMessage `json:"payload"`
+	Signature string          `json:"signature"`
+}
+
+// shareTasks returns the published view of the tasks matching filter
+func shareTasks(tasks []Task, filter taskFilter) []sharedTask {
+	shared := []sharedTask{}
+	for _, task := range filterTasks(tasks, filter) {
+		shared = append(shared, sharedTask{
+			ID:       task.ID,
+			Title:    task.Title,
+			Status:   task.Status,
+			DueDate:  task.DueDate,
+			Priority: task.Priority,
+			Project:  task.Project,
+			Tags:     task.Tags,
+		})
+	}
+	sort.Slice(shared, func(i, j int) bool { return shared[i].ID < shared[j].ID })
+	return shared
+}
+
+// signShare returns the hex HMAC-SHA256 of payload
+func signShare(payload []byte, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// shareHTML is a self-contained page that renders the embedded share data,
+// so it works from file:// without network access
+const shareHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Shared tasks</title>
+<style>
+  body { font-family: system-ui, sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; color: #222; }
+  h1 { font-size: 1.4em; }
+  li { padding: 0.3em 0; list-style: none; }
+  .done { color: #888; text-decoration: line-through; }
+  .meta { color: #666; font-size: 0.85em; margin-left: 0.5em; }
+  footer { margin-top: 2em; color: #888; font-size: 0.8em; }
+</style>
+</head>
+<body>
+<h1 id="title">Shared tasks</h1>
+<ul id="tasks"></ul>
+<footer id="footer"></footer>
+<script id="share-data" type="application/json">%s</script>
+<script>
+  var share = JSON.parse(document.getElementById("share-data").textContent);
+  var payload = share.payload;
+  var emoji = { "todo": "⏳", "in-progress": "🔄", "done": "✅" };
+  if (payload.filter) {
+    document.getElementById("title").textContent = "Shared tasks: " + payload.filter;
+  }
+  var list = document.getElementById("tasks");
+  payload.tasks.forEach(function (task) {
+    var item = document.createElement("li");
+    var title = document.createElement("span");
+    title.textContent = (emoji[task.status] || "❓") + " " + task.title;
+    if (task.status === "done") { title.className = "done"; }
+    item.appendChild(title);
+    var meta = [];
+    if (task.priority) { meta.push(task.priority); }
+    if (task.due_date) { meta.push("due " + task.due_date); }
+    if (meta.length) {
+      var extra = document.createElement("span");
+      extra.className = "meta";
+      extra.textContent = meta.join(" · ");
+      item.appendChild(extra);
+    }
+    list.appendChild(item);
+  });
+  document.getElementById("footer").textContent =
+    "Generated " + payload.generated_at + " · signature " + share.signature.slice(0, 12);
+</script>
+</body>
+</html>
+`
+
+// renderShareHTML returns the page embedding the given share.json content
+func renderShareHTML(shareJSON []byte) []byte {
+	return []byte(fmt.Sprintf(shareHTML, shareJSON))
+}
+
+// readShare loads and authenticates the share in dir, returning its payload
+func readShare(dir string) (sharePayload, []byte, error) {
+	var payload sharePayload
+	if config.ShareKey == "" {
+		return payload, nil, newError(ErrUsage, "set share_key in %s to sign and verify shares", configFile)
+	}
+
+	path := filepath.Join(dir, "share.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return payload, nil, wrapError(ErrIO, err, "could not read %s", path)
+	}
+
+	var file shareFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return payload, nil, wrapError(ErrCorrupt, err, "%s is not a valid share", path)
+	}
+	if !hmac.Equal([]byte(file.Signature), []byte(signShare(file.Payload, config.ShareKey))) {
+		return payload, nil, newError(ErrCorrupt, "signature mismatch: %s was modified or signed with another key", path)
+	}
+	if err := json.Unmarshal(file.Payload, &payload); err != nil {
+		return payload, nil, wrapError(ErrCorrupt, err, "%s has an invalid payload", path)
+	}
+	return payload, data, nil
+}
+
+// exportShare writes a signed, read-only HTML view of the tasks matching filterExpr
+// into dir. Regenerating an unchanged view leaves the existing files untouched.
+func exportShare(ctx context.Context, filterExpr string, dir string) error {
+	if config.ShareKey == "" {
+		return newError(ErrUsage, "set share_key in %s to sign shares", configFile)
+	}
+	if dir == "" {
+		return newError(ErrUsage, "please provide an output directory with --out")
+	}
+
+	now := clock.Now()
+	filter, err := parseFilter(filterExpr, now)
+	if err != nil {
+		return newError(ErrInvalid, "%v", err)
+	}
+
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+	shared := shareTasks(tasks, filter)
+
+	if existing, _, err := readShare(dir); err == nil && existing.Filter == filterExpr {
+		before, _ := json.Marshal(existing.Tasks)
+		after, _ := json.Marshal(shared)
+		if bytes.Equal(before, after) {
+			fmt.Printf("%s🔗 Share in %s is already up to date (%s, generated %s)%s\n",
+				ColorCyan, dir, plural(len(shared), "task"), existing.GeneratedAt, ColorReset)
+			return nil
+		}
+	}
+
+	payload, err := json.Marshal(sharePayload{
+		GeneratedAt: now.Format(timeLayout),
+		Filter:      filterExpr,
+		Tasks:       shared,
+	})
+	if err != nil {
+		return wrapError(ErrIO, err, "could not encode share")
+	}
+	// Not indented: MarshalIndent would reformat the signed payload bytes
+	shareJSON, err := json.Marshal(shareFile{Payload: payload, Signature: signShare(payload, config.ShareKey)})
+	if err != nil {
+		return wrapError(ErrIO, err, "could not encode share")
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return wrapError(ErrIO, err, "could not create %s", dir)
+	}
+	for name, content := range map[string][]byte{
+		"share.json": shareJSON,
+		"index.html": renderShareHTML(shareJSON),
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			return wrapError(ErrIO, err, "could not write %s", path)
+		}
+	}
+
+	fmt.Printf("%s🔗 Shared %s in %s%s\n", ColorGreen, plural(len(shared), "task"), filepath.Join(dir, "index.html"), ColorReset)
+	return nil
+}
+
+// verifyShare checks that the share in dir is authentic, that index.html
+// matches share.json, and that its tasks still match the current data
+func verifyShare(ctx context.Context, dir string, maxAge string) error {
+	payload, shareJSON, err := readShare(dir)
+	if err != nil {
+		return err
+	}
+
+	htmlPath := filepath.Join(dir, "index.html")
+	page, err := os.ReadFile(htmlPath)
+	if err != nil {
+		return wrapError(ErrIO, err, "could not read %s", htmlPath)
+	}
+	if !bytes.Equal(page, renderShareHTML(shareJSON)) {
+		return newError(ErrCorrupt, "%s was modified after it was generated", htmlPath)
+	}
+
+	now := clock.Now()
+	generated, err := parseTimestamp(payload.GeneratedAt)
+	if err != nil {
+		return wrapError(ErrCorrupt, err, "share has an invalid generation time")
+	}
+	if maxAge != "" {
+		iv, err := parseInterval(maxAge)
+		if err != nil {
+			return newError(ErrInvalid, "%v", err)
+		}
+		if iv.addTo(generated).Before(now) {
+			return newError(ErrStale, "share was generated %s, more than %s ago", payload.GeneratedAt, iv)
+		}
+	}
+
+	filter, err := parseFilter(payload.Filter, generated)
+	if err != nil {
+		return wrapError(ErrCorrupt, err, "share has an invalid filter")
+	}
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+	before, _ := json.Marshal(payload.Tasks)
+	after, _ := json.Marshal(shareTasks(tasks, filter))
+	if !bytes.Equal(before, after) {
+		return newError(ErrStale, "share is stale: matching tasks changed since %s (run export share again)", payload.GeneratedAt)
+	}
+
+	fmt.Printf("%s✅ Share verified: %s, generated %s%s\n",
+		ColorGreen, plural(len(payload.Tasks), "task"), payload.GeneratedAt, ColorReset)
+	return nil
+}
+
+// compactedField marks the history event that stands in for removed events
+const compactedField = "compacted"
+
+// lastModified returns when task last changed: its newest history event,
+// completion or creation
+func lastModified(task Task) string {
+	latest := task.CreatedAt
+	if task.CompletedAt > latest {
+		latest = task.CompletedAt
+	}
+	for _, event := range task.History {
+		if event.At > latest {
+			latest = event.At
+		}
+	}
+	return latest
+}
+
+// compactHistory replaces history events older than cutoff with a single
+// marker counting them, and returns how many events it newly removed
+func compactHistory(task *Task, cutoff string) int {
+	var kept []HistoryEvent
+	removed, total := 0, 0
+	marker := HistoryEvent{Field: compactedField}
+	for _, event := range task.History {
+		if event.At >= cutoff {
+			kept = append(kept, event)
+			continue
+		}
+		if event.Field == compactedField {
+			count := 0
+			fmt.Sscanf(event.Note, "%d", &count)
+			total += count
+		} else {
+			removed++
+			total++
+		}
+		if event.At > marker.At {
+			marker.At = event.At
+		}
+	}
+	if removed == 0 {
+		return 0
+	}
+
+	marker.Note = fmt.Sprintf("%d older %s removed", total, pluralNoun(total, "change"))
+	task.History = append([]HistoryEvent{marker}, kept...)
+	return removed
+}
+
+// compactComments keeps the newest limit comments of task behind a single
+// marker comment counting the older ones, and returns how many it newly
+// removed
+func compactComments(task *Task, limit int) int {
+	comments, total := task.Comments, 0
+	if len(comments) > 0 && slices.Contains(comments[0].Tags, compactedField) {
+		fmt.Sscanf(comments[0].Text, "%d", &total)
+		comments = comments[1:]
+	}
+	removed := len(comments) - limit
+	if removed <= 0 {
+		return 0
+	}
+
+	total += removed
+	marker := Comment{
+		At:   comments[removed-1].At,
+		Text: fmt.Sprintf("%d older %s removed", total, pluralNoun(total, "comment")),
+		Tags: []string{compactedField},
+	}
+	task.Comments = append([]Comment{marker}, comments[removed:]...)
+	return removed
+}
+
+// compactTimeLog replaces the finished time entries of task that ended
+// before cutoff with one entry per day, starting at midnight and lasting
+// the day's total, and returns how many entries fewer the log holds
+func compactTimeLog(task *Task, cutoff time.Time) int {
+	totals := map[string]time.Duration{}
+	var kept []TimeEntry
+	old := 0
+	for _, entry := range task.TimeLog {
+		start, err := parseTimestamp(entry.Start)
+		if err != nil || entry.End == "" {
+			kept = append(kept, entry)
+			continue
+		}
+		end, err := parseTimestamp(entry.End)
+		if err != nil || !end.Before(cutoff) {
+			kept = append(kept, entry)
+			continue
+		}
+		old++
+		for _, span := range splitByDay(start, end) {
+			totals[span.Day] += span.Duration
+		}
+	}
+	if old <= len(totals) {
+		return 0
+	}
+
+	days := slices.Sorted(maps.Keys(totals))
+	daily := make([]TimeEntry, 0, len(days)+len(kept))
+	for _, day := range days {
+		midnight, _ := time.ParseInLocation(dateLayout, day, time.Local)
+		daily = append(daily, TimeEntry{Start: midnight.Format(timeLayout), End: midnight.Add(totals[day]).Format(timeLayout)})
+	}
+	task.TimeLog = append(daily, kept...)
+	return old - len(days)
+}
+
+// pluralNoun returns noun, with an s unless n is 1
+func pluralNoun(n int, noun string) string {
+	if n == 1 {
+		return noun
+	}
+	return noun + "s"
+}
+
+// formatSize formats a byte count for humans, e.g. 12.3 KB
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// compactTasks rewrites the data file without detail older than the retention
+// config allows. Tasks modified in the last 24 hours are left alone. Without
+// yes it only reports what would change; with yes it first copies the data
+// file to a timestamped backup.
+func compactTasks(ctx context.Context, yes bool) error {
+	unlock, err := lockDataFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	original, err := readDataFile()
+	if os.IsNotExist(err) {
+		fmt.Printf("%s🗜️  Nothing to compact: %s does not exist%s\n", ColorYellow, dataFile, ColorReset)
+		return nil
+	}
+	if err != nil {
+		return wrapError(ErrIO, err, "could not read %s", dataFile)
+	}
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := clock.Now()
+	retention := config.Retention
+	recent := now.Add(-24 * time.Hour).Format(timeLayout)
+	historyCutoff := now.AddDate(0, 0, -retention.HistoryDays).Format(timeLayout)
+	timeLogCutoff := startOfDay(now).AddDate(0, 0, -retention.TimeLogDays)
+	events, comments, entries, compacted, skipped := 0, 0, 0, 0, 0
+	for i := range tasks {
+		if lastModified(tasks[i]) >= recent {
+			skipped++
+			continue
+		}
+		removed := 0
+		if retention.HistoryDays > 0 {
+			n := compactHistory(&tasks[i], historyCutoff)
+			events, removed = events+n, removed+n
+		}
+		if retention.MaxComments > 0 {
+			n := compactComments(&tasks[i], retention.MaxComments)
+			comments, removed = comments+n, removed+n
+		}
+		if retention.TimeLogDays > 0 {
+			n := compactTimeLog(&tasks[i], timeLogCutoff)
+			entries, removed = entries+n, removed+n
+		}
+		if removed > 0 {
+			compacted++
+		}
+	}
+
+	if ctx.Err() != nil {
+		return canceledError(ctx)
+	}
+	if compacted == 0 {
+		fmt.Printf("%s🗜️  Nothing to compact in %s (%s)%s\n", ColorGreen, dataFile, formatSize(int64(len(original))), ColorReset)
+		return nil
+	}
+
+	data, err := json.MarshalIndent(tasks, "", "  ")
+	if err != nil {
+		return wrapError(ErrIO, err, "could not encode tasks")
+	}
+	var parts []string
+	if events > 0 {
+		parts = append(parts, fmt.Sprintf("%s older than %d days removed", plural(events, "history event"), retention.HistoryDays))
+	}
+	if comments > 0 {
+		parts = append(parts, fmt.Sprintf("%s beyond the newest %d removed", plural(comments, "comment"), retention.MaxComments))
+	}
+	if entries > 0 {
+		parts = append(parts, fmt.Sprintf("%s older than %d days folded into daily totals", plural(entries, "tracked session"), retention.TimeLogDays))
+	}
+	fmt.Printf("%s🗜️  In %s: %s%s", ColorCyan, plural(compacted, "task"), strings.Join(parts, ", "), ColorReset)
+	if skipped > 0 {
+		fmt.Printf(" %s(%s modified in the last 24 hours left alone)%s", ColorYellow, plural(skipped, "task"), ColorReset)
+	}
+	fmt.Println()
+	fmt.Printf("  Size: %s → %s\n", formatSize(int64(len(original))), formatSize(int64(len(data))))
+
+	if !yes {
+		fmt.Printf("%sNothing written. Re-run with --yes to compact %s (a backup is kept).%s\n", ColorYellow, dataFile, ColorReset)
+		return nil
+	}
+
+	backup := fmt.Sprintf("%s.%s.bak", dataFile, now.Format("20060102-150405"))
+	if err := writeFileSynced(backup, original, fileMode(dataFile)); err != nil {
+		return wrapError(ErrIO, err, "could not write backup %s", backup)
+	}
+	if err := saveTasks(ctx, tasks); err != nil {
+		return err
+	}
+	fmt.Printf("  Backup: %s\n", backup)
+	fmt.Printf("%s✅ Compacted %s%s\n", ColorGreen, dataFile, ColorReset)
+	return nil
+}
+
+// progressReporter prints throttled progress for long operations to stderr:
+// a single updating line on a terminal, periodic plain lines otherwise
+type progressReporter struct {
+	label   string
+	total   int
+	current int
+	quiet   bool
+	tty     bool
+	drawn   bool
+	out     io.Writer
+	now     func() time.Time // wall time, not the clock tasks are dated by
+	started time.Time
+	printed time.Time
+}
+
+// newProgressReporter starts reporting progress for an operation over total items
+func newProgressReporter(label string, total int, quiet bool) *progressReporter {
+	return &progressReporter{
+		label:   label,
+		total:   total,
+		quiet:   quiet,
+		tty:     isTerminal(os.Stderr),
+		out:     os.Stderr,
+		now:     time.Now,
+		started: time.Now(),
+	}
+}
+
+// isTerminal reports whether f is attached to a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// Add records n more processed items, printing an update if one is due
+func (p *progressReporter) Add(n int) {
+	p.current += n
+	if p.quiet {
+		return
+	}
+
+	interval := 2 * time.Second
+	if p.tty {
+		interval = 250 * time.Millisecond
+	}
+	now := p.now()
+	if p.printed.IsZero() {
+		p.printed = p.started
+	}
+	if now.Sub(p.printed) < interval && p.current < p.total {
+		return
+	}
+	p.printed = now
+
+	line := fmt.Sprintf("%s: processed %s / %s", p.label, formatCount(p.current), formatCount(p.total))
+	elapsed := now.Sub(p.started)
+	if elapsed > 3*time.Second && p.current > 0 {
+		remaining := time.Duration(float64(elapsed) / float64(p.current) * float64(p.total-p.current))
+		line += fmt.Sprintf(" (%s elapsed, ETA %s)", elapsed.Round(time.Second), remaining.Round(time.Second))
+	}
+
+	if p.tty {
+		fmt.Fprintf(p.out, "\r\033[K%s", line)
+		p.drawn = true
+	} else {
+		fmt.Fprintln(p.out, line)
+	}
+}
+
+// Finish clears the progress line so it does not interleave with the summary
+func (p *progressReporter) Finish() {
+	if p.drawn {
+		fmt.Fprint(p.out, "\r\033[K")
+		p.drawn = false
+	}
+}
+
+// plural formats a count with a noun, e.g. "1 task" or "3 tasks"
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// formatCount formats n with thousands separators, e.g. 10,000
+func formatCount(n int) string {
+	digits := fmt.Sprintf("%d", n)
+	if n < 0 {
+		return "-" + formatCount(-n)
+	}
+	for i := len(digits) - 3; i > 0; i -= 3 {
+		digits = digits[:i] + "," + digits[i:]
+	}
+	return digits
+}
+
+// commonShortWords are short words that are lowercased when an all-caps
+// title is converted to sentence case; other words of up to four letters
+// are taken to be acronyms and kept
+var commonShortWords = map[string]bool{
+	"a": true, "an": true, "the": true, "and": true, "or": true, "but": true, "nor": true,
+	"for": true, "so": true, "yet": true, "to": true, "of": true, "in": true, "on": true,
+	"at": true, "by": true, "up": true, "off": true, "out": true, "as": true, "is": true,
+	"am": true, "are": true, "was": true, "be": true, "been": true, "do": true, "does": true,
+	"did": true, "has": true, "had": true, "have": true, "it": true, "its": true, "my": true,
+	"me": true, "we": true, "us": true, "our": true, "you": true, "your": true, "he": true,
+	"him": true, "his": true, "she": true, "her": true, "they": true, "them": true,
+	"this": true, "that": true, "what": true, "when": true, "who": true, "why": true,
+	"how": true, "not": true, "no": true, "new": true, "fix": true, "add": true, "get": true,
+	"set": true, "call": true, "buy": true, "pay": true, "send": true, "read": true,
+	"make": true, "take": true, "plan": true, "book": true, "move": true, "from": true,
+	"with": true, "into": true, "over": true, "help": true, "test": true, "all": true,
+	"any": true, "one": true, "two": true, "some": true, "more": true, "less": true,
+	"each": true, "next": true, "last": true, "than": true, "then": true, "also": true,
+	"ask": true, "go": true, "see": true, "use": true, "via": true, "per": true, "if": true,
+	"bug": true, "bugs": true, "doc": true, "docs": true, "post": true, "task": true,
+	"code": true, "data": true, "page": true, "site": true, "team": true, "meet": true,
+	"day": true, "week": true, "list": true, "file": true, "work": true, "home": true,
+	"item": true, "note": true, "bill": true, "rent": true, "car": true, "job": true,
+	"form": true, "tax": true, "gym": true, "log": true, "logs": true, "run": true,
+	"back": true, "down": true, "done": true, "old": true, "big": true, "shop": true,
+	"mail": true, "food": true, "gift": true, "room": true, "wash": true, "sort": true,
+}
+
+// normalizeTitle strips leading emoji and symbols and trailing punctuation,
+// and converts an all-caps title to sentence case, keeping words of up to
+// four letters that are not common words as acronyms
+func normalizeTitle(title string) string {
+	normalized := strings.TrimLeftFunc(title, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsSymbol(r) || unicode.Is(unicode.Mn, r) ||
+			unicode.Is(unicode.Cf, r) || r == '\ufe0f' || unicode.IsPunct(r) && !strings.ContainsRune("([{\"'#", r)
+	})
+	normalized = strings.TrimRightFunc(normalized, func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune(".,;:!…", r)
+	})
+	if normalized == "" {
+		return title
+	}
+
+	letters, upper := 0, 0
+	for _, r := range normalized {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	if letters < 2 || upper != letters {
+		return normalized
+	}
+
+	words := strings.Fields(normalized)
+	for i, word := range words {
+		core := strings.TrimFunc(word, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsNumber(r) })
+		if core != "" && len([]rune(core)) <= 4 && !commonShortWords[strings.ToLower(core)] {
+			continue
+		}
+		lower := []rune(strings.ToLower(word))
+		if i == 0 {
+			for j, r := range lower {
+				if unicode.IsLetter(r) {
+					lower[j] = unicode.ToUpper(r)
+					break
+				}
+			}
+		}
+		words[i] = string(lower)
+	}
+	return strings.Join(words, " ")
+}
+
+// normalizeTaskTitle normalizes the title of task, recording the original in
+// its history, and reports whether it changed
+func normalizeTaskTitle(task *Task, now time.Time) bool {
+	normalized := normalizeTitle(task.Title)
+	if normalized == task.Title {
+		return false
+	}
+	recordChange(task, now, "title", task.Title, normalized)
+	task.History[len(task.History)-1].Note = "normalized"
+	task.Title = normalized
+	return true
+}
+
+// maintainTasks applies maintenance rules to existing tasks, printing each
+// change; with dryRun nothing is written
+func maintainTasks(ctx context.Context, normalize bool, dryRun bool) error {
+	if !normalize {
+		return newError(ErrUsage, "please choose a maintenance task: --normalize-titles, --enforce-schema or --prune-conflicts")
+	}
+
+	now := clock.Now()
+	changed := 0
+	report := func(tasks []Task) []Task {
+		for i := range tasks {
+			before := tasks[i].Title
+			if normalizeTaskTitle(&tasks[i], now) {
+				changed++
+				fmt.Printf("  %s: %q → %s%q%s\n", formatID(tasks[i].ID), before, ColorBright, tasks[i].Title, ColorReset)
+			}
+		}
+		return tasks
+	}
+
+	if dryRun {
+		tasks, err := loadTasks(ctx)
+		if err != nil {
+			return err
+		}
+		report(tasks)
+		if changed == 0 {
+			fmt.Printf("%s✨ All titles are already normalized%s\n", ColorGreen, ColorReset)
+			return nil
+		}
+		fmt.Printf("%sWould normalize %s; nothing written (run without --dry-run to apply)%s\n",
+			ColorYellow, plural(changed, "title"), ColorReset)
+		return nil
+	}
+
+	err := updateTasks(ctx, func(tasks []Task) ([]Task, error) {
+		return report(tasks), nil
+	})
+	if err != nil {
+		return err
+	}
+	if changed == 0 {
+		fmt.Printf("%s✨ All titles are already normalized%s\n", ColorGreen, ColorReset)
+		return nil
+	}
+	fmt.Printf("%s✨ Normalized %s (originals are kept in history)%s\n", ColorGreen, plural(changed, "title"), ColorReset)
+	return nil
+}
+
+// schemaFix is what enforceSchema asked for to bring one task in line
+type schemaFix struct {
+	Project  *string
+	Priority *Priority
+	Due      *string
+	Tags     []string
+}
+
+// enforceSchema goes through the open tasks that break the schema and asks
+// on the terminal for each field they miss or hold a value not allowed;
+// an empty answer leaves the field as it is. The answers are written in
+// one change at the end; with dryRun the tasks are only listed.
+func enforceSchema(ctx context.Context, dryRun bool) error {
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+	var broken []Task
+	for _, task := range tasks {
+		if len(schemaViolations(task)) > 0 {
+			broken = append(broken, task)
+		}
+	}
+	if len(broken) == 0 {
+		fmt.Printf("%s✨ All open tasks follow the schema%s\n", ColorGreen, ColorReset)
+		return nil
+	}
+	if dryRun {
+		for _, task := range broken {
+			fmt.Printf("  %s %s: %s\n", formatID(task.ID), task.Title, strings.Join(schemaViolations(task), "; "))
+		}
+		fmt.Printf("%sTasks breaking the schema: %d; nothing written (run without --dry-run to fix them)%s\n",
+			ColorYellow, len(broken), ColorReset)
+		return nil
+	}
+	if !isTerminal(os.Stdin) {
+		return newError(ErrUsage, "maintain --enforce-schema asks for values; run it on a terminal (or see them with --dry-run)")
+	}
+
+	now := clock.Now()
+	input := bufio.NewReader(os.Stdin)
+	ask := func(prompt string, valid func(string) error) (string, error) {
+		for {
+			fmt.Printf("    %s: ", prompt)
+			line, err := input.ReadString('\n')
+			if err != nil && (err != io.EOF || line == "") {
+				return "", newError(ErrCanceled, "no answer; nothing was written")
+			}
+			line = strings.TrimSpace(line)
+			if line == "" {
+				return "", nil
+			}
+			if err := valid(line); err != nil {
+				fmt.Printf("    %s%v%s\n", ColorRed, err, ColorReset)
+				continue
+			}
+			return line, nil
+		}
+	}
+	allowed := func(values []string) string {
+		if len(values) == 0 {
+			return ""
+		}
+		return ", one of " + strings.Join(values, ", ")
+	}
+
+	fixes := map[int]schemaFix{}
+	for _, task := range broken {
+		fmt.Printf("%s%s: %s%s%s\n", ColorWhite, formatID(task.ID), ColorBright, task.Title, ColorReset)
+		fmt.Printf("  %s%s%s\n", ColorYellow, strings.Join(schemaViolations(task), "; "), ColorReset)
+		var fix schemaFix
+		if slices.Contains(config.Schema.Required, "project") && task.Project == "" ||
+			task.Project != "" && len(config.Schema.Projects) > 0 && !slices.Contains(config.Schema.Projects, task.Project) {
+			value, err := ask("project"+allowed(config.Schema.Projects), func(value string) error {
+				if len(config.Schema.Projects) > 0 && !slices.Contains(config.Schema.Projects, value) {
+					return fmt.Errorf("not one of %s", strings.Join(config.Schema.Projects, ", "))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if value != "" {
+				fix.Project = &value
+			}
+		}
+		if slices.Contains(config.Schema.Required, "priority") && task.Priority == PriorityNone {
+			value, err := ask("priority (high, medium or low)", func(value string) error {
+				_, err := parsePriority(value)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if value != "" {
+				priority, _ := parsePriority(value)
+				fix.Priority = &priority
+			}
+		}
+		if slices.Contains(config.Schema.Required, "due") && task.DueDate == "" {
+			value, err := ask("due date", func(value string) error {
+				_, err := parseDate(value, now)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if value != "" {
+				due, _ := parseDate(value, now)
+				date := due.Format(dateLayout)
+				fix.Due = &date
+			}
+		}
+		tagsOK := true
+		for _, tag := range task.Tags {
+			tagsOK = tagsOK && (len(config.Schema.Tags) == 0 || slices.Contains(config.Schema.Tags, tag))
+		}
+		if slices.Contains(config.Schema.Required, "tags") && len(task.Tags) == 0 || !tagsOK {
+			value, err := ask("tags, comma-separated"+allowed(config.Schema.Tags), func(value string) error {
+				var tags stringList
+				tags.Set(value)
+				for _, tag := range tags {
+					if len(config.Schema.Tags) > 0 && !slices.Contains(config.Schema.Tags, tag) {
+						return fmt.Errorf("tag %q is not one of %s", tag, strings.Join(config.Schema.Tags, ", "))
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if value != "" {
+				var tags stringList
+				tags.Set(value)
+				fix.Tags = tags
+			}
+		}
+		if fix.Project != nil || fix.Priority != nil || fix.Due != nil || fix.Tags != nil {
+			fixes[task.ID] = fix
+		}
+	}
+	if len(fixes) == 0 {
+		fmt.Printf("%sNothing changed%s\n", ColorYellow, ColorReset)
+		return nil
+	}
+
+	remaining := 0
+	err = updateTasks(ctx, func(tasks []Task) ([]Task, error) {
+		remaining = 0
+		for i := range tasks {
+			t := &tasks[i]
+			if fix, ok := fixes[t.ID]; ok {
+				if fix.Project != nil {
+					recordChange(t, now, "project", t.Project, *fix.Project)
+					t.Project = *fix.Project
+				}
+				if fix.Priority != nil {
+					recordChange(t, now, "priority", t.Priority.Format("word"), fix.Priority.Format("word"))
+					t.Priority = *fix.Priority
+				}
+				if fix.Due != nil {
+					recordChange(t, now, "due", t.DueDate, *fix.Due)
+					t.DueDate = *fix.Due
+				}
+				if fix.Tags != nil {
+					recordChange(t, now, "tags", strings.Join(t.Tags, ","), strings.Join(fix.Tags, ","))
+					t.Tags = fix.Tags
+				}
+			}
+			if len(schemaViolations(*t)) > 0 {
+				remaining++
+			}
+		}
+		return tasks, nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s✨ Fixed %s%s", ColorGreen, plural(len(fixes), "task"), ColorReset)
+	if remaining > 0 {
+		fmt.Printf(" %s(still breaking the schema: %s)%s", ColorYellow, plural(remaining, "task"), ColorReset)
+	}
+	fmt.Println()
+	return nil
+}
+
+// mergeTasks merges the tasks of another store, e.g. a copy edited on
+// another machine, into this one without changing any ID. A task on both
+// sides is taken to be the same task when it has the same ID and creation
+// time, and the side changed last wins. Different tasks sharing an ID are
+// reported and nothing is written.
+func mergeTasks(ctx context.Context, path string, dryRun, quiet bool) error {
+	incoming, err := readJSONTasks(path)
+	if err != nil {
+		return err
+	}
+	if !dryRun {
+		if err := confirmBatch(len(incoming)); err != nil {
+			return err
+		}
+	}
+
+	added, updated, unchanged := 0, 0, 0
+	var conflicts []conflictRecord
+	merge := func(tasks []Task) ([]Task, error) {
+		added, updated, unchanged, conflicts = 0, 0, 0, nil
+		at := clock.Now().Format(timeLayout)
+		progress := newProgressReporter("merging", len(incoming), quiet)
+		defer progress.Finish()
+		byID := make(map[int]int, len(tasks))
+		for i, task := range tasks {
+			byID[task.ID] = i
+		}
+
+		var collisions []string
+		for _, theirs := range incoming {
+			if ctx.Err() != nil {
+				return nil, canceledError(ctx)
+			}
+			progress.Add(1)
+			i, exists := byID[theirs.ID]
+			if !exists {
+				byID[theirs.ID] = len(tasks)
+				tasks = append(tasks, theirs)
+				added++
+				continue
+			}
+			ours := tasks[i]
+			if ours.CreatedAt != theirs.CreatedAt {
+				collisions = append(collisions, fmt.Sprintf("%s (%q here, %q in %s)", formatID(ours.ID), ours.Title, theirs.Title, path))
+				continue
+			}
+			a, _ := json.Marshal(ours)
+			b, _ := json.Marshal(theirs)
+			if bytes.Equal(a, b) {
+				unchanged++
+				continue
+			}
+			// the side changed last wins; what the other side changed on its
+			// own is journaled so it can be restored
+			keepOurs := lastModified(theirs) <= lastModified(ours)
+			winner, loser, side := theirs, ours, "theirs"
+			if keepOurs {
+				winner, loser, side = ours, theirs, "ours"
+			}
+			ourFields, theirFields := taskFields(ours), taskFields(theirs)
+			for _, field := range lostFields(loser, winner) {
+				conflicts = append(conflicts, conflictRecord{
+					At: at, TaskID: ours.ID, CreatedAt: ours.CreatedAt, Title: winner.Title, Field: field,
+					Ours: ourFields[field], Theirs: theirFields[field], Winner: side, Source: path,
+				})
+			}
+			if keepOurs {
+				unchanged++
+				continue
+			}
+			tasks[i] = theirs
+			updated++
+		}
+		if len(collisions) > 0 {
+			hint := "set id_allocation to actor and a distinct actor_slot on each machine so new IDs never collide"
+			if config.IDAllocation == "actor" {
+				hint = fmt.Sprintf("give each machine its own actor_slot (1-%d); hashed slots can be the same", actorSlots)
+			}
+			return nil, newError(ErrInvalid, "cannot merge %s: different tasks share %s: %s (%s)",
+				path, plural(len(collisions), "ID"), strings.Join(collisions, "; "), hint)
+		}
+		sort.SliceStable(tasks, func(i, j int) bool { return tasks[i].ID < tasks[j].ID })
+		return tasks, validateTasks(tasks)
+	}
+
+	if dryRun {
+		tasks, err := loadTasks(ctx)
+		if err != nil {
+			return err
+		}
+		if _, err := merge(tasks); err != nil {
+			return err
+		}
+		fmt.Printf("%s🔀 Merging %s would add %d, update %d and keep %d; nothing written%s\n",
+			ColorCyan, path, added, updated, unchanged, ColorReset)
+		if len(conflicts) > 0 {
+			fmt.Printf("%s⚖️  It would auto-resolve %s by keeping the side changed last%s\n",
+				ColorYellow, plural(len(conflicts), "conflict"), ColorReset)
+		}
+		return nil
+	}
+
+	// the values the merge drops are journaled before it is saved, so they
+	// are never lost unrecorded; a save failing after that leaves records
+	// whose values the tasks still hold
+	err = updateTasks(ctx, func(tasks []Task) ([]Task, error) {
+		tasks, err := merge(tasks)
+		if err != nil {
+			return nil, err
+		}
+		if len(conflicts) > 0 {
+			if err := appendConflicts(conflicts); err != nil {
+				return nil, err
+			}
+		}
+		return tasks, nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s🔀 Merged %s: %d added, %d updated, %d unchanged (no IDs changed)%s\n",
+		ColorGreen, path, added, updated, unchanged, ColorReset)
+	if len(conflicts) > 0 {
+		fmt.Printf("%s⚖️  Auto-resolved %s by keeping the side changed last; review them with `conflicts list`%s\n",
+			ColorYellow, plural(len(conflicts), "conflict"), ColorReset)
+	}
+	return nil
+}
+
+// conflictFile journals the conflicts merge resolved on its own, one JSON
+// record per line, so the values it dropped can be found and restored
+var conflictFile = defaultConflictFile
+
+// defaultConflictFile is the conflict journal of the default store; other
+// stores keep theirs next to the data file
+const defaultConflictFile = "conflicts.jsonl"
+
+// conflictRecord is a field merge found changed on both sides of a task,
+// or changed on the side that lost, with both values and the side kept
+type conflictRecord struct {
+	At        string          `json:"at"`
+	TaskID    int             `json:"task_id"`
+	CreatedAt string          `json:"created_at"` // with TaskID, names the task on every device
+	Title     string          `json:"title"`
+	Field     string          `json:"field"`
+	Ours      json.RawMessage `json:"ours"`   // the value in this store before the merge
+	Theirs    json.RawMessage `json:"theirs"` // the value in the merged file
+	Winner    string          `json:"winner"` // ours or theirs
+	Source    string          `json:"source"`
+	Restored  string          `json:"restored,omitempty"` // when conflicts restore applied the lost value
+}
+
+// lost returns the value the merge dropped
+func (c conflictRecord) lost() json.RawMessage {
+	if c.Winner == "ours" {
+		return c.Theirs
+	}
+	return c.Ours
+}
+
+// taskFields returns the JSON fields of a task by name; omitted fields are
+// missing from the map
+func taskFields(task Task) map[string]json.RawMessage {
+	fields := map[string]json.RawMessage{}
+	data, _ := json.Marshal(task)
+	json.Unmarshal(data, &fields)
+	return fields
+}
+
+// historyTaskFields names the task fields a history event changes where
+// they differ from the event's field
+var historyTaskFields = map[string][]string{
+	"due":    {"due_date"},
+	"status": {"status", "completed_at"},
+}
+
+// lostFields returns the fields whose changes on loser the merge drops:
+// those with history events newer than the last event both sides share,
+// and comments, time entries and attachments only loser has. Fields loser
+// merely never updated are not conflicts.
+func lostFields(loser, winner Task) []string {
+	shared := 0
+	for shared < len(loser.History) && shared < len(winner.History) && loser.History[shared] == winner.History[shared] {
+		shared++
+	}
+	changed := map[string]bool{}
+	for _, event := range loser.History[shared:] {
+		if fields, ok := historyTaskFields[event.Field]; ok {
+			for _, field := range fields {
+				changed[field] = true
+			}
+		} else {
+			changed[event.Field] = true
+		}
+	}
+
+	ours, theirs := taskFields(loser), taskFields(winner)
+	for _, field := range listFields {
+		if len(missingItems(ours[field], theirs[field])) > 0 {
+			changed[field] = true
+		}
+	}
+
+	var fields []string
+	for field := range changed {
+		if !bytes.Equal(ours[field], theirs[field]) {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// listFields are the task fields that only ever grow by items, so a merge
+// conflict on one is about the items the losing side alone has
+var listFields = []string{"comments", "time_log", "attachments"}
+
+// missingItems returns the items of the JSON array from that the JSON array
+// in lacks, in their order
+func missingItems(from, in json.RawMessage) []json.RawMessage {
+	var items, kept []json.RawMessage
+	json.Unmarshal(from, &items)
+	json.Unmarshal(in, &kept)
+	var missing []json.RawMessage
+	for _, item := range items {
+		if !slices.ContainsFunc(kept, func(other json.RawMessage) bool { return bytes.Equal(item, other) }) {
+			missing = append(missing, item)
+		}
+	}
+	return missing
+}
+
+// appendConflicts adds records to the conflict journal
+func appendConflicts(records []conflictRecord) error {
+	var buf bytes.Buffer
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return wrapError(ErrIO, err, "could not encode a conflict record")
+		}
+		buf.Write(append(line, '\n'))
+	}
+	f, err := os.OpenFile(conflictFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return wrapError(ErrIO, err, "could not journal the conflicts in %s; nothing was merged", conflictFile)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return wrapError(ErrIO, err, "could not journal the conflicts in %s; nothing was merged", conflictFile)
+	}
+	if err := f.Close(); err != nil {
+		return wrapError(ErrIO, err, "could not journal the conflicts in %s; nothing was merged", conflictFile)
+	}
+	return nil
+}
+
+// loadConflicts reads the conflict journal; a missing journal is empty
+func loadConflicts() ([]conflictRecord, error) {
+	data, err := os.ReadFile(conflictFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, wrapError(ErrIO, err, "could not read %s", conflictFile)
+	}
+	var records []conflictRecord
+	for n, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var record conflictRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return nil, wrapError(ErrCorrupt, err, "%s line %d is not a conflict record", conflictFile, n+1)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// saveConflicts rewrites the conflict journal atomically
+func saveConflicts(records []conflictRecord) error {
+	var buf bytes.Buffer
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return wrapError(ErrIO, err, "could not encode a conflict record")
+		}
+		buf.Write(append(line, '\n'))
+	}
+	tmpFile := conflictFile + ".tmp"
+	if err := os.WriteFile(tmpFile, buf.Bytes(), 0644); err != nil {
+		os.Remove(tmpFile)
+		return wrapError(ErrIO, err, "could not write %s", conflictFile)
+	}
+	if err := os.Rename(tmpFile, conflictFile); err != nil {
+		os.Remove(tmpFile)
+		return wrapError(ErrIO, err, "could not write %s", conflictFile)
+	}
+	return nil
+}
+
+// conflictValue renders a journaled value for display and history: strings
+// without quotes, a missing value as "", anything else as JSON
+func conflictValue(raw json.RawMessage) string {
+	var text string
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text
+	}
+	return string(raw)
+}
+
+// conflictAt returns the record numbered n (from 1) in conflicts list
+func conflictAt(records []conflictRecord, arg string) (int, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > len(records) {
+		return 0, newError(ErrNotFound, "no conflict %s (conflicts list numbers them 1 to %d)", arg, len(records))
+	}
+	return n - 1, nil
+}
+
+// listConflicts prints the journaled conflicts, oldest first
+func listConflicts() error {
+	records, err := loadConflicts()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		printEmpty("conflicts")
+		return nil
+	}
+	fmt.Printf("%s⚖️  %s resolved by merge%s\n", ColorCyan, plural(len(records), "conflict"), ColorReset)
+	for n, record := range records {
+		state := ""
+		if record.Restored != "" {
+			state = ColorDim + " (restored)" + ColorReset
+		}
+		fmt.Printf("  %3d  %s  %s %s: %s%s%s, kept %s%s\n", n+1, record.At, formatID(record.TaskID), record.Title,
+			ColorBright, record.Field, ColorReset, record.Winner, state)
+	}
+	return nil
+}
+
+// showConflict prints one journaled conflict with both values
+func showConflict(arg string) error {
+	records, err := loadConflicts()
+	if err != nil {
+		return err
+	}
+	i, err := conflictAt(records, arg)
+	if err != nil {
+		return err
+	}
+	record := records[i]
+	mark := func(side string) string {
+		if side == record.Winner {
+			return ColorGreen + " (kept)" + ColorReset
+		}
+		return ColorRed + " (dropped)" + ColorReset
+	}
+	fmt.Printf("%sConflict %d: %s %s%s%s\n", ColorWhite, i+1, formatID(record.TaskID), ColorBright, record.Title, ColorReset)
+	fmt.Printf("  Task:     created %s\n", record.CreatedAt)
+	fmt.Printf("  Field:    %s\n", record.Field)
+	fmt.Printf("  Merged:   %s from %s\n", record.At, record.Source)
+	value := func(raw json.RawMessage) string {
+		if len(raw) == 0 || string(raw) == "null" {
+			return "(none)"
+		}
+		return string(raw)
+	}
+	fmt.Printf("  Here:     %s%s\n", value(record.Ours), mark("ours"))
+	fmt.Printf("  There:    %s%s\n", value(record.Theirs), mark("theirs"))
+	if record.Restored != "" {
+		fmt.Printf("  Restored: %s\n", record.Restored)
+	} else {
+		fmt.Printf("  %sRestore the dropped value with `conflicts restore %d`%s\n", ColorDim, i+1, ColorReset)
+	}
+	return nil
+}
+
+// restoreConflict sets the field of a journaled conflict back to the value
+// the merge dropped, as a change recorded in the task's history
+func restoreConflict(ctx context.Context, arg string) error {
+	records, err := loadConflicts()
+	if err != nil {
+		return err
+	}
+	i, err := conflictAt(records, arg)
+	if err != nil {
+		return err
+	}
+	record := records[i]
+	if record.Restored != "" {
+		return newError(ErrInvalid, "conflict %d was already restored at %s", i+1, record.Restored)
+	}
+
+	now := clock.Now()
+	var task Task
+	err = updateTasks(ctx, func(tasks []Task) ([]Task, error) {
+		j := findTaskByID(tasks, record.TaskID)
+		if j < 0 || tasks[j].CreatedAt != record.CreatedAt {
+			return nil, &TaskError{Kind: ErrNotFound, ID: record.TaskID, Message: fmt.Sprintf(
+				"task %s of conflict %d no longer exists", formatID(record.TaskID), i+1)}
+		}
+		fields := taskFields(tasks[j])
+		before := conflictValue(fields[record.Field])
+		lost := record.lost()
+		switch {
+		case slices.Contains(listFields, record.Field):
+			// only the items the task lacks come back; what was added
+			// since stays
+			var items []json.RawMessage
+			json.Unmarshal(fields[record.Field], &items)
+			items = append(items, missingItems(lost, fields[record.Field])...)
+			if len(items) > 0 {
+				merged, err := json.Marshal(items)
+				if err != nil {
+					return nil, wrapError(ErrIO, err, "could not restore conflict %d", i+1)
+				}
+				fields[record.Field] = merged
+			}
+		case len(lost) == 0 || string(lost) == "null":
+			delete(fields, record.Field)
+		default:
+			fields[record.Field] = lost
+		}
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return nil, wrapError(ErrIO, err, "could not restore conflict %d", i+1)
+		}
+		var restored Task
+		if err := json.Unmarshal(data, &restored); err != nil {
+			return nil, wrapError(ErrCorrupt, err, "conflict %d holds an invalid %s", i+1, record.Field)
+		}
+		recordChange(&restored, now, record.Field, before, conflictValue(taskFields(restored)[record.Field]))
+		if n := len(restored.History); n > 0 && restored.History[n-1].At == now.Format(timeLayout) && restored.History[n-1].Field == record.Field {
+			restored.History[n-1].Note = fmt.Sprintf("restored from conflict %d", i+1)
+		}
+		tasks[j] = restored
+		task = restored
+		return tasks, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	records[i].Restored = now.Format(timeLayout)
+	if err := saveConflicts(records); err != nil {
+		return err
+	}
+	fmt.Printf("%s↩️  Restored %s of %s: %s%s%s\n", ColorGreen, record.Field, formatID(task.ID), ColorBright, task.Title, ColorReset)
+	return nil
+}
+
+// pruneConflicts drops conflict records older than retention.conflict_days;
+// with dryRun they are only counted
+func pruneConflicts(dryRun bool) error {
+	days := config.Retention.ConflictDays
+	if days <= 0 {
+		fmt.Printf("%s🧹 retention.conflict_days is 0; every conflict record is kept%s\n", ColorGreen, ColorReset)
+		return nil
+	}
+	records, err := loadConflicts()
+	if err != nil {
+		return err
+	}
+	cutoff := clock.Now().AddDate(0, 0, -days).Format(timeLayout)
+	kept := records[:0:0]
+	for _, record := range records {
+		if record.At >= cutoff {
+			kept = append(kept, record)
+		}
+	}
+	pruned := len(records) - len(kept)
+	switch {
+	case pruned == 0:
+		fmt.Printf("%s🧹 No conflict records older than %d days%s\n", ColorGreen, days, ColorReset)
+	case dryRun:
+		fmt.Printf("%s🧹 Would prune %s older than %d days; nothing written%s\n", ColorYellow, plural(pruned, "conflict record"), days, ColorReset)
+	default:
+		if err := saveConflicts(kept); err != nil {
+			return err
+		}
+		fmt.Printf("%s🧹 Pruned %s older than %d days%s\n", ColorGreen, plural(pruned, "conflict record"), days, ColorReset)
+	}
+	return nil
+}
+
+// readJSONTasks reads the tasks of a JSON export file
+func readJSONTasks(path string) ([]Task, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, wrapError(ErrIO, err, "could not read %s", path)
+	}
+
+	var incoming []Task
+	if err := json.Unmarshal(data, &incoming); err != nil {
+		return nil, wrapError(ErrInvalid, err, "%s is not a valid task export", path)
+	}
+	return incoming, nil
+}
+
+// csvFields are the task fields a CSV column can be mapped to
+var csvFields = []string{"Title", "Status", "DueDate", "Project", "Tags", "Priority", "CreatedAt", "IdempotencyKey"}
+
+// csvField returns the canonical spelling of a mappable task field
+func csvField(name string) (string, error) {
+	for _, field := range csvFields {
+		if strings.EqualFold(field, strings.TrimSpace(name)) {
+			return field, nil
+		}
+	}
+	return "", fmt.Errorf("unknown task field %q (use %s)", name, strings.Join(csvFields, ", "))
+}
+
+// isValidStatus reports whether status is one of the task statuses
+func isValidStatus(status string) bool {
+	return status == "todo" || status == "in-progress" || status == "done"
+}
+
+// parsePairs parses a comma-separated list of key=value pairs
+func parsePairs(value string) (map[string]string, error) {
+	pairs := map[string]string{}
+	for _, item := range strings.Split(value, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(key) == "" || strings.TrimSpace(val) == "" {
+			return nil, fmt.Errorf("invalid pair %q (use Key=Value)", item)
+		}
+		pairs[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	}
+	return pairs, nil
+}
+
+// buildCSVMapping combines the named mapping from the config with the
+// --map and --status flags, which take precedence
+func buildCSVMapping(name, columns, statuses string) (CSVMapping, error) {
+	mapping := CSVMapping{Columns: map[string]string{}, Status: map[string]string{}}
+
+	var layers []CSVMapping
+	if name != "" {
+		saved, ok := config.CSVMappings[name]
+		if !ok {
+			return mapping, newError(ErrUsage, "no csv mapping named %q in %s", name, configFile)
+		}
+		layers = append(layers, saved)
+	}
+	flagColumns, err := parsePairs(columns)
+	if err != nil {
+		return mapping, newError(ErrUsage, "--map: %v", err)
+	}
+	flagStatuses, err := parsePairs(statuses)
+	if err != nil {
+		return mapping, newError(ErrUsage, "--status: %v", err)
+	}
+	layers = append(layers, CSVMapping{Columns: flagColumns, Status: flagStatuses})
+
+	for _, layer := range layers {
+		for field, column := range layer.Columns {
+			canonical, err := csvField(field)
+			if err != nil {
+				return mapping, newError(ErrUsage, "%v", err)
+			}
+			mapping.Columns[canonical] = column
+		}
+		for from, to := range layer.Status {
+			if !isValidStatus(to) {
+				return mapping, newError(ErrUsage, "status rule %s=%s: %q is not todo, in-progress or done", from, to, to)
+			}
+			mapping.Status[strings.ToLower(from)] = to
+		}
+	}
+	return mapping, nil
+}
+
+// readCSVTasks reads tasks from a CSV file with a header row. Columns are
+// mapped onto task fields by mapping, or by header names matching the field
+// names when mapping has no columns.
+func readCSVTasks(path string, mapping CSVMapping) ([]Task, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, wrapError(ErrIO, err, "could not read %s", path)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, wrapError(ErrInvalid, err, "%s has no CSV header row", path)
+	}
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+
+	position := map[string]int{}
+	for i, column := range header {
+		position[strings.ToLower(strings.TrimSpace(column))] = i
+	}
+
+	columns := mapping.Columns
+	if len(columns) == 0 {
+		columns = map[string]string{}
+		for _, column := range header {
+			if field, err := csvField(column); err == nil {
+				columns[field] = column
+			}
+		}
+	}
+
+	index := map[string]int{}
+	var missing []string
+	if _, ok := columns["Title"]; !ok {
+		missing = append(missing, "Title (not mapped; use --map Title=<column>)")
+	}
+	for _, field := range csvFields {
+		column, ok := columns[field]
+		if !ok {
+			continue
+		}
+		i, found := position[strings.ToLower(column)]
+		if !found {
+			missing = append(missing, fmt.Sprintf("%s=%s (no such column)", field, column))
+			continue
+		}
+		index[field] = i
+	}
+	if len(missing) > 0 {
+		return nil, newError(ErrInvalid, "%s: missing required columns: %s; the file has: %s",
+			path, strings.Join(missing, ", "), strings.Join(header, ", "))
+	}
+
+	var incoming []Task
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, wrapError(ErrInvalid, err, "%s is not valid CSV", path)
+		}
+		line, _ := reader.FieldPos(0)
+
+		value := func(field string) string {
+			if i, ok := index[field]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		task, err := csvTask(value, mapping.Status)
+		if err != nil {
+			return nil, newError(ErrInvalid, "%s line %d: %v", path, line, err)
+		}
+		incoming = append(incoming, task)
+	}
+	return incoming, nil
+}
+
+// csvTask builds a task from the mapped values of one CSV row
+func csvTask(value func(field string) string, statusRules map[string]string) (Task, error) {
+	task := Task{
+		Title:          value("Title"),
+		Project:        strings.TrimPrefix(value("Project"), "+"),
+		IdempotencyKey: value("IdempotencyKey"),
+	}
+	if task.Title == "" {
+		return task, fmt.Errorf("empty Title")
+	}
+
+	status := value("Status")
+	if to, ok := statusRules[strings.ToLower(status)]; ok {
+		task.Status = to
+	} else if status == "" || isValidStatus(strings.ToLower(status)) {
+		task.Status = strings.ToLower(status)
+	} else {
+		return task, fmt.Errorf("unknown status %q (add a rule such as --status \"%s=todo\")", status, status)
+	}
+
+	if due := value("DueDate"); due != "" {
+		date, err := parseLayoutDate(due)
+		if err != nil {
+			return task, fmt.Errorf("DueDate %q matches neither YYYY-MM-DD nor date_layouts in %s", due, configFile)
+		}
+		task.DueDate = date.Format(dateLayout)
+	}
+	if created := value("CreatedAt"); created != "" {
+		at, err := parseTimestamp(created)
+		if err != nil {
+			if at, err = parseLayoutDate(created); err != nil {
+				return task, fmt.Errorf("CreatedAt %q matches neither %s nor date_layouts in %s", created, timeLayout, configFile)
+			}
+		}
+		task.CreatedAt = at.Format(timeLayout)
+	}
+	if p := value("Priority"); p != "" {
+		priority, err := parsePriority(p)
+		if err != nil {
+			return task, err
+		}
+		task.Priority = priority
+	}
+	for _, tag := range strings.FieldsFunc(value("Tags"), func(r rune) bool { return r == ',' || r == ';' || r == ' ' }) {
+		task.Tags = append(task.Tags, strings.TrimPrefix(tag, "@"))
+	}
+	return task, nil
+}
+
+// previewImport prints how the first tasks of an import would be stored,
+// without writing anything
+func previewImport(ctx context.Context, incoming []Task) error {
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+
+	shown := incoming
+	if len(shown) > 5 {
+		shown = shown[:5]
+	}
+	fmt.Printf("%s👀 Preview of %s (first %d shown, nothing written):%s\n",
+		ColorCyan, plural(len(incoming), "task"), len(shown), ColorReset)
+
+	ids := newIDAllocator(tasks)
+	for _, task := range shown {
+		if task.IdempotencyKey != "" && findTaskByKey(tasks, task.IdempotencyKey) >= 0 {
+			fmt.Printf("  %s⏭️  %s (skipped: key %q already exists)%s\n", ColorYellow, task.Title, task.IdempotencyKey, ColorReset)
+			continue
+		}
+		task.ID = ids.next()
+		if task.Status == "" {
+			task.Status = "todo"
+		}
+		printTaskLine(task, nil)
+	}
+	return nil
+}
+
+// importTasks adds the tasks read from path, assigning them new IDs.
+// Tasks whose idempotency key is already present are skipped.
+func importTasks(ctx context.Context, path string, incoming []Task, quiet bool) error {
+	imported, skipped := 0, 0
+	err := updateTasks(ctx, func(tasks []Task) ([]Task, error) {
+		ids := newIDAllocator(tasks)
+		progress := newProgressReporter("importing", len(incoming), quiet)
+		defer progress.Finish()
+
+		for _, task := range incoming {
+			if ctx.Err() != nil {
+				return nil, canceledError(ctx)
+			}
+			if task.IdempotencyKey != "" && findTaskByKey(tasks, task.IdempotencyKey) >= 0 {
+				skipped++
+				progress.Add(1)
+				continue
+			}
+
+			task.ID = ids.next()
+			if task.Status == "" {
+				task.Status = "todo"
+			}
+			if task.CreatedAt == "" {
+				task.CreatedAt = clock.Now().Format(timeLayout)
+			}
+			tasks = append(tasks, task)
+			imported++
+			progress.Add(1)
+		}
+		return tasks, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if quiet {
+		return nil
+	}
+	fmt.Printf("%s📥 Imported %s tasks from %s%s", ColorGreen, formatCount(imported), path, ColorReset)
+	if skipped > 0 {
+		fmt.Printf(" %s(%s skipped: key already exists)%s", ColorYellow, formatCount(skipped), ColorReset)
+	}
+	fmt.Println()
+	return nil
+}
+
+// parseFlags parses command flags that may be mixed with positional arguments
+// and returns the positional arguments
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	fs.SetOutput(io.Discard)
+
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, newError(ErrUsage, "%v", err)
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// globalOptions holds the flags accepted before or after any command
+type globalOptions struct {
+	ErrorFormat string
+	Plain       bool
+	Theme       string // overrides the theme setting when set
+	File        string // the task store given with --file
+	Global      bool   // use the default store even below a .tasks.json
+	Verbose     bool
+	Quiet       bool   // print less; see printEmpty and the commands' own --quiet
+	Context     string // the store the user means to work on, checked by guardContext
+	Force       bool   // skip the confirm_context guards
+	ReadOnly    bool   // the data file cannot be written; see readOnly
+	// readOnlyKnown is set once ReadOnly has been found out
+	readOnlyKnown bool
+}
+
+// globals holds the global flags of the current invocation
+var globals = globalOptions{ErrorFormat: "text"}
+
+// parseGlobalFlags removes the global flags from args and records them in globals
+func parseGlobalFlags(args []string) ([]string, error) {
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--errors":
+			if i+1 >= len(args) {
+				return nil, newError(ErrUsage, "--errors requires a value (text or json)")
+			}
+			i++
+			globals.ErrorFormat = args[i]
+		case strings.HasPrefix(arg, "--errors="):
+			globals.ErrorFormat = strings.TrimPrefix(arg, "--errors=")
+		case arg == "--plain":
+			globals.Plain = true
+		case arg == "--global":
+			globals.Global = true
+		case arg == "--verbose":
+			globals.Verbose = true
+		case arg == "--quiet":
+			globals.Quiet = true
+		case arg == "--force":
+			globals.Force = true
+		case arg == "--context":
+			if i+1 >= len(args) {
+				return nil, newError(ErrUsage, "--context requires a name")
+			}
+			i++
+			globals.Context = args[i]
+		case strings.HasPrefix(arg, "--context="):
+			globals.Context = strings.TrimPrefix(arg, "--context=")
+		case arg == "--file":
+			if i+1 >= len(args) {
+				return nil, newError(ErrUsage, "--file requires a path")
+			}
+			i++
+			globals.File = args[i]
+		case strings.HasPrefix(arg, "--file="):
+			globals.File = strings.TrimPrefix(arg, "--file=")
+		case arg == "--theme" || strings.HasPrefix(arg, "--theme="):
+			name, ok := strings.CutPrefix(arg, "--theme=")
+			if !ok {
+				if i+1 >= len(args) {
+					return nil, newError(ErrUsage, "--theme requires a value (default or colorblind)")
+				}
+				i++
+				name = args[i]
+			}
+			if _, known := themes[name]; !known {
+				return nil, newError(ErrUsage, "unknown theme %q (use default or colorblind)", name)
+			}
+			globals.Theme = name
+		default:
+			rest = append(rest, arg)
+			continue
+		}
+
+		if globals.ErrorFormat != "text" && globals.ErrorFormat != "json" {
+			format := globals.ErrorFormat
+			globals.ErrorFormat = "text"
+			return nil, newError(ErrUsage, "invalid --errors value %q (use text or json)", format)
+		}
+	}
+	return rest, nil
+}
+
+// spoolFile holds the writes serve has accepted but not yet applied, so a
+// crash does not lose them
+var spoolFile = dataFile + ".spool"
+
+const (
+	// queueRetryInterval is how often serve retries queued writes while the
+	// data file is locked
+	queueRetryInterval = 200 * time.Millisecond
+	// queueDrainTimeout bounds how long serve keeps applying queued writes
+	// after it is asked to stop
+	queueDrainTimeout = 30 * time.Second
+	// finishedOperationsKept is how many applied or failed operations stay
+	// queryable at /operations/{id}
+	finishedOperationsKept = 1000
+	// defaultPageSize and maxPageSize bound how many tasks GET /tasks
+	// returns; larger limits are capped at maxPageSize
+	defaultPageSize = 100
+	maxPageSize     = 500
+)
+
+// apiFilterParams maps the filter query parameters of GET /tasks onto the
+// fields of the filter language, so the API filters exactly like list --filter
+var apiFilterParams = map[string]string{
+	"status":     "status",
+	"tag":        "tag",
+	"project":    "project",
+	"priority":   "priority",
+	"due_before": "due-before",
+	"due_after":  "due-after",
+}
+
+// taskQuery is a parsed GET /tasks query
+type taskQuery struct {
+	filter taskFilter
+	sort   string
+	limit  int
+	offset int
+}
+
+// parseTaskQuery parses the query of GET /tasks. Filter parameters may be
+// repeated and all must match; q holds words to find in titles and filter a
+// whole expression as given to list --filter. Errors carry the text the CLI
+// prints for the same filter.
+func parseTaskQuery(query url.Values, now time.Time) (taskQuery, error) {
+	q := taskQuery{sort: config.DefaultSort, limit: defaultPageSize}
+	for name, values := range query {
+		for _, value := range values {
+			var err error
+			switch field, isFilter := apiFilterParams[name]; {
+			case isFilter:
+				var term filterTerm
+				term, err = parseFilterTerm(field+":"+value, now)
+				q.filter = append(q.filter, term)
+			case name == "q":
+				for _, word := range strings.Fields(value) {
+					q.filter = append(q.filter, filterTerm{field: "text", value: strings.ToLower(word)})
+				}
+			case name == "filter":
+				var filter taskFilter
+				filter, err = parseFilter(value, now)
+				q.filter = append(q.filter, filter...)
+			case name == "sort":
+				q.sort = value
+			case name == "limit":
+				q.limit, err = strconv.Atoi(value)
+				if err != nil || q.limit <= 0 {
+					err = fmt.Errorf("invalid limit %q (use a positive number, at most %d)", value, maxPageSize)
+				}
+				q.limit = min(q.limit, maxPageSize)
+			case name == "offset":
+				q.offset, err = strconv.Atoi(value)
+				if err != nil || q.offset < 0 {
+					err = fmt.Errorf("invalid offset %q (use 0 or more)", value)
+				}
+			default:
+				err = fmt.Errorf("unknown query parameter %q (use status, tag, project, priority, due_before, due_after, q, filter, sort, limit or offset)", name)
+			}
+			if err != nil {
+				return q, newError(ErrInvalid, "%v", err)
+			}
+		}
+	}
+	return q, nil
+}
+
+// Operation states reported by GET /operations/{id}
+const (
+	OpQueued  = "queued"
+	OpApplied = "applied"
+	OpFailed  = "failed"
+)
+
+// apiAddRequest is the body of POST /tasks; the fields match the add flags
+type apiAddRequest struct {
+	Title    string   `json:"title"`
+	Due      string   `json:"due,omitempty"`
+	Every    string   `json:"every,omitempty"`
+	Anchor   string   `json:"anchor,omitempty"`
+	Project  string   `json:"project,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Priority string   `json:"priority,omitempty"`
+	Key      string   `json:"key,omitempty"`
+}
+
+// options returns the add options equivalent to the request
+func (req apiAddRequest) options() addOptions {
+	return addOptions{
+		Key:      req.Key,
+		Due:      req.Due,
+		Every:    req.Every,
+		Anchor:   req.Anchor,
+		Project:  req.Project,
+		Tags:     req.Tags,
+		Priority: req.Priority,
+	}
+}
+
+// apiOperation is a write received by serve. Writes that find the data file
+// locked are queued and applied in the order they were accepted.
+type apiOperation struct {
+	ID         string         `json:"id,omitempty"`
+	Kind       string         `json:"kind"`
+	TaskID     int            `json:"task_id,omitempty"`
+	Reason     string         `json:"reason,omitempty"`
+	Add        *apiAddRequest `json:"add,omitempty"`
+	AcceptedAt time.Time      `json:"accepted_at"`
+	Status     string         `json:"status"`
+	Task       *Task          `json:"task,omitempty"`
+	Warnings   []string       `json:"warnings,omitempty"`
+	Error      *errorPayload  `json:"error,omitempty"`
+	Token      string         `json:"token,omitempty"`
+}
+
+// apply performs the operation, using the time it was accepted as the time
+// of the change. Adds are idempotent by key, completions by nature, so an
+// operation replayed from the spool is applied at most once.
+func (op *apiOperation) apply(ctx context.Context, store *taskStore) error {
+	now := op.AcceptedAt
+	var result Task
+	var err error
+	switch op.Kind {
+	case "add":
+		opts := op.Add.options()
+		var task Task
+		task, err = newTaskFromOptions(op.Add.Title, opts, now)
+		if err != nil {
+			return err
+		}
+		err = store.update(ctx, func(tasks []Task) ([]Task, error) {
+			var err error
+			tasks, result, _, op.Warnings, err = insertTask(tasks, task, opts, now)
+			return tasks, err
+		})
+	case "done":
+		err = store.update(ctx, func(tasks []Task) ([]Task, error) {
+			i := findTaskByID(tasks, op.TaskID)
+			if i < 0 {
+				return nil, notFoundError(op.TaskID)
+			}
+			if tasks[i].Status != "done" {
+				var err error
+				if tasks, _, err = markDone(tasks, i, now, op.Reason); err != nil {
+					return nil, err
+				}
+			}
+			result = tasks[i]
+			return tasks, nil
+		})
+	default:
+		return newError(ErrInvalid, "unknown operation %q", op.Kind)
+	}
+	if err != nil {
+		return err
+	}
+	op.Task = &result
+	return nil
+}
+
+// writeQueue serializes the writes made through serve. A write is applied
+// at once unless the data file is locked or earlier writes are still
+// waiting, in which case it is queued, spooled to disk and applied in order
+// by run.
+type writeQueue struct {
+	store   *taskStore
+	applyMu sync.Mutex // held while applying, so writes never overtake each other
+
+	mu       sync.Mutex
+	pending  []*apiOperation
+	ops      map[string]*apiOperation
+	finished []string
+	limit    int
+}
+
+// newWriteQueue returns a queue holding at most limit writes, resuming any
+// left in the spool file by an earlier serve
+func newWriteQueue(store *taskStore, limit int) (*writeQueue, error) {
+	q := &writeQueue{store: store, ops: make(map[string]*apiOperation), limit: limit}
+
+	data, err := os.ReadFile(spoolFile)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, wrapError(ErrIO, err, "could not read %s", spoolFile)
+	}
+	if err := json.Unmarshal(data, &q.pending); err != nil {
+		return nil, wrapError(ErrCorrupt, err, "%s is not a valid write spool", spoolFile)
+	}
+	for _, op := range q.pending {
+		q.ops[op.ID] = op
+	}
+	return q, nil
+}
+
+// newOperationID returns a random ID for a queued write
+func newOperationID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", wrapError(ErrIO, err, "could not generate an operation ID")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// submit applies op, or queues it if the data file is locked or writes are
+// already queued, and reports whether it was queued
+func (q *writeQueue) submit(ctx context.Context, op *apiOperation) (bool, error) {
+	q.applyMu.Lock()
+	defer q.applyMu.Unlock()
+
+	if q.backlog() == 0 {
+		if err := op.apply(ctx, q.store); !errors.Is(err, ErrLocked) {
+			return false, err
+		}
+	}
+	return true, q.enqueue(op)
+}
+
+// backlog returns the number of queued writes
+func (q *writeQueue) backlog() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// enqueue adds op to the queue and the spool; op is only accepted once it
+// is on disk
+func (q *writeQueue) enqueue(op *apiOperation) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.pending) >= q.limit {
+		return newError(ErrLocked, "the write queue is full (%s waiting for %s, serve_queue_limit is %d)", plural(len(q.pending), "write"), dataFile, q.limit)
+	}
+	id, err := newOperationID()
+	if err != nil {
+		return err
+	}
+	op.ID, op.Status = id, OpQueued
+	if op.Add != nil && op.Add.Key == "" {
+		// replaying the spool after a crash must not add the task twice
+		op.Add.Key = "api-op-" + id
+	}
+
+	q.pending = append(q.pending, op)
+	if err := q.writeSpool(); err != nil {
+		q.pending = q.pending[:len(q.pending)-1]
+		return err
+	}
+	q.ops[id] = op
+	return nil
+}
+
+// writeSpool saves the queued writes, removing the spool once the queue is
+// empty; the caller holds q.mu
+func (q *writeQueue) writeSpool() error {
+	if len(q.pending) == 0 {
+		if err := os.Remove(spoolFile); err != nil && !os.IsNotExist(err) {
+			return wrapError(ErrIO, err, "could not remove %s", spoolFile)
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(q.pending, "", "  ")
+	if err != nil {
+		return wrapError(ErrIO, err, "could not encode the write queue")
+	}
+	tmpFile := spoolFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		os.Remove(tmpFile)
+		return wrapError(ErrIO, err, "could not write %s", spoolFile)
+	}
+	if err := os.Rename(tmpFile, spoolFile); err != nil {
+		os.Remove(tmpFile)
+		return wrapError(ErrIO, err, "could not write %s", spoolFile)
+	}
+	return nil
+}
+
+// lookup returns a copy of the operation with the given ID
+func (q *writeQueue) lookup(id string) (apiOperation, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	op, ok := q.ops[id]
+	if !ok {
+		return apiOperation{}, false
+	}
+	return *op, true
+}
+
+// flush applies queued writes in order until the queue is empty, the data
+// file is locked or ctx ends, and returns how many are left
+func (q *writeQueue) flush(ctx context.Context) int {
+	q.applyMu.Lock()
+	defer q.applyMu.Unlock()
+
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.mu.Unlock()
+			return 0
+		}
+		op := q.pending[0]
+		q.mu.Unlock()
+
+		// apply works on a copy; readers of the operation take q.mu
+		applied := *op
+		err := applied.apply(ctx, q.store)
+		if err != nil && (errors.Is(err, ErrLocked) || errors.Is(err, ErrCanceled) || errorKind(err) == ErrIO) {
+			return q.backlog()
+		}
+
+		q.mu.Lock()
+		*op = applied
+		op.Status = OpApplied
+		if err != nil {
+			payload := newErrorPayload(err)
+			op.Status, op.Error = OpFailed, &payload
+		}
+		q.pending = q.pending[1:]
+		if err := q.writeSpool(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s⚠️  %v%s\n", ColorYellow, err, ColorReset)
+		}
+		q.finished = append(q.finished, op.ID)
+		if len(q.finished) > finishedOperationsKept {
+			delete(q.ops, q.finished[0])
+			q.finished = q.finished[1:]
+		}
+		q.mu.Unlock()
+	}
+}
+
+// run retries queued writes until ctx ends
+func (q *writeQueue) run(ctx context.Context) {
+	ticker := time.NewTicker(queueRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			q.flush(ctx)
+		}
+	}
+}
+
+// drain keeps applying queued writes until none are left or timeout passes,
+// and returns how many are left
+func (q *writeQueue) drain(timeout time.Duration) int {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for {
+		left := q.flush(ctx)
+		if left == 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return left
+		case <-time.After(queueRetryInterval):
+		}
+	}
+}
+
+// httpStatus maps an error kind onto an HTTP status code
+func httpStatus(err error) int {
+	switch errorKind(err) {
+	case ErrNotFound:
+		return http.StatusNotFound
+	case ErrUsage, ErrInvalid:
+		return http.StatusBadRequest
+	case ErrReason:
+		return http.StatusUnprocessableEntity
+	case ErrLimit:
+		return http.StatusTooManyRequests
+	case ErrReadOnly:
+		return http.StatusForbidden
+	case ErrLocked, ErrCanceled:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeJSON writes value as the JSON body of a response
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeAPIError writes err in the same form as --errors json
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := httpStatus(err)
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "1")
+	}
+	writeJSON(w, status, newErrorPayload(err))
+}
+
+// submitOperation answers a write: 202 with the operation when it was
+// queued, otherwise successStatus with the task it produced
+func submitOperation(w http.ResponseWriter, r *http.Request, queue *writeQueue, op *apiOperation, successStatus int) {
+	queued, err := queue.submit(r.Context(), op)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if queued {
+		w.Header().Set("Location", "/operations/"+op.ID)
+		writeJSON(w, http.StatusAccepted, map[string]string{"operation": op.ID, "status": OpQueued})
+		return
+	}
+	writeJSON(w, successStatus, op.Task)
+}
+
+// tokenScopes are the scopes of API tokens; each may do everything the
+// ones before it may. read may only GET, write may also add and complete
+// tasks, and admin may also follow the writes of other tokens.
+var tokenScopes = []string{"read", "write", "admin"}
+
+// scopeRank returns the place of scope in tokenScopes, counting from 1, or
+// 0 for an unknown scope
+func scopeRank(scope string) int {
+	for i, name := range tokenScopes {
+		if name == scope {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// hashToken returns the form in which a token secret is kept in config.json
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// checkAPITokens reports the first token in config.json with an unknown
+// scope or an invalid filter, so serve does not start with it
+func checkAPITokens() error {
+	for name, token := range config.APITokens {
+		if scopeRank(token.Scope) == 0 {
+			return newError(ErrInvalid, "api token %q in %s has unknown scope %q (use %s)", name, configFile, token.Scope, strings.Join(tokenScopes, ", "))
+		}
+		if _, err := parseFilter(token.Filter, clock.Now()); err != nil {
+			return newError(ErrInvalid, "api token %q in %s has an invalid filter: %v", name, configFile, err)
+		}
+	}
+	return nil
+}
+
+// apiCaller is the token a request to serve was made with
+type apiCaller struct {
+	Name  string
+	Token APIToken
+}
+
+type callerKey struct{}
+
+// callerOf returns the token of a request, or nil when serve runs without
+// api_tokens
+func callerOf(r *http.Request) *apiCaller {
+	caller, _ := r.Context().Value(callerKey{}).(*apiCaller)
+	return caller
+}
+
+// name returns the name of the token, or "" without one
+func (c *apiCaller) name() string {
+	if c == nil {
+		return ""
+	}
+	return c.Name
+}
+
+// sees reports whether the token's filter lets it see task; without a
+// token or a filter every task is visible
+func (c *apiCaller) sees(task Task, now time.Time) bool {
+	if c == nil || c.Token.Filter == "" {
+		return true
+	}
+	filter, err := parseFilter(c.Token.Filter, now)
+	return err == nil && filter.matches(task)
+}
+
+// authorize requires a bearer token from api_tokens on every request once
+// any are configured: 401 without a known one, 403 when its scope does not
+// cover the request. Without api_tokens every request is let through.
+func authorize(next http.Handler) http.Handler {
+	if len(config.APITokens) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var caller *apiCaller
+		if secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			hash := hashToken(strings.TrimSpace(secret))
+			for name, token := range config.APITokens {
+				if subtle.ConstantTimeCompare([]byte(hash), []byte(token.Hash)) == 1 {
+					caller = &apiCaller{Name: name, Token: token}
+				}
+			}
+		}
+		if caller == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="task-tracker"`)
+			writeJSON(w, http.StatusUnauthorized, errorPayload{Code: "unauthorized", Message: "a valid bearer token is required"})
+			return
+		}
+
+		needed := "write"
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			needed = "read"
+		}
+		if scopeRank(caller.Token.Scope) < scopeRank(needed) {
+			writeJSON(w, http.StatusForbidden, errorPayload{
+				Code:    "forbidden",
+				Message: fmt.Sprintf("token %q has scope %s; %s %s needs scope %s", caller.Name, caller.Token.Scope, r.Method, r.URL.Path, needed),
+			})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, caller)))
+	})
+}
+
+// generateToken creates an API token for serve and saves its hash under
+// api_tokens in config.json, replacing a token of the same name. The secret
+// is printed once and cannot be recovered.
+func generateToken(name, scope, filter string) error {
+	if strings.TrimSpace(name) == "" {
+		return newError(ErrUsage, "usage: token generate <name> [--scope read|write|admin] [--filter <expr>]")
+	}
+	if scopeRank(scope) == 0 {
+		return newError(ErrUsage, "unknown scope %q (use %s)", scope, strings.Join(tokenScopes, ", "))
+	}
+	if _, err := parseFilter(filter, clock.Now()); err != nil {
+		return newError(ErrInvalid, "%v", err)
+	}
+
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return wrapError(ErrIO, err, "could not generate a token")
+	}
+	secret := "tt_" + hex.EncodeToString(b)
+
+	// edited as raw JSON so the other settings are kept as they are
+	settings := map[string]json.RawMessage{}
+	data, err := os.ReadFile(configFile)
+	if err != nil && !os.IsNotExist(err) {
+		return wrapError(ErrIO, err, "could not read %s", configFile)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &settings); err != nil {
+			return wrapError(ErrInvalid, err, "%s is not valid JSON", configFile)
+		}
+	}
+	tokens := map[string]APIToken{}
+	if raw, ok := settings["api_tokens"]; ok {
+		if err := json.Unmarshal(raw, &tokens); err != nil {
+			return wrapError(ErrInvalid, err, "api_tokens in %s is invalid", configFile)
+		}
+	}
+	_, replaced := tokens[name]
+	tokens[name] = APIToken{Hash: hashToken(secret), Scope: scope, Filter: filter}
+	if settings["api_tokens"], err = json.Marshal(tokens); err != nil {
+		return wrapError(ErrIO, err, "could not encode api_tokens")
+	}
+
+	data, err = json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return wrapError(ErrIO, err, "could not encode %s", configFile)
+	}
+	tmpFile := configFile + ".tmp"
+	if err := os.WriteFile(tmpFile, append(data, '\n'), 0600); err != nil {
+		os.Remove(tmpFile)
+		return wrapError(ErrIO, err, "could not write %s", configFile)
+	}
+	if err := os.Rename(tmpFile, configFile); err != nil {
+		os.Remove(tmpFile)
+		return wrapError(ErrIO, err, "could not write %s", configFile)
+	}
+
+	action := "Created"
+	if replaced {
+		action = "Replaced"
+	}
+	limit := ""
+	if filter != "" {
+		limit = ", only tasks matching " + filter
+	}
+	fmt.Fprintf(os.Stderr, "%s🔑 %s token %q (scope %s%s) in %s. Copy it now, it is not shown again:%s\n",
+		ColorGreen, action, name, scope, limit, configFile, ColorReset)
+	fmt.Println(secret)
+	return nil
+}
+
+// newAPIHandler returns the routes served by serve
+func newAPIHandler(queue *writeQueue) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /tasks", func(w http.ResponseWriter, r *http.Request) {
+		now := clock.Now()
+		query, err := parseTaskQuery(r.URL.Query(), now)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		tasks, err := queue.store.tasks(r.Context())
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		tasks = filterTasks(tasks, query.filter)
+		if caller := callerOf(r); caller != nil && caller.Token.Filter != "" {
+			kept := tasks[:0]
+			for _, task := range tasks {
+				if caller.sees(task, now) {
+					kept = append(kept, task)
+				}
+			}
+			tasks = kept
+		}
+		if err := sortTasks(tasks, query.sort, urgencyScores(tasks, now)); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+
+		total := len(tasks)
+		page := tasks[min(query.offset, total):min(query.offset+query.limit, total)]
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		if query.offset+len(page) < total {
+			next := r.URL.Query()
+			next.Set("offset", strconv.Itoa(query.offset+len(page)))
+			next.Set("limit", strconv.Itoa(query.limit))
+			w.Header().Set("Link", fmt.Sprintf("</tasks?%s>; rel=\"next\"", next.Encode()))
+		}
+		if page == nil {
+			page = []Task{}
+		}
+		writeJSON(w, http.StatusOK, page)
+	})
+
+	mux.HandleFunc("GET /tasks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := parseID(r.PathValue("id"))
+		if err != nil {
+			writeAPIError(w, newError(ErrInvalid, "%v", err))
+			return
+		}
+		tasks, err := queue.store.tasks(r.Context())
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		// tasks outside the token's filter are answered as if they did not exist
+		i := findTaskByID(tasks, id)
+		if i < 0 || !callerOf(r).sees(tasks[i], clock.Now()) {
+			writeAPIError(w, notFoundError(id))
+			return
+		}
+		writeJSON(w, http.StatusOK, tasks[i])
+	})
+
+	mux.HandleFunc("POST /tasks", func(w http.ResponseWriter, r *http.Request) {
+		var req apiAddRequest
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			writeAPIError(w, newError(ErrInvalid, "invalid request body: %v", err))
+			return
+		}
+		caller := callerOf(r)
+		op := &apiOperation{Kind: "add", Add: &req, AcceptedAt: clock.Now(), Token: caller.name()}
+		// reject bad input now rather than when a queued write is applied
+		task, err := newTaskFromOptions(req.Title, req.options(), op.AcceptedAt)
+		if err == nil {
+			err = checkSchema(task, "the new task")
+		}
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		if !caller.sees(task, op.AcceptedAt) {
+			writeJSON(w, http.StatusForbidden, errorPayload{
+				Code:    "forbidden",
+				Message: fmt.Sprintf("token %q may only add tasks matching %s", caller.Name, caller.Token.Filter),
+			})
+			return
+		}
+		submitOperation(w, r, queue, op, http.StatusCreated)
+	})
+
+	mux.HandleFunc("POST /tasks/{id}/done", func(w http.ResponseWriter, r *http.Request) {
+		id, err := parseID(r.PathValue("id"))
+		if err != nil {
+			writeAPIError(w, newError(ErrInvalid, "%v", err))
+			return
+		}
+		// the body is optional: {"reason": "..."} for tasks completed late
+		var req struct {
+			Reason string `json:"reason"`
+		}
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil && err != io.EOF {
+			writeAPIError(w, newError(ErrInvalid, "invalid request body: %v", err))
+			return
+		}
+		caller := callerOf(r)
+		if caller != nil && caller.Token.Filter != "" {
+			tasks, err := queue.store.tasks(r.Context())
+			if err != nil {
+				writeAPIError(w, err)
+				return
+			}
+			if i := findTaskByID(tasks, id); i >= 0 && !caller.sees(tasks[i], clock.Now()) {
+				writeAPIError(w, notFoundError(id))
+				return
+			}
+		}
+		op := &apiOperation{Kind: "done", TaskID: id, Reason: strings.TrimSpace(req.Reason), AcceptedAt: clock.Now(), Token: caller.name()}
+		submitOperation(w, r, queue, op, http.StatusOK)
+	})
+
+	mux.HandleFunc("GET /operations/{id}", func(w http.ResponseWriter, r *http.Request) {
+		// only the token that made a write, or an admin token, may follow it
+		op, ok := queue.lookup(r.PathValue("id"))
+		if caller := callerOf(r); ok && caller != nil && caller.Token.Scope != "admin" && op.Token != caller.Name {
+			ok = false
+		}
+		if !ok {
+			writeAPIError(w, newError(ErrNotFound, "no operation with id %s", r.PathValue("id")))
+			return
+		}
+		writeJSON(w, http.StatusOK, op)
+	})
+
+	return authorize(mux)
+}
+
+// serveTasks serves the HTTP API on addr until ctx ends, then stops taking
+// requests and applies the writes still queued
+func serveTasks(ctx context.Context, addr string) error {
+	limit := config.ServeQueueLimit
+	if limit <= 0 {
+		return newError(ErrInvalid, "serve_queue_limit must be positive, got %d", limit)
+	}
+	queue, err := newWriteQueue(&taskStore{}, limit)
+	if err != nil {
+		return err
+	}
+	if n := queue.backlog(); n > 0 {
+		fmt.Printf("%s↻ Resuming %s from %s%s\n", ColorYellow, plural(n, "queued write"), spoolFile, ColorReset)
+	}
+
+	if err := checkAPITokens(); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return wrapError(ErrIO, err, "could not listen on %s", addr)
+	}
+	server := &http.Server{Handler: newAPIHandler(queue), ReadHeaderTimeout: 10 * time.Second}
+
+	workerCtx, stopWorker := context.WithCancel(ctx)
+	defer stopWorker()
+	go queue.run(workerCtx)
+
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(listener) }()
+	fmt.Printf("%s🌐 Serving tasks on http://%s (Ctrl-C to stop)%s\n", ColorGreen, listener.Addr(), ColorReset)
+	if n := len(config.APITokens); n > 0 {
+		fmt.Printf("🔑 Requests need one of %s from %s\n", plural(n, "API token"), configFile)
+	}
+
+	select {
+	case err := <-served:
+		return wrapError(ErrIO, err, "serve stopped")
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(shutdownCtx)
+	stopWorker()
+
+	if n := queue.backlog(); n > 0 {
+		fmt.Printf("Applying %s before exiting...\n", plural(n, "queued write"))
+	}
+	if left := queue.drain(queueDrainTimeout); left > 0 {
+		fmt.Printf("%s⚠️  Could not apply %s (is %s still locked?); kept in %s for the next serve%s\n",
+			ColorYellow, plural(left, "queued write"), dataFile, spoolFile, ColorReset)
+		return nil
+	}
+	fmt.Printf("%s✅ Stopped; no queued writes left%s\n", ColorGreen, ColorReset)
+	return nil
+}
+
+// demoTitles are combined into the titles of generated tasks
+var demoTitles = struct {
+	verbs, objects []string
+}{
+	verbs:   []string{"Write", "Review", "Fix", "Plan", "Call", "Email", "Update", "Book", "Pay", "Clean", "Draft", "Test"},
+	objects: []string{"quarterly report", "login bug", "team offsite", "dentist", "landlord", "release notes", "flights", "electricity bill", "garage", "project proposal", "API docs", "backup script"},
+}
+
+// demoProjects, demoTags and demoPeople are drawn from for generated tasks
+var (
+	demoProjects = []string{"work", "home", "garden", "side-project"}
+	demoTags     = []string{"errands", "urgent", "reading", "calls", "weekend", "bugs"}
+	demoPeople   = []string{"Alice", "Bob", "Carol", "Dan"}
+)
+
+// generateFixtures returns count tasks spread across statuses, priorities,
+// projects, tags and dates around now. The same seed and now always give
+// the same tasks, so they suit screenshots and checks that need known data.
+func generateFixtures(seed uint64, count int, now time.Time) []Task {
+	r := mathrand.New(mathrand.NewPCG(seed, seed^0x9e3779b97f4a7c15))
+	day := startOfDay(now)
+	pick := func(values []string) string { return values[r.IntN(len(values))] }
+
+	tasks := make([]Task, 0, count)
+	for id := 1; id <= count; id++ {
+		created := day.AddDate(0, 0, -r.IntN(120)).Add(time.Duration(8*60+r.IntN(10*60)) * time.Minute)
+		if created.After(now) {
+			created = now
+		}
+		task := Task{
+			ID:        id,
+			Title:     pick(demoTitles.verbs) + " " + pick(demoTitles.objects),
+			Status:    "todo",
+			CreatedAt: created.Format(timeLayout),
+			Priority:  Priority(r.IntN(4)),
+		}
+		if r.IntN(3) > 0 {
+			task.Project = pick(demoProjects)
+		}
+		for _, tag := range demoTags {
+			if r.IntN(6) == 0 {
+				task.Tags = append(task.Tags, tag)
+			}
+		}
+		if r.IntN(2) == 0 {
+			task.DueDate = day.AddDate(0, 0, r.IntN(45)-20).Format(dateLayout)
+		}
+		if r.IntN(8) == 0 {
+			task.Recurrence, task.Anchor = pick([]string{"1d", "1w", "2w", "1mo"}), pick([]string{AnchorDue, AnchorDone})
+		}
+
+		switch roll := r.IntN(10); {
+		case roll < 4:
+			// done some time between creation and now
+			span := now.Sub(created)
+			completed := created.Add(time.Duration(r.Int64N(int64(span) + 1)))
+			recordChange(&task, completed, "status", "todo", "done")
+			task.Status, task.CompletedAt = "done", completed.Format(timeLayout)
+		case roll < 6:
+			recordChange(&task, created.Add(time.Hour), "status", "todo", "in-progress")
+			task.Status = "in-progress"
+		case roll == 6:
+			task.Waiting = &WaitingOn{
+				Person: pick(demoPeople),
+				Since:  created.Format(timeLayout),
+				Until:  day.AddDate(0, 0, r.IntN(14)-7).Format(dateLayout),
+			}
+		}
+		if task.Status != "done" && id > 1 && r.IntN(10) == 0 {
+			task.BlockedBy = []int{1 + r.IntN(id-1)}
+		}
+		if task.Status != "done" && r.IntN(15) == 0 {
+			task.Pinned = true
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks
+}
+
+// writeDemo writes count generated tasks to a tasks.json in dir, or in a new
+// temporary directory when dir is empty, and prints where to find them
+func writeDemo(seed uint64, count int, dir string) error {
+	if count <= 0 {
+		return newError(ErrInvalid, "--count must be positive, got %d", count)
+	}
+	if dir == "" {
+		tmp, err := os.MkdirTemp("", "task-tracker-demo-")
+		if err != nil {
+			return wrapError(ErrIO, err, "could not create a demo directory")
+		}
+		dir = tmp
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return wrapError(ErrIO, err, "could not create %s", dir)
+	}
+
+	path := filepath.Join(dir, dataFile)
+	if _, err := os.Stat(path); err == nil {
+		return newError(ErrUsage, "%s already exists; demo only writes to a fresh directory", path)
+	}
+	now := clock.Now()
+	data, err := json.MarshalIndent(generateFixtures(seed, count, now), "", "  ")
+	if err != nil {
+		return wrapError(ErrIO, err, "could not encode demo tasks")
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return wrapError(ErrIO, err, "could not write %s", path)
+	}
+
+	fmt.Printf("%s🎬 Wrote %s (seed %d) to %s%s\n", ColorGreen, plural(count, "demo task"), seed, path, ColorReset)
+	fmt.Printf("   cd %s to try them; set %s=%q to view them as of now on a later day\n", dir, clockEnv, now.Format(timeLayout))
+	return nil
+}
+
+// captureFile collects tasks added by capture. Captures only ever append a
+// line to it, so they need neither the data file lock nor a read of
+// tasks.json; the next other command turns them into tasks.
+var captureFile = defaultCaptureFile
+
+// defaultCaptureFile is the capture file of the default store; other stores
+// keep theirs at <store>.inbox.jsonl
+const defaultCaptureFile = "inbox.jsonl"
+
+// drainingFile holds the captures being turned into tasks. It only exists
+// during a drain, or after one was interrupted, in which case the next
+// drain picks it up again.
+var drainingFile = captureFile + ".draining"
+
+// capturedTask is one line of the capture file. Key becomes the task's
+// idempotency key, so a line drained twice adds one task.
+type capturedTask struct {
+	Title      string `json:"title"`
+	Key        string `json:"key"`
+	CapturedAt string `json:"captured_at"`
+}
+
+// captureTask appends a task to the capture file in a single write. The
+// file may be renamed for draining between opening and writing it, and a
+// line written to the renamed file could be missed by the drain already
+// reading it, so the line is appended again until it lands in the file at
+// captureFile; the drain skips the copies by key.
+func captureTask(title string, quiet bool) error {
+	if strings.TrimSpace(title) == "" {
+		return newError(ErrUsage, "please provide a task description")
+	}
+	capture := capturedTask{
+		Title:      title,
+		Key:        fmt.Sprintf("capture-%016x", mathrand.Uint64()),
+		CapturedAt: clock.Now().Format(timeLayout),
+	}
+	line, err := json.Marshal(capture)
+	if err != nil {
+		return wrapError(ErrIO, err, "could not encode the capture")
+	}
+	line = append(line, '\n')
+
+	for {
+		f, err := os.OpenFile(captureFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if isReadOnlyError(err) {
+			return readOnlyError(captureFile)
+		}
+		if err != nil {
+			return wrapError(ErrIO, err, "could not open %s", captureFile)
+		}
+		_, err = f.Write(line)
+		written, statErr := f.Stat()
+		f.Close()
+		if err != nil || statErr != nil {
+			return wrapError(ErrIO, errors.Join(err, statErr), "could not write %s", captureFile)
+		}
+		if current, err := os.Stat(captureFile); err == nil && os.SameFile(written, current) {
+			break
+		}
+	}
+
+	if !quiet {
+		fmt.Printf("%s📥 Captured: %s%s%s\n", ColorGreen, ColorBright, title, ColorReset)
+	}
+	return nil
+}
+
+// drainCaptures turns captured tasks into real tasks. Captures made while
+// it runs go to a new capture file and are drained next time.
+func drainCaptures(ctx context.Context) error {
+	_, err := os.Stat(drainingFile)
+	interrupted := err == nil
+	if !interrupted {
+		if _, err := os.Stat(captureFile); err != nil {
+			return nil
+		}
+	}
+
+	unlock, err := lockDataFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// a drain interrupted after saving leaves its captures behind; they are
+	// read again, and skipped by key, before taking new ones
+	if _, err := os.Stat(drainingFile); os.IsNotExist(err) {
+		if err := os.Rename(captureFile, drainingFile); os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return wrapError(ErrIO, err, "could not drain %s", captureFile)
+		}
+	}
+	data, err := os.ReadFile(drainingFile)
+	if err != nil {
+		return wrapError(ErrIO, err, "could not read %s", drainingFile)
+	}
+
+	var captures []capturedTask
+	var rejected []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var capture capturedTask
+		if err := json.Unmarshal([]byte(line), &capture); err != nil || capture.Key == "" {
+			rejected = append(rejected, line)
+			continue
+		}
+		captures = append(captures, capture)
+	}
+
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return err
+	}
+	added := 0
+	var warnings []string
+	for _, capture := range captures {
+		at, err := parseTimestamp(capture.CapturedAt)
+		if err != nil {
+			at = clock.Now()
+		}
+		opts := addOptions{Key: capture.Key}
+		task, err := newTaskFromOptions(capture.Title, opts, at)
+		if err != nil {
+			rejected = append(rejected, fmt.Sprintf("%s (%v)", capture.Title, err))
+			continue
+		}
+		var existed bool
+		var more []string
+		if tasks, _, existed, more, err = insertTask(tasks, task, opts, at); err != nil {
+			return err
+		}
+		if !existed {
+			added++
+			warnings = append(warnings, more...)
+		}
+	}
+	if added > 0 {
+		if err := saveTasks(ctx, tasks); err != nil {
+			return err
+		}
+	}
+	if len(rejected) > 0 {
+		// kept for the user to look at rather than dropped
+		f, err := os.OpenFile(captureFile+".rejected", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return wrapError(ErrIO, err, "could not write %s.rejected", captureFile)
+		}
+		f.WriteString(strings.Join(rejected, "\n") + "\n")
+		f.Close()
+	}
+	if err := os.Remove(drainingFile); err != nil {
+		return wrapError(ErrIO, err, "could not remove %s", drainingFile)
+	}
+
+	if added > 0 {
+		fmt.Fprintf(os.Stderr, "%s📥 Imported %s%s\n", ColorCyan, plural(added, "captured task"), ColorReset)
+	}
+	if len(rejected) > 0 {
+		fmt.Fprintf(os.Stderr, "%s⚠️  Skipped %s; see %s.rejected%s\n", ColorYellow, plural(len(rejected), "invalid capture"), captureFile, ColorReset)
+	}
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "%s⚠️  %s%s\n", ColorYellow, warning, ColorReset)
+	}
+	return nil
+}
+
+// stateFile records what background commands have already done, such as the
+// last digest sent, so a restart does not repeat it
+var stateFile = dataFile + ".state"
+
+// trackerState is the content of the state file
+type trackerState struct {
+	DigestSlot  string    `json:"digest_slot,omitempty"`
+	SeenSymbols []string  `json:"seen_symbols,omitempty"` // list symbols legend has explained
+	Holidays    []Holiday `json:"holidays,omitempty"`     // upcoming days off, by date
+}
+
+// loadState reads the state file; a missing file is an empty state
+func loadState() (trackerState, error) {
+	var state trackerState
+	data, err := os.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, wrapError(ErrIO, err, "could not read %s", stateFile)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, wrapError(ErrCorrupt, err, "%s is not a valid state file", stateFile)
+	}
+	return state, nil
+}
+
+// saveState writes the state file atomically
+func saveState(state trackerState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return wrapError(ErrIO, err, "could not encode state")
+	}
+	tmpFile := stateFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		os.Remove(tmpFile)
+		return wrapError(ErrIO, err, "could not write %s", stateFile)
+	}
+	if err := os.Rename(tmpFile, stateFile); err != nil {
+		os.Remove(tmpFile)
+		return wrapError(ErrIO, err, "could not write %s", stateFile)
+	}
+	return nil
+}
+
+// Holiday is a day off loaded by holidays import
+type Holiday struct {
+	Date string `json:"date"` // YYYY-MM-DD
+	Name string `json:"name,omitempty"`
+}
+
+// workCalendar tells working days from days off: weekends and holidays.
+// Everything that counts or skips working days goes through it, so a
+// holiday on a weekend is one day off, not two.
+type workCalendar struct {
+	holidays map[string]string // date → name
+}
+
+var (
+	calendarOnce sync.Once
+	calendar     workCalendar
+)
+
+// workingCalendar returns the calendar with the holidays of the state file,
+// read once per run
+func workingCalendar() workCalendar {
+	calendarOnce.Do(func() {
+		calendar.holidays = map[string]string{}
+		state, err := loadState()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s⚠️  Ignoring holidays: %v%s\n", ColorYellow, err, ColorReset)
+			return
+		}
+		for _, holiday := range state.Holidays {
+			calendar.holidays[holiday.Date] = holiday.Name
+		}
+	})
+	return calendar
+}
+
+// holiday returns the name of the holiday on day, if it is one
+func (c workCalendar) holiday(day time.Time) (string, bool) {
+	name, ok := c.holidays[day.Format(dateLayout)]
+	return name, ok
+}
+
+// isWorkingDay reports whether day is a weekday that is not a holiday
+func (c workCalendar) isWorkingDay(day time.Time) bool {
+	if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+		return false
+	}
+	_, off := c.holiday(day)
+	return !off
+}
+
+// addWorkingDays returns the nth working day after day
+func (c workCalendar) addWorkingDays(day time.Time, n int) time.Time {
+	for n > 0 {
+		day = day.AddDate(0, 0, 1)
+		if c.isWorkingDay(day) {
+			n--
+		}
+	}
+	return day
+}
+
+// workingDaysBetween counts the working days after from up to and including
+// to. Each day is looked at once, so a holiday on a weekend takes nothing
+// more off.
+func (c workCalendar) workingDaysBetween(from, to time.Time) int {
+	count := 0
+	for day := startOfDay(from).AddDate(0, 0, 1); !day.After(to); day = day.AddDate(0, 0, 1) {
+		if c.isWorkingDay(day) {
+			count++
+		}
+	}
+	return count
+}
+
+// pruneHolidays drops holidays before today and sorts the rest by date
+func pruneHolidays(holidays []Holiday, today string) []Holiday {
+	kept := holidays[:0]
+	for _, holiday := range holidays {
+		if holiday.Date >= today {
+			kept = append(kept, holiday)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].Date < kept[j].Date })
+	return kept
+}
+
+// readHolidays reads holidays from an iCalendar file (the all-day events
+// calendar apps export, one holiday per event day) or from a CSV file of
+// date,name rows with an optional header
+func readHolidays(path string) ([]Holiday, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, wrapError(ErrIO, err, "could not read %s", path)
+	}
+	if strings.HasSuffix(strings.ToLower(path), ".ics") || bytes.HasPrefix(bytes.TrimSpace(data), []byte("BEGIN:VCALENDAR")) {
+		return parseICSHolidays(string(data), path)
+	}
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, wrapError(ErrInvalid, err, "%s is not a valid CSV file", path)
+	}
+	var holidays []Holiday
+	for n, row := range rows {
+		if len(row) == 0 || strings.TrimSpace(row[0]) == "" {
+			continue
+		}
+		date, err := parseLayoutDate(row[0])
+		if err != nil {
+			if n == 0 {
+				continue // header
+			}
+			return nil, newError(ErrInvalid, "%s line %d: invalid date %q", path, n+1, row[0])
+		}
+		holiday := Holiday{Date: date.Format(dateLayout)}
+		if len(row) > 1 {
+			holiday.Name = strings.TrimSpace(row[1])
+		}
+		holidays = append(holidays, holiday)
+	}
+	return holidays, nil
+}
+
+// parseICSHolidays reads the days of the VEVENTs of an iCalendar file. An
+// event with a DTEND covers every day up to, not including, that date.
+func parseICSHolidays(text string, path string) ([]Holiday, error) {
+	// long lines are folded onto lines starting with a space or tab
+	text = strings.NewReplacer("\r\n ", "", "\r\n\t", "", "\n ", "", "\n\t", "").Replace(text)
+	unescape := strings.NewReplacer(`\,`, ",", `\;`, ";", `\n`, " ", `\N`, " ", `\\`, `\`)
+	day := func(value string) (time.Time, error) {
+		if len(value) < 8 {
+			return time.Time{}, fmt.Errorf("invalid date %q", value)
+		}
+		return time.ParseInLocation("20060102", value[:8], time.Local)
+	}
+
+	var holidays []Holiday
+	var start, end, summary string
+	inEvent := false
+	for n, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name, _, _ = strings.Cut(strings.ToUpper(name), ";")
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			inEvent, start, end, summary = true, "", "", ""
+		case !inEvent:
+		case name == "DTSTART":
+			start = value
+		case name == "DTEND":
+			end = value
+		case name == "SUMMARY":
+			summary = unescape.Replace(value)
+		case name == "END" && value == "VEVENT":
+			inEvent = false
+			first, err := day(start)
+			if err != nil {
+				return nil, newError(ErrInvalid, "%s line %d: event without a valid DTSTART", path, n+1)
+			}
+			last := first
+			if end != "" {
+				if stop, err := day(end); err == nil && stop.After(first) {
+					last = stop.AddDate(0, 0, -1)
+				}
+			}
+			for d := first; !d.After(last); d = d.AddDate(0, 0, 1) {
+				holidays = append(holidays, Holiday{Date: d.Format(dateLayout), Name: summary})
+			}
+		}
+	}
+	return holidays, nil
+}
+
+// importHolidays adds the holidays of a file to the state file, keeping
+// one holiday per date and skipping those already past
+func importHolidays(path string) error {
+	incoming, err := readHolidays(path)
+	if err != nil {
+		return err
+	}
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+	today := startOfDay(clock.Now()).Format(dateLayout)
+	state.Holidays = pruneHolidays(state.Holidays, today)
+
+	known := map[string]bool{}
+	for _, holiday := range state.Holidays {
+		known[holiday.Date] = true
+	}
+	added, duplicate, past := 0, 0, 0
+	for _, holiday := range incoming {
+		switch {
+		case holiday.Date < today:
+			past++
+		case known[holiday.Date]:
+			duplicate++
+		default:
+			known[holiday.Date] = true
+			state.Holidays = append(state.Holidays, holiday)
+			added++
+		}
+	}
+	state.Holidays = pruneHolidays(state.Holidays, today)
+	if err := saveState(state); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s🏖  Imported %s from %s%s", ColorGreen, plural(added, "holiday"), path, ColorReset)
+	var skipped []string
+	if duplicate > 0 {
+		skipped = append(skipped, plural(duplicate, "date")+" already known")
+	}
+	if past > 0 {
+		skipped = append(skipped, plural(past, "past date"))
+	}
+	if len(skipped) > 0 {
+		fmt.Printf(" %s(skipped %s)%s", ColorDim, strings.Join(skipped, ", "), ColorReset)
+	}
+	fmt.Println()
+	return nil
+}
+
+// listHolidays prints the upcoming holidays, dropping past ones from the
+// state file
+func listHolidays() error {
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+	today := startOfDay(clock.Now()).Format(dateLayout)
+	before := len(state.Holidays)
+	state.Holidays = pruneHolidays(state.Holidays, today)
+	if len(state.Holidays) < before && !readOnly() {
+		if err := saveState(state); err != nil {
+			return err
+		}
+	}
+
+	if len(state.Holidays) == 0 {
+		printEmpty("holidays")
+		return nil
+	}
+	fmt.Printf("%s🏖  %s%s\n", ColorCyan, plural(len(state.Holidays), "upcoming holiday"), ColorReset)
+	for _, holiday := range state.Holidays {
+		day, _ := time.ParseInLocation(dateLayout, holiday.Date, time.Local)
+		weekend := ""
+		if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+			weekend = ColorDim + " (weekend)" + ColorReset
+		}
+		fmt.Printf("  %s %s  %s%s\n", holiday.Date, day.Format("Mon"), holiday.Name, weekend)
+	}
+	return nil
+}
+
+// cronField is the set of values one field of a cron expression allows
+type cronField uint64
+
+// cronSchedule is a parsed five-field cron expression: minute, hour, day of
+// month, month and day of week
+type cronSchedule struct {
+	minute, hour, dom, month, dow cronField
+	// anyDom and anyDow record a day field starting with *, such as * or
+	// */2; when both days are restricted a time matches either, as in cron
+	anyDom, anyDow bool
+}
+
+// parseCronField parses a comma-separated list of *, n, a-b and */n or
+// a-b/n items with values from lo to hi
+func parseCronField(expr string, lo, hi int) (cronField, error) {
+	var field cronField
+	for _, item := range strings.Split(expr, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", item)
+			}
+			step = n
+		}
+
+		start, end := lo, hi
+		if rangePart != "*" {
+			a, b, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if start, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("invalid value %q", item)
+			}
+			end = start
+			if isRange {
+				if end, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("invalid range %q", item)
+				}
+			} else if hasStep {
+				end = hi
+			}
+		}
+		if start < lo || end > hi || start > end {
+			return 0, fmt.Errorf("%q is outside %d-%d", item, lo, hi)
+		}
+		for v := start; v <= end; v += step {
+			field |= 1 << v
+		}
+	}
+	return field, nil
+}
+
+// parseCron parses a cron expression such as "0 9 * * 1-5"; day of week 0
+// and 7 are both Sunday
+func parseCron(expr string) (cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("invalid cron expression %q: want 5 fields (minute hour day month weekday)", expr)
+	}
+	var sched cronSchedule
+	targets := []struct {
+		field  *cronField
+		lo, hi int
+		name   string
+	}{
+		{&sched.minute, 0, 59, "minute"},
+		{&sched.hour, 0, 23, "hour"},
+		{&sched.dom, 1, 31, "day of month"},
+		{&sched.month, 1, 12, "month"},
+		{&sched.dow, 0, 7, "day of week"},
+	}
+	for i, t := range targets {
+		field, err := parseCronField(fields[i], t.lo, t.hi)
+		if err != nil {
+			return cronSchedule{}, fmt.Errorf("invalid cron expression %q: %s: %v", expr, t.name, err)
+		}
+		*t.field = field
+	}
+	if sched.dow&(1<<7) != 0 {
+		sched.dow |= 1
+	}
+	sched.anyDom, sched.anyDow = strings.HasPrefix(fields[2], "*"), strings.HasPrefix(fields[4], "*")
+	return sched, nil
+}
+
+// matches reports whether the minute of t is a scheduled time
+func (c cronSchedule) matches(t time.Time) bool {
+	has := func(field cronField, v int) bool { return field&(1<<v) != 0 }
+	if !has(c.minute, t.Minute()) || !has(c.hour, t.Hour()) || !has(c.month, int(t.Month())) {
+		return false
+	}
+	domOK, dowOK := has(c.dom, t.Day()), has(c.dow, int(t.Weekday()))
+	if c.anyDom || c.anyDow {
+		return domOK && dowOK
+	}
+	return domOK || dowOK
+}
+
+// latest returns the most recent scheduled minute at or before now and no
+// more than window earlier
+func (c cronSchedule) latest(now time.Time, window time.Duration) (time.Time, bool) {
+	t := now.Truncate(time.Minute)
+	for earliest := now.Add(-window); !t.Before(earliest); t = t.Add(-time.Minute) {
+		if c.matches(t) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
 }
 
-// Colors for terminal output
 const (
-	ColorReset  = "\033[0m"
-	ColorBright = "\033[1m"
-	ColorRed    = "\033[31m"
-	ColorGreen  = "\033[32m"
-	ColorYellow = "\033[33m"
-	ColorBlue   = "\033[34m"
-	ColorCyan   = "\033[36m"
-	ColorWhite  = "\033[37m"
+	// digestCatchUp is how late a digest may still be sent for its slot,
+	// e.g. when the daemon was restarted just after the scheduled time
+	digestCatchUp = time.Hour
+	// digestCheckInterval is how often the daemon checks the schedule
+	digestCheckInterval = 30 * time.Second
+	// slotLayout identifies a digest slot in the state file
+	slotLayout = "2006-01-02 15:04"
 )
 
-const dataFile = "tasks.json"
+// webhookEvent is the body of every webhook POST
+type webhookEvent struct {
+	Event  string `json:"event"`
+	SentAt string `json:"sent_at"`
+	Data   any    `json:"data"`
+}
+
+// digestData is the data of a digest event
+type digestData struct {
+	Slot     string `json:"slot,omitempty"`
+	Overdue  []Task `json:"overdue"`
+	DueToday []Task `json:"due_today"`
+}
 
-// loadTasks loads tasks from JSON file
-func loadTasks() []Task {
-	if _, err := os.Stat(dataFile); os.IsNotExist(err) {
-		return []Task{}
+// buildDigest collects the open tasks that are overdue, most overdue first,
+// and those due today
+func buildDigest(tasks []Task, now time.Time) digestData {
+	today := now.Format(dateLayout)
+	sortTasks(tasks, "due", nil)
+	digest := digestData{Overdue: []Task{}, DueToday: []Task{}}
+	for _, task := range tasks {
+		switch {
+		case task.Status == "done" || task.DueDate == "":
+		case task.DueDate < today:
+			digest.Overdue = append(digest.Overdue, task)
+		case task.DueDate == today:
+			digest.DueToday = append(digest.DueToday, task)
+		}
 	}
+	return digest
+}
 
-	data, err := ioutil.ReadFile(dataFile)
+// postWebhook sends event to the configured webhook_url
+func postWebhook(ctx context.Context, event webhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return wrapError(ErrIO, err, "could not encode %s event", event.Event)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return newError(ErrInvalid, "invalid webhook_url %q: %v", config.WebhookURL, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return []Task{}
+		return wrapError(ErrIO, err, "could not post %s event to webhook_url", event.Event)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return newError(ErrIO, "webhook_url answered %s to the %s event", resp.Status, event.Event)
 	}
+	return nil
+}
 
-	var tasks []Task
-	if err := json.Unmarshal(data, &tasks); err != nil {
-		return []Task{}
+// sendDigest posts the digest of overdue and due-today tasks, or prints it
+// with dryRun
+func sendDigest(ctx context.Context, slot string, dryRun bool) (digestData, error) {
+	tasks, err := loadTasks(ctx)
+	if err != nil {
+		return digestData{}, err
 	}
+	now := clock.Now()
+	digest := buildDigest(tasks, now)
+	digest.Slot = slot
+	event := webhookEvent{Event: "digest", SentAt: now.Format(time.RFC3339), Data: digest}
 
-	return tasks
+	if dryRun {
+		data, _ := json.MarshalIndent(event, "", "  ")
+		fmt.Println(string(data))
+		return digest, nil
+	}
+	if config.WebhookURL == "" {
+		return digest, newError(ErrUsage, "set webhook_url in %s to send digests", configFile)
+	}
+	return digest, postWebhook(ctx, event)
 }
 
-// saveTasks saves tasks to JSON file
-func saveTasks(tasks []Task) error {
-	data, err := json.MarshalIndent(tasks, "", "  ")
-	if err != nil {
+// notifyOnce sends the digest now, whatever the schedule
+func notifyOnce(ctx context.Context, dryRun bool) error {
+	digest, err := sendDigest(ctx, "", dryRun)
+	if err != nil || dryRun {
 		return err
 	}
-
-	return ioutil.WriteFile(dataFile, data, 0644)
+	fmt.Printf("%s📨 Sent digest: %d overdue, %d due today%s\n", ColorGreen, len(digest.Overdue), len(digest.DueToday), ColorReset)
+	return nil
 }
 
-// getNextID returns the next available ID
-func getNextID(tasks []Task) int {
-	if len(tasks) == 0 {
-		return 1
+// runDigestDaemon sends the digest once per digest_cron slot until ctx
+// ends. The last slot sent is kept in the state file, so restarting within
+// a slot does not send it twice; a failed send is retried until the slot
+// is more than digestCatchUp old.
+func runDigestDaemon(ctx context.Context) error {
+	if config.DigestCron == "" {
+		return newError(ErrUsage, "set digest_cron in %s, e.g. \"0 9 * * 1-5\"", configFile)
+	}
+	if config.WebhookURL == "" {
+		return newError(ErrUsage, "set webhook_url in %s to send digests", configFile)
+	}
+	sched, err := parseCron(config.DigestCron)
+	if err != nil {
+		return newError(ErrInvalid, "%v", err)
+	}
+	if _, err := loadState(); err != nil {
+		return err
 	}
 
-	maxID := 0
-	for _, task := range tasks {
-		if task.ID > maxID {
-			maxID = task.ID
+	fmt.Printf("%s⏰ Sending digests on %q to webhook_url (Ctrl-C to stop)%s\n", ColorGreen, config.DigestCron, ColorReset)
+	ticker := time.NewTicker(digestCheckInterval)
+	defer ticker.Stop()
+	for {
+		if slot, ok := sched.latest(clock.Now(), digestCatchUp); ok {
+			if err := sendDueDigest(ctx, slot.Format(slotLayout)); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				fmt.Fprintf(os.Stderr, "%s⚠️  %v (retrying)%s\n", ColorYellow, err, ColorReset)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
 		}
 	}
-	return maxID + 1
 }
 
-// addTask adds a new task
-func addTask(title string) {
-	tasks := loadTasks()
-	newTask := Task{
-		ID:        getNextID(tasks),
-		Title:     title,
-		Status:    "todo",
-		CreatedAt: time.Now().Format("2006-01-02 15:04:05"),
+// sendDueDigest sends the digest for slot unless the state file shows it
+// was already sent
+func sendDueDigest(ctx context.Context, slot string) error {
+	state, err := loadState()
+	if err != nil {
+		return err
 	}
-
-	tasks = append(tasks, newTask)
-	saveTasks(tasks)
-
-	fmt.Printf("%s✅ Added task #%d: %s%s%s\n", 
-		ColorGreen, newTask.ID, ColorBright, title, ColorReset)
+	if state.DigestSlot == slot {
+		return nil
+	}
+	digest, err := sendDigest(ctx, slot, false)
+	if err != nil {
+		return err
+	}
+	state.DigestSlot = slot
+	if err := saveState(state); err != nil {
+		return err
+	}
+	fmt.Printf("%s📨 Sent the %s digest: %d overdue, %d due today%s\n", ColorGreen, slot, len(digest.Overdue), len(digest.DueToday), ColorReset)
+	return nil
 }
 
-// listTasks lists all tasks, optionally filtered by status
-func listTasks(statusFilter string) {
-	tasks := loadTasks()
+// runDoctor checks the data file and the files kept beside it, reporting
+// problems and how to fix them
+func runDoctor(ctx context.Context, quiet bool) error {
+	path, err := filepath.Abs(dataFile)
+	if err != nil {
+		path = dataFile
+	}
+	fmt.Printf("%s🩺 Checking %s (%s)%s\n", ColorCyan, path, dataFileSource, ColorReset)
+	ok := func(format string, args ...any) {
+		fmt.Printf("  %s✅ %s%s\n", ColorGreen, fmt.Sprintf(format, args...), ColorReset)
+	}
+	warn := func(format string, args ...any) {
+		fmt.Printf("  %s⚠️  %s%s\n", ColorYellow, fmt.Sprintf(format, args...), ColorReset)
+	}
+	fail := func(format string, args ...any) {
+		fmt.Printf("  %s❌ %s%s\n", ColorRed, fmt.Sprintf(format, args...), ColorReset)
+	}
 
-	if len(tasks) == 0 {
-		fmt.Printf("%s📋 No tasks yet! Add one with: %sgo run task-tracker.go add \"your task\"%s\n",
-			ColorYellow, ColorBright, ColorReset)
-		return
+	var tasks []Task
+	if info, err := os.Stat(dataFile); os.IsNotExist(err) {
+		ok("No %s yet; it is created by the first change", dataFile)
+	} else if err != nil {
+		fail("Cannot read %s: %v", dataFile, err)
+	} else if loaded, err := loadTasks(ctx); err != nil {
+		fail("%v", err)
+	} else {
+		tasks = loaded
+		ok("%s holds %s (%s)", dataFile, plural(len(tasks), "task"), formatSize(info.Size()))
 	}
 
-	// Filter tasks if status specified
-	if statusFilter != "" {
-		var filteredTasks []Task
-		for _, task := range tasks {
-			if task.Status == statusFilter {
-				filteredTasks = append(filteredTasks, task)
+	// the per-task checks run with progress on stderr; what they find is
+	// printed once it is cleared
+	schema := config.Schema
+	checkSchema := len(schema.Required) > 0 || len(schema.Projects) > 0 || len(schema.Tags) > 0
+	var missing, breaking []string
+	attachments, broken := 0, 0
+	progress := newProgressReporter("checking", len(tasks), quiet)
+	for _, task := range tasks {
+		if ctx.Err() != nil {
+			progress.Finish()
+			return canceledError(ctx)
+		}
+		for _, path := range task.Attachments {
+			attachments++
+			if !fileExists(path) {
+				missing = append(missing, fmt.Sprintf("Attachment of task %s is missing: %s", formatID(task.ID), abbreviateHome(path)))
 			}
 		}
-		tasks = filteredTasks
-
-		if len(tasks) == 0 {
-			fmt.Printf("%s📋 No %s tasks found!%s\n", ColorYellow, statusFilter, ColorReset)
-			return
+		if checkSchema {
+			if problems := schemaViolations(task); len(problems) > 0 {
+				broken++
+				breaking = append(breaking, fmt.Sprintf("Task %s breaks the schema: %s", formatID(task.ID), strings.Join(problems, "; ")))
+			}
 		}
-		fmt.Printf("%s📋 Your %s tasks:%s\n", ColorCyan, statusFilter, ColorReset)
-	} else {
-		fmt.Printf("%s📋 Your tasks:%s\n", ColorCyan, ColorReset)
+		progress.Add(1)
 	}
+	progress.Finish()
 
-	// Sort tasks by ID for consistent display
-	sort.Slice(tasks, func(i, j int) bool {
-		return tasks[i].ID < tasks[j].ID
-	})
+	for _, line := range missing {
+		warn("%s", line)
+	}
+	if attachments > 0 && len(missing) == 0 {
+		ok("All %s exist", plural(attachments, "attachment"))
+	}
 
-	for _, task := range tasks {
-		emoji := "❓"
-		statusColor := ColorWhite
+	if checkSchema {
+		for _, line := range breaking {
+			warn("%s", line)
+		}
+		if broken > 0 {
+			warn("Tasks breaking the schema: %d; fix them with maintain --enforce-schema", broken)
+		} else {
+			ok("All open tasks follow the schema")
+		}
+	}
 
-		switch task.Status {
-		case "todo":
-			emoji = "⏳"
-			statusColor = ColorYellow
-		case "in-progress":
-			emoji = "🔄"
-			statusColor = ColorBlue
-		case "done":
-			emoji = "✅"
-			statusColor = ColorGreen
+	if readOnly() {
+		warn("%v; reading commands work, changes exit with code 3", readOnlyError(dataFile))
+	} else {
+		ok("%s is writable", dataFile)
+	}
+
+	lockPath := dataFile + ".lock"
+	if info, err := os.Stat(lockPath); err == nil {
+		owner := "an unknown process"
+		if pid, _ := os.ReadFile(lockPath); len(bytes.TrimSpace(pid)) > 0 {
+			owner = "pid " + string(bytes.TrimSpace(pid))
 		}
+		warn("%s was created by %s at %s; delete it if no command is running",
+			lockPath, owner, info.ModTime().Format(timeLayout))
+	} else {
+		ok("Not locked")
+	}
 
-		fmt.Printf("  %s %s#%d: %s%s%s %s(%s)%s\n",
-			emoji, ColorWhite, task.ID, ColorBright, task.Title, ColorReset,
-			statusColor, task.Status, ColorReset)
+	if data, err := os.ReadFile(spoolFile); err == nil {
+		var pending []apiOperation
+		if err := json.Unmarshal(data, &pending); err != nil {
+			fail("%s is not a valid write spool: %v", spoolFile, err)
+		} else {
+			warn("%s waiting in %s; start serve to apply them", plural(len(pending), "queued write"), spoolFile)
+		}
+	}
+	if _, err := loadState(); err != nil {
+		fail("%v", err)
+	}
+	for _, path := range []string{captureFile, drainingFile} {
+		if data, err := os.ReadFile(path); err == nil {
+			if n := strings.Count(string(data), "\n"); n > 0 {
+				warn("%s waiting in %s; any other command adds them", plural(n, "captured task"), path)
+			}
+		}
 	}
+	if _, err := os.Stat(captureFile + ".rejected"); err == nil {
+		warn("%s.rejected holds captures that could not be added", captureFile)
+	}
+	return nil
+}
+
+// commandHelp is one command's entry in help: the lines it gets under
+// Commands, and the empty states its listings print through printEmpty,
+// by variant ("" unless the message depends on the filters in use). An
+// empty state's suggestion must be a command of this table.
+type commandHelp struct {
+	name  string
+	help  string
+	empty map[string]emptyState
+}
+
+// commandHelps lists the commands in the order help shows them
+var commandHelps = []commandHelp{
+	{name: "add", help: `  add <description>    Add a new task
+      --key <key>      Idempotency key; reuse the task holding it instead of adding
+      --update         With --key, apply the new description and the flags given to the
+                       existing task
+      --quiet          Print only the task ID
+      --due <date>     Due date: YYYY-MM-DD, today, tomorrow, a weekday, +3d or
+                       +3wd (working days, skipping weekends and holidays)
+      --every <n>      Repeat every interval, e.g. 3d, 2w, 1mo or 1y
+      --anchor <mode>  Schedule repeats from the due date (due) or completion (done, default)
+      --project <name> Assign the task to a project
+      --tag <tag>      Attach a tag (repeatable or comma-separated)
+      --strict         Refuse instead of warning when over daily_add_limit
+      --strict-budget  Refuse instead of warning when the project is over its budget
+      --priority <p>   Priority: high/medium/low, A/B/C, 1/2/3 or H/M/L
+`},
+	{name: "done", help: `  done <id>            Mark a task as done, then show how many were done today and
+                       how many are left for its tag or project (see done_summary)
+      --quiet          Print nothing on success
+      --json           Print the completed task and its next occurrence as JSON
+      --reason <text>  Why it is late; stored as a comment tagged late (required past
+                       require_late_reason, and asked for on a terminal)
+      --undo-last      Revert the most recent completion (within undo_window)
+`},
+	{name: "oops", help: `  oops                 Same as done --undo-last
+`},
+	{name: "reopen", help: `  reopen <id>          Move a done task back to todo
+`},
+	{name: "set", help: `  set <id>             Change a task's --title, --priority, --due, --project or --tag,
+                       --pinned[=false] or --blocked-by <ids>
+                       (--priority, --due and --blocked-by accept none to clear)
+      --because <why>  Note why the due date moved; kept in history for report slippage
+`},
+	{name: "wait", help: `  wait <id>            Mark a task as waiting on someone (completing it clears this)
+      --on <person>    Who you are waiting on
+      --until <date>   When to follow up; the task comes back in next after that
+      --clear          Stop waiting
+`},
+	{name: "capture", help: `  capture <description>  Append a task to inbox.jsonl without locking or reading
+                       tasks.json; the next other command adds it with a new ID
+      --quiet          Print nothing on success
+`},
+	{name: "show", help: `  show <id>            Show all details of a task; #<id> references in the title and
+                       comments are highlighted with the referenced task's title
+`},
+	{name: "link", help: `  link --scan          List "#<id>" references in titles and comments that are not
+                       relations yet: "blocks #7" and "blocked by #7" (or "depends
+                       on", "after", "needs") become blocked-by, others links
+      --yes            Add the relations found
+`},
+	{name: "attach", help: `  attach <id> <file>   Attach a local file (stored as an absolute path)
+      --allow-missing  Attach a file that is not on this machine
+`},
+	{name: "attachments open", help: `  attachments open <id> <n>  Open a task's n-th attachment
+`},
+	{name: "list", help: `  list [status]        List all tasks, optionally filter by status
+      --sort <key>     Sort by id (default), priority, due, created or urgency
+      --filter <expr>  Only tasks matching every term, e.g. "tag:work -status:done report"
+                       (status:, tag:, project:, priority:, due-before:, due-after:, words)
+      --waiting        Group waiting tasks by the person they wait on
+                       (on a terminal, these three are remembered per status until changed)
+      --reset-view     Go back to the defaults
+`, empty: map[string]emptyState{
+		"":        {"📋", "yellow", "No tasks yet", `add "your task"`},
+		"status":  {"📋", "yellow", "No %s tasks", "list"},
+		"done":    {"📋", "yellow", "Nothing is done yet", "next"},
+		"filter":  {"📋", "yellow", "No tasks match %s", "list"},
+		"view":    {"📋", "yellow", "No tasks match %s (view: %s)", "list --reset-view"},
+		"waiting": {"⏸ ", "yellow", "No tasks are waiting on anyone", "wait <id> --on <person>"},
+	}},
+	{name: "legend", help: `  legend               Explain each status and the markers list lines can show
+`},
+	{name: "holidays import", help: `  holidays import <file>
+                       Add the days of an .ics calendar or a date,name CSV as holidays
+`},
+	{name: "holidays", help: `  holidays [list]      List upcoming holidays; past ones are dropped. Working days
+                       (+3wd, and those left in show and agenda) skip them
+`, empty: map[string]emptyState{
+		"": {"🏖 ", "yellow", "No upcoming holidays", "holidays import <file.ics>"},
+	}},
+	{name: "next", help: `  next                 Show the most urgent tasks that are not blocked or waiting,
+                       after nudges for overdue follow-ups
+      --count <n>      How many tasks to show (default 5)
+`, empty: map[string]emptyState{
+		"": {"🎉", "green", "Nothing to do next: every open task is done, blocked or waiting", "list --waiting"},
+	}},
+	{name: "search", help: `  search <words>       Find tasks whose title, project, tags or comments contain words
+                       starting with each search word ("data" finds "database")
+`, empty: map[string]emptyState{
+		"": {"🔍", "yellow", "No tasks match %q", "list"},
+	}},
+	{name: "agenda", help: `  agenda               Show overdue tasks (most late first), today's and upcoming ones
+      --days <n>       How many days ahead to include (default 7)
+`, empty: map[string]emptyState{
+		"": {"📆", "green", "Nothing overdue or due in the next %s 🎉", "next"},
+	}},
+	{name: "stats", help: `  stats                Show task counts by status and for this week
+      --json           Print JSON, including how much of each budget is used
+`},
+	{name: "projects", help: `  projects             List projects with their tasks and budget consumption bars
+`, empty: map[string]emptyState{
+		"": {"📁", "yellow", "No projects yet", `add --project <name> "your task"`},
+	}},
+	{name: "track start", help: `  track start <id>     Start tracking time on a task (stops any other timer)
+`},
+	{name: "track stop", help: `  track stop           Stop the timer and warn if its project is over budget
+      --strict-budget  Refuse to stop past the weekly hours budget instead
+`},
+	{name: "report month", help: `  report month [YYYY-MM]      Summarize a month: created, completed, completion rate,
+`},
+	{name: "report quarter", help: `  report quarter [YYYY-Qn]    median time to complete, top tags and projects and the
+`},
+	{name: "report week", help: `  report week [date]          oldest open tasks (default: the current period)
+      --md | --json    Print Markdown or JSON instead of text
+`},
+	{name: "report time", help: `  report time [week|month|quarter] [period]
+                       Heatmap of hours tracked per day (time past midnight counts
+                       toward the next day) and totals per project (--json for JSON)
+`},
+	{name: "report late", help: `  report late          List tasks completed after their due date with the reasons given,
+                       and the average days late per tag and project (--json for JSON)
+`, empty: map[string]emptyState{
+		"": {"📊", "green", "No tasks were completed late 🎉", "report week"},
+	}},
+	{name: "report slippage", help: `  report slippage      List tasks whose due date moved, how often and how many days
+                       later in total, worst first (--json for JSON)
+`, empty: map[string]emptyState{
+		"": {"📊", "green", "No due dates have moved 🎉", "report late"},
+	}},
+	{name: "compact", help: `  compact              Drop detail past the retention limits (dry run)
+      --yes            Rewrite tasks.json, keeping a timestamped backup first
+`},
+	{name: "export json", help: `  export json          Print all tasks as JSON
+      --redact         Replace all free text with placeholders for bug reports
+      --keep-tags      Keep tags and projects readable when redacting
+`},
+	{name: "export review", help: `  export review [file] Print tasks, or those of a JSON file, one sorted block per task
+                       for diffing and editing
+`},
+	{name: "export share", help: `  export share         Write a signed read-only HTML view (needs share_key in config)
+      --filter <expr>  Tasks to include, e.g. "tag:groceries"
+      --out <dir>      Directory for index.html and share.json
+`},
+	{name: "verify-share", help: `  verify-share <dir>   Check a share for tampering and for changes since it was generated
+      --max-age <n>    Also fail when the share is older than n, e.g. 7d
+`},
+	{name: "import json", help: `  import json <file>   Add the tasks from a JSON export
+`},
+	{name: "import review", help: `  import review <file> Replace all tasks with those of a review file, keeping IDs
+                       (--preview counts the changes without writing)
+`},
+	{name: "import csv", help: `  import csv <file>    Add tasks from a CSV file with a header row
+      --map <pairs>    Map task fields to columns, e.g. "Title=Summary,Status=State,DueDate=Deadline"
+                       (fields: Title, Status, DueDate, Project, Tags, Priority, CreatedAt,
+                       IdempotencyKey; without a mapping, columns named like a field are used)
+      --mapping <name> Use a mapping saved under csv_mappings in config
+      --status <pairs> Translate statuses, e.g. "Closed=done,Open=todo"
+      --preview        Show the first 5 tasks as they would be imported, writing nothing
+      --normalize-titles  Trim trailing punctuation and leading emoji, and turn
+                       ALL-CAPS titles into sentence case (for json and csv)
+      --quiet          Suppress progress and summary output
+`},
+	{name: "maintain", help: `  maintain --normalize-titles  Apply the same title rules to existing tasks
+`},
+	{name: "maintain", help: `  maintain --enforce-schema    Ask for the fields open tasks miss for the schema
+                       in config.json, and for allowed values in place of others
+`},
+	{name: "maintain", help: `  maintain --prune-conflicts   Drop conflict records older than retention.conflict_days
+      --dry-run        Show the changes (or the tasks breaking the schema) without writing
+`},
+	{name: "serve", help: `  serve                Serve tasks over HTTP: GET /tasks, GET /tasks/<id>, POST /tasks,
+                       POST /tasks/<id>/done and GET /operations/<op>
+                       GET /tasks takes status, tag, project, priority, due_before,
+                       due_after, q, filter, sort, limit (max 500) and offset
+      --addr <addr>    Address to listen on (default 127.0.0.1:8080)
+                       Writes that find tasks.json locked are answered 202 with an
+                       operation ID and applied in order once it frees
+                       With api_tokens in config.json, requests need a bearer token
+`},
+	{name: "token generate", help: `  token generate <name>
+                       Create an API token for serve and print its secret once
+      --scope <scope>  read (GET only, the default), write (also POST) or admin
+                       (also GET /operations of other tokens)
+      --filter <expr>  Only let the token see and add tasks matching the filter
+`},
+	{name: "notify", help: `  notify               Post a digest of overdue and due-today tasks to webhook_url now
+      --dry-run        Print the digest event instead of sending it
+      --daemon         Keep running and send the digest once per digest_cron slot
+`},
+	{name: "merge", help: `  merge <file>         Merge another copy of tasks.json by ID, keeping the newer side
+                       of each task; never renumbers (see id_allocation)
+      --dry-run        Show the counts without writing
+      --quiet          No progress counter on stderr
+                       Fields changed on the side that is not kept are journaled in
+                       conflicts.jsonl
+`},
+	{name: "conflicts", help: `  conflicts [list]     List the conflicts merge resolved on its own
+`, empty: map[string]emptyState{
+		"": {"⚖️ ", "green", "No merge conflicts recorded", "merge <file>"},
+	}},
+	{name: "conflicts show", help: `  conflicts show <n>   Show both values of a conflict and which one was kept
+`},
+	{name: "conflicts restore", help: `  conflicts restore <n>  Set the field back to the value the merge dropped
+`},
+	{name: "init", help: `  init                 Create an empty task store
+      --local          Create .tasks.json here; commands run in this directory or below
+                       use it instead of tasks.json
+`},
+	{name: "doctor", help: `  doctor               Check the task store in use for corruption, read-only access,
+                       stale locks, unapplied queued writes and missing attachments
+                       (alias: fsck)
+      --quiet          No progress counter on stderr
+`},
+	{name: "help", help: `  help                 Show this help message
+`},
 }
 
 // showHelp displays help information
@@ -157,49 +9312,713 @@ func showHelp() {
 
 Usage: go run task-tracker.go <command> [arguments]
 
+Task IDs (<id>) are %s.
+Any <id> may also be @last (the newest task), @prev (the one before) or @n (the
+n-th newest, e.g. @3), ordered by creation time and then by ID.
+
 Commands:
-  add <description>    Add a new task
-  list [status]        List all tasks, optionally filter by status
-  help                 Show this help message
+`, ColorCyan, ColorReset, idHelp())
+	for _, command := range commandHelps {
+		fmt.Print(command.help)
+	}
+	fmt.Print(`
+Global options:
+  --errors json        Print failures to stderr as a JSON object:
+                       {"code":"not_found","message":"no task with id 99","id":99}
+  --plain              No colors (also when NO_COLOR is set)
+  --theme <name>       Color theme: default, or colorblind (blue and orange instead of
+                       green and red). Statuses are always written out and overdue
+                       tasks marked !, !! or !!! by how late they are, in every theme
+  --file <path>        Use this task store (also TASK_TRACKER_FILE); no .tasks.json search
+  --global             Use tasks.json in the current directory even below a .tasks.json
+  --verbose            Print the task store in use on stderr
+  --quiet              Print nothing when a list or report is empty; for capture, add,
+                       done and import, the same as their own --quiet
+  --context <name>     Warn unless the store in use has this name (global, the directory
+                       of a .tasks.json, or the --file name)
+  --force              Skip the confirm_context guards, e.g. in scripts
+
+Exit codes:
+  0  success
+  1  io          the data file could not be read or written
+  2  usage       invalid command, flag or value ("usage" or "invalid")
+  3  read_only   tasks.json cannot be written; only reading commands work
+  4  not_found   no task with the given ID
+  5  locked      another command is updating the data file
+  6  corrupt     the data file is not valid task data
+  7  limit       refused by daily_add_limit (--strict) or a budget (--strict-budget)
+  8  stale       verify-share found the share out of date
+  9  reason_required  done needs --reason for a task past require_late_reason
+  130 canceled   interrupted with Ctrl-C; the data file was left unchanged
 
 Examples:
   go run task-tracker.go add "Learn Go"
+  go run task-tracker.go add --key deploy-2024-06-11 --quiet "deploy hotfix"
+  go run task-tracker.go add --due 2024-07-01 --every 1mo --anchor due "Pay rent"
+  go run task-tracker.go add --every 3d "Water plants"
+  go run task-tracker.go add --project home --tag errands "Buy stamps"
   go run task-tracker.go list
   go run task-tracker.go list done
-`, ColorCyan, ColorReset)
+  go run task-tracker.go list --sort priority
+  go run task-tracker.go set 3 --priority A
+  go run task-tracker.go set 4 --pinned --blocked-by 3
+  go run task-tracker.go list --sort urgency
+  go run task-tracker.go done 3
+  go run task-tracker.go oops
+  go run task-tracker.go stats
+  go run task-tracker.go export json --redact > tasks-redacted.json
+  go run task-tracker.go export share --filter "tag:groceries" --out share/
+  go run task-tracker.go import csv issues.csv --map "Title=Summary,Status=State" --status "Closed=done" --preview
+
+Configuration (config.json):
+  {"week_start": "sunday"}   First day of the week (monday or sunday)
+  {"daily_add_limit": 5}     Warn when adding more than 5 tasks in one day
+  {"budgets": {"side-hustle": {"open_tasks": 10, "weekly_hours": 5}}}
+                             Warn when a project has more open tasks or tracked hours
+  {"inbox_limit": 10}        Warn when over 10 open tasks have no tags or project
+  {"priority_display": "letter"}  Show priorities as word (high), letter (A) or number (1)
+  {"theme": "colorblind"}    Blue and orange instead of green and red (--theme overrides)
+  {"confirm_context": "work", "confirm_batch": 10}  Name the work store on every change
+                             and ask for its name before importing or merging over 10 tasks
+  {"require_late_reason": "7d"}  Completing a task more than 7 days overdue needs a reason
+  {"undo_window": "10m"}     How long after completing a task oops can revert it
+  {"done_summary": false}    Skip the "That's 4 done today" line after done
+  {"default_sort": "urgency"}  Sort list by urgency unless --sort is given
+  {"id_display": "base36"}   Show and accept short base36 IDs (stored IDs stay integers)
+  {"id_allocation": "actor", "actor_slot": 2}  Take new IDs from this machine's own
+                             block (e.g. 2001-2999) so copies merged later never collide;
+                             without actor_slot the slot is a hash of actor or the host name
+  {"urgency_weights": {"priority": 6, "due": 12, "age": 2, "pinned": 5, "blocked": -5}}
+  {"share_key": "..."}       Secret used to sign export share output
+  {"retention": {"history_days": 180, "time_log_days": 90, "max_comments": 50}}
+                             Detail compact keeps: history, individual tracked
+                             sessions, comments per task (0 keeps all)
+  {"overdue_days": {"late": 3, "very_late": 14}}  Days late before overdue
+                             tasks turn from yellow (!) to red (!!), and to bright red (!!!)
+  {"normalize_titles": true}  Normalize titles on every import
+  {"webhook_url": "https://..."}  Where notify posts events as JSON
+  {"digest_cron": "0 9 * * 1-5"}  When notify --daemon sends digests (minute hour day month weekday)
+  {"serve_queue_limit": 100}  Writes serve queues while tasks.json is locked before answering 503
+  {"date_layouts": ["01/02/2006"]}  Extra Go date layouts accepted for due dates and CSV imports
+  {"csv_mappings": {"jira": {"columns": {"Title": "Summary"}, "status": {"Closed": "done"}}}}
+`)
 }
 
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Printf("%s❌ No command provided%s\n", ColorRed, ColorReset)
+// run dispatches a command and its arguments
+func run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
 		showHelp()
-		os.Exit(1)
+		return newError(ErrUsage, "no command provided")
 	}
 
-	command := os.Args[1]
+	command := args[0]
+	guardContext(command)
 
 	switch command {
+	case "capture", "help", "--help", "init", "demo", "doctor", "fsck":
+	default:
+		// a locked or read-only data file just leaves the captures for later
+		if err := drainCaptures(ctx); err != nil && !errors.Is(err, ErrLocked) && !errors.Is(err, ErrReadOnly) {
+			return err
+		}
+	}
+
+	switch command {
+	case "capture":
+		fs := flag.NewFlagSet("capture", flag.ContinueOnError)
+		quiet := fs.Bool("quiet", globals.Quiet, "print nothing on success")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		return captureTask(strings.Join(rest, " "), *quiet)
+
 	case "add":
-		if len(os.Args) < 3 {
-			fmt.Printf("%s❌ Please provide a task description%s\n", ColorRed, ColorReset)
-			os.Exit(1)
+		var opts addOptions
+		fs := flag.NewFlagSet("add", flag.ContinueOnError)
+		fs.StringVar(&opts.Key, "key", "", "idempotency key identifying this task")
+		fs.BoolVar(&opts.Update, "update", false, "update the task already holding --key")
+		fs.BoolVar(&opts.Quiet, "quiet", globals.Quiet, "print only the task ID")
+		fs.StringVar(&opts.Due, "due", "", "due date")
+		fs.StringVar(&opts.Every, "every", "", "recurrence interval")
+		fs.StringVar(&opts.Anchor, "anchor", "", "recurrence anchor (due or done)")
+		fs.StringVar(&opts.Project, "project", "", "project the task belongs to")
+		fs.Var((*stringList)(&opts.Tags), "tag", "tag to attach (repeatable)")
+		fs.BoolVar(&opts.Strict, "strict", false, "refuse instead of warning when over daily_add_limit")
+		fs.BoolVar(&opts.StrictBudget, "strict-budget", false, "refuse instead of warning when the project is over budget")
+		fs.StringVar(&opts.Priority, "priority", "", "priority (high/medium/low, A/B/C or 1/2/3)")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) == 0 {
+			return newError(ErrUsage, "please provide a task description")
 		}
-		title := strings.Join(os.Args[2:], " ")
-		addTask(title)
+		return addTask(ctx, strings.Join(rest, " "), opts)
 
 	case "list":
-		statusFilter := ""
-		if len(os.Args) > 2 {
-			statusFilter = os.Args[2]
+		fs := flag.NewFlagSet("list", flag.ContinueOnError)
+		opts := listOptions{}
+		fs.StringVar(&opts.Sort, "sort", config.DefaultSort, "sort key")
+		fs.StringVar(&opts.Filter, "filter", "", "filter expression")
+		fs.BoolVar(&opts.Waiting, "waiting", false, "group waiting tasks by person")
+		resetView := fs.Bool("reset-view", false, "forget the remembered sort, filter and grouping")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) > 0 {
+			opts.Status = rest[0]
+		}
+		set := map[string]bool{}
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name != "reset-view" {
+				set[f.Name] = true
+			}
+		})
+		return listWithView(ctx, opts, set, *resetView)
+
+	case "done":
+		fs := flag.NewFlagSet("done", flag.ContinueOnError)
+		undoLast := fs.Bool("undo-last", false, "revert the most recent completion")
+		quiet := fs.Bool("quiet", globals.Quiet, "print nothing on success")
+		asJSON := fs.Bool("json", false, "print the completed task as JSON")
+		reason := fs.String("reason", "", "why the task is done late (stored as a comment)")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if *undoLast {
+			if len(rest) != 0 {
+				return newError(ErrUsage, "--undo-last does not take a task ID")
+			}
+			return undoLastCompletion(ctx)
+		}
+		if len(rest) != 1 {
+			return newError(ErrUsage, "please provide a task ID")
+		}
+		if *quiet && *asJSON {
+			return newError(ErrUsage, "choose one of --quiet and --json")
 		}
-		listTasks(statusFilter)
+		return completeTask(ctx, rest[0], *quiet, *asJSON, strings.TrimSpace(*reason))
+
+	case "oops":
+		return undoLastCompletion(ctx)
+
+	case "reopen":
+		if len(args) != 2 {
+			return newError(ErrUsage, "please provide a task ID")
+		}
+		return reopenTask(ctx, args[1])
+
+	case "set":
+		opts := setOptions{changed: map[string]bool{}}
+		fs := flag.NewFlagSet("set", flag.ContinueOnError)
+		fs.StringVar(&opts.Title, "title", "", "new title")
+		fs.StringVar(&opts.Priority, "priority", "", "new priority")
+		fs.StringVar(&opts.Due, "due", "", "new due date")
+		fs.StringVar(&opts.Project, "project", "", "new project")
+		fs.Var((*stringList)(&opts.Tags), "tag", "replacement tags (repeatable)")
+		fs.BoolVar(&opts.Pinned, "pinned", false, "pin the task (--pinned=false unpins)")
+		fs.Var((*stringList)(&opts.BlockedBy), "blocked-by", "IDs of tasks blocking this one")
+		fs.StringVar(&opts.Because, "because", "", "why the due date changes")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) != 1 {
+			return newError(ErrUsage, "please provide a task ID")
+		}
+		fs.Visit(func(f *flag.Flag) { opts.changed[f.Name] = true })
+		return setTask(ctx, rest[0], opts)
+
+	case "attach":
+		fs := flag.NewFlagSet("attach", flag.ContinueOnError)
+		allowMissing := fs.Bool("allow-missing", false, "attach a file that does not exist on this machine")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) != 2 {
+			return newError(ErrUsage, "usage: attach <id> <file> [--allow-missing]")
+		}
+		return attachFile(ctx, rest[0], rest[1], *allowMissing)
+
+	case "attachments":
+		if len(args) != 4 || args[1] != "open" {
+			return newError(ErrUsage, "usage: attachments open <id> <n>")
+		}
+		return openAttachment(ctx, args[2], args[3])
+
+	case "holidays":
+		switch {
+		case len(args) == 3 && args[1] == "import":
+			return importHolidays(args[2])
+		case len(args) == 1 || len(args) == 2 && args[1] == "list":
+			return listHolidays()
+		}
+		return newError(ErrUsage, "usage: holidays import <file.ics|file.csv> | holidays list")
+
+	case "link":
+		fs := flag.NewFlagSet("link", flag.ContinueOnError)
+		scan := fs.Bool("scan", false, "turn #<id> references into relations")
+		yes := fs.Bool("yes", false, "add the relations found")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if !*scan || len(rest) != 0 {
+			return newError(ErrUsage, "usage: link --scan [--yes]")
+		}
+		return scanLinks(ctx, *yes)
+
+	case "show":
+		if len(args) != 2 {
+			return newError(ErrUsage, "please provide a task ID")
+		}
+		return showTask(ctx, args[1])
+
+	case "search":
+		if len(args) < 2 {
+			return newError(ErrUsage, "please provide words to search for")
+		}
+		return searchTasks(ctx, strings.Join(args[1:], " "))
+
+	case "wait":
+		fs := flag.NewFlagSet("wait", flag.ContinueOnError)
+		person := fs.String("on", "", "who the task is waiting on")
+		until := fs.String("until", "", "follow-up date")
+		clearWait := fs.Bool("clear", false, "stop waiting")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) != 1 {
+			return newError(ErrUsage, "please provide a task ID")
+		}
+		if *clearWait == (*person != "") {
+			return newError(ErrUsage, "please provide either --on <person> or --clear")
+		}
+		return waitTask(ctx, rest[0], *person, *until)
+
+	case "next":
+		fs := flag.NewFlagSet("next", flag.ContinueOnError)
+		count := fs.Int("count", 5, "how many tasks to show")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) != 0 {
+			return newError(ErrUsage, "next does not take arguments")
+		}
+		return showNext(ctx, *count)
+
+	case "agenda":
+		fs := flag.NewFlagSet("agenda", flag.ContinueOnError)
+		days := fs.Int("days", 7, "how many days ahead to show")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) != 0 {
+			return newError(ErrUsage, "agenda does not take arguments")
+		}
+		return showAgenda(ctx, *days)
+
+	case "stats":
+		fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+		asJSON := fs.Bool("json", false, "print JSON, including budget utilization")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) != 0 {
+			return newError(ErrUsage, "stats does not take arguments")
+		}
+		return showStats(ctx, *asJSON)
+
+	case "projects":
+		if len(args) != 1 {
+			return newError(ErrUsage, "projects does not take arguments")
+		}
+		return showProjects(ctx)
+
+	case "track":
+		fs := flag.NewFlagSet("track", flag.ContinueOnError)
+		strictBudget := fs.Bool("strict-budget", false, "refuse to stop when the project goes over its weekly hours")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(rest) == 2 && rest[0] == "start":
+			return startTimer(ctx, rest[1])
+		case len(rest) == 1 && rest[0] == "stop":
+			return stopTimer(ctx, *strictBudget)
+		}
+		return newError(ErrUsage, "usage: track start <id> | track stop [--strict-budget]")
+
+	case "serve":
+		fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+		addr := fs.String("addr", "127.0.0.1:8080", "address to listen on")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) != 0 {
+			return newError(ErrUsage, "serve does not take arguments")
+		}
+		return serveTasks(ctx, *addr)
+
+	case "token":
+		fs := flag.NewFlagSet("token", flag.ContinueOnError)
+		scope := fs.String("scope", "read", "what the token may do: read, write or admin")
+		filter := fs.String("filter", "", "only let the token see and add tasks matching this filter")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) != 2 || rest[0] != "generate" {
+			return newError(ErrUsage, "usage: token generate <name> [--scope read|write|admin] [--filter <expr>]")
+		}
+		return generateToken(rest[1], *scope, *filter)
+
+	case "merge":
+		fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+		dryRun := fs.Bool("dry-run", false, "show what would change without writing")
+		quiet := fs.Bool("quiet", globals.Quiet, "suppress progress output")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) != 1 {
+			return newError(ErrUsage, "usage: merge <tasks.json from another machine> [--dry-run] [--quiet]")
+		}
+		return mergeTasks(ctx, rest[0], *dryRun, *quiet)
+
+	case "conflicts":
+		switch {
+		case len(args) == 1 || len(args) == 2 && args[1] == "list":
+			return listConflicts()
+		case len(args) == 3 && args[1] == "show":
+			return showConflict(args[2])
+		case len(args) == 3 && args[1] == "restore":
+			return restoreConflict(ctx, args[2])
+		}
+		return newError(ErrUsage, "usage: conflicts [list] | conflicts show <n> | conflicts restore <n>")
+
+	case "doctor", "fsck":
+		fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+		quiet := fs.Bool("quiet", globals.Quiet, "suppress progress output")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) != 0 {
+			return newError(ErrUsage, "%s does not take arguments", args[0])
+		}
+		return runDoctor(ctx, *quiet)
+
+	case "notify":
+		fs := flag.NewFlagSet("notify", flag.ContinueOnError)
+		daemon := fs.Bool("daemon", false, "keep running and send digests on digest_cron")
+		dryRun := fs.Bool("dry-run", false, "print the digest instead of sending it")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) != 0 {
+			return newError(ErrUsage, "notify does not take arguments")
+		}
+		if *daemon {
+			if *dryRun {
+				return newError(ErrUsage, "--dry-run cannot be combined with --daemon")
+			}
+			return runDigestDaemon(ctx)
+		}
+		return notifyOnce(ctx, *dryRun)
+
+	case "legend":
+		if len(args) != 1 {
+			return newError(ErrUsage, "legend does not take arguments")
+		}
+		showLegend()
+		return nil
+
+	case "init":
+		fs := flag.NewFlagSet("init", flag.ContinueOnError)
+		local := fs.Bool("local", false, "create .tasks.json in the current directory")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) != 0 {
+			return newError(ErrUsage, "init does not take arguments")
+		}
+		return initDataFile(*local)
+
+	case "demo":
+		// not listed in help: generates throwaway data for screenshots and manual testing
+		fs := flag.NewFlagSet("demo", flag.ContinueOnError)
+		seed := fs.Uint64("seed", 1, "seed for the generated tasks")
+		count := fs.Int("count", 40, "number of tasks to generate")
+		dir := fs.String("dir", "", "directory for tasks.json (default: a new temporary directory)")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) != 0 {
+			return newError(ErrUsage, "demo does not take arguments")
+		}
+		return writeDemo(*seed, *count, *dir)
+
+	case "report":
+		fs := flag.NewFlagSet("report", flag.ContinueOnError)
+		markdown := fs.Bool("md", false, "print Markdown")
+		asJSON := fs.Bool("json", false, "print JSON")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) == 1 && rest[0] == "late" {
+			if *markdown {
+				return newError(ErrUsage, "report late prints text or --json")
+			}
+			return showLateReport(ctx, *asJSON)
+		}
+		if len(rest) == 1 && rest[0] == "slippage" {
+			if *markdown {
+				return newError(ErrUsage, "report slippage prints text or --json")
+			}
+			return showSlippageReport(ctx, *asJSON)
+		}
+		if len(rest) >= 1 && rest[0] == "time" {
+			if *markdown || len(rest) > 3 {
+				return newError(ErrUsage, "usage: report time [week|month|quarter] [period] [--json]")
+			}
+			kind, value := "week", ""
+			if len(rest) > 1 {
+				kind = rest[1]
+			}
+			if len(rest) > 2 {
+				value = rest[2]
+			}
+			return showTimeReport(ctx, kind, value, *asJSON)
+		}
+		if len(rest) < 1 || len(rest) > 2 {
+			return newError(ErrUsage, "usage: report week|month|quarter [period] [--md|--json], or report late|slippage [--json]")
+		}
+		if *markdown && *asJSON {
+			return newError(ErrUsage, "choose one of --md and --json")
+		}
+		format := "text"
+		if *markdown {
+			format = "md"
+		} else if *asJSON {
+			format = "json"
+		}
+		value := ""
+		if len(rest) == 2 {
+			value = rest[1]
+		}
+		return showReport(ctx, rest[0], value, format)
+
+	case "compact":
+		fs := flag.NewFlagSet("compact", flag.ContinueOnError)
+		yes := fs.Bool("yes", false, "rewrite the data file")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) != 0 {
+			return newError(ErrUsage, "compact does not take arguments")
+		}
+		return compactTasks(ctx, *yes)
+
+	case "import":
+		fs := flag.NewFlagSet("import", flag.ContinueOnError)
+		quiet := fs.Bool("quiet", globals.Quiet, "suppress progress and summary output")
+		preview := fs.Bool("preview", false, "show the first tasks without importing")
+		columns := fs.String("map", "", "CSV column mapping, e.g. Title=Summary,DueDate=Deadline")
+		mappingName := fs.String("mapping", "", "named CSV mapping from config")
+		statuses := fs.String("status", "", "CSV status translations, e.g. Closed=done")
+		normalize := fs.Bool("normalize-titles", config.NormalizeTitles, "clean up imported titles")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if readOnly() && !*preview {
+			// refuse before reading what could be a large input file
+			return readOnlyError(dataFile)
+		}
+		if len(rest) != 2 {
+			return newError(ErrUsage, "usage: import json|csv|review <file>")
+		}
+		if rest[0] == "review" {
+			// a review file is the whole task list, restored as written
+			incoming, err := readReviewTasks(rest[1])
+			if err != nil {
+				return err
+			}
+			if !*preview {
+				if err := checkImportSchema(incoming, rest[1]); err != nil {
+					return err
+				}
+				if err := confirmBatch(len(incoming)); err != nil {
+					return err
+				}
+			}
+			return restoreReview(ctx, rest[1], incoming, *preview)
+		}
+
+		var incoming []Task
+		switch rest[0] {
+		case "json":
+			incoming, err = readJSONTasks(rest[1])
+		case "csv":
+			mapping, mapErr := buildCSVMapping(*mappingName, *columns, *statuses)
+			if mapErr != nil {
+				return mapErr
+			}
+			incoming, err = readCSVTasks(rest[1], mapping)
+		default:
+			return newError(ErrUsage, "unknown import format: %s (supported: json, csv, review)", rest[0])
+		}
+		if err != nil {
+			return err
+		}
+		if *normalize {
+			now := clock.Now()
+			for i := range incoming {
+				normalizeTaskTitle(&incoming[i], now)
+			}
+		}
+		if *preview {
+			return previewImport(ctx, incoming)
+		}
+		if err := checkImportSchema(incoming, rest[1]); err != nil {
+			return err
+		}
+		if err := confirmBatch(len(incoming)); err != nil {
+			return err
+		}
+		return importTasks(ctx, rest[1], incoming, *quiet)
+
+	case "maintain":
+		fs := flag.NewFlagSet("maintain", flag.ContinueOnError)
+		normalize := fs.Bool("normalize-titles", false, "clean up existing titles")
+		enforce := fs.Bool("enforce-schema", false, "fill in what tasks miss for the schema")
+		prune := fs.Bool("prune-conflicts", false, "drop conflict records past retention.conflict_days")
+		dryRun := fs.Bool("dry-run", false, "show changes without writing")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) != 0 {
+			return newError(ErrUsage, "maintain does not take arguments")
+		}
+		if *enforce && *normalize || *prune && (*enforce || *normalize) {
+			return newError(ErrUsage, "run --normalize-titles, --enforce-schema and --prune-conflicts separately")
+		}
+		if *prune {
+			return pruneConflicts(*dryRun)
+		}
+		if *enforce {
+			return enforceSchema(ctx, *dryRun)
+		}
+		return maintainTasks(ctx, *normalize, *dryRun)
+
+	case "export":
+		fs := flag.NewFlagSet("export", flag.ContinueOnError)
+		redact := fs.Bool("redact", false, "replace free text with placeholders")
+		keepTags := fs.Bool("keep-tags", false, "keep tags and projects when redacting")
+		filterExpr := fs.String("filter", "", "filter expression for share")
+		out := fs.String("out", "", "output directory for share")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) == 2 && rest[0] == "review" {
+			return exportReview(ctx, rest[1])
+		}
+		if len(rest) != 1 {
+			return newError(ErrUsage, "please provide an export format (json, review or share)")
+		}
+		if rest[0] == "review" {
+			return exportReview(ctx, "")
+		}
+		if rest[0] == "share" {
+			return exportShare(ctx, *filterExpr, *out)
+		}
+		return exportTasks(ctx, rest[0], *redact, *keepTags)
+
+	case "verify-share":
+		fs := flag.NewFlagSet("verify-share", flag.ContinueOnError)
+		maxAge := fs.String("max-age", "", "fail if the share is older than this, e.g. 7d")
+		rest, err := parseFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(rest) != 1 {
+			return newError(ErrUsage, "please provide the share directory")
+		}
+		return verifyShare(ctx, rest[0], *maxAge)
 
 	case "help", "--help":
 		showHelp()
+		return nil
 
 	default:
-		fmt.Printf("%s❌ Unknown command: %s%s\n", ColorRed, command, ColorReset)
 		showHelp()
-		os.Exit(1)
+		return newError(ErrUsage, "unknown command: %s", command)
+	}
+}
+
+func main() {
+	// Ctrl-C cancels long operations such as imports and compaction before
+	// anything is written; a second Ctrl-C exits immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if err := start(ctx, os.Args[1:]); err != nil {
+		reportError(err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// start sets up a run from the command line and runs the command. The
+// config and theme are loaded here, before any command, since nearly every
+// command and all output depend on them; the data file is read only when a
+// command first loads its tasks.
+func start(ctx context.Context, argv []string) error {
+	args, err := parseGlobalFlags(argv)
+	if os.Getenv("NO_COLOR") != "" {
+		globals.Plain = true
+	}
+	if globals.Plain {
+		disableColors()
+	}
+	if err == nil {
+		clock, err = clockFromEnv()
+	}
+	if err == nil {
+		err = resolveDataFile()
+	}
+	if err == nil {
+		config = loadConfig()
+		if !globals.Plain {
+			theme := config.Theme
+			if globals.Theme != "" {
+				theme = globals.Theme
+			}
+			if apply, ok := themes[theme]; ok {
+				apply()
+			}
+		}
+		err = run(ctx, args)
 	}
+	return err
 }
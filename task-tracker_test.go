@@ -0,0 +1,3717 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testNow is the time every test runs at, a Wednesday morning
+var testNow = time.Date(2026, 6, 10, 9, 30, 0, 0, time.Local)
+
+// useTestStore makes a fresh tasks.json holding tasks, in a temporary
+// directory that is the working directory for the rest of the test, and
+// resets everything a previous command may have left behind
+func useTestStore(t *testing.T, tasks []Task) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+
+	colors := []*string{&ColorReset, &ColorBright, &ColorDim, &ColorRed, &ColorGreen, &ColorYellow, &ColorBlue, &ColorCyan, &ColorWhite}
+	saved := make([]string, len(colors))
+	for i, color := range colors {
+		saved[i] = *color
+	}
+	t.Cleanup(func() {
+		for i, color := range colors {
+			*color = saved[i]
+		}
+	})
+	disableColors()
+
+	config = defaultConfig()
+	clock = fixedClock(testNow)
+	globals = globalOptions{ErrorFormat: "text", Plain: true}
+	useDataFile(defaultDataFile, "default")
+	dataFileCache.data, dataFileCache.stamp = nil, fileStamp{}
+	readOnlyBanner = sync.Once{}
+	calendarOnce = sync.Once{}
+	invalidateSearchIndex()
+
+	if tasks != nil {
+		if err := saveTasks(context.Background(), tasks); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// runCommand runs a command line the way main does after parsing the
+// global flags and returns what it printed
+func runCommand(t *testing.T, args ...string) (string, string, error) {
+	t.Helper()
+	return captureOutput(t, func() error { return run(context.Background(), args) })
+}
+
+// captureOutput returns what fn writes to stdout and stderr
+func captureOutput(t *testing.T, fn func() error) (string, string, error) {
+	t.Helper()
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = outW, errW
+
+	read := func(r *os.File, into *bytes.Buffer, done chan<- struct{}) {
+		io.Copy(into, r)
+		r.Close()
+		close(done)
+	}
+	var outBuf, errBuf bytes.Buffer
+	outDone, errDone := make(chan struct{}), make(chan struct{})
+	go read(outR, &outBuf, outDone)
+	go read(errR, &errBuf, errDone)
+
+	runErr := fn()
+	os.Stdout, os.Stderr = stdout, stderr
+	outW.Close()
+	errW.Close()
+	<-outDone
+	<-errDone
+	return outBuf.String(), errBuf.String(), runErr
+}
+
+// readStore returns the tasks saved in the test store
+func readStore(t *testing.T) []Task {
+	t.Helper()
+	tasks, err := loadTasks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tasks
+}
+
+// roundTripFixtures returns generated tasks with every kind of field set
+// somewhere, including text that is hard to keep intact
+func roundTripFixtures(seed uint64) []Task {
+	tasks := generateFixtures(seed, 40, testNow)
+	texts := []string{
+		"Prüfung für Zoë — naïve café ✅",
+		"line one\nline two\n\tindented = \"quoted\"",
+		"[task 3] looks like a header\n# and a comment",
+		"<b>html</b> & \\backslashes\\ and \r\n windows endings",
+		"日本語のタイトル 🎉",
+	}
+	for i := range tasks {
+		task := &tasks[i]
+		if i%3 == 0 {
+			task.Title = texts[i%len(texts)]
+		}
+		if i%4 == 0 {
+			task.Comments = append(task.Comments, Comment{At: task.CreatedAt, Text: texts[(i+1)%len(texts)], Tags: []string{lateTag}})
+		}
+		if i%5 == 0 {
+			task.TimeLog = append(task.TimeLog, TimeEntry{Start: task.CreatedAt, End: testNow.Format(timeLayout)})
+			task.Attachments = append(task.Attachments, "/home/user/notes/ü file.txt")
+		}
+		if i%6 == 0 && i > 0 {
+			task.Links = []int{tasks[i-1].ID}
+			recordChange(task, testNow, "title", "old "+texts[i%len(texts)], task.Title)
+			task.History[len(task.History)-1].Note = "renamed"
+		}
+	}
+	return tasks
+}
+
+// TestJSONRoundTrip checks that export json, import json into an empty
+// store and export json again give the same bytes
+func TestJSONRoundTrip(t *testing.T) {
+	for seed := uint64(1); seed <= 5; seed++ {
+		useTestStore(t, roundTripFixtures(seed))
+		first, _, err := runCommand(t, "export", "json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		exported := filepath.Join(t.TempDir(), "export.json")
+		if err := os.WriteFile(exported, []byte(first), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		useTestStore(t, nil)
+		if _, _, err := runCommand(t, "import", "json", exported, "--quiet"); err != nil {
+			t.Fatal(err)
+		}
+		second, _, err := runCommand(t, "export", "json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first != second {
+			t.Fatalf("seed %d: export json changed after import:\n%s", seed, firstDifference(first, second))
+		}
+	}
+}
+
+// TestReviewRoundTrip checks that export review, import review and export
+// review again give the same bytes and the same tasks
+func TestReviewRoundTrip(t *testing.T) {
+	for seed := uint64(1); seed <= 5; seed++ {
+		fixtures := roundTripFixtures(seed)
+		useTestStore(t, fixtures)
+		first, _, err := runCommand(t, "export", "review")
+		if err != nil {
+			t.Fatal(err)
+		}
+		exported := filepath.Join(t.TempDir(), "tasks.review")
+		if err := os.WriteFile(exported, []byte(first), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		useTestStore(t, nil)
+		if _, _, err := runCommand(t, "import", "review", exported); err != nil {
+			t.Fatal(err)
+		}
+		if tasks := readStore(t); !reflect.DeepEqual(tasks, fixtures) {
+			t.Fatalf("seed %d: import review changed the tasks", seed)
+		}
+		second, _, err := runCommand(t, "export", "review")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first != second {
+			t.Fatalf("seed %d: export review changed after import:\n%s", seed, firstDifference(first, second))
+		}
+	}
+}
+
+// firstDifference shows the first line where two outputs differ
+func firstDifference(a, b string) string {
+	aLines, bLines := strings.Split(a, "\n"), strings.Split(b, "\n")
+	for i := 0; i < len(aLines) && i < len(bLines); i++ {
+		if aLines[i] != bLines[i] {
+			return fmt.Sprintf("line %d:\n- %s\n+ %s", i+1, aLines[i], bLines[i])
+		}
+	}
+	return "one output is a prefix of the other"
+}
+
+// FuzzParseDate checks that parseDate never panics or hangs, and that a
+// date it accepts is a real calendar date: written as YYYY-MM-DD it parses
+// back to itself
+func FuzzParseDate(f *testing.F) {
+	for _, seed := range []string{"today", "tomorrow", "fri", "Monday", "+3d", "+2w", "+1mo", "+1y", "+3wd", "2026-02-29", "2024-02-29", "+0d", "-3d", "+wd"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		date, err := parseDate(value, testNow)
+		if err != nil {
+			if !date.IsZero() {
+				t.Fatalf("parseDate(%q) returned %v with error %v", value, date, err)
+			}
+			return
+		}
+		formatted := date.Format(dateLayout)
+		again, err := parseDate(formatted, testNow)
+		if err != nil || !again.Equal(date) {
+			t.Fatalf("parseDate(%q) = %s, which does not parse back (%v, %v)", value, formatted, again, err)
+		}
+	})
+}
+
+// FuzzParseInterval checks that an accepted interval is written back the
+// way it parses and moves a date by at most a century
+func FuzzParseInterval(f *testing.F) {
+	for _, seed := range []string{"1d", "3d", "2w", "1mo", "12mo", "1y", "100y", "0d", "-1w", "mo", "1m", "36600d"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		iv, err := parseInterval(value)
+		if err != nil {
+			if iv != (interval{}) {
+				t.Fatalf("parseInterval(%q) returned %v with error %v", value, iv, err)
+			}
+			return
+		}
+		if iv.count <= 0 || unitDays[iv.unit] == 0 {
+			t.Fatalf("parseInterval(%q) = %#v", value, iv)
+		}
+		again, err := parseInterval(iv.String())
+		if err != nil || again != iv {
+			t.Fatalf("parseInterval(%q) = %s, which parses back as %v (%v)", value, iv, again, err)
+		}
+		if moved := iv.addTo(testNow); moved.Year() > testNow.Year()+101 || !moved.After(testNow) {
+			t.Fatalf("%s moves %s to %s", iv, testNow.Format(dateLayout), moved.Format(dateLayout))
+		}
+	})
+}
+
+// FuzzParseFilter checks that parseFilter never panics, returns no filter
+// with an error, and gives terms that can be matched against any task
+func FuzzParseFilter(f *testing.F) {
+	for _, seed := range []string{"", "tag:work", "-status:done project:home", "priority:A due-before:+3d", "due-after:2026-01-01 report", "status:", "foo:bar", "-", "--tag:x", "priority:(b)"} {
+		f.Add(seed)
+	}
+	task := Task{ID: 1, Title: "Write report", Status: "todo", Project: "work", Tags: []string{"urgent"}, Priority: PriorityHigh, DueDate: "2026-06-12"}
+	f.Fuzz(func(t *testing.T, expr string) {
+		filter, err := parseFilter(expr, testNow)
+		if err != nil {
+			if filter != nil {
+				t.Fatalf("parseFilter(%q) returned %v with error %v", expr, filter, err)
+			}
+			return
+		}
+		for _, term := range filter {
+			switch term.field {
+			case "text", "status", "tag", "project", "priority":
+			case "due-before", "due-after":
+				if _, err := time.Parse(dateLayout, term.value); err != nil {
+					t.Fatalf("parseFilter(%q) compares due dates with %q", expr, term.value)
+				}
+			default:
+				t.Fatalf("parseFilter(%q) accepted field %q", expr, term.field)
+			}
+		}
+		filter.matches(task)
+	})
+}
+
+// secretTask is a task with "secret" in every piece of free text it has
+func secretTask() Task {
+	return Task{
+		ID:             7,
+		Title:          "secret title with https://secret.example.com/path",
+		Status:         "done",
+		CreatedAt:      "2026-05-01 08:00:00",
+		IdempotencyKey: "secret-key",
+		DueDate:        "2026-05-20",
+		CompletedAt:    "2026-06-01 17:00:00",
+		Recurrence:     "1w",
+		Anchor:         AnchorDue,
+		RecurDay:       20,
+		Project:        "secret-project",
+		Tags:           []string{"secret-tag", "other secret"},
+		Priority:       PriorityHigh,
+		RecurFrom:      3,
+		Pinned:         true,
+		BlockedBy:      []int{2},
+		Links:          []int{3, 4},
+		Waiting:        &WaitingOn{Person: "Secret Person", Since: "2026-05-02 09:00:00", Until: "2026-05-09"},
+		Attachments:    []string{"/home/secretuser/secret-plans.pdf"},
+		Comments:       []Comment{{At: "2026-06-01 17:00:00", Text: "secret reason, see https://secret.example.com", Tags: []string{lateTag}}},
+		TimeLog:        []TimeEntry{{Start: "2026-05-03 09:00:00", End: "2026-05-03 10:00:00"}},
+		History: []HistoryEvent{
+			{At: "2026-05-02 09:00:00", Field: "title", From: "old secret title", To: "secret title"},
+			{At: "2026-05-02 09:00:00", Field: "due", From: "2026-05-13", To: "2026-05-20", Note: "secret because"},
+			{At: "2026-05-02 09:00:00", Field: "waiting", To: "Secret Person until 2026-05-09"},
+			{At: "2026-06-01 17:00:00", Field: "status", From: "todo", To: "done"},
+			{At: "2026-06-02 08:00:00", Field: compactedField, Note: "3 older changes removed"},
+			{At: "2026-06-02 08:00:00", Field: "attachments", To: "/home/secretuser/secret-plans.pdf"},
+		},
+	}
+}
+
+// TestRedactTask checks that a redacted task keeps its structure and none
+// of its text
+func TestRedactTask(t *testing.T) {
+	task := secretTask()
+	key := []byte("one export")
+	redacted := redactTask(task, key, false)
+	data, err := json.Marshal(redacted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(strings.ToLower(string(data)), "secret") {
+		t.Fatalf("redacted task still holds free text: %s", data)
+	}
+
+	kept := []struct {
+		name      string
+		got, want any
+	}{
+		{"id", redacted.ID, task.ID},
+		{"status", redacted.Status, task.Status},
+		{"created_at", redacted.CreatedAt, task.CreatedAt},
+		{"due_date", redacted.DueDate, task.DueDate},
+		{"completed_at", redacted.CompletedAt, task.CompletedAt},
+		{"recurrence", redacted.Recurrence, task.Recurrence},
+		{"priority", redacted.Priority, task.Priority},
+		{"blocked_by", redacted.BlockedBy, task.BlockedBy},
+		{"links", redacted.Links, task.Links},
+		{"time_log", redacted.TimeLog, task.TimeLog},
+		{"title length", len(redacted.Title), len(task.Title)},
+		{"key length", len(redacted.IdempotencyKey), len(task.IdempotencyKey)},
+		{"tag count", len(redacted.Tags), len(task.Tags)},
+		{"history length", len(redacted.History), len(task.History)},
+		{"status change", redacted.History[3], task.History[3]},
+		{"due change", redacted.History[1].To, task.History[1].To},
+		{"compaction marker", redacted.History[4], task.History[4]},
+		{"comment count", len(redacted.Comments), len(task.Comments)},
+		{"comment time", redacted.Comments[0].At, task.Comments[0].At},
+		{"late tag", redacted.Comments[0].Tags, task.Comments[0].Tags},
+		{"comment length", len(redacted.Comments[0].Text), len(task.Comments[0].Text)},
+		{"waiting since", redacted.Waiting.Since, task.Waiting.Since},
+		{"waiting until", redacted.Waiting.Until, task.Waiting.Until},
+		{"person length", len(redacted.Waiting.Person), len(task.Waiting.Person)},
+		{"waiting change", redacted.History[2].Field, "waiting"},
+		{"attachment count", len(redacted.Attachments), len(task.Attachments)},
+	}
+	for _, field := range kept {
+		if !reflect.DeepEqual(field.got, field.want) {
+			t.Errorf("%s: got %v, want %v", field.name, field.got, field.want)
+		}
+	}
+
+	if again := redactTask(task, key, false); !reflect.DeepEqual(again, redacted) {
+		t.Errorf("redaction is not deterministic within an export: %+v and %+v", redacted, again)
+	}
+	if other := redactTask(task, []byte("another export"), false); other.Title == redacted.Title || other.Waiting.Person == redacted.Waiting.Person {
+		t.Errorf("two exports share placeholders %q and %q", redacted.Title, redacted.Waiting.Person)
+	}
+	if withTags := redactTask(task, key, true); withTags.Project != task.Project || !reflect.DeepEqual(withTags.Tags, task.Tags) {
+		t.Errorf("--keep-tags lost project %q or tags %v", withTags.Project, withTags.Tags)
+	}
+}
+
+// TestExportRedacted checks the command end to end, including the reminder
+// that tags and projects are redacted too
+func TestExportRedacted(t *testing.T) {
+	useTestStore(t, []Task{secretTask()})
+	stdout, stderr, err := runCommand(t, "export", "json", "--redact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(strings.ToLower(stdout), "secret") {
+		t.Fatalf("export json --redact leaks free text:\n%s", stdout)
+	}
+	if !strings.Contains(stderr, "--keep-tags") {
+		t.Errorf("no --keep-tags reminder on stderr: %q", stderr)
+	}
+	if _, stderr, _ := runCommand(t, "export", "json", "--redact", "--keep-tags"); strings.Contains(stderr, "--keep-tags") {
+		t.Errorf("reminder printed with --keep-tags: %q", stderr)
+	}
+
+	// each export draws its own key, so the same text is not linkable
+	// between two of them
+	again, _, err := runCommand(t, "export", "json", "--redact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first, second []Task
+	if err := json.Unmarshal([]byte(stdout), &first); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(again), &second); err != nil {
+		t.Fatal(err)
+	}
+	if first[0].Title == second[0].Title {
+		t.Errorf("two redacted exports both hold %q", first[0].Title)
+	}
+}
+
+// TestServeConcurrentRequests hammers the serve handlers with concurrent
+// lists, adds and completions while another command keeps touching the
+// data file. Run it with -race: readers and the writer both reload the
+// file through the same cache.
+func TestServeConcurrentRequests(t *testing.T) {
+	useTestStore(t, generateFixtures(1, 20, testNow))
+	queue, err := newWriteQueue(&taskStore{}, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go queue.run(ctx)
+	handler := newAPIHandler(queue)
+
+	touched := make(chan struct{})
+	go func() {
+		defer close(touched)
+		stamp := time.Now()
+		for ctx.Err() == nil {
+			stamp = stamp.Add(time.Second)
+			os.Chtimes(dataFile, stamp, stamp)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	const workers, rounds = 8, 20
+	var wg sync.WaitGroup
+	failures := make(chan string, workers*rounds*3)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				requests := []*http.Request{
+					httptest.NewRequest("GET", "/tasks?limit=500", nil),
+					httptest.NewRequest("POST", "/tasks", strings.NewReader(fmt.Sprintf(`{"title": "Task %d-%d", "key": "stress-%d-%d"}`, w, i, w, i))),
+					httptest.NewRequest("POST", fmt.Sprintf("/tasks/%d/done", 1+(w*rounds+i)%20), nil),
+				}
+				for _, req := range requests {
+					rec := httptest.NewRecorder()
+					handler.ServeHTTP(rec, req)
+					if rec.Code >= 300 {
+						failures <- fmt.Sprintf("%s %s: %d %s", req.Method, req.URL, rec.Code, rec.Body)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	stop()
+	<-touched
+	close(failures)
+	for failure := range failures {
+		t.Error(failure)
+	}
+	if left := queue.drain(5 * time.Second); left > 0 {
+		t.Fatalf("%d writes still queued", left)
+	}
+
+	added := 0
+	for _, task := range readStore(t) {
+		if strings.HasPrefix(task.IdempotencyKey, "stress-") {
+			added++
+		}
+	}
+	if added != workers*rounds {
+		t.Errorf("%d of %d concurrent adds were saved", added, workers*rounds)
+	}
+}
+
+// TestServeWriteQueue checks that writes finding the data file locked are
+// accepted with 202, kept in order behind each other, refused with 503 once
+// the queue is full, and survive a crash through the spool without being
+// applied twice
+func TestServeWriteQueue(t *testing.T) {
+	useTestStore(t, []Task{{ID: 1, Title: "Write report", Status: "todo", CreatedAt: testNow.Format(timeLayout)}})
+	queue, err := newWriteQueue(&taskStore{}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newAPIHandler(queue)
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, reader))
+		return rec
+	}
+	lock := func(locked bool) {
+		t.Helper()
+		if locked {
+			if err := os.WriteFile(dataFile+".lock", []byte("1\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := os.Remove(dataFile + ".lock"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	accept := func(method, path, body string) string {
+		t.Helper()
+		rec := serve(method, path, body)
+		var accepted map[string]string
+		json.Unmarshal(rec.Body.Bytes(), &accepted)
+		if rec.Code != http.StatusAccepted || accepted["status"] != OpQueued || rec.Header().Get("Location") != "/operations/"+accepted["operation"] {
+			t.Fatalf("%s %s: %d %s, want 202 with a queued operation", method, path, rec.Code, rec.Body)
+		}
+		return accepted["operation"]
+	}
+
+	lock(true)
+	first := accept("POST", "/tasks", `{"title": "Queued while locked"}`)
+	accept("POST", "/tasks/1/done", "")
+	lock(false)
+	// the file is free again, but a write must not overtake those queued
+	accept("POST", "/tasks", `{"title": "Queued behind"}`)
+	lock(true)
+	if rec := serve("POST", "/tasks", `{"title": "One too many"}`); rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("write to a full queue: %d %s, want 503 with Retry-After", rec.Code, rec.Body)
+	}
+	rec := serve("GET", "/operations/"+first, "")
+	var op apiOperation
+	if err := json.Unmarshal(rec.Body.Bytes(), &op); err != nil || op.Status != OpQueued {
+		t.Errorf("GET /operations/%s: %d %s, want it queued", first, rec.Code, rec.Body)
+	}
+	if tasks := readStore(t); len(tasks) != 1 || tasks[0].Status != "todo" {
+		t.Fatalf("queued writes were applied while the file was locked: %+v", tasks)
+	}
+
+	// as after a crash: a new serve resumes the writes from the spool
+	spool, err := os.ReadFile(spoolFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock(false)
+	for range 2 {
+		resumed, err := newWriteQueue(&taskStore{}, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := resumed.backlog(); n != 3 {
+			t.Fatalf("resumed %d writes from the spool, want 3", n)
+		}
+		if left := resumed.flush(context.Background()); left != 0 {
+			t.Fatalf("%d resumed writes left", left)
+		}
+		if _, err := os.Stat(spoolFile); !os.IsNotExist(err) {
+			t.Errorf("spool kept after its writes were applied: %v", err)
+		}
+		var got []string
+		for _, task := range readStore(t) {
+			got = append(got, fmt.Sprintf("%d %s %s", task.ID, task.Title, task.Status))
+		}
+		if want := []string{"1 Write report done", "2 Queued while locked todo", "3 Queued behind todo"}; !slices.Equal(got, want) {
+			t.Errorf("after replaying the spool the tasks are %q, want %q", got, want)
+		}
+		// replaying the same spool again must not add anything twice
+		if err := os.WriteFile(spoolFile, spool, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Remove(spoolFile)
+
+	if left := queue.flush(context.Background()); left != 0 {
+		t.Fatalf("%d writes left in the first queue", left)
+	}
+	if err := json.Unmarshal(serve("GET", "/operations/"+first, "").Body.Bytes(), &op); err != nil || op.Status != OpApplied || op.Task == nil || op.Task.ID != 2 {
+		t.Errorf("operation %s is %+v, want applied to task 2", first, op)
+	}
+	if rec := serve("GET", "/operations/unknown", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET of an unknown operation: %d, want 404", rec.Code)
+	}
+
+	// shutdown gives up on a lock that stays and keeps the write spooled
+	lock(true)
+	accept("POST", "/tasks", `{"title": "Left for the next serve"}`)
+	if left := queue.drain(2 * queueRetryInterval); left != 1 {
+		t.Errorf("drain with the file locked left %d writes, want 1", left)
+	}
+	if _, err := os.Stat(spoolFile); err != nil {
+		t.Errorf("the write left at shutdown is not spooled: %v", err)
+	}
+	lock(false)
+	if left := queue.drain(time.Second); left != 0 || len(readStore(t)) != 4 {
+		t.Errorf("drain with the file free left %d writes", left)
+	}
+}
+
+// TestAPIPagination checks that GET /tasks pages through the tasks with a
+// capped limit, X-Total-Count and next links, that its query parameters
+// select the same tasks as list --filter, and that a bad parameter gets 400
+// with the text list would print
+func TestAPIPagination(t *testing.T) {
+	useTestStore(t, generateFixtures(4, 1200, testNow))
+	queue, err := newWriteQueue(&taskStore{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newAPIHandler(queue)
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+	// pages returns the IDs on every page from path on, following the next links
+	pages := func(path string) []int {
+		t.Helper()
+		var ids []int
+		for path != "" {
+			rec := get(path)
+			var page []Task
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); rec.Code != http.StatusOK || err != nil {
+				t.Fatalf("GET %s: %d %s", path, rec.Code, rec.Body)
+			}
+			if total, _ := strconv.Atoi(rec.Header().Get("X-Total-Count")); len(ids) == 0 && total < len(page) {
+				t.Errorf("GET %s: X-Total-Count %d for a page of %d", path, total, len(page))
+			}
+			for _, task := range page {
+				ids = append(ids, task.ID)
+			}
+			path = ""
+			if link := rec.Header().Get("Link"); link != "" {
+				path = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+			}
+		}
+		slices.Sort(ids)
+		return ids
+	}
+
+	for _, c := range []struct {
+		query string
+		size  int
+	}{
+		{"", defaultPageSize},
+		{"?limit=20", 20},
+		{"?limit=100000", maxPageSize},
+		{"?offset=1190", 10},
+		{"?offset=5000", 0},
+	} {
+		rec := get("/tasks" + c.query)
+		var page []Task
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil || len(page) != c.size || rec.Header().Get("X-Total-Count") != "1200" {
+			t.Errorf("GET /tasks%s: %d tasks of %s, want %d of 1200", c.query, len(page), rec.Header().Get("X-Total-Count"), c.size)
+		}
+	}
+	if ids := pages("/tasks?limit=500"); len(ids) != 1200 || len(slices.Compact(slices.Clone(ids))) != 1200 {
+		t.Errorf("paging through /tasks returned %d tasks, want each of the 1200 once", len(ids))
+	}
+
+	listed := func(filter string) []int {
+		t.Helper()
+		out, _, err := runCommand(t, "list", "--filter", filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int
+		for _, m := range regexp.MustCompile(`#(\d+):`).FindAllStringSubmatch(out, -1) {
+			id, _ := strconv.Atoi(m[1])
+			ids = append(ids, id)
+		}
+		slices.Sort(ids)
+		return ids
+	}
+	for _, c := range []struct{ query, filter string }{
+		{"status=in-progress&tag=urgent", "status:in-progress tag:urgent"},
+		{"project=home&priority=high", "project:home priority:high"},
+		{"due_before=2026-06-20&due_after=2026-06-01", "due-before:2026-06-20 due-after:2026-06-01"},
+		{"q=report", "report"},
+		{"filter=-status:done+tag:bugs", "-status:done tag:bugs"},
+	} {
+		want := listed(c.filter)
+		if len(want) == 0 {
+			t.Fatalf("list --filter %q matches nothing; pick another filter", c.filter)
+		}
+		if got := pages("/tasks?limit=37&" + c.query); !slices.Equal(got, want) {
+			t.Errorf("GET /tasks?%s returned %v, list --filter %q %v", c.query, got, c.filter, want)
+		}
+	}
+
+	for _, c := range []struct{ query, filter string }{
+		{"priority=urgent", "priority:urgent"},
+		{"due_before=someday", "due-before:someday"},
+		{"filter=color:red", "color:red"},
+	} {
+		_, _, cliErr := runCommand(t, "list", "--filter", c.filter)
+		rec := get("/tasks?" + c.query)
+		var payload errorPayload
+		json.Unmarshal(rec.Body.Bytes(), &payload)
+		if cliErr == nil || rec.Code != http.StatusBadRequest || payload.Message != cliErr.Error() {
+			t.Errorf("GET /tasks?%s: %d %q, want 400 with the text of list --filter: %v", c.query, rec.Code, payload.Message, cliErr)
+		}
+	}
+	for _, query := range []string{"limit=0", "offset=-1", "colour=red"} {
+		if rec := get("/tasks?" + query); rec.Code != http.StatusBadRequest {
+			t.Errorf("GET /tasks?%s: %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+// TestDataFileAccess checks how often commands open, read and write the
+// data file: commands that only read open and read it once and never write
+// it, help leaves it alone, and a change reads it once and writes it once,
+// also when it first adds a capture. Each command line goes through start,
+// as from main, so loading the config and theme is counted too.
+func TestDataFileAccess(t *testing.T) {
+	t.Setenv(clockEnv, testNow.Format(timeLayout))
+	commands := []struct {
+		args                 []string
+		captured             bool
+		opens, reads, writes int
+	}{
+		{[]string{"list"}, false, 1, 1, 0},
+		{[]string{"next"}, false, 1, 1, 0},
+		{[]string{"stats"}, false, 1, 1, 0},
+		{[]string{"show", "1"}, false, 1, 1, 0},
+		{[]string{"search", "report"}, false, 1, 1, 0},
+		{[]string{"agenda"}, false, 1, 1, 0},
+		{[]string{"projects"}, false, 1, 1, 0},
+		{[]string{"report", "week"}, false, 1, 1, 0},
+		{[]string{"help"}, false, 0, 0, 0},
+		// the lock checks the file is writable before it is read
+		{[]string{"add", "Another task"}, false, 2, 1, 1},
+		{[]string{"list"}, true, 2, 1, 1},
+	}
+	for _, c := range commands {
+		useTestStore(t, generateFixtures(3, 50, testNow))
+		if c.captured {
+			if err := captureTask("Captured task", true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// as in a new process: nothing cached or counted yet
+		dataFileCache.data, dataFileCache.opens, dataFileCache.reads, dataFileCache.writes = nil, 0, 0, 0
+		argv := append([]string{"--plain"}, c.args...)
+		if _, _, err := captureOutput(t, func() error { return start(context.Background(), argv) }); err != nil {
+			t.Errorf("%v: %v", c.args, err)
+			continue
+		}
+		if dataFileCache.opens != c.opens || dataFileCache.reads != c.reads || dataFileCache.writes != c.writes {
+			t.Errorf("%v (captured %v): %d opens, %d reads and %d writes of the data file, want %d, %d and %d", c.args, c.captured,
+				dataFileCache.opens, dataFileCache.reads, dataFileCache.writes, c.opens, c.reads, c.writes)
+		}
+	}
+}
+
+// TestClock checks that TASK_TRACKER_NOW fixes the clock commands use, so
+// what they stamp and print is the same on any day, and that demo writes
+// the same tasks for the same seed
+func TestClock(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		want  time.Time
+		ok    bool
+	}{
+		{"", time.Time{}, true},
+		{"2026-06-10", time.Date(2026, 6, 10, 0, 0, 0, 0, time.Local), true},
+		{"2026-06-10 09:30:00", testNow, true},
+		{"2026-06-10T09:30:00", time.Time{}, false},
+		{"tomorrow", time.Time{}, false},
+	} {
+		t.Setenv(clockEnv, c.value)
+		got, err := clockFromEnv()
+		switch {
+		case !c.ok:
+			if errorKind(err) != ErrUsage {
+				t.Errorf("%s=%q: err %v, want a usage error", clockEnv, c.value, err)
+			}
+		case err != nil:
+			t.Errorf("%s=%q: %v", clockEnv, c.value, err)
+		case c.value == "":
+			if _, real := got.(realClock); !real {
+				t.Errorf("unset %s gives %T, want the system clock", clockEnv, got)
+			}
+		case !got.Now().Equal(c.want):
+			t.Errorf("%s=%q: now is %v, want %v", clockEnv, c.value, got.Now(), c.want)
+		}
+	}
+
+	useTestStore(t, nil)
+	t.Setenv(clockEnv, "2024-02-29 18:00:00")
+	for range 2 {
+		if _, _, err := captureOutput(t, func() error {
+			return start(context.Background(), []string{"--plain", "add", "--due", "tomorrow", "Leap day task"})
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, task := range readStore(t) {
+		if task.CreatedAt != "2024-02-29 18:00:00" || task.DueDate != "2024-03-01" {
+			t.Errorf("task %d created %s due %s, want created 2024-02-29 18:00:00 due 2024-03-01", task.ID, task.CreatedAt, task.DueDate)
+		}
+	}
+
+	demo := func(seed uint64) []byte {
+		dir := filepath.Join(t.TempDir(), "demo")
+		if _, _, err := runCommand(t, "demo", "--seed", fmt.Sprint(seed), "--count", "30", "--dir", dir); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, dataFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := runCommand(t, "demo", "--dir", dir); errorKind(err) != ErrUsage {
+			t.Errorf("demo into a directory holding tasks: err %v, want a usage error", err)
+		}
+		return data
+	}
+	first := demo(7)
+	if !bytes.Equal(demo(7), first) {
+		t.Error("demo --seed 7 wrote different tasks on the second run")
+	}
+	if bytes.Equal(demo(8), first) {
+		t.Error("demo --seed 8 wrote the same tasks as --seed 7")
+	}
+}
+
+// TestErrorContract checks that failures map to their documented exit
+// codes and that --errors json prints exactly one JSON object on stderr
+func TestErrorContract(t *testing.T) {
+	cases := []struct {
+		name  string
+		setup func(t *testing.T)
+		args  []string
+		kind  error
+		code  int
+		id    int
+	}{
+		{"unknown command", nil, []string{"frobnicate"}, ErrUsage, 2, 0},
+		{"missing task", nil, []string{"show", "99"}, ErrNotFound, 4, 99},
+		{"locked", func(t *testing.T) {
+			if err := os.WriteFile(dataFile+".lock", []byte("1\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"add", "Another task"}, ErrLocked, 5, 0},
+		{"corrupt", func(t *testing.T) {
+			if err := os.WriteFile(dataFile, []byte("[{\"id\": 1,"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"list"}, ErrCorrupt, 6, 0},
+	}
+	for _, c := range cases {
+		for _, format := range []string{"text", "json"} {
+			useTestStore(t, []Task{{ID: 1, Title: "Write report", Status: "todo", CreatedAt: testNow.Format(timeLayout)}})
+			if c.setup != nil {
+				c.setup(t)
+			}
+			argv := append([]string{"--plain", "--errors", format}, c.args...)
+			_, stderr, err := captureOutput(t, func() error {
+				err := start(context.Background(), argv)
+				if err != nil {
+					reportError(err)
+				}
+				return err
+			})
+			if !errors.Is(err, c.kind) || exitCode(err) != c.code {
+				t.Errorf("%s: err %v exits %d, want %v exiting %d", c.name, err, exitCode(err), c.kind, c.code)
+				continue
+			}
+			if format == "text" {
+				if !strings.Contains(stderr, "❌ "+err.Error()) {
+					t.Errorf("%s: stderr %q does not report %q", c.name, stderr, err)
+				}
+				continue
+			}
+			var payload errorPayload
+			if lines := strings.Split(strings.TrimSpace(stderr), "\n"); len(lines) != 1 || json.Unmarshal([]byte(lines[0]), &payload) != nil {
+				t.Errorf("%s: --errors json wrote %q, want one JSON object", c.name, stderr)
+				continue
+			}
+			want := errorPayload{Code: c.kind.Error(), Message: err.Error(), ID: c.id}
+			if payload != want {
+				t.Errorf("%s: --errors json wrote %+v, want %+v", c.name, payload, want)
+			}
+		}
+	}
+}
+
+// TestAddLimits checks that daily_add_limit and inbox_limit warn on add,
+// that --strict refuses instead, that stats reports both counters, and that
+// without the keys nothing is said
+func TestAddLimits(t *testing.T) {
+	yesterday := testNow.AddDate(0, 0, -1).Format(timeLayout)
+	useTestStore(t, []Task{
+		{ID: 1, Title: "Old untagged task", Status: "todo", CreatedAt: yesterday},
+		{ID: 2, Title: "Tagged task", Status: "todo", CreatedAt: testNow.Format(timeLayout), Tags: []string{"home"}},
+	})
+	for i := range 3 {
+		_, stderr, err := runCommand(t, "add", "--tag", "home", fmt.Sprintf("Task %d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(stderr, "⚠️") {
+			t.Errorf("without limits, add %d warned: %q", i, stderr)
+		}
+	}
+	out, _, err := runCommand(t, "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "Added today") || strings.Contains(out, "Inbox") {
+		t.Errorf("without limits, stats reports them:\n%s", out)
+	}
+
+	useTestStore(t, []Task{
+		{ID: 1, Title: "Old untagged task", Status: "todo", CreatedAt: yesterday},
+		{ID: 2, Title: "Tagged task", Status: "todo", CreatedAt: testNow.Format(timeLayout), Tags: []string{"home"}},
+	})
+	config.DailyAddLimit, config.InboxLimit = 2, 1
+	steps := []struct {
+		args []string
+		warn string
+		kind error
+	}{
+		{[]string{"add", "--tag", "home", "Second today"}, "", nil},
+		{[]string{"add", "--tag", "home", "Third today"}, "That's 3 tasks added today, over your daily limit of 2", nil},
+		{[]string{"add", "--tag", "home", "--strict", "Refused"}, "", ErrLimit},
+		{[]string{"add", "Untagged"}, "2 untriaged tasks have no tags or project (inbox_limit is 1)", nil},
+	}
+	for _, step := range steps {
+		_, stderr, err := runCommand(t, step.args...)
+		if step.kind != nil {
+			if !errors.Is(err, step.kind) || exitCode(err) != 7 {
+				t.Errorf("%v: err %v, want %v exiting 7", step.args, err, step.kind)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", step.args, err)
+		}
+		if step.warn == "" && strings.Contains(stderr, "⚠️") || !strings.Contains(stderr, step.warn) {
+			t.Errorf("%v: stderr %q, want warning %q", step.args, stderr, step.warn)
+		}
+	}
+	if tasks := readStore(t); len(tasks) != 5 {
+		t.Errorf("got %d tasks, want 5 with the strict add refused", len(tasks))
+	}
+	out, _, err = runCommand(t, "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Added today: 4 / 2", "Inbox (no tags or project): 2 / 1"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("stats lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+// TestShareExport checks that export share publishes only the filtered
+// tasks in a page that needs no network, that regenerating leaves the
+// files alone, and that verify-share tells tampering from staleness
+func TestShareExport(t *testing.T) {
+	created := testNow.Format(timeLayout)
+	useTestStore(t, []Task{
+		{ID: 1, Title: "Buy milk", Status: "todo", CreatedAt: created, Tags: []string{"groceries"}},
+		{ID: 2, Title: "Salary review", Status: "todo", CreatedAt: created, Project: "work"},
+		{ID: 3, Title: "Buy eggs", Status: "done", CreatedAt: created, Tags: []string{"groceries"}},
+	})
+	if _, _, err := runCommand(t, "export", "share", "--filter", "tag:groceries", "--out", "share"); errorKind(err) != ErrUsage {
+		t.Errorf("share without share_key: err %v, want a usage error", err)
+	}
+	config.ShareKey = "secret"
+	if _, _, err := runCommand(t, "export", "share", "--filter", "tag:groceries", "--out", "share"); err != nil {
+		t.Fatal(err)
+	}
+	payload, shareJSON, err := readShare("share")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, task := range payload.Tasks {
+		titles = append(titles, task.Title)
+	}
+	if want := []string{"Buy milk", "Buy eggs"}; !slices.Equal(titles, want) || payload.GeneratedAt != created {
+		t.Errorf("share holds %q generated %s, want %q generated %s", titles, payload.GeneratedAt, want, created)
+	}
+	page, err := os.ReadFile(filepath.Join("share", "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(page, shareJSON) || bytes.Contains(page, []byte("http")) || bytes.Contains(page, []byte("src=")) {
+		t.Error("index.html does not embed share.json or loads something from elsewhere")
+	}
+
+	old := testNow.Add(-time.Hour)
+	for _, name := range []string{"share.json", "index.html"} {
+		if err := os.Chtimes(filepath.Join("share", name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, _, err := runCommand(t, "export", "share", "--filter", "tag:groceries", "--out", "share")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "already up to date") {
+		t.Errorf("regenerating an unchanged share printed %q", out)
+	}
+	for _, name := range []string{"share.json", "index.html"} {
+		if info, err := os.Stat(filepath.Join("share", name)); err != nil || !info.ModTime().Equal(old) {
+			t.Errorf("regenerating an unchanged share rewrote %s", name)
+		}
+	}
+	if _, _, err := runCommand(t, "verify-share", "share"); err != nil {
+		t.Errorf("verify-share of a fresh share: %v", err)
+	}
+
+	tamper := func(name, from, to string) {
+		t.Helper()
+		path := filepath.Join("share", name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, bytes.Replace(data, []byte(from), []byte(to), 1), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checks := []struct {
+		name   string
+		change func()
+		undo   func()
+		args   []string
+		kind   error
+	}{
+		{"edited share.json", func() { tamper("share.json", "Buy milk", "Buy beer") }, func() { tamper("share.json", "Buy beer", "Buy milk") }, nil, ErrCorrupt},
+		{"edited index.html", func() { tamper("index.html", "<h1", "<h2") }, func() { tamper("index.html", "<h2", "<h1") }, nil, ErrCorrupt},
+		{"another key", func() { config.ShareKey = "other" }, func() { config.ShareKey = "secret" }, nil, ErrCorrupt},
+		{"too old", func() { clock = fixedClock(testNow.AddDate(0, 0, 8)) }, func() { clock = fixedClock(testNow) }, []string{"--max-age", "7d"}, ErrStale},
+		{"changed tasks", func() {
+			if _, _, err := runCommand(t, "add", "--tag", "groceries", "Buy bread"); err != nil {
+				t.Fatal(err)
+			}
+		}, nil, nil, ErrStale},
+	}
+	for _, c := range checks {
+		c.change()
+		_, _, err := runCommand(t, append([]string{"verify-share", "share"}, c.args...)...)
+		if !errors.Is(err, c.kind) {
+			t.Errorf("%s: verify-share err %v, want %v", c.name, err, c.kind)
+		}
+		if c.undo != nil {
+			c.undo()
+		}
+	}
+}
+
+// TestImportCSVMapping checks that import csv maps columns and statuses
+// from a saved mapping and the flags, parses dates with date_layouts, writes
+// nothing with --preview and names what is missing when a mapping is wrong
+func TestImportCSVMapping(t *testing.T) {
+	useTestStore(t, nil)
+	config.DateLayouts = []string{"02/01/2006"}
+	config.CSVMappings = map[string]CSVMapping{
+		"tracker": {Columns: map[string]string{"Title": "Summary", "Status": "State"}, Status: map[string]string{"Closed": "done"}},
+	}
+	rows := "Deadline,Summary,State,Labels\n31/07/2026,Fix login,Closed,\"bug,web\"\n,Write docs,Open,\n"
+	for i := range 5 {
+		rows += fmt.Sprintf(",Task %d,Open,\n", i)
+	}
+	if err := os.WriteFile("export.csv", []byte(rows), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mapping := []string{"import", "csv", "export.csv", "--mapping", "tracker", "--map", "DueDate=Deadline,Tags=Labels", "--status", "open=todo"}
+
+	out, _, err := runCommand(t, append(mapping, "--preview")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "Preview of 7 tasks (first 5 shown, nothing written)") || !strings.Contains(out, "Task 2") || strings.Contains(out, "Task 3") {
+		t.Errorf("preview printed:\n%s", out)
+	}
+	if _, err := os.Stat(dataFile); !os.IsNotExist(err) {
+		t.Errorf("--preview wrote %s", dataFile)
+	}
+
+	if _, _, err := runCommand(t, mapping...); err != nil {
+		t.Fatal(err)
+	}
+	tasks := readStore(t)
+	if len(tasks) != 7 {
+		t.Fatalf("imported %d tasks, want 7", len(tasks))
+	}
+	got := Task{Title: tasks[0].Title, Status: tasks[0].Status, DueDate: tasks[0].DueDate, Tags: tasks[0].Tags}
+	if want := (Task{Title: "Fix login", Status: "done", DueDate: "2026-07-31", Tags: []string{"bug", "web"}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("first row imported as %+v, want %+v", got, want)
+	}
+	if tasks[1].Title != "Write docs" || tasks[1].Status != "todo" || tasks[1].DueDate != "" {
+		t.Errorf("second row imported as %+v, want Write docs, todo, no due date", tasks[1])
+	}
+
+	for _, c := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"--map", "Title=Name"}, []string{"Title=Name (no such column)", "the file has: Deadline, Summary, State, Labels"}},
+		{nil, []string{"Title (not mapped; use --map Title=<column>)"}},
+		{[]string{"--map", "Title=Summary,Status=State"}, []string{"export.csv line 2", `unknown status "Closed"`}},
+		{[]string{"--mapping", "tracker", "--map", "Title=Summary,DueDate=Summary"}, []string{"export.csv line 2", `DueDate "Fix login"`}},
+	} {
+		_, _, err := runCommand(t, append([]string{"import", "csv", "export.csv"}, c.args...)...)
+		if errorKind(err) != ErrInvalid {
+			t.Errorf("%v: err %v, want an invalid input error", c.args, err)
+			continue
+		}
+		for _, want := range c.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%v: error %q does not mention %q", c.args, err, want)
+			}
+		}
+	}
+	if tasks := readStore(t); len(tasks) != 7 {
+		t.Errorf("failed imports left %d tasks, want the 7 imported before", len(tasks))
+	}
+}
+
+// TestNormalizeTitles checks the title rules, that imports only apply them
+// when asked, keeping the original in history, and that maintain
+// --normalize-titles --dry-run changes nothing
+func TestNormalizeTitles(t *testing.T) {
+	for _, c := range []struct{ title, want string }{
+		{"FIX THE API BUG.", "Fix the API bug"},
+		{"URGENT: UPDATE DNS RECORDS", "Urgent: update DNS records"},
+		{"🔥🔥 Deploy now!!!", "Deploy now"},
+		{"✅ Done already", "Done already"},
+		{"Hello, world…", "Hello, world"},
+		{"Call NASA about it", "Call NASA about it"},
+		{"(draft) notes", "(draft) notes"},
+		{"#12 follow up", "#12 follow up"},
+		{"...", "..."},
+	} {
+		if got := normalizeTitle(c.title); got != c.want {
+			t.Errorf("normalizeTitle(%q) = %q, want %q", c.title, got, c.want)
+		}
+	}
+
+	incoming := `[{"title": "PAY THE RENT."}, {"title": "🎉 Plan party"}, {"title": "Already fine"}]`
+	for _, normalize := range []bool{false, true} {
+		useTestStore(t, nil)
+		if err := os.WriteFile("incoming.json", []byte(incoming), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config.NormalizeTitles = normalize
+		if _, _, err := runCommand(t, "import", "json", "incoming.json"); err != nil {
+			t.Fatal(err)
+		}
+		var titles []string
+		for _, task := range readStore(t) {
+			titles = append(titles, task.Title)
+			if !normalize && len(task.History) > 0 {
+				t.Errorf("import without normalizing recorded %+v", task.History)
+			}
+		}
+		want := []string{"PAY THE RENT.", "🎉 Plan party", "Already fine"}
+		if normalize {
+			want = []string{"Pay the rent", "Plan party", "Already fine"}
+		}
+		if !slices.Equal(titles, want) {
+			t.Errorf("normalize_titles %v: imported %q, want %q", normalize, titles, want)
+		}
+	}
+	task := readStore(t)[0]
+	if n := len(task.History); n == 0 || task.History[n-1] != (HistoryEvent{At: testNow.Format(timeLayout), Field: "title", From: "PAY THE RENT.", To: "Pay the rent", Note: "normalized"}) {
+		t.Errorf("normalized import recorded %+v, want the original title in history", task.History)
+	}
+
+	useTestStore(t, []Task{
+		{ID: 1, Title: "CALL THE BANKER!", Status: "todo", CreatedAt: testNow.Format(timeLayout)},
+		{ID: 2, Title: "Water plants", Status: "todo", CreatedAt: testNow.Format(timeLayout)},
+	})
+	before, err := os.ReadFile(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _, err := runCommand(t, "maintain", "--normalize-titles", "--dry-run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, `"CALL THE BANKER!" → "Call the banker"`) || !strings.Contains(out, "Would normalize 1 title") {
+		t.Errorf("dry run printed:\n%s", out)
+	}
+	if after, _ := os.ReadFile(dataFile); !bytes.Equal(after, before) {
+		t.Error("maintain --dry-run wrote the data file")
+	}
+	if _, _, err := runCommand(t, "maintain", "--normalize-titles"); err != nil {
+		t.Fatal(err)
+	}
+	if tasks := readStore(t); tasks[0].Title != "Call the banker" || tasks[1].Title != "Water plants" || len(tasks[1].History) != 0 {
+		t.Errorf("maintain left %q and %q", tasks[0].Title, tasks[1].Title)
+	}
+}
+
+// TestIDDisplay checks that id_display base36 changes only how IDs are
+// shown and typed: every shown ID parses back to its task, all-digit input
+// stays decimal, help names the mode and tasks.json keeps integers
+func TestIDDisplay(t *testing.T) {
+	useTestStore(t, []Task{{ID: 10007, Title: "Write report", Status: "todo", CreatedAt: testNow.Format(timeLayout)}})
+	for _, c := range []struct {
+		mode, input string
+		want        int
+	}{
+		{"decimal", "42", 42},
+		{"decimal", "#42", 42},
+		{"decimal", "7pz", 0},
+		{"base36", "7pz", 10007},
+		{"base36", "#7PZ", 10007},
+		{"base36", "42", 42},
+		{"base36", "0", 0},
+	} {
+		config.IDDisplay = c.mode
+		got, err := parseID(c.input)
+		if c.want == 0 {
+			if err == nil || !strings.Contains(err.Error(), "IDs are "+c.mode) {
+				t.Errorf("%s: parseID(%q) = %d, %v, want an error naming the mode", c.mode, c.input, got, err)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("%s: parseID(%q) = %d, %v, want %d", c.mode, c.input, got, err, c.want)
+		}
+	}
+
+	config.IDDisplay = "base36"
+	for id := 1; id <= 50000; id++ {
+		if got, err := parseID(displayID(id)); err != nil || got != id {
+			t.Fatalf("base36 shows %d as %q, which parses as %d, %v", id, displayID(id), got, err)
+		}
+	}
+	if displayID(36) != "36" || displayID(10007) != "7pz" {
+		t.Errorf("base36 shows 36 as %q and 10007 as %q, want 36 (its base36 form 10 is all digits) and 7pz", displayID(36), displayID(10007))
+	}
+
+	out, _, err := runCommand(t, "show", "7pz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "#7pz") || !strings.Contains(out, "Write report") {
+		t.Errorf("show 7pz printed:\n%s", out)
+	}
+	if _, _, err := runCommand(t, "done", "7pz"); err != nil {
+		t.Fatal(err)
+	}
+	help, _, _ := runCommand(t, "help")
+	if !strings.Contains(help, idHelp()) {
+		t.Errorf("help does not mention the active ID mode %q", idHelp())
+	}
+	data, err := os.ReadFile(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`"id": 10007`)) || bytes.Contains(data, []byte("7pz")) {
+		t.Errorf("%s does not keep the ID as an integer:\n%s", dataFile, data)
+	}
+}
+
+// TestDoneSummary checks the line done prints after the confirmation: the
+// tasks completed since local midnight, the open tasks left in the task's
+// tag or project, no second read of the data file, and silence with
+// --quiet, --json or done_summary off
+func TestDoneSummary(t *testing.T) {
+	created := testNow.AddDate(0, 0, -3).Format(timeLayout)
+	tasks := []Task{
+		{ID: 1, Title: "Write report", Status: "todo", CreatedAt: created, Tags: []string{"work"}},
+		{ID: 2, Title: "Done before midnight", Status: "done", CreatedAt: created, CompletedAt: "2026-06-09 23:59:59", Tags: []string{"work"}},
+		{ID: 3, Title: "Done at midnight", Status: "done", CreatedAt: created, CompletedAt: "2026-06-10 00:00:00", Tags: []string{"work"}},
+		{ID: 4, Title: "Review slides", Status: "todo", CreatedAt: created, Tags: []string{"work"}},
+		{ID: 5, Title: "Water plants", Status: "todo", CreatedAt: created, Tags: []string{"home"}},
+		{ID: 6, Title: "Mow the lawn", Status: "todo", CreatedAt: created, Project: "garden"},
+		{ID: 7, Title: "Plant tulips", Status: "todo", CreatedAt: created, Project: "garden"},
+	}
+	useTestStore(t, tasks)
+	for _, c := range []struct{ id, want string }{
+		{"1", "That's 2 done today — 1 todo left for @work"},
+		{"5", "That's 3 done today — nothing left for @home 🎉"},
+		{"6", "That's 4 done today — 1 todo left for +garden"},
+	} {
+		dataFileCache.opens, dataFileCache.reads = 0, 0
+		dataFileCache.data = nil
+		out, _, err := runCommand(t, "done", c.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+		if len(lines) != 2 || !strings.HasPrefix(lines[0], "✅ Completed task #"+c.id) || lines[1] != c.want {
+			t.Errorf("done %s printed %q, want the confirmation and %q", c.id, lines, c.want)
+		}
+		if dataFileCache.reads != 1 {
+			t.Errorf("done %s read the data file %d times, want once", c.id, dataFileCache.reads)
+		}
+	}
+
+	for _, args := range [][]string{{"done", "--quiet", "4"}, {"done", "--json", "7"}} {
+		useTestStore(t, tasks)
+		out, _, err := runCommand(t, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(out, "done today") {
+			t.Errorf("%v printed the summary:\n%s", args, out)
+		}
+	}
+	useTestStore(t, tasks)
+	config.DoneSummary = false
+	out, _, err := runCommand(t, "done", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(out, "\n") != 1 {
+		t.Errorf("with done_summary off, done printed:\n%s", out)
+	}
+}
+
+// TestBudgets checks project budgets: add warns once a project has more
+// open tasks than its budget, track stop once this week's hours pass it,
+// --strict-budget refuses both, and stats and projects report the usage of
+// the week starting on week_start
+func TestBudgets(t *testing.T) {
+	created := testNow.AddDate(0, 0, -14).Format(timeLayout)
+	useTestStore(t, []Task{
+		{ID: 1, Title: "Landing page", Status: "todo", CreatedAt: created, Project: "side", TimeLog: []TimeEntry{
+			{Start: "2026-06-05 10:00:00", End: "2026-06-05 20:00:00"}, // last week
+			{Start: "2026-06-08 09:00:00", End: "2026-06-08 12:00:00"},
+		}},
+		{ID: 2, Title: "Logo", Status: "done", CreatedAt: created, CompletedAt: created, Project: "side"},
+		{ID: 3, Title: "Pricing", Status: "in-progress", CreatedAt: created, Project: "side", TimeLog: []TimeEntry{{Start: "2026-06-10 07:00:00"}}},
+	})
+	config.Budgets = map[string]Budget{"side": {OpenTasks: 2, WeeklyHours: 5}}
+	usage := func() budgetUsage {
+		t.Helper()
+		out, _, err := runCommand(t, "stats", "--json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stats statsJSON
+		if err := json.Unmarshal([]byte(out), &stats); err != nil || len(stats.Budgets) != 1 {
+			t.Fatalf("stats --json has budgets %+v (%v), want the one of +side", stats.Budgets, err)
+		}
+		return stats.Budgets[0]
+	}
+
+	steps := []struct {
+		args []string
+		warn string
+	}{
+		{[]string{"add", "--project", "other", "Unbudgeted"}, ""},
+		{[]string{"add", "--project", "side", "Newsletter"}, "+side is over budget: 3 open tasks, budget 2"},
+	}
+	for _, step := range steps {
+		_, stderr, err := runCommand(t, step.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if step.warn == "" && strings.Contains(stderr, "⚠️") || !strings.Contains(stderr, step.warn) {
+			t.Errorf("%v: stderr %q, want warning %q", step.args, stderr, step.warn)
+		}
+	}
+	if _, _, err := runCommand(t, "add", "--project", "side", "--strict-budget", "Blog"); !errors.Is(err, ErrLimit) || len(readStore(t)) != 5 {
+		t.Errorf("add --strict-budget over budget: err %v, want it refused", err)
+	}
+	want := budgetUsage{Project: "side", OpenTasks: 3, OpenLimit: 2, Hours: 5.5, HoursLimit: 5, Utilization: 1.5}
+	if got := usage(); got != want {
+		t.Errorf("stats reports %+v, want %+v", got, want)
+	}
+
+	if _, _, err := runCommand(t, "track", "stop", "--strict-budget"); !errors.Is(err, ErrLimit) {
+		t.Errorf("track stop --strict-budget over budget: err %v, want it refused", err)
+	}
+	if _, e := runningTimer(readStore(t)); e < 0 {
+		t.Error("refused track stop stopped the timer")
+	}
+	out, stderr, err := runCommand(t, "track", "stop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "Tracked 2h30m on task #3") || !strings.Contains(stderr, "+side is over budget: 5h30m tracked this week, budget 5h") {
+		t.Errorf("track stop printed %q and %q", out, stderr)
+	}
+	out, _, err = runCommand(t, "projects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bar := range []string{"open tasks  ██████████ 3/2", "this week   ██████████ 5h30m/5h"} {
+		if !strings.Contains(out, bar) {
+			t.Errorf("projects lacks %q:\n%s", bar, out)
+		}
+	}
+
+	// on Sunday the week from Monday still holds the hours; one from Sunday does not
+	clock = fixedClock(time.Date(2026, 6, 14, 10, 0, 0, 0, time.Local))
+	if got := usage().Hours; got != 5.5 {
+		t.Errorf("with week_start monday, Sunday's week has %gh, want 5.5", got)
+	}
+	config.WeekStart = "sunday"
+	if got := usage().Hours; got != 0 {
+		t.Errorf("with week_start sunday, Sunday's week has %gh, want 0", got)
+	}
+}
+
+// TestRecentRefs checks that @last, @prev and @n name tasks by creation
+// time with ties broken by ID, work wherever an ID does, and fail clearly
+// when there are too few tasks
+func TestRecentRefs(t *testing.T) {
+	useTestStore(t, []Task{
+		{ID: 1, Title: "First", Status: "todo", CreatedAt: "2026-06-09 09:00:00"},
+		{ID: 2, Title: "Same second, lower ID", Status: "todo", CreatedAt: "2026-06-09 10:00:00"},
+		{ID: 3, Title: "Same second, higher ID", Status: "todo", CreatedAt: "2026-06-09 10:00:00"},
+		{ID: 4, Title: "Imported, created earlier", Status: "todo", CreatedAt: "2026-06-01 08:00:00"},
+	})
+	for _, c := range []struct {
+		ref  string
+		want int
+		err  string
+	}{
+		{"@last", 3, ""},
+		{"@prev", 2, ""},
+		{"@1", 3, ""},
+		{"@3", 1, ""},
+		{"@4", 4, ""},
+		{"@5", 0, "@5 needs at least 5 tasks, but there are 4 tasks"},
+		{"@0", 0, "invalid task reference @0"},
+		{"@first", 0, "invalid task reference @first"},
+	} {
+		got, err := parseID(c.ref)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("parseID(%q) = %d, %v, want an error with %q", c.ref, got, err, c.err)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("parseID(%q) = %d, %v, want %d", c.ref, got, err, c.want)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"add", "Call bank"},
+		{"set", "@last", "--due", "tomorrow"},
+		{"done", "@prev"},
+	} {
+		if _, _, err := runCommand(t, args...); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+	tasks := readStore(t)
+	if added := tasks[len(tasks)-1]; added.Title != "Call bank" || added.DueDate != "2026-06-11" {
+		t.Errorf("set @last after add changed %q (due %q), want Call bank due 2026-06-11", added.Title, added.DueDate)
+	}
+	if tasks[2].Status != "done" || tasks[1].Status != "todo" {
+		t.Errorf("done @prev completed the wrong task: %+v", tasks)
+	}
+	if _, _, err := runCommand(t, "show", "@9"); err == nil || !strings.Contains(err.Error(), "needs at least 9 tasks, but there are 5 tasks") {
+		t.Errorf("show @9: err %v, want it to say there are too few tasks", err)
+	}
+	if help, _, _ := runCommand(t, "help"); !strings.Contains(help, "@last (the newest task), @prev") {
+		t.Error("help does not explain @last and @prev")
+	}
+}
+
+// TestListViews checks that list remembers the sort, filter and grouping
+// chosen for each status argument on a terminal, reuses them for a bare
+// list and shows them in the header, forgets them with --reset-view, and
+// never applies or saves them when its output goes to a script
+func TestListViews(t *testing.T) {
+	useTestStore(t, generateFixtures(2, 30, testNow))
+	// os.DevNull is a character device, which isTerminal takes for a terminal
+	onTerminal := func(args ...string) {
+		t.Helper()
+		devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer devNull.Close()
+		stdout := os.Stdout
+		os.Stdout = devNull
+		defer func() { os.Stdout = stdout }()
+		if err := run(context.Background(), args); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+	views := func() map[string]listView {
+		t.Helper()
+		views, err := loadViews()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return views
+	}
+
+	if _, _, err := runCommand(t, "list", "--sort", "due"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(viewFile); !os.IsNotExist(err) {
+		t.Fatalf("list to a pipe saved a view: %v", err)
+	}
+
+	onTerminal("list", "--sort", "due", "--filter", "tag:urgent")
+	onTerminal("list", "todo", "--waiting")
+	want := map[string]listView{"": {Sort: "due", Filter: "tag:urgent"}, "todo": {Waiting: true}}
+	if got := views(); !reflect.DeepEqual(got, want) {
+		t.Errorf("views are %+v, want %+v", got, want)
+	}
+	saved, _ := os.ReadFile(viewFile)
+	onTerminal("list")
+	onTerminal("list", "todo")
+	if after, _ := os.ReadFile(viewFile); !bytes.Equal(after, saved) {
+		t.Errorf("a bare list rewrote the views:\n%s", after)
+	}
+
+	// a bare list takes the remembered view; a flag replaces only its own part
+	opts := listOptions{Sort: config.DefaultSort}
+	if view := views()[""].merge(&opts, nil); opts.Sort != "due" || opts.Filter != "tag:urgent" || view != want[""] {
+		t.Errorf("bare list runs with %+v and keeps %+v", opts, view)
+	}
+	opts = listOptions{Sort: config.DefaultSort, Filter: "project:home"}
+	if view := views()[""].merge(&opts, map[string]bool{"filter": true}); opts.Sort != "due" || view.Filter != "project:home" || view.Sort != "due" {
+		t.Errorf("list --filter project:home runs with %+v and keeps %+v", opts, view)
+	}
+
+	out, _, err := captureOutput(t, func() error {
+		return listTasks(context.Background(), listOptions{Sort: "due", Filter: "tag:urgent", View: want[""].describe()})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header, _, _ := strings.Cut(out, "\n"); !strings.Contains(header, "(view: sort=due, filter=tag:urgent)") {
+		t.Errorf("header %q does not show the view", header)
+	}
+	if out, _, err := runCommand(t, "list"); err != nil || strings.Contains(out, "(view:") || !strings.Contains(out, "#1:") {
+		t.Errorf("list to a pipe applied the view (%v):\n%s", err, out)
+	}
+
+	onTerminal("list", "--reset-view")
+	if got := views(); !reflect.DeepEqual(got, map[string]listView{"todo": {Waiting: true}}) {
+		t.Errorf("after list --reset-view the views are %+v, want only the one for todo", got)
+	}
+}
+
+// TestDueSlippage checks that moving a due date is recorded with its
+// reason while setting the first one is not, and that report slippage and
+// show count the moves and the days slipped
+func TestDueSlippage(t *testing.T) {
+	created := testNow.AddDate(0, 0, -7).Format(timeLayout)
+	useTestStore(t, []Task{
+		{ID: 1, Title: "Vendor contract", Status: "todo", CreatedAt: created},
+		{ID: 2, Title: "Slides", Status: "todo", CreatedAt: created, DueDate: "2026-06-12"},
+		{ID: 3, Title: "Taxes", Status: "todo", CreatedAt: created, DueDate: "2026-06-15"},
+	})
+	for _, args := range [][]string{
+		{"set", "1", "--due", "2026-06-20"},
+		{"set", "1", "--due", "2026-06-27", "--because", "waiting on vendor"},
+		{"set", "1", "--due", "2026-07-04"},
+		{"set", "2", "--due", "2026-06-30"},
+		{"set", "3", "--due", "2026-06-13"},
+		{"set", "3", "--due", "2026-06-13"},
+	} {
+		if _, _, err := runCommand(t, args...); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+	if _, _, err := runCommand(t, "set", "2", "--because", "no reason"); errorKind(err) != ErrUsage {
+		t.Errorf("--because without --due: err %v, want a usage error", err)
+	}
+	history := readStore(t)[0].History
+	if len(history) != 3 || history[1] != (HistoryEvent{At: testNow.Format(timeLayout), Field: "due", From: "2026-06-20", To: "2026-06-27", Note: "waiting on vendor"}) {
+		t.Errorf("task 1 history is %+v, want each change with the reason on the second", history)
+	}
+
+	out, _, err := runCommand(t, "report", "slippage", "--json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var slips []dueSlip
+	if err := json.Unmarshal([]byte(out), &slips); err != nil {
+		t.Fatal(err)
+	}
+	want := []dueSlip{
+		{ID: 2, Title: "Slides", DueDate: "2026-06-30", Moves: 1, SlipDays: 18},
+		{ID: 1, Title: "Vendor contract", DueDate: "2026-07-04", Moves: 2, SlipDays: 14, LastReason: "waiting on vendor"},
+		{ID: 3, Title: "Taxes", DueDate: "2026-06-13", Moves: 1, SlipDays: 0},
+	}
+	if !reflect.DeepEqual(slips, want) {
+		t.Errorf("report slippage is\n%+v\nwant\n%+v", slips, want)
+	}
+
+	if out, _, err := runCommand(t, "show", "1"); err != nil || !strings.Contains(out, "Due:        2026-07-04 (moved 2×)") {
+		t.Errorf("show 1 (%v):\n%s", err, out)
+	}
+	if _, _, err := runCommand(t, "add", "--due", "2026-06-19", "Fresh"); err != nil {
+		t.Fatal(err)
+	}
+	if out, _, err := runCommand(t, "show", "4"); err != nil || strings.Contains(out, "moved") {
+		t.Errorf("show of a task whose due date never moved (%v):\n%s", err, out)
+	}
+}
+
+// TestLocalDataFile checks that commands find the nearest .tasks.json
+// walking up from the current directory, that --global, --file and
+// TASK_TRACKER_FILE skip the search, and that doctor and --verbose name the
+// store in use
+func TestLocalDataFile(t *testing.T) {
+	useTestStore(t, nil)
+	t.Setenv(clockEnv, testNow.Format(timeLayout))
+	root, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, deep := filepath.Join(root, "repo"), filepath.Join(root, "repo", "src", "deep")
+	if err := os.MkdirAll(deep, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// main runs each command line in a new process
+	command := func(args ...string) (string, string, error) {
+		t.Helper()
+		globals = globalOptions{ErrorFormat: "text", Plain: true}
+		useDataFile(defaultDataFile, "default")
+		return captureOutput(t, func() error { return start(context.Background(), args) })
+	}
+	titles := func(path string) []string {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tasks []Task
+		if err := json.Unmarshal(data, &tasks); err != nil {
+			t.Fatal(err)
+		}
+		var titles []string
+		for _, task := range tasks {
+			titles = append(titles, task.Title)
+		}
+		return titles
+	}
+
+	t.Chdir(repo)
+	if _, _, err := command("init", "--local"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := command("init", "--local"); errorKind(err) != ErrInvalid {
+		t.Errorf("second init --local: err %v, want it refused", err)
+	}
+	t.Chdir(deep)
+	for _, args := range [][]string{
+		{"add", "Fix the parser"},
+		{"add", "Global task", "--global"},
+		{"--file", "other.json", "add", "Explicit task"},
+	} {
+		if _, _, err := command(args...); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+	t.Setenv(dataFileEnv, filepath.Join(root, "env.json"))
+	if _, _, err := command("add", "From the environment"); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(dataFileEnv, "")
+	for path, want := range map[string][]string{
+		filepath.Join(repo, localDataFile):   {"Fix the parser"},
+		filepath.Join(deep, defaultDataFile): {"Global task"},
+		filepath.Join(deep, "other.json"):    {"Explicit task"},
+		filepath.Join(root, "env.json"):      {"From the environment"},
+	} {
+		if got := titles(path); !slices.Equal(got, want) {
+			t.Errorf("%s holds %q, want %q", path, got, want)
+		}
+	}
+
+	local := filepath.Join(repo, localDataFile)
+	_, stderr, err := command("--verbose", "list")
+	if err != nil || !strings.Contains(stderr, "Using "+local+" (found .tasks.json)") {
+		t.Errorf("--verbose list (%v) printed %q, want the store found in %s", err, stderr, repo)
+	}
+	out, _, _ := command("doctor")
+	if !strings.Contains(out, "Checking "+local+" (found .tasks.json)") {
+		t.Errorf("doctor does not name the store in use:\n%s", out)
+	}
+	if _, _, err := command("--file", "other.json", "--global", "list"); errorKind(err) != ErrUsage {
+		t.Errorf("--file with --global: err %v, want a usage error", err)
+	}
+}
+
+// TestContextGuards checks the confirm_context guards: changes to that
+// store are announced with its name, a batch over confirm_batch needs the
+// name typed on a terminal and is refused off one, a --context naming
+// another store is warned about, and --force skips all of it
+func TestContextGuards(t *testing.T) {
+	useTestStore(t, []Task{{ID: 1, Title: "Write report", Status: "todo", CreatedAt: testNow.Format(timeLayout)}})
+	t.Setenv(clockEnv, testNow.Format(timeLayout))
+	if err := os.WriteFile(configFile, []byte(`{"confirm_context": "global", "confirm_batch": 2}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, count := range map[string]int{"small.json": 2, "big.json": 3} {
+		var tasks []Task
+		for i := range count {
+			tasks = append(tasks, Task{Title: fmt.Sprintf("Imported %d", i), Status: "todo", CreatedAt: testNow.Format(timeLayout)})
+		}
+		data, _ := json.Marshal(tasks)
+		if err := os.WriteFile(name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a pipe says "global" but is not a terminal; the null device is a
+	// character device, which isTerminal takes for one, and reads nothing
+	pipe := func() *os.File {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.WriteString("global\n")
+		w.Close()
+		return r
+	}
+	devNull := func() *os.File {
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	command := func(stdin *os.File, args ...string) (string, error) {
+		t.Helper()
+		defer stdin.Close()
+		saved := os.Stdin
+		os.Stdin = stdin
+		defer func() { os.Stdin = saved }()
+		globals = globalOptions{ErrorFormat: "text", Plain: true}
+		_, stderr, err := captureOutput(t, func() error { return start(context.Background(), args) })
+		return stderr, err
+	}
+
+	for _, c := range []struct {
+		stdin    func() *os.File
+		args     []string
+		kind     error
+		announce bool
+		warn     string
+	}{
+		{pipe, []string{"list"}, nil, false, ""},
+		{pipe, []string{"add", "Personal errand"}, nil, true, ""},
+		{pipe, []string{"import", "json", "small.json"}, nil, true, ""},
+		{pipe, []string{"import", "json", "big.json"}, ErrUsage, true, "needs confirmation; run it on a terminal or pass --force"},
+		{devNull, []string{"import", "json", "big.json"}, ErrCanceled, true, "Type global to continue"},
+		{pipe, []string{"--context", "work", "list"}, nil, false, "--context work, but the task store in use is global"},
+		{pipe, []string{"--force", "--context", "work", "import", "json", "big.json"}, nil, false, ""},
+	} {
+		stderr, err := command(c.stdin(), c.args...)
+		if c.kind == nil && err != nil || c.kind != nil && !errors.Is(err, c.kind) {
+			t.Errorf("%v: err %v, want %v", c.args, err, c.kind)
+		}
+		if strings.Contains(stderr, "[global]") != c.announce {
+			t.Errorf("%v: stderr %q, want the store announced: %v", c.args, stderr, c.announce)
+		}
+		if err != nil {
+			stderr += err.Error()
+		}
+		if c.warn == "" && strings.Contains(stderr, "⚠️") || !strings.Contains(stderr, c.warn) {
+			t.Errorf("%v: printed and failed with %q, want %q", c.args, stderr, c.warn)
+		}
+	}
+	if tasks := readStore(t); len(tasks) != 7 {
+		t.Errorf("got %d tasks, want 7: the two refused imports must write nothing", len(tasks))
+	}
+
+	// other stores are not guarded
+	if err := os.WriteFile(configFile, []byte(`{"confirm_context": "work", "confirm_batch": 2}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if stderr, err := command(pipe(), "import", "json", "big.json"); err != nil || strings.Contains(stderr, "[global]") || strings.Contains(stderr, "⚠️") {
+		t.Errorf("import into an unguarded store: %v, %q", err, stderr)
+	}
+}
+
+// TestLegend checks that legend explains every symbol a list line can
+// show and records them as seen, and that list hints at legend only on a
+// terminal and only while it shows a symbol not seen before
+func TestLegend(t *testing.T) {
+	explained := map[string]legendEntry{}
+	for _, entry := range append(append([]legendEntry{}, statusLegend...), badgeLegend...) {
+		explained[entry.key] = entry
+	}
+	tasks := generateFixtures(1, 300, testNow)
+	tasks = append(tasks, Task{ID: 301, Title: "Everything at once", Status: "todo", CreatedAt: testNow.Format(timeLayout),
+		Priority: PriorityHigh, Pinned: true, BlockedBy: []int{1}, Waiting: &WaitingOn{Person: "Sam", Since: "2026-06-01", Until: "2026-06-05"},
+		Project: "work", Tags: []string{"a"}, DueDate: "2026-06-01", Recurrence: "1w"})
+	useTestStore(t, tasks)
+	scores := urgencyScores(tasks, testNow)
+	shown := map[string]bool{}
+	for _, task := range tasks {
+		for _, key := range legendKeys(task, scores) {
+			shown[key] = true
+			if _, ok := explained[key]; !ok {
+				t.Errorf("task %d shows %q, which legend does not explain", task.ID, key)
+			}
+		}
+	}
+	if want := []string{"urgency", "priority", "pinned", "blocked", "follow-up", "project", "tag", "due", "overdue", "recurring"}; !slices.Equal(legendKeys(tasks[300], scores)[1:], want) {
+		t.Errorf("task 301 shows %q, want the status and %q", legendKeys(tasks[300], scores), want)
+	}
+
+	out, _, err := runCommand(t, "legend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range explained {
+		if !strings.Contains(out, entry.symbol) || !strings.Contains(out, entry.meaning) || !strings.Contains(out, entry.command) {
+			t.Errorf("legend does not explain %q (%s)", entry.symbol, entry.meaning)
+		}
+	}
+	if state, err := loadState(); err != nil || len(state.SeenSymbols) != len(explained) {
+		t.Errorf("legend recorded %q as seen (%v), want all %d symbols", state.SeenSymbols, err, len(explained))
+	}
+	if markLegendSeen([]string{"pinned", "status:done"}) {
+		t.Error("symbols legend explained count as new")
+	}
+
+	// the hint goes with the first symbol not seen yet, and never again
+	useTestStore(t, tasks[:5])
+	if out, _, err := runCommand(t, "list"); err != nil || strings.Contains(out, "legend") {
+		t.Errorf("list to a pipe (%v) printed a hint:\n%s", err, out)
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Errorf("list to a pipe recorded symbols as seen: %v", err)
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	stdout := os.Stdout
+	os.Stdout = devNull // a character device, which isTerminal takes for a terminal
+	err = run(context.Background(), []string{"list"})
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadState()
+	if err != nil || len(state.SeenSymbols) == 0 {
+		t.Fatalf("list on a terminal recorded %q (%v), want the symbols it showed", state.SeenSymbols, err)
+	}
+	for _, key := range state.SeenSymbols {
+		if !shown[key] {
+			t.Errorf("list recorded %q, which it cannot show", key)
+		}
+	}
+	if markLegendSeen(state.SeenSymbols) {
+		t.Error("the symbols already hinted at count as new again")
+	}
+	if !markLegendSeen([]string{"recurring", "status:todo"}) || markLegendSeen([]string{"recurring"}) {
+		t.Error("a symbol new to the state file must be hinted at exactly once")
+	}
+}
+
+// TestSchema checks that the schema in config.json is enforced by add,
+// set, import and the API, that fsck and maintain --enforce-schema list
+// the open tasks breaking it, and that without a schema nothing changes
+func TestSchema(t *testing.T) {
+	useTestStore(t, []Task{
+		{ID: 1, Title: "Old open task", Status: "todo", CreatedAt: "2026-06-01 09:00:00"},
+		{ID: 2, Title: "Old done task", Status: "done", CreatedAt: "2026-06-01 09:00:00", CompletedAt: "2026-06-02 09:00:00"},
+	})
+	if _, _, err := runCommand(t, "add", "Bare task"); err != nil {
+		t.Fatalf("add without a schema: %v", err)
+	}
+	if out, _, _ := runCommand(t, "doctor"); strings.Contains(out, "schema") {
+		t.Errorf("doctor talks about a schema that is not set:\n%s", out)
+	}
+
+	useTestStore(t, []Task{
+		{ID: 1, Title: "Old open task", Status: "todo", CreatedAt: "2026-06-01 09:00:00"},
+		{ID: 2, Title: "Old done task", Status: "done", CreatedAt: "2026-06-01 09:00:00", CompletedAt: "2026-06-02 09:00:00"},
+	})
+	config.Schema = Schema{Required: []string{"project", "priority", "due"}, Projects: []string{"work", "home"}}
+
+	_, _, err := runCommand(t, "add", "Bare task")
+	if errorKind(err) != ErrInvalid {
+		t.Fatalf("add breaking the schema: %v", err)
+	}
+	for _, want := range []string{"missing project", "missing priority", "missing due date"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not say %q", err, want)
+		}
+	}
+	if _, _, err := runCommand(t, "add", "--project", "garden", "--priority", "high", "--due", "tomorrow", "Weeding"); errorKind(err) != ErrInvalid ||
+		!strings.Contains(err.Error(), `project "garden" is not allowed (use work, home)`) {
+		t.Errorf("add with a project outside the schema: %v", err)
+	}
+	if _, _, err := runCommand(t, "add", "--project", "work", "--priority", "high", "--due", "tomorrow", "Write the report"); err != nil {
+		t.Errorf("add following the schema: %v", err)
+	}
+	if n := len(readStore(t)); n != 3 {
+		t.Errorf("refused adds were stored: %d tasks", n)
+	}
+
+	// an old task can be fixed one field at a time, but not made worse
+	if _, _, err := runCommand(t, "set", "1", "--project", "work"); err != nil {
+		t.Errorf("set fixing one field of an old task: %v", err)
+	}
+	if _, _, err := runCommand(t, "set", "1", "--project", "garden"); errorKind(err) != ErrInvalid {
+		t.Errorf("set to a project outside the schema: %v", err)
+	}
+	if task := readStore(t)[0]; task.Project != "work" {
+		t.Errorf("a refused set changed the task: %+v", task)
+	}
+
+	path := filepath.Join(t.TempDir(), "import.json")
+	incoming := `[{"title": "Fine", "project": "home", "priority": "low", "due_date": "2026-06-20"}, {"title": "No project", "priority": "low", "due_date": "2026-06-20"}, {"title": "Nothing"}]`
+	if err := os.WriteFile(path, []byte(incoming), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.ReadFile(dataFile)
+	_, _, err = runCommand(t, "import", "json", path, "--quiet")
+	if errorKind(err) != ErrInvalid || !strings.Contains(err.Error(), "2 tasks of 3 break the schema; nothing imported") {
+		t.Errorf("import breaking the schema: %v", err)
+	}
+	if after, _ := os.ReadFile(dataFile); !bytes.Equal(after, before) {
+		t.Error("a refused import rewrote the data file")
+	}
+
+	queue, err := newWriteQueue(&taskStore{}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	newAPIHandler(queue).ServeHTTP(rec, httptest.NewRequest("POST", "/tasks", strings.NewReader(`{"title": "From the API", "project": "work"}`)))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "missing priority") {
+		t.Errorf("POST /tasks breaking the schema: %d %s", rec.Code, rec.Body)
+	}
+
+	out, _, _ := runCommand(t, "doctor")
+	if !strings.Contains(out, "Task #1 breaks the schema: missing priority; missing due date") ||
+		strings.Contains(out, "Task #2 breaks") || !strings.Contains(out, "Tasks breaking the schema: 1") {
+		t.Errorf("doctor does not list the open task breaking the schema:\n%s", out)
+	}
+
+	before, _ = os.ReadFile(dataFile)
+	out, _, err = runCommand(t, "maintain", "--enforce-schema", "--dry-run")
+	if err != nil || !strings.Contains(out, "Old open task: missing priority; missing due date") || strings.Contains(out, "Old done task") ||
+		!strings.Contains(out, "Tasks breaking the schema: 1; nothing written") {
+		t.Errorf("maintain --enforce-schema --dry-run: %v\n%s", err, out)
+	}
+	if after, _ := os.ReadFile(dataFile); !bytes.Equal(after, before) {
+		t.Error("maintain --dry-run rewrote the data file")
+	}
+	// go test may hand over /dev/null as stdin, which isTerminal takes for
+	// one; a pipe is what a script would give
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin; r.Close() }()
+	if _, _, err := runCommand(t, "maintain", "--enforce-schema"); errorKind(err) != ErrUsage {
+		t.Errorf("maintain --enforce-schema off a terminal: %v", err)
+	}
+}
+
+// TestAddUpdate checks that add --key --update applies every flag given to
+// the task holding the key, records each change and leaves the rest alone
+func TestAddUpdate(t *testing.T) {
+	useTestStore(t, nil)
+	if _, _, err := runCommand(t, "add", "--key", "k1", "--project", "work", "--tag", "a", "--every", "1mo", "--anchor", "due", "--due", "2026-06-15", "Write report"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := runCommand(t, "add", "--key", "k1", "--update", "--due", "2026-07-31", "--tag", "b,c", "--priority", "B", "Write the report"); err != nil {
+		t.Fatal(err)
+	}
+	tasks := readStore(t)
+	if len(tasks) != 1 {
+		t.Fatalf("got %d tasks, want the one updated", len(tasks))
+	}
+	task := tasks[0]
+	want := Task{Title: "Write the report", DueDate: "2026-07-31", RecurDay: 31, Project: "work", Tags: []string{"b", "c"}, Priority: PriorityMedium, Recurrence: "1mo", Anchor: AnchorDue}
+	got := Task{Title: task.Title, DueDate: task.DueDate, RecurDay: task.RecurDay, Project: task.Project, Tags: task.Tags, Priority: task.Priority, Recurrence: task.Recurrence, Anchor: task.Anchor}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("updated task is %+v, want %+v", got, want)
+	}
+	var fields []string
+	for _, event := range task.History {
+		fields = append(fields, event.Field)
+	}
+	if !reflect.DeepEqual(fields, []string{"title", "due", "tags", "priority"}) {
+		t.Errorf("history records %v", fields)
+	}
+
+	// a new interval keeps the series' anchor
+	if _, _, err := runCommand(t, "add", "--key", "k1", "--update", "--every", "2w", "Write the report"); err != nil {
+		t.Fatal(err)
+	}
+	if task := readStore(t)[0]; task.Recurrence != "2w" || task.Anchor != AnchorDue || task.RecurDay != 0 {
+		t.Errorf("after --every 2w: recurrence %q, anchor %q, recur day %d", task.Recurrence, task.Anchor, task.RecurDay)
+	}
+
+	if _, _, err := runCommand(t, "add", "--update", "No key"); errorKind(err) != ErrUsage {
+		t.Errorf("--update without --key: %v", err)
+	}
+}
+
+// TestAddUpdateSchema checks that an update may leave a task breaking the
+// schema as it did, but not break it in a new way
+func TestAddUpdateSchema(t *testing.T) {
+	useTestStore(t, []Task{{ID: 1, Title: "Old task", Status: "todo", CreatedAt: "2026-06-01 09:00:00", IdempotencyKey: "k1", Project: "work"}})
+	config.Schema = Schema{Required: []string{"project", "priority"}, Tags: []string{"a", "b"}}
+
+	// missing priority was already the case, and the project is kept
+	if _, _, err := runCommand(t, "add", "--key", "k1", "--update", "Renamed task"); err != nil {
+		t.Errorf("update keeping the task as it was: %v", err)
+	}
+	if _, _, err := runCommand(t, "add", "--key", "k1", "--update", "--tag", "x", "Renamed task"); errorKind(err) != ErrInvalid {
+		t.Errorf("update adding a tag outside the schema: %v", err)
+	}
+	if task := readStore(t)[0]; task.Title != "Renamed task" || len(task.Tags) != 0 {
+		t.Errorf("a refused update changed the task: %+v", task)
+	}
+	if _, _, err := runCommand(t, "add", "--key", "k2", "--update", "--project", "home", "New task"); errorKind(err) != ErrInvalid {
+		t.Errorf("--update adding a new task missing a priority: %v", err)
+	}
+}
+
+// TestPastPeriodsStable checks that working on tasks today leaves the
+// reports of a past week as they were
+func TestPastPeriodsStable(t *testing.T) {
+	useTestStore(t, []Task{
+		{ID: 1, Title: "Done last week", Status: "done", CreatedAt: "2026-06-02 09:00:00", CompletedAt: "2026-06-04 17:00:00", Project: "work", Tags: []string{"a"},
+			TimeLog: []TimeEntry{{Start: "2026-06-03 10:00:00", End: "2026-06-03 12:00:00"}}},
+		{ID: 2, Title: "Opened last week", Status: "todo", CreatedAt: "2026-06-03 09:00:00", Project: "work", Tags: []string{"b"}},
+		{ID: 3, Title: "Due last week", Status: "todo", CreatedAt: "2026-06-01 09:00:00", DueDate: "2026-06-05", Project: "home"},
+	})
+	lastWeek := func() (periodSummary, string) {
+		out, _, err := runCommand(t, "report", "week", "2026-06-03", "--json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var summary periodSummary
+		if err := json.Unmarshal([]byte(out), &summary); err != nil {
+			t.Fatal(err)
+		}
+		// the oldest open tasks are by definition those still open now
+		summary.OldestOpen = nil
+		hours, _, err := runCommand(t, "report", "time", "week", "2026-06-03", "--json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return summary, hours
+	}
+	before, beforeHours := lastWeek()
+	if before.Created != 3 || before.Completed != 1 {
+		t.Fatalf("last week has %d created and %d completed, want 3 and 1", before.Created, before.Completed)
+	}
+
+	for _, args := range [][]string{
+		{"done", "2"},
+		{"wait", "3", "--on", "sam"},
+		{"set", "3", "--due", "2026-06-20", "--tag", "c"},
+		{"track", "start", "3"},
+		{"track", "stop"},
+		{"add", "Added today"},
+	} {
+		if _, _, err := runCommand(t, args...); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+	after, afterHours := lastWeek()
+	if !reflect.DeepEqual(after, before) {
+		t.Errorf("last week changed:\n%+v\nwas\n%+v", after, before)
+	}
+	if afterHours != beforeHours {
+		t.Errorf("last week's hours changed:\n%s\nwas\n%s", afterHours, beforeHours)
+	}
+
+	// reopening a task takes back its completion, in the week it was done
+	if _, _, err := runCommand(t, "reopen", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if reopened, _ := lastWeek(); reopened.Completed != 0 {
+		t.Errorf("after reopening, last week has %d completed, want 0", reopened.Completed)
+	}
+}
+
+// TestRollupReports checks the month and quarter reports: every figure
+// for a known set of tasks, calendar quarter boundaries, all sections with
+// zeros for an empty period, and that stats agrees with the week report
+func TestRollupReports(t *testing.T) {
+	useTestStore(t, []Task{
+		{ID: 1, Title: "April task", Status: "done", CreatedAt: "2026-04-10 09:00:00", CompletedAt: "2026-04-12 09:00:00", Project: "work", Tags: []string{"a"}},
+		{ID: 2, Title: "Early May task", Status: "done", CreatedAt: "2026-05-01 09:00:00", CompletedAt: "2026-05-05 09:00:00", Project: "work", Tags: []string{"a", "b"}},
+		{ID: 3, Title: "Late May task", Status: "done", CreatedAt: "2026-05-20 09:00:00", CompletedAt: "2026-05-26 09:00:00", Project: "home", Tags: []string{"b"}},
+		{ID: 4, Title: "Still open", Status: "todo", CreatedAt: "2026-05-25 09:00:00"},
+		{ID: 5, Title: "March task", Status: "done", CreatedAt: "2026-03-30 09:00:00", CompletedAt: "2026-05-02 09:00:00", Project: "work"},
+		{ID: 6, Title: "This week", Status: "done", CreatedAt: "2026-06-08 09:00:00", CompletedAt: "2026-06-09 09:00:00"},
+	})
+	report := func(args ...string) periodSummary {
+		t.Helper()
+		out, _, err := runCommand(t, append(append([]string{"report"}, args...), "--json")...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var summary periodSummary
+		if err := json.Unmarshal([]byte(out), &summary); err != nil {
+			t.Fatal(err)
+		}
+		return summary
+	}
+
+	may := report("month", "2026-05")
+	want := periodSummary{
+		Period: "May 2026", Start: "2026-05-01", End: "2026-05-31",
+		Created: 3, Completed: 3, CreatedAndCompleted: 2, CompletionRate: 2.0 / 3, MedianDaysToComplete: 6,
+		TopTags:     []countEntry{{"b", 2}, {"a", 1}},
+		TopProjects: []countEntry{{"work", 2}, {"home", 1}},
+		OldestOpen:  []openTaskEntry{{ID: 4, Title: "Still open", CreatedAt: "2026-05-25 09:00:00", AgeDays: 16}},
+	}
+	if !reflect.DeepEqual(may, want) {
+		t.Errorf("May report is\n%+v\nwant\n%+v", may, want)
+	}
+	q2 := report("quarter", "2026-Q2")
+	if q2.Start != "2026-04-01" || q2.End != "2026-06-30" || q2.Created != 5 || q2.Completed != 5 || q2.CreatedAndCompleted != 4 || q2.MedianDaysToComplete != 4 {
+		t.Errorf("Q2 report is %+v, want 2026-04-01 to 2026-06-30 with 5 created, 5 completed (4 of them created in Q2), median 4 days", q2)
+	}
+	if q4 := report("quarter", "2026-q4"); q4.Start != "2026-10-01" || q4.End != "2026-12-31" {
+		t.Errorf("Q4 runs %s to %s, want 2026-10-01 to 2026-12-31", q4.Start, q4.End)
+	}
+	for _, args := range [][]string{{"quarter", "2026-Q5"}, {"month", "2026-13"}} {
+		if _, _, err := runCommand(t, append([]string{"report"}, args...)...); errorKind(err) != ErrInvalid {
+			t.Errorf("report %v: err %v, want an invalid input error", args, err)
+		}
+	}
+
+	empty := report("month", "2025-01")
+	if empty.Created != 0 || empty.Completed != 0 || empty.TopTags == nil || empty.TopProjects == nil || empty.OldestOpen == nil {
+		t.Errorf("empty month is %+v, want zeros and empty lists", empty)
+	}
+	for format, sections := range map[string][]string{
+		"":     {"Created:            0", "Completion rate:    0% (0 of 0 created)", "Top tags:           none", "Top projects:       none", "Oldest open tasks:  none"},
+		"--md": {"| Created | 0 |", "## Top tags\n\nNone.", "## Top projects\n\nNone.", "## Oldest open tasks\n\nNone."},
+	} {
+		args := []string{"report", "month", "2025-01"}
+		if format != "" {
+			args = append(args, format)
+		}
+		out, _, err := runCommand(t, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, section := range sections {
+			if !strings.Contains(out, section) {
+				t.Errorf("report month 2025-01 %s lacks %q:\n%s", format, section, out)
+			}
+		}
+	}
+
+	out, _, err := runCommand(t, "stats", "--json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats statsJSON
+	if err := json.Unmarshal([]byte(out), &stats); err != nil {
+		t.Fatal(err)
+	}
+	week := report("week")
+	if stats.WeekStart != week.Start || stats.WeekAdded != week.Created || stats.WeekCompleted != week.Completed || week.Completed != 1 {
+		t.Errorf("stats has week %s with %d added and %d completed, report week %s with %d and %d", stats.WeekStart, stats.WeekAdded, stats.WeekCompleted, week.Start, week.Created, week.Completed)
+	}
+}
+
+// TestSearch checks that search covers comments, long ones included, and
+// picks up a write made by another command to the data file behind a
+// cached index
+func TestSearch(t *testing.T) {
+	old := []Task{{ID: 1, Title: "Plan the trip", Status: "todo", CreatedAt: "2026-06-01 09:00:00",
+		Comments: []Comment{{At: "2026-06-02 10:00:00", Text: "Ask about the ferry timetable"}}}}
+	useTestStore(t, []Task{{ID: 1, Title: "Plan the holiday", Status: "todo", CreatedAt: "2026-06-01 09:00:00"}})
+	renamed, err := os.ReadFile(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveTasks(context.Background(), old); err != nil {
+		t.Fatal(err)
+	}
+
+	out, _, err := runCommand(t, "search", "ferry", "time")
+	if err != nil || !strings.Contains(out, "Plan the trip") {
+		t.Fatalf("search in comments printed %q, %v", out, err)
+	}
+
+	// another command renames the task behind the cached index
+	if err := os.WriteFile(dataFile, renamed, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later := testNow.Add(time.Hour)
+	if err := os.Chtimes(dataFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	out, _, err = runCommand(t, "search", "holiday")
+	if err != nil || !strings.Contains(out, "Plan the holiday") {
+		t.Errorf("search after another command's write printed %q, %v", out, err)
+	}
+
+	// a comment far longer than any index bound still matches by word
+	// prefix only, like every other field
+	long := strings.Repeat("lorem ipsum dolor ", 1000) + "Database MIGRATION notes"
+	useTestStore(t, []Task{{ID: 1, Title: "Long notes", Status: "todo", CreatedAt: "2026-06-01 09:00:00",
+		Comments: []Comment{{At: "2026-06-02 10:00:00", Text: long}}}})
+	for query, want := range map[string]bool{"migra": true, "data notes": true, "gration": false, "psum": false} {
+		out, _, err := runCommand(t, "search", query)
+		if err != nil || strings.Contains(out, "Long notes") != want {
+			t.Errorf("search %q in a long comment printed %q, %v; want a match: %v", query, out, err, want)
+		}
+	}
+}
+
+// BenchmarkSearch measures building the index over 10,000 tasks with a
+// 1 KB comment each, and searching it once built
+func BenchmarkSearch(b *testing.B) {
+	words := strings.Fields("alpha bravo charlie delta echo foxtrot golf hotel india juliett kilo lima mike november oscar papa quebec romeo sierra tango")
+	tasks := make([]Task, 10000)
+	for i := range tasks {
+		var text strings.Builder
+		for j := 0; text.Len() < 1024; j++ {
+			text.WriteString(words[(i*7+j*3)%len(words)])
+			fmt.Fprintf(&text, "%d ", (i+j)%97)
+		}
+		tasks[i] = Task{ID: i + 1, Title: fmt.Sprintf("Task %d %s", i, words[i%len(words)]), Project: words[i%5], Tags: []string{words[i%3]},
+			Comments: []Comment{{At: "2026-06-01 09:00:00", Text: text.String()}}}
+	}
+
+	b.Run("build", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			buildSearchIndex(tasks)
+		}
+	})
+	b.Run("query", func(b *testing.B) {
+		index := buildSearchIndex(tasks)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			index.search("char del")
+		}
+	})
+}
+
+// TestScanRefs checks which "#<id>" are task references, in decimal and in
+// base36, and that naming an existing task wins over looking like a color
+func TestScanRefs(t *testing.T) {
+	useTestStore(t, nil)
+	t.Cleanup(func() { config = defaultConfig() })
+	tasks := []Task{{ID: 101001}, {ID: 888}, {ID: 19995}}
+	tests := []struct {
+		text string
+		want []taskRef
+	}{
+		{"see #12", []taskRef{{ID: 12, Start: 4, End: 7, Relation: RefLink}}},
+		{"#3 first", []taskRef{{ID: 3, Start: 0, End: 2, Relation: RefLink}}},
+		{"blocked by #7.", []taskRef{{ID: 7, Start: 11, End: 13, Relation: RefBlockedBy}}},
+		{"blocks (#8)", []taskRef{{ID: 8, Start: 8, End: 10, Relation: RefBlocks}}},
+		{"fixes #333", []taskRef{{ID: 333, Start: 6, End: 10, Relation: RefLink}}},
+		{"see #1234 and #5", []taskRef{{ID: 1234, Start: 4, End: 9, Relation: RefLink}, {ID: 5, Start: 14, End: 16, Relation: RefLink}}},
+		{"#fff", nil},
+		{"#0a0a0a", nil},
+		{"#123456", nil},
+		{"use #12345678 for the overlay", nil},
+		{"text color #333", nil},
+		{"Colour: #1234", nil},
+		{"background #999 on hover", nil},
+		{"border: 1px solid #333;", nil},
+		{"color:#333", nil},
+		{"page#12", nil},
+		{"&#38;", nil},
+		{"## 12", nil},
+		{"# Plan", nil},
+		{"`#12`", nil},
+		{"#012", nil},
+		{"#12a", nil},
+		{"see #101001", []taskRef{{ID: 101001, Start: 4, End: 11, Relation: RefLink}}},
+		{"see #101002", nil},
+		{"text color #888", []taskRef{{ID: 888, Start: 11, End: 15, Relation: RefLink}}},
+		{"#fff", nil},
+		{"ÿ#12", nil},
+		{"#12é", nil},
+	}
+	for _, tt := range tests {
+		if got := scanRefs(tt.text, tasks); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("scanRefs(%q) = %+v, want %+v", tt.text, got, tt.want)
+		}
+	}
+
+	// with base36 IDs, a word naming a task is a reference and any other
+	// one, such as a hashtag or a hex color, is not
+	config.IDDisplay = "base36"
+	base36 := []struct {
+		text string
+		want []taskRef
+	}{
+		{"after #25xl", []taskRef{{ID: 101001, Start: 6, End: 11, Relation: RefBlockedBy}}},
+		{"see #fff", []taskRef{{ID: 19995, Start: 4, End: 8, Relation: RefLink}}},
+		{"see #FFF", []taskRef{{ID: 19995, Start: 4, End: 8, Relation: RefLink}}},
+		{"see #101001", []taskRef{{ID: 101001, Start: 4, End: 11, Relation: RefLink}}},
+		{"#todo later", nil},
+		{"fill #0a0a0a", nil},
+		{"see #12", []taskRef{{ID: 12, Start: 4, End: 7, Relation: RefLink}}},
+	}
+	for _, tt := range base36 {
+		if got := scanRefs(tt.text, tasks); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("with base36 IDs, scanRefs(%q) = %+v, want %+v", tt.text, got, tt.want)
+		}
+	}
+}
+
+// TestPrintEmpty checks the empty-state line, its fallback for a key
+// without one, that --quiet leaves it out while --errors json does not,
+// and that every suggestion is a command and flags help lists
+func TestPrintEmpty(t *testing.T) {
+	useTestStore(t, []Task{})
+	tests := []struct {
+		name  string
+		setup func()
+		want  string
+	}{
+		{"default", func() {}, "🔍 No tasks match \"nothing\"\n"},
+		{"quiet", func() { globals.Quiet = true }, ""},
+		{"errors json", func() { globals.ErrorFormat = "json" }, "🔍 No tasks match \"nothing\"\n"},
+	}
+	for _, tt := range tests {
+		globals = globalOptions{ErrorFormat: "text", Plain: true}
+		tt.setup()
+		out, _, err := runCommand(t, "search", "nothing")
+		if err != nil || out != tt.want {
+			t.Errorf("%s: search printed %q, %v; want %q", tt.name, out, err, tt.want)
+		}
+	}
+
+	globals = globalOptions{ErrorFormat: "text", Plain: true}
+	out, _, _ := captureOutput(t, func() error {
+		printEmpty("no such command")
+		return nil
+	})
+	if out != "Nothing to show\n" {
+		t.Errorf("unregistered key printed %q", out)
+	}
+
+	for _, command := range commandHelps {
+		for variant, state := range command.empty {
+			// the command is the words up to the first argument or flag
+			var words, flags []string
+			args := false
+			for _, word := range strings.Fields(state.next) {
+				args = args || strings.ContainsAny(word[:1], "-<\"[")
+				switch {
+				case strings.HasPrefix(word, "--"):
+					flags = append(flags, word)
+				case !args:
+					words = append(words, word)
+				}
+			}
+			i := slices.IndexFunc(commandHelps, func(c commandHelp) bool {
+				return strings.Contains("\n"+c.help, "\n  "+strings.Join(words, " ")+" ")
+			})
+			if i < 0 {
+				t.Errorf("empty state %s:%s suggests %q, which help does not list", command.name, variant, state.next)
+				continue
+			}
+			for _, flag := range flags {
+				if !strings.Contains(commandHelps[i].help, flag) {
+					t.Errorf("empty state %s:%s suggests %s, which help does not list for %s", command.name, variant, flag, strings.Join(words, " "))
+				}
+			}
+		}
+	}
+
+	if _, err := parseGlobalFlags([]string{"add", "--quiet", "Task"}); err != nil || !globals.Quiet {
+		t.Errorf("--quiet after the command: quiet %v, %v", globals.Quiet, err)
+	}
+	out, _, err := runCommand(t, "add", "Task")
+	if err != nil || strings.TrimSpace(out) != "1" {
+		t.Errorf("add with the global --quiet printed %q, %v; want the ID alone", out, err)
+	}
+}
+
+// TestConcurrentCaptures checks that captures made from many goroutines,
+// while drains run, each end up as exactly one task
+func TestConcurrentCaptures(t *testing.T) {
+	useTestStore(t, nil)
+	const workers, perWorker = 8, 25
+	const captures = workers * perWorker
+	ctx := context.Background()
+
+	_, _, err := captureOutput(t, func() error {
+		var wg sync.WaitGroup
+		errs := make(chan error, workers+1)
+		stop := make(chan struct{})
+		drained := make(chan struct{})
+		go func() {
+			defer close(drained)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := drainCaptures(ctx); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := w * perWorker; i < (w+1)*perWorker; i++ {
+					if err := captureTask(fmt.Sprintf("Captured %d", i), true); err != nil {
+						errs <- err
+						return
+					}
+					// spread the captures over many drains
+					time.Sleep(200 * time.Microsecond)
+				}
+			}()
+		}
+		wg.Wait()
+		close(stop)
+		<-drained
+		close(errs)
+		for err := range errs {
+			return err
+		}
+		return drainCaptures(ctx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	titles := map[string]int{}
+	keys := map[string]bool{}
+	for _, task := range readStore(t) {
+		titles[task.Title]++
+		if keys[task.IdempotencyKey] {
+			t.Errorf("key %s added twice", task.IdempotencyKey)
+		}
+		keys[task.IdempotencyKey] = true
+	}
+	for i := 0; i < captures; i++ {
+		if n := titles[fmt.Sprintf("Captured %d", i)]; n != 1 {
+			t.Errorf("capture %d became %d tasks", i, n)
+		}
+	}
+	if _, err := os.Stat(captureFile); !os.IsNotExist(err) {
+		t.Errorf("%s is left after the last drain: %v", captureFile, err)
+	}
+}
+
+// TestServeTokens checks serve's api_tokens: requests need a known token,
+// a read token cannot write, and a token's filter hides the tasks outside
+// it from listing and lookup alike
+func TestServeTokens(t *testing.T) {
+	useTestStore(t, []Task{
+		{ID: 1, Title: "Family dinner", Status: "todo", CreatedAt: "2026-06-01 09:00:00", Tags: []string{"family"}},
+		{ID: 2, Title: "Quarterly review", Status: "todo", CreatedAt: "2026-06-01 09:00:00", Tags: []string{"work"}},
+		{ID: 3, Title: "Birthday present", Status: "todo", CreatedAt: "2026-06-02 09:00:00", Tags: []string{"family"}},
+	})
+	config.APITokens = map[string]APIToken{
+		"tablet": {Hash: hashToken("tt_read"), Scope: "read", Filter: "tag:family"},
+		"laptop": {Hash: hashToken("tt_write"), Scope: "write"},
+	}
+	queue, err := newWriteQueue(&taskStore{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go queue.run(ctx)
+	handler := newAPIHandler(queue)
+
+	request := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name, method, path, token, body string
+		code                            int
+		contains                        string
+	}{
+		{"no token", "GET", "/tasks", "", "", http.StatusUnauthorized, `"unauthorized"`},
+		{"unknown token", "GET", "/tasks", "tt_guess", "", http.StatusUnauthorized, `"unauthorized"`},
+		{"read token writing", "POST", "/tasks", "tt_read", `{"title": "Sneaky"}`, http.StatusForbidden, "has scope read"},
+		{"read token completing", "POST", "/tasks/1/done", "tt_read", "", http.StatusForbidden, "needs scope write"},
+		{"task outside the filter", "GET", "/tasks/2", "tt_read", "", http.StatusNotFound, `"not_found"`},
+		{"task inside the filter", "GET", "/tasks/3", "tt_read", "", http.StatusOK, "Birthday present"},
+		{"write token", "GET", "/tasks/2", "tt_write", "", http.StatusOK, "Quarterly review"},
+	}
+	for _, tt := range tests {
+		rec := request(tt.method, tt.path, tt.token, tt.body)
+		if rec.Code != tt.code || !strings.Contains(rec.Body.String(), tt.contains) {
+			t.Errorf("%s: %s %s answered %d %s, want %d with %s", tt.name, tt.method, tt.path, rec.Code, rec.Body, tt.code, tt.contains)
+		}
+	}
+	if rec := request("GET", "/tasks", "", ""); rec.Header().Get("WWW-Authenticate") == "" {
+		t.Error("401 without WWW-Authenticate")
+	}
+
+	rec := request("GET", "/tasks", "tt_read", "")
+	var listed []Task
+	if err := json.Unmarshal(rec.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("GET /tasks answered %d %s", rec.Code, rec.Body)
+	}
+	var ids []int
+	for _, task := range listed {
+		ids = append(ids, task.ID)
+	}
+	if !reflect.DeepEqual(ids, []int{1, 3}) || rec.Header().Get("X-Total-Count") != "2" {
+		t.Errorf("filtered GET /tasks listed %v (X-Total-Count %s), want [1 3]", ids, rec.Header().Get("X-Total-Count"))
+	}
+
+	if left := queue.drain(5 * time.Second); left > 0 {
+		t.Fatalf("%d writes still queued", left)
+	}
+	if tasks := readStore(t); len(tasks) != 3 || tasks[0].Status != "todo" {
+		t.Errorf("refused writes changed the store: %+v", tasks)
+	}
+}
+
+// TestReadOnlyDataFile checks view-only mode on a tasks.json without write
+// permission: reading commands work under a banner, changes exit with code 3
+// naming the file and its owner, and doctor reports it
+func TestReadOnlyDataFile(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write any file")
+	}
+	useTestStore(t, []Task{{ID: 1, Title: "Look but do not touch", Status: "todo", CreatedAt: "2026-06-01 09:00:00"}})
+	if err := os.Chmod(dataFile, 0o444); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, stderr, err := runCommand(t, "list")
+	if err != nil || !strings.Contains(out, "Look but do not touch") || !strings.Contains(stderr, "[read-only]") {
+		t.Errorf("list printed %q and %q, %v; want the task under the read-only banner", out, stderr, err)
+	}
+
+	_, _, err = runCommand(t, "done", "1")
+	if exitCode(err) != 3 {
+		t.Fatalf("done on a read-only store: %v, exit code %d; want 3", err, exitCode(err))
+	}
+	abs, _ := filepath.Abs(dataFile)
+	info, _ := os.Stat(dataFile)
+	if owner := fileOwner(info); !strings.Contains(err.Error(), abs) || owner == "" || !strings.Contains(err.Error(), "owned by "+owner) {
+		t.Errorf("error %q does not name %s and its owner %q", err, abs, owner)
+	}
+	if after, _ := os.ReadFile(dataFile); !bytes.Equal(after, before) {
+		t.Error("a refused change rewrote the data file")
+	}
+
+	out, _, _ = runCommand(t, "doctor")
+	if !strings.Contains(out, "is read-only") || !strings.Contains(out, "exit with code 3") {
+		t.Errorf("doctor does not report the read-only store:\n%s", out)
+	}
+}
+
+// cancelAfter is a context canceled once Err has been asked calls times,
+// so a test can cancel at a known point inside a long operation
+type cancelAfter struct {
+	context.Context
+	mu    sync.Mutex
+	calls int
+}
+
+func (c *cancelAfter) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.calls--; c.calls < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+// TestImportCanceled checks that an import canceled halfway leaves
+// tasks.json byte for byte as it was
+func TestImportCanceled(t *testing.T) {
+	useTestStore(t, generateFixtures(1, 20, testNow))
+	before, err := os.ReadFile(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	incoming := generateFixtures(2, 20000, testNow)
+
+	ctx := &cancelAfter{Context: context.Background(), calls: 10000}
+	_, _, err = captureOutput(t, func() error { return importTasks(ctx, "big.json", incoming, true) })
+	if errorKind(err) != ErrCanceled || exitCode(err) != 130 {
+		t.Fatalf("canceled import returned %v (exit code %d)", err, exitCode(err))
+	}
+	if ctx.calls >= 0 {
+		t.Fatal("the import finished before it was canceled")
+	}
+	after, err := os.ReadFile(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after, before) {
+		t.Error("a canceled import changed tasks.json")
+	}
+	if matches, _ := filepath.Glob(dataFile + "*.tmp"); len(matches) > 0 {
+		t.Errorf("a canceled import left %v", matches)
+	}
+}
+
+// TestWriteParseReview checks that parseReview gives back exactly the tasks
+// writeReview wrote, whatever their text holds
+func TestWriteParseReview(t *testing.T) {
+	texts := []string{
+		"Zoë's café — naïve résumé",
+		"日本語のタイトル 🎉 and עברית",
+		"first line\nsecond line\n\n  indented after a blank line",
+		"[task 9]\n# not a comment\ntitle = \"not a field\"",
+		"ends with a backslash \\",
+		"tabs\tand \"quotes\" and <html> & entities",
+		"line separator\u2028 and windows\r\nendings",
+		"  leading and trailing spaces  ",
+	}
+	for i, text := range texts {
+		task := Task{ID: 10 - i, Title: text, Status: "todo", CreatedAt: "2026-06-01 09:00:00", Project: text, Tags: []string{text, "plain"},
+			Comments: []Comment{{At: "2026-06-02 10:00:00", Text: text + "\n" + text}}}
+		var buf bytes.Buffer
+		if err := writeReview(&buf, []Task{task}); err != nil {
+			t.Fatal(err)
+		}
+		tasks, err := parseReview(&buf, "test.review")
+		if err != nil {
+			t.Errorf("%q: %v", text, err)
+			continue
+		}
+		if !reflect.DeepEqual(tasks, []Task{task}) {
+			t.Errorf("%q: parsed back as %+v", text, tasks)
+		}
+	}
+
+	// tasks come back in ID order, and writing them again changes nothing
+	tasks := []Task{
+		{ID: 7, Title: texts[2], Status: "done", CreatedAt: "2026-06-01 09:00:00", CompletedAt: "2026-06-03 18:00:00"},
+		{ID: 2, Title: texts[1], Status: "in-progress", CreatedAt: "2026-06-01 09:00:00", BlockedBy: []int{7}},
+	}
+	var first, second bytes.Buffer
+	if err := writeReview(&first, tasks); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseReview(bytes.NewReader(first.Bytes()), "test.review")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, []Task{tasks[1], tasks[0]}) {
+		t.Errorf("parsed back as %+v", parsed)
+	}
+	if err := writeReview(&second, parsed); err != nil {
+		t.Fatal(err)
+	}
+	if first.String() != second.String() {
+		t.Errorf("writing the parsed tasks changed the review:\n%s", firstDifference(first.String(), second.String()))
+	}
+
+	for _, bad := range []string{
+		"title = \"no block\"\n",
+		"[task 1]\ntitle = \"a\"\ntitle = \"b\"\n",
+		"[task 1]\ntitle = not json\n",
+		"[task 1]\ncolour = \"unknown field\"\n",
+		"[task 1]\ntitle = \"a\"\nstatus = \"todo\"\ncreated_at = \"2026-06-01 09:00:00\"\n[task 1]\ntitle = \"b\"\nstatus = \"todo\"\ncreated_at = \"2026-06-01 09:00:00\"\n",
+	} {
+		if _, err := parseReview(strings.NewReader(bad), "bad.review"); errorKind(err) != ErrInvalid {
+			t.Errorf("parseReview(%q) = %v, want an invalid error", bad, err)
+		}
+	}
+}
+
+// TestRecurrenceMonthEnds checks month and year steps from days that
+// shorter months do not have
+func TestRecurrenceMonthEnds(t *testing.T) {
+	date := func(value string) time.Time {
+		d, err := time.ParseInLocation(dateLayout, value, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	tests := []struct{ from, every, want string }{
+		{"2026-01-31", "1mo", "2026-02-28"},
+		{"2028-01-31", "1mo", "2028-02-29"},
+		{"2026-03-31", "1mo", "2026-04-30"},
+		{"2026-12-31", "1mo", "2027-01-31"},
+		{"2026-01-31", "13mo", "2027-02-28"},
+		{"2028-02-29", "1y", "2029-02-28"},
+		{"2028-02-29", "4y", "2032-02-29"},
+		{"2027-02-28", "1y", "2028-02-28"},
+	}
+	for _, tt := range tests {
+		iv, err := parseInterval(tt.every)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := iv.addTo(date(tt.from)).Format(dateLayout); got != tt.want {
+			t.Errorf("%s + %s = %s, want %s", tt.from, tt.every, got, tt.want)
+		}
+	}
+
+	// a due-anchored series goes back to its day after a clamped month
+	series := []struct {
+		every string
+		dues  []string
+	}{
+		{"1mo", []string{"2026-01-31", "2026-02-28", "2026-03-31", "2026-04-30", "2026-05-31"}},
+		{"1y", []string{"2028-02-29", "2029-02-28", "2030-02-28", "2031-02-28", "2032-02-29"}},
+	}
+	for _, s := range series {
+		useTestStore(t, nil)
+		if _, _, err := runCommand(t, "add", "--every", s.every, "--anchor", "due", "--due", s.dues[0], "Pay rent"); err != nil {
+			t.Fatal(err)
+		}
+		for i, want := range s.dues[1:] {
+			if _, _, err := runCommand(t, "done", fmt.Sprint(i+1)); err != nil {
+				t.Fatal(err)
+			}
+			tasks := readStore(t)
+			if next := tasks[len(tasks)-1]; next.Status != "todo" || next.DueDate != want {
+				t.Errorf("%s series after %s: next is %s due %s, want due %s", s.every, s.dues[i], next.Status, next.DueDate, want)
+				break
+			}
+		}
+	}
+}
+
+// TestParsePriority checks every accepted spelling of a priority and the
+// message for one that is not
+func TestParsePriority(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Priority
+	}{
+		{"high", PriorityHigh}, {"HIGH", PriorityHigh}, {"h", PriorityHigh}, {"H", PriorityHigh},
+		{"a", PriorityHigh}, {"A", PriorityHigh}, {"(A)", PriorityHigh}, {"1", PriorityHigh}, {" High ", PriorityHigh},
+		{"medium", PriorityMedium}, {"Med", PriorityMedium}, {"m", PriorityMedium}, {"M", PriorityMedium},
+		{"B", PriorityMedium}, {"(b)", PriorityMedium}, {"2", PriorityMedium},
+		{"low", PriorityLow}, {"L", PriorityLow}, {"C", PriorityLow}, {"(C)", PriorityLow}, {"3", PriorityLow},
+		{"none", PriorityNone}, {"None", PriorityNone}, {"", PriorityNone}, {"  ", PriorityNone},
+	}
+	for _, tt := range tests {
+		got, err := parsePriority(tt.value)
+		if err != nil || got != tt.want {
+			t.Errorf("parsePriority(%q) = %v, %v; want %v", tt.value, got, err, tt.want)
+		}
+	}
+
+	for _, value := range []string{"urgent", "D", "4", "0", "hi", "(AB)"} {
+		_, err := parsePriority(value)
+		want := fmt.Sprintf("invalid priority %q (use high/medium/low, A/B/C or 1/2/3)", value)
+		if err == nil || err.Error() != want {
+			t.Errorf("parsePriority(%q) error = %v, want %s", value, err, want)
+		}
+	}
+
+	// stored values take the same spellings, as strings or numbers
+	for data, want := range map[string]Priority{`"B"`: PriorityMedium, `2`: PriorityMedium, `"(c)"`: PriorityLow, `1`: PriorityHigh} {
+		var p Priority
+		if err := json.Unmarshal([]byte(data), &p); err != nil || p != want {
+			t.Errorf("unmarshal %s = %v, %v; want %v", data, p, err, want)
+		}
+	}
+	if data, _ := json.Marshal(PriorityMedium); string(data) != `"medium"` {
+		t.Errorf("medium is stored as %s", data)
+	}
+}
+
+// TestUrgency checks each factor of the urgency score and that the score
+// is their weighted sum
+func TestUrgency(t *testing.T) {
+	day := func(offset int) string { return testNow.AddDate(0, 0, offset).Format(dateLayout) }
+	ago := func(days int) string { return testNow.Add(-time.Duration(days) * 24 * time.Hour).Format(timeLayout) }
+	type factors struct{ priority, due, age, pinned, blocked float64 }
+	tests := []struct {
+		name    string
+		task    Task
+		blocked bool
+		want    factors
+	}{
+		{"nothing set", Task{}, false, factors{}},
+		{"high", Task{Priority: PriorityHigh}, false, factors{priority: 1}},
+		{"medium", Task{Priority: PriorityMedium}, false, factors{priority: 0.65}},
+		{"low", Task{Priority: PriorityLow}, false, factors{priority: 0.3}},
+		{"due today", Task{DueDate: day(0)}, false, factors{due: 1 - 7*0.8/21}},
+		{"due in a week", Task{DueDate: day(7)}, false, factors{due: 1 - 14*0.8/21}},
+		{"due in two weeks", Task{DueDate: day(14)}, false, factors{due: 0.2}},
+		{"due in a month", Task{DueDate: day(30)}, false, factors{due: 0.2}},
+		{"three days overdue", Task{DueDate: day(-3)}, false, factors{due: 1 - 4*0.8/21}},
+		{"a week overdue", Task{DueDate: day(-7)}, false, factors{due: 1}},
+		{"a month overdue", Task{DueDate: day(-30)}, false, factors{due: 1}},
+		{"bad due date", Task{DueDate: "someday"}, false, factors{}},
+		{"73 days old", Task{CreatedAt: ago(73)}, false, factors{age: 0.2}},
+		{"two years old", Task{CreatedAt: ago(730)}, false, factors{age: 1}},
+		{"created later", Task{CreatedAt: ago(-2)}, false, factors{}},
+		{"pinned", Task{Pinned: true}, false, factors{pinned: 1}},
+		{"blocked", Task{}, true, factors{blocked: 1}},
+		{"everything", Task{Priority: PriorityHigh, DueDate: day(-7), CreatedAt: ago(730), Pinned: true}, true, factors{1, 1, 1, 1, 1}},
+	}
+	weights := defaultConfig().Urgency
+	for _, tt := range tests {
+		total, components := urgency(tt.task, testNow, tt.blocked, weights)
+		want := map[string]float64{"priority": tt.want.priority, "due": tt.want.due, "age": tt.want.age, "pinned": tt.want.pinned, "blocked": tt.want.blocked}
+		sum := 0.0
+		for _, c := range components {
+			if diff := c.Factor - want[c.Name]; diff > 1e-9 || diff < -1e-9 {
+				t.Errorf("%s: %s factor %.4f, want %.4f", tt.name, c.Name, c.Factor, want[c.Name])
+			}
+			sum += want[c.Name] * c.Weight
+		}
+		if len(components) != len(want) {
+			t.Errorf("%s: %d components, want %d", tt.name, len(components), len(want))
+		}
+		if diff := total - sum; diff > 1e-9 || diff < -1e-9 {
+			t.Errorf("%s: total %.4f, want %.4f", tt.name, total, sum)
+		}
+	}
+
+	// the weights come from the config
+	total, _ := urgency(Task{Priority: PriorityHigh, Pinned: true}, testNow, true, UrgencyWeights{Priority: 1, Pinned: 10, Blocked: -100})
+	if total != -89 {
+		t.Errorf("custom weights: total %v, want -89", total)
+	}
+}
+
+// TestOverdueBucket checks the buckets on both sides of the late and
+// very_late thresholds, with the defaults and with a config of its own
+func TestOverdueBucket(t *testing.T) {
+	useTestStore(t, nil)
+	dueDaysAgo := func(days int) Task {
+		return Task{Status: "todo", DueDate: testNow.AddDate(0, 0, -days).Format(dateLayout)}
+	}
+	tests := []struct {
+		late, veryLate int
+		daysLate       int
+		want           overdueLevel
+	}{
+		{3, 14, -1, NotOverdue},
+		{3, 14, 0, NotOverdue},
+		{3, 14, 1, OverdueRecent},
+		{3, 14, 2, OverdueRecent},
+		{3, 14, 3, OverdueLate},
+		{3, 14, 13, OverdueLate},
+		{3, 14, 14, OverdueSevere},
+		{3, 14, 400, OverdueSevere},
+		{1, 2, 1, OverdueLate},
+		{1, 2, 2, OverdueSevere},
+		{7, 7, 6, OverdueRecent},
+		{7, 7, 7, OverdueSevere},
+	}
+	for _, tt := range tests {
+		config.OverdueDays = OverdueThresholds{Late: tt.late, VeryLate: tt.veryLate}
+		level, days := overdueBucket(dueDaysAgo(tt.daysLate), testNow)
+		wantDays := max(tt.daysLate, 0)
+		if level != tt.want || days != wantDays {
+			t.Errorf("late %d, very_late %d, %d days late: bucket %d with %d days, want %d with %d", tt.late, tt.veryLate, tt.daysLate, level, days, tt.want, wantDays)
+		}
+	}
+
+	config.OverdueDays = defaultConfig().OverdueDays
+	for _, task := range []Task{
+		{Status: "done", DueDate: dueDaysAgo(30).DueDate},
+		{Status: "todo"},
+		{Status: "todo", DueDate: "not a date"},
+	} {
+		if level, days := overdueBucket(task, testNow); level != NotOverdue || days != 0 {
+			t.Errorf("%+v: bucket %d with %d days, want not overdue", task, level, days)
+		}
+	}
+	// the time of day does not matter, only the date
+	if level, days := overdueBucket(dueDaysAgo(3), time.Date(2026, 6, 10, 23, 59, 0, 0, time.Local)); level != OverdueLate || days != 3 {
+		t.Errorf("late in the evening: bucket %d with %d days", level, days)
+	}
+}
+
+// TestSundayWeekBucket checks that a task completed on a Sunday evening
+// lands in the same week in stats, report week and the time heatmap, for
+// either first day of the week
+func TestSundayWeekBucket(t *testing.T) {
+	sunday := time.Date(2026, 6, 7, 23, 45, 0, 0, time.Local)
+	for _, tt := range []struct{ weekStart, start string }{
+		{"monday", "2026-06-01"},
+		{"sunday", "2026-06-07"},
+	} {
+		useTestStore(t, []Task{{ID: 1, Title: "Weekend chores", Status: "done", CreatedAt: "2026-06-07 10:00:00", CompletedAt: "2026-06-07 23:30:00",
+			Project: "home", TimeLog: []TimeEntry{{Start: "2026-06-07 20:00:00", End: "2026-06-07 23:00:00"}}}})
+		config.WeekStart = tt.weekStart
+		clock = fixedClock(sunday)
+
+		out, _, err := runCommand(t, "stats", "--json")
+		var stats statsJSON
+		if err == nil {
+			err = json.Unmarshal([]byte(out), &stats)
+		}
+		if err != nil || stats.WeekStart != tt.start || stats.WeekCompleted != 1 || stats.WeekAdded != 1 {
+			t.Errorf("%s: stats week %s with %d added and %d completed (%v), want week %s with 1 and 1", tt.weekStart, stats.WeekStart, stats.WeekAdded, stats.WeekCompleted, err, tt.start)
+		}
+
+		out, _, err = runCommand(t, "report", "week", "--json")
+		var report periodSummary
+		if err == nil {
+			err = json.Unmarshal([]byte(out), &report)
+		}
+		if err != nil || report.Start != tt.start || report.Completed != 1 {
+			t.Errorf("%s: report week from %s with %d completed (%v), want %s with 1", tt.weekStart, report.Start, report.Completed, err, tt.start)
+		}
+
+		out, _, err = runCommand(t, "report", "time", "week", "--json")
+		var hours timeSummary
+		if err == nil {
+			err = json.Unmarshal([]byte(out), &hours)
+		}
+		if err != nil || hours.Start != tt.start || len(hours.Days) != 7 || hours.TotalHours != 3 {
+			t.Fatalf("%s: heatmap from %s over %d days with %v hours (%v), want %s, 7 days and 3 hours", tt.weekStart, hours.Start, len(hours.Days), hours.TotalHours, err, tt.start)
+		}
+		for _, d := range hours.Days {
+			if want := map[bool]float64{true: 3}[d.Date == "2026-06-07"]; d.Hours != want {
+				t.Errorf("%s: heatmap has %v hours on %s, want %v", tt.weekStart, d.Hours, d.Date, want)
+			}
+		}
+
+		// asked for by date from a later day, the same week holds it
+		clock = fixedClock(testNow)
+		out, _, _ = runCommand(t, "report", "week", "2026-06-07", "--json")
+		if err := json.Unmarshal([]byte(out), &report); err != nil || report.Start != tt.start || report.Completed != 1 {
+			t.Errorf("%s: report week 2026-06-07 from %s with %d completed (%v)", tt.weekStart, report.Start, report.Completed, err)
+		}
+	}
+}
+
+// TestActorSlotMerge checks that two copies of a store adding tasks on
+// their own, each with an actor slot, merge without any ID being changed,
+// while sequential IDs and a shared hashed slot collide
+func TestActorSlotMerge(t *testing.T) {
+	base := []Task{
+		{ID: 1, Title: "Shared one", Status: "todo", CreatedAt: "2026-06-01 09:00:00"},
+		{ID: 2, Title: "Shared two", Status: "todo", CreatedAt: "2026-06-01 09:05:00"},
+		{ID: 3, Title: "Shared three", Status: "todo", CreatedAt: "2026-06-01 09:10:00"},
+	}
+	// diverge writes what machine does to its copy of base, using its
+	// number as actor slot with actor IDs, and returns the IDs it added
+	diverge := func(allocation string, machine int, done string, titles ...string) []int {
+		useTestStore(t, base)
+		config.IDAllocation = allocation
+		if allocation == "actor" {
+			config.ActorSlot = machine
+		}
+		clock = fixedClock(testNow.Add(time.Duration(machine) * time.Minute))
+		var ids []int
+		for _, title := range titles {
+			out, _, err := runCommand(t, "add", "--quiet", title)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, err := parseID(strings.TrimSpace(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		if _, _, err := runCommand(t, "done", done); err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+	laptopFile := filepath.Join(t.TempDir(), "laptop.json")
+
+	laptopIDs := diverge("actor", 2, "2", "Laptop one", "Laptop two")
+	laptop := readStore(t)
+	data, err := os.ReadFile(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(laptopFile, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	desktopIDs := diverge("actor", 1, "1", "Desktop one", "Desktop two", "Desktop three")
+	desktop := readStore(t)
+	if !reflect.DeepEqual(laptopIDs, []int{2001, 2002}) || !reflect.DeepEqual(desktopIDs, []int{1001, 1002, 1003}) {
+		t.Fatalf("slots 2 and 1 added %v and %v", laptopIDs, desktopIDs)
+	}
+
+	if _, _, err := runCommand(t, "merge", laptopFile); err != nil {
+		t.Fatal(err)
+	}
+	merged := map[int]Task{}
+	for _, task := range readStore(t) {
+		merged[task.ID] = task
+	}
+	if len(merged) != 8 {
+		t.Errorf("merged store has %d tasks, want 8", len(merged))
+	}
+	for _, side := range [][]Task{desktop, laptop} {
+		for _, task := range side {
+			if got, ok := merged[task.ID]; !ok || got.Title != task.Title || got.CreatedAt != task.CreatedAt {
+				t.Errorf("task %d %q is %q after the merge", task.ID, task.Title, got.Title)
+			}
+		}
+	}
+	if merged[1].Status != "done" || merged[2].Status != "done" || merged[3].Status != "todo" {
+		t.Errorf("shared tasks after the merge: %s, %s, %s; want done, done, todo", merged[1].Status, merged[2].Status, merged[3].Status)
+	}
+
+	// the same work with sequential IDs hands out 4 and 5 on both sides
+	diverge("sequential", 2, "2", "Laptop one", "Laptop two")
+	data, _ = os.ReadFile(dataFile)
+	os.WriteFile(laptopFile, data, 0o644)
+	diverge("sequential", 1, "1", "Desktop one", "Desktop two")
+	if _, _, err := runCommand(t, "merge", laptopFile); errorKind(err) != ErrInvalid || !strings.Contains(err.Error(), "id_allocation") {
+		t.Errorf("merging colliding sequential IDs: %v", err)
+	}
+
+	// without actor_slot the slot is hashed, so two machines can share it:
+	// the first ID taken warns, and the collision points at actor_slot
+	hashed := func(minute int, title string) string {
+		useTestStore(t, base)
+		config.IDAllocation, config.Actor = "actor", "same-name"
+		clock = fixedClock(testNow.Add(time.Duration(minute) * time.Minute))
+		_, stderr, err := runCommand(t, "add", title)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, again, err := runCommand(t, "add", title+" again"); err != nil || again != "" {
+			t.Errorf("second ID in the slot warned %q, %v", again, err)
+		}
+		return stderr
+	}
+	if stderr := hashed(2, "Laptop one"); !strings.Contains(stderr, "actor_slot") {
+		t.Errorf("first hashed-slot ID printed %q on stderr, want an actor_slot warning", stderr)
+	}
+	data, _ = os.ReadFile(dataFile)
+	os.WriteFile(laptopFile, data, 0o644)
+	hashed(1, "Desktop one")
+	if _, _, err := runCommand(t, "merge", laptopFile); errorKind(err) != ErrInvalid || !strings.Contains(err.Error(), "actor_slot") {
+		t.Errorf("merging IDs from the same hashed slot: %v", err)
+	}
+}
+
+// TestMergeConflicts checks that a merge journals the comments only the
+// losing side added before it saves, refuses to merge when it cannot, and
+// that restoring them keeps what the winning side added
+func TestMergeConflicts(t *testing.T) {
+	shared := Comment{At: "2026-06-01 10:00:00", Text: "Agreed on scope"}
+	here := Comment{At: "2026-06-08 10:00:00", Text: "Added on this machine"}
+	there := Comment{At: "2026-06-09 10:00:00", Text: "Added on the other"}
+	useTestStore(t, []Task{{ID: 1, Title: "Shared", Status: "todo", CreatedAt: "2026-06-01 09:00:00",
+		Comments: []Comment{shared, here}}})
+	otherFile := filepath.Join(t.TempDir(), "other.json")
+	other, err := json.Marshal([]Task{{ID: 1, Title: "Shared, renamed", Status: "todo", CreatedAt: "2026-06-01 09:00:00",
+		Comments: []Comment{shared, there},
+		History:  []HistoryEvent{{At: "2026-06-09 11:00:00", Field: "title", From: "Shared", To: "Shared, renamed"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(otherFile, other, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a journal that cannot be written leaves the store as it was
+	if err := os.Mkdir(conflictFile, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := runCommand(t, "merge", otherFile); errorKind(err) != ErrIO {
+		t.Errorf("merging without a writable journal: %v, want an IO error", err)
+	}
+	if tasks := readStore(t); tasks[0].Title != "Shared" {
+		t.Errorf("a merge that could not journal saved %q", tasks[0].Title)
+	}
+	os.Remove(conflictFile)
+
+	if _, _, err := runCommand(t, "merge", otherFile); err != nil {
+		t.Fatal(err)
+	}
+	if tasks := readStore(t); !reflect.DeepEqual(tasks[0].Comments, []Comment{shared, there}) {
+		t.Errorf("merged comments %v, want the other side's", tasks[0].Comments)
+	}
+	out, _, err := runCommand(t, "conflicts", "list")
+	if err != nil || !strings.Contains(out, "comments, kept theirs") {
+		t.Errorf("conflicts list = %q, %v", out, err)
+	}
+	out, _, err = runCommand(t, "conflicts", "show", "1")
+	if err != nil || !strings.Contains(out, here.Text) || !strings.Contains(out, "conflicts restore 1") {
+		t.Errorf("conflicts show 1 = %q, %v", out, err)
+	}
+
+	if _, _, err := runCommand(t, "conflicts", "restore", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if tasks := readStore(t); !reflect.DeepEqual(tasks[0].Comments, []Comment{shared, there, here}) {
+		t.Errorf("restored comments %v, want both sides'", tasks[0].Comments)
+	}
+	if _, _, err := runCommand(t, "conflicts", "restore", "1"); errorKind(err) != ErrInvalid {
+		t.Errorf("restoring conflict 1 twice: %v", err)
+	}
+
+	// records past retention.conflict_days are pruned, and only counted
+	// on a dry run
+	clock = fixedClock(testNow.AddDate(0, 0, config.Retention.ConflictDays+1))
+	if _, _, err := runCommand(t, "maintain", "--prune-conflicts", "--dry-run"); err != nil {
+		t.Fatal(err)
+	}
+	if records, err := loadConflicts(); err != nil || len(records) != 1 {
+		t.Errorf("a dry run left %d conflict records, %v", len(records), err)
+	}
+	if _, _, err := runCommand(t, "maintain", "--prune-conflicts"); err != nil {
+		t.Fatal(err)
+	}
+	if records, err := loadConflicts(); err != nil || len(records) != 0 {
+		t.Errorf("pruning left %d conflict records, %v", len(records), err)
+	}
+}
+
+// TestSplitByDay checks that tracked time is split at each local midnight,
+// across two midnights and across the spring-forward gap
+func TestSplitByDay(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	at := func(loc *time.Location, value string) time.Time {
+		tm, err := time.ParseInLocation(timeLayout, value, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	tests := []struct {
+		name       string
+		loc        *time.Location
+		start, end string
+		want       []daySpan
+	}{
+		{"two midnights", newYork, "2026-06-09 22:00:00", "2026-06-11 01:30:00",
+			[]daySpan{{"2026-06-09", 2 * time.Hour}, {"2026-06-10", 24 * time.Hour}, {"2026-06-11", 90 * time.Minute}}},
+		{"spring forward", newYork, "2026-03-07 22:00:00", "2026-03-08 04:00:00",
+			[]daySpan{{"2026-03-07", 2 * time.Hour}, {"2026-03-08", 3 * time.Hour}}},
+		{"over the short day", newYork, "2026-03-07 12:00:00", "2026-03-09 12:00:00",
+			[]daySpan{{"2026-03-07", 12 * time.Hour}, {"2026-03-08", 23 * time.Hour}, {"2026-03-09", 12 * time.Hour}}},
+		{"over the long day", newYork, "2026-10-31 12:00:00", "2026-11-02 12:00:00",
+			[]daySpan{{"2026-10-31", 12 * time.Hour}, {"2026-11-01", 25 * time.Hour}, {"2026-11-02", 12 * time.Hour}}},
+		{"ends at midnight", time.UTC, "2026-06-09 23:00:00", "2026-06-10 00:00:00",
+			[]daySpan{{"2026-06-09", time.Hour}}},
+		{"within a day", time.UTC, "2026-06-09 09:00:00", "2026-06-09 09:45:00",
+			[]daySpan{{"2026-06-09", 45 * time.Minute}}},
+		{"empty", time.UTC, "2026-06-09 09:00:00", "2026-06-09 09:00:00", nil},
+		{"backwards", time.UTC, "2026-06-09 10:00:00", "2026-06-09 09:00:00", nil},
+	}
+	for _, tt := range tests {
+		start, end := at(tt.loc, tt.start), at(tt.loc, tt.end)
+		got := splitByDay(start, end)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: splitByDay(%s, %s) = %v, want %v", tt.name, tt.start, tt.end, got, tt.want)
+		}
+		total := time.Duration(0)
+		for _, span := range got {
+			total += span.Duration
+		}
+		if elapsed := max(end.Sub(start), 0); total != elapsed {
+			t.Errorf("%s: the days add up to %v of %v", tt.name, total, elapsed)
+		}
+	}
+}
+
+// defaultColors are the colors before any test turns them off
+var defaultColors = []string{ColorReset, ColorBright, ColorDim, ColorRed, ColorGreen, ColorYellow, ColorBlue, ColorCyan, ColorWhite}
+
+// ansiEscape matches the color codes of colored output
+var ansiEscape = regexp.MustCompile("\033\\[[0-9;]*m")
+
+// TestPlainOutputKeepsMeaning checks that every status and severity shown
+// in color is also written out: --plain output is the colored output of
+// each theme without its color codes, and holds the status words, overdue
+// markers and over-budget label
+func TestPlainOutputKeepsMeaning(t *testing.T) {
+	day := func(offset int) string { return testNow.AddDate(0, 0, offset).Format(dateLayout) }
+	tasks := []Task{
+		{ID: 1, Title: "Waiting to start", Status: "todo", CreatedAt: "2026-06-01 09:00:00", Project: "work"},
+		{ID: 2, Title: "Under way", Status: "in-progress", CreatedAt: "2026-06-01 09:00:00", Project: "work"},
+		{ID: 3, Title: "Finished", Status: "done", CreatedAt: "2026-06-01 09:00:00", CompletedAt: "2026-06-09 12:00:00", Project: "work"},
+		{ID: 4, Title: "A little late", Status: "todo", CreatedAt: "2026-05-01 09:00:00", DueDate: day(-1)},
+		{ID: 5, Title: "Rather late", Status: "todo", CreatedAt: "2026-05-01 09:00:00", DueDate: day(-5)},
+		{ID: 6, Title: "Very late", Status: "in-progress", CreatedAt: "2026-05-01 09:00:00", DueDate: day(-20)},
+	}
+	commands := [][]string{{"list"}, {"agenda"}, {"next", "--count", "10"}, {"projects"}, {"show", "6"}}
+	run := func() []string {
+		var outs []string
+		for _, args := range commands {
+			out, _, err := runCommand(t, args...)
+			if err != nil {
+				t.Fatalf("%v: %v", args, err)
+			}
+			outs = append(outs, out)
+		}
+		return outs
+	}
+	setup := func() {
+		useTestStore(t, tasks)
+		config.Budgets = map[string]Budget{"work": {OpenTasks: 1}}
+	}
+
+	setup()
+	plain := run()
+	list, agenda, projects := plain[0], plain[1], plain[3]
+	for _, want := range []string{
+		"Waiting to start (todo)", "Under way (in-progress)", "Finished (done)",
+		"A little late (todo)", "Rather late (todo)", "Very late (in-progress)",
+	} {
+		if !strings.Contains(list, want) {
+			t.Errorf("plain list has no %q:\n%s", want, list)
+		}
+	}
+	for _, want := range []string{"(1 day late) !\n", "(5 days late) !!\n", "(20 days late) !!!\n"} {
+		if !strings.Contains(list+agenda, want) {
+			t.Errorf("plain list and agenda have no overdue marker %q:\n%s\n%s", want, list, agenda)
+		}
+	}
+	if !strings.Contains(projects, "2/1 over") {
+		t.Errorf("plain projects does not say the work budget is over:\n%s", projects)
+	}
+
+	for _, theme := range []string{"default", "colorblind"} {
+		setup()
+		colors := []*string{&ColorReset, &ColorBright, &ColorDim, &ColorRed, &ColorGreen, &ColorYellow, &ColorBlue, &ColorCyan, &ColorWhite}
+		for i, color := range colors {
+			*color = defaultColors[i]
+		}
+		themes[theme]()
+		globals.Plain = false
+		for i, out := range run() {
+			if !strings.Contains(out, "\033[") {
+				t.Errorf("%s theme: %v printed no colors", theme, commands[i])
+			}
+			if stripped := ansiEscape.ReplaceAllString(out, ""); stripped != plain[i] {
+				t.Errorf("%s theme: %v says more in color than plain:\n%s", theme, commands[i], firstDifference(stripped, plain[i]))
+			}
+		}
+	}
+}
+
+// TestWorkingDays checks that working days skip weekends and holidays, and
+// that a holiday on a Saturday is not taken off a second time
+func TestWorkingDays(t *testing.T) {
+	// testNow is Wednesday June 10; June 12 is a Friday, June 13 a Saturday
+	for _, tt := range []struct {
+		name     string
+		holidays string
+		count    int    // working days after Wednesday up to next Wednesday
+		plus3    string // +3wd from Wednesday
+	}{
+		{"no holidays", "", 5, "2026-06-15"},
+		{"on a Saturday", "2026-06-13,Saturday fair\n", 5, "2026-06-15"},
+		{"on a Friday", "2026-06-12,Bridge day\n", 4, "2026-06-16"},
+		{"on both", "2026-06-12,Bridge day\n2026-06-13,Saturday fair\n", 4, "2026-06-16"},
+	} {
+		useTestStore(t, []Task{{ID: 1, Title: "Ship it", Status: "todo", CreatedAt: "2026-06-01 09:00:00", DueDate: "2026-06-17"}})
+		if tt.holidays != "" {
+			file := filepath.Join(t.TempDir(), "holidays.csv")
+			if err := os.WriteFile(file, []byte(tt.holidays), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := runCommand(t, "holidays", "import", file); err != nil {
+				t.Fatal(err)
+			}
+			calendarOnce = sync.Once{}
+		}
+
+		nextWeek := testNow.AddDate(0, 0, 7)
+		if got := workingCalendar().workingDaysBetween(testNow, nextWeek); got != tt.count {
+			t.Errorf("%s: %d working days in the week ahead, want %d", tt.name, got, tt.count)
+		}
+		if due, err := parseDate("+3wd", testNow); err != nil || due.Format(dateLayout) != tt.plus3 {
+			t.Errorf("%s: +3wd is %s (%v), want %s", tt.name, due.Format(dateLayout), err, tt.plus3)
+		}
+		out, _, _ := runCommand(t, "show", "1")
+		if want := fmt.Sprintf("Due:        2026-06-17 (%d working days left)", tt.count); !strings.Contains(out, want) {
+			t.Errorf("%s: show has no %q:\n%s", tt.name, want, out)
+		}
+		out, _, _ = runCommand(t, "agenda", "--days", "7")
+		if want := fmt.Sprintf("Next 7 days, %d working days (1):", tt.count); !strings.Contains(out, want) {
+			t.Errorf("%s: agenda has no %q:\n%s", tt.name, want, out)
+		}
+	}
+}
+
+// TestCompact checks that compact drops history past retention, keeps the
+// newest comments behind a marker, folds old tracked sessions into daily
+// totals without changing the time tracked, backs the file up first, and
+// leaves recently modified tasks alone
+func TestCompact(t *testing.T) {
+	var comments []Comment
+	for i := range 55 {
+		comments = append(comments, Comment{At: fmt.Sprintf("2026-01-01 10:%02d:00", i), Text: fmt.Sprintf("Comment %d", i)})
+	}
+	old := Task{ID: 1, Title: "Long running", Status: "todo", CreatedAt: "2025-01-01 09:00:00",
+		History: []HistoryEvent{
+			{At: "2025-06-01 09:00:00", Field: "title", From: "Long", To: "Longer"},
+			{At: "2025-06-02 09:00:00", Field: "title", From: "Longer", To: "Long running"},
+			{At: "2026-05-01 09:00:00", Field: "priority", From: "low", To: "high"},
+		},
+		Comments: comments,
+		TimeLog: []TimeEntry{
+			{Start: "2026-02-02 09:00:00", End: "2026-02-02 10:00:00"},
+			{Start: "2026-02-02 14:00:00", End: "2026-02-02 15:30:00"},
+			{Start: "2026-02-02 16:00:00", End: "2026-02-02 16:30:00"},
+			{Start: "2026-02-03 23:00:00", End: "2026-02-04 01:00:00"},
+			{Start: "2026-02-04 08:00:00", End: "2026-02-04 08:45:00"},
+			{Start: "2026-06-01 09:00:00", End: "2026-06-01 10:00:00"},
+		},
+	}
+	touched := old
+	touched.ID, touched.Title = 2, "Just touched"
+	touched.History = append(slices.Clone(old.History), HistoryEvent{At: "2026-06-10 08:30:00", Field: "pinned", To: "true"})
+	useTestStore(t, []Task{old, touched})
+	if err := os.Chmod(dataFile, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	original, err := os.ReadFile(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracked := func(task Task) time.Duration {
+		var total time.Duration
+		for _, entry := range task.TimeLog {
+			start, _ := parseTimestamp(entry.Start)
+			end, _ := parseTimestamp(entry.End)
+			total += end.Sub(start)
+		}
+		return total
+	}
+
+	out, _, err := runCommand(t, "compact")
+	if err != nil || !strings.Contains(out, "Nothing written") {
+		t.Fatalf("compact without --yes = %q, %v", out, err)
+	}
+	if data, _ := os.ReadFile(dataFile); !bytes.Equal(data, original) {
+		t.Error("compact without --yes changed the data file")
+	}
+
+	if _, _, err := runCommand(t, "compact", "--yes"); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := os.ReadFile(dataFile + ".20260610-093000.bak")
+	if err != nil || !bytes.Equal(backup, original) {
+		t.Errorf("backup does not hold the file before compaction: %v", err)
+	}
+	if mode := fileMode(dataFile + ".20260610-093000.bak"); mode != 0o600 {
+		t.Errorf("backup of a 0600 data file has mode %v", mode)
+	}
+	tasks := readStore(t)
+	got := tasks[0]
+	if want := []HistoryEvent{{At: "2025-06-02 09:00:00", Field: compactedField, Note: "2 older changes removed"}, old.History[2]}; !reflect.DeepEqual(got.History, want) {
+		t.Errorf("compacted history %v, want %v", got.History, want)
+	}
+	if want := append([]Comment{{At: "2026-01-01 10:04:00", Text: "5 older comments removed", Tags: []string{compactedField}}}, comments[5:]...); !reflect.DeepEqual(got.Comments, want) {
+		t.Errorf("compacted comments start %v, want %v", got.Comments[:2], want[:2])
+	}
+	wantLog := []TimeEntry{
+		{Start: "2026-02-02 00:00:00", End: "2026-02-02 03:00:00"},
+		{Start: "2026-02-03 00:00:00", End: "2026-02-03 01:00:00"},
+		{Start: "2026-02-04 00:00:00", End: "2026-02-04 01:45:00"},
+		{Start: "2026-06-01 09:00:00", End: "2026-06-01 10:00:00"},
+	}
+	if !reflect.DeepEqual(got.TimeLog, wantLog) {
+		t.Errorf("compacted time log %v, want %v", got.TimeLog, wantLog)
+	}
+	if tracked(got) != tracked(old) {
+		t.Errorf("compaction changed the time tracked from %v to %v", tracked(old), tracked(got))
+	}
+	if !reflect.DeepEqual(tasks[1], touched) {
+		t.Error("compact changed a task modified in the last 24 hours")
+	}
+
+	out, _, err = runCommand(t, "compact", "--yes")
+	if err != nil || !strings.Contains(out, "Nothing to compact") {
+		t.Errorf("compacting twice = %q, %v", out, err)
+	}
+	// a lower limit adds to the count the marker already holds
+	config.Retention.MaxComments = 45
+	if _, _, err := runCommand(t, "compact", "--yes"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readStore(t)[0].Comments; len(got) != 46 || got[0].Text != "10 older comments removed" {
+		t.Errorf("compacting to 45 comments left %d, starting %q", len(got), got[0].Text)
+	}
+}
+
+// TestSaveKeepsFile checks that saving replaces the data file without
+// changing its permissions, and writes through a symlinked data file
+// instead of replacing the link
+func TestSaveKeepsFile(t *testing.T) {
+	useTestStore(t, []Task{{ID: 1, Title: "Private", Status: "todo", CreatedAt: "2026-06-01 09:00:00"}})
+	if err := os.Chmod(dataFile, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := runCommand(t, "add", "Second"); err != nil {
+		t.Fatal(err)
+	}
+	if mode := fileMode(dataFile); mode != 0o600 {
+		t.Errorf("saving a 0600 data file left mode %v", mode)
+	}
+
+	real := filepath.Join(t.TempDir(), "synced.json")
+	data, err := os.ReadFile(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(real, data, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(t.TempDir(), "tasks.json")
+	if err := os.Symlink(real, link); err != nil {
+		t.Fatal(err)
+	}
+	useDataFile(link, "test")
+	if _, _, err := runCommand(t, "add", "Third"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("saving replaced the symlinked data file: %v", err)
+	}
+	if mode := fileMode(real); mode != 0o640 {
+		t.Errorf("saving through a symlink left mode %v", mode)
+	}
+	if tasks := readStore(t); len(tasks) != 3 {
+		t.Errorf("the linked store holds %d tasks, want 3", len(tasks))
+	}
+}
+
+// TestProgressReporter checks that progress is throttled to a few updates a
+// second on a terminal and one every two seconds otherwise, always shows
+// the last item, adds an ETA once an operation takes a few seconds, and
+// that merge and doctor report it unless --quiet is given
+func TestProgressReporter(t *testing.T) {
+	start := time.Date(2026, 6, 10, 9, 30, 0, 0, time.UTC)
+	at := start
+	report := func(tty, quiet bool) (*progressReporter, *bytes.Buffer) {
+		var out bytes.Buffer
+		at = start
+		return &progressReporter{label: "merging", total: 10, quiet: quiet, tty: tty, out: &out,
+			now: func() time.Time { return at }, started: start}, &out
+	}
+	step := func(p *progressReporter, after time.Duration) {
+		at = start.Add(after)
+		p.Add(1)
+	}
+
+	p, out := report(false, false)
+	for _, after := range []time.Duration{100 * time.Millisecond, 2100 * time.Millisecond, 2500 * time.Millisecond, 5 * time.Second} {
+		step(p, after)
+	}
+	for i := 4; i < 10; i++ {
+		step(p, 5*time.Second+time.Duration(i)*time.Millisecond)
+	}
+	p.Finish()
+	want := "merging: processed 2 / 10\n" +
+		"merging: processed 4 / 10 (5s elapsed, ETA 8s)\n" +
+		"merging: processed 10 / 10 (5s elapsed, ETA 0s)\n"
+	if out.String() != want {
+		t.Errorf("plain progress:\n%q\nwant\n%q", out.String(), want)
+	}
+
+	p, out = report(true, false)
+	step(p, 100*time.Millisecond)
+	step(p, 300*time.Millisecond)
+	step(p, 400*time.Millisecond)
+	p.Finish()
+	if want := "\r\033[Kmerging: processed 2 / 10\r\033[K"; out.String() != want {
+		t.Errorf("terminal progress %q, want %q", out.String(), want)
+	}
+
+	p, out = report(true, true)
+	for i := range 10 {
+		step(p, time.Duration(i)*time.Second)
+	}
+	p.Finish()
+	if out.Len() != 0 {
+		t.Errorf("quiet progress printed %q", out.String())
+	}
+
+	useTestStore(t, []Task{{ID: 1, Title: "Shared", Status: "todo", CreatedAt: "2026-06-01 09:00:00"}})
+	otherFile := filepath.Join(t.TempDir(), "other.json")
+	data, err := os.ReadFile(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(otherFile, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"merge", otherFile}, {"doctor"}} {
+		_, stderr, err := runCommand(t, args...)
+		if err != nil || !strings.Contains(stderr, "processed 1 / 1") {
+			t.Errorf("%s printed %q on stderr, %v", args[0], stderr, err)
+		}
+		_, stderr, err = runCommand(t, append(args, "--quiet")...)
+		if err != nil || stderr != "" {
+			t.Errorf("%s --quiet printed %q on stderr, %v", args[0], stderr, err)
+		}
+	}
+}
+
+// TestParseCron checks the fields a cron expression sets and the
+// expressions it refuses
+func TestParseCron(t *testing.T) {
+	bits := func(values ...int) cronField {
+		var field cronField
+		for _, v := range values {
+			field |= 1 << v
+		}
+		return field
+	}
+	every := func(lo, hi int) cronField {
+		var field cronField
+		for v := lo; v <= hi; v++ {
+			field |= 1 << v
+		}
+		return field
+	}
+	valid := []struct {
+		expr string
+		want cronSchedule
+	}{
+		{"0 9 * * 1-5", cronSchedule{minute: bits(0), hour: bits(9), dom: every(1, 31), month: every(1, 12), dow: bits(1, 2, 3, 4, 5), anyDom: true}},
+		{"*/15 * * * *", cronSchedule{minute: bits(0, 15, 30, 45), hour: every(0, 23), dom: every(1, 31), month: every(1, 12), dow: every(0, 7), anyDom: true, anyDow: true}},
+		{"5,10-20/5 8 1,15 6 7", cronSchedule{minute: bits(5, 10, 15, 20), hour: bits(8), dom: bits(1, 15), month: bits(6), dow: bits(0, 7)}},
+		{"0 9 */2 * 1-5", cronSchedule{minute: bits(0), hour: bits(9), dom: bits(1, 3, 5, 7, 9, 11, 13, 15, 17, 19, 21, 23, 25, 27, 29, 31), month: every(1, 12), dow: bits(1, 2, 3, 4, 5), anyDom: true}},
+		{"0 9 10-31/10 * */2", cronSchedule{minute: bits(0), hour: bits(9), dom: bits(10, 20, 30), month: every(1, 12), dow: bits(0, 2, 4, 6), anyDow: true}},
+	}
+	for _, tt := range valid {
+		got, err := parseCron(tt.expr)
+		if err != nil || got != tt.want {
+			t.Errorf("parseCron(%q) = %+v, %v; want %+v", tt.expr, got, err, tt.want)
+		}
+	}
+	for _, expr := range []string{"", "0 9 * *", "0 9 * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8",
+		"*/0 * * * *", "5-1 * * * *", "a * * * *", "1-x * * * *", "*/x * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) accepted it", expr)
+		}
+	}
+}
+
+// TestCronSchedule checks which minutes a schedule matches: both day
+// fields must match when either starts with *, and either one otherwise,
+// as in cron; and how far back latest looks for a missed slot
+func TestCronSchedule(t *testing.T) {
+	at := func(value string) time.Time {
+		parsed, err := time.ParseInLocation("2006-01-02 15:04:05", value, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	matches := []struct {
+		expr, at string
+		want     bool
+	}{
+		{"0 9 * * 1-5", "2026-06-10 09:00:00", true},
+		{"0 9 * * 1-5", "2026-06-13 09:00:00", false},
+		{"0 9 * * 1-5", "2026-06-10 09:01:00", false},
+		// */2 restricts the days of the month, but is still a * field
+		{"0 9 */2 * 1-5", "2026-06-11 09:00:00", true},
+		{"0 9 */2 * 1-5", "2026-06-10 09:00:00", false},
+		{"0 9 */2 * 1-5", "2026-06-13 09:00:00", false},
+		{"0 9 1,15 * 1", "2026-06-08 09:00:00", true},
+		{"0 9 1,15 * 1", "2026-07-01 09:00:00", true},
+		{"0 9 1,15 * 1", "2026-06-10 09:00:00", false},
+		{"30 9 * * 0", "2026-06-14 09:30:00", true},
+		{"30 9 * * 7", "2026-06-14 09:30:00", true},
+		{"30 9 * 7 *", "2026-06-14 09:30:00", false},
+	}
+	for _, tt := range matches {
+		sched, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sched.matches(at(tt.at)); got != tt.want {
+			t.Errorf("%q matches %s: %v, want %v", tt.expr, tt.at, got, tt.want)
+		}
+	}
+
+	sched, err := parseCron("0 9 * * 1-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := []struct {
+		now  string
+		want string // empty for no slot
+	}{
+		{"2026-06-10 09:00:45", "2026-06-10 09:00:00"},
+		{"2026-06-10 09:30:00", "2026-06-10 09:00:00"},
+		{"2026-06-10 10:00:00", "2026-06-10 09:00:00"},
+		{"2026-06-10 10:01:00", ""},
+		{"2026-06-10 08:59:59", ""},
+		{"2026-06-13 09:30:00", ""},
+	}
+	for _, tt := range latest {
+		got, ok := sched.latest(at(tt.now), digestCatchUp)
+		if tt.want == "" {
+			if ok {
+				t.Errorf("latest at %s = %s, want none within %v", tt.now, got, digestCatchUp)
+			}
+		} else if !ok || !got.Equal(at(tt.want)) {
+			t.Errorf("latest at %s = %s, %v; want %s", tt.now, got, ok, tt.want)
+		}
+	}
+}
+
+// TestSendDueDigest checks that a digest slot is sent once, however often
+// the daemon finds it due, and that the next slot is sent again
+func TestSendDueDigest(t *testing.T) {
+	useTestStore(t, []Task{{ID: 1, Title: "Overdue", Status: "todo", CreatedAt: "2026-06-01 09:00:00", DueDate: "2026-06-09"}})
+	var mu sync.Mutex
+	var slots []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event struct {
+			Data digestData `json:"data"`
+		}
+		json.NewDecoder(r.Body).Decode(&event)
+		mu.Lock()
+		slots = append(slots, event.Data.Slot)
+		mu.Unlock()
+	}))
+	defer server.Close()
+	config.WebhookURL = server.URL
+
+	for _, slot := range []string{"2026-06-10 09:00", "2026-06-10 09:00", "2026-06-11 09:00", "2026-06-11 09:00"} {
+		if _, _, err := captureOutput(t, func() error { return sendDueDigest(context.Background(), slot) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"2026-06-10 09:00", "2026-06-11 09:00"}; !reflect.DeepEqual(slots, want) {
+		t.Errorf("sent slots %v, want %v", slots, want)
+	}
+	if state, err := loadState(); err != nil || state.DigestSlot != "2026-06-11 09:00" {
+		t.Errorf("state file holds slot %q, %v", state.DigestSlot, err)
+	}
+}
+
+// TestUndoLastCompletion checks that done --undo-last gives back the task
+// as it was before done: status, the wait done cleared, no late reason and
+// no next occurrence, with only history telling the two apart
+func TestUndoLastCompletion(t *testing.T) {
+	before := Task{ID: 1, Title: "Chase the vendor", Status: "in-progress", CreatedAt: "2026-06-01 09:00:00",
+		DueDate: "2026-06-05", Recurrence: "1w",
+		Waiting:  &WaitingOn{Person: "Alice Until", Since: "2026-06-03 10:00:00", Until: "2026-06-12"},
+		Comments: []Comment{{At: "2026-06-02 09:00:00", Text: "Asked for a quote"}},
+		History: []HistoryEvent{
+			{At: "2026-06-02 08:00:00", Field: "status", From: "todo", To: "in-progress"},
+			{At: "2026-06-03 10:00:00", Field: "waiting", To: "Alice Until until 2026-06-12"},
+		},
+	}
+	useTestStore(t, []Task{before})
+
+	if _, _, err := runCommand(t, "done", "1", "--reason", "vendor was slow"); err != nil {
+		t.Fatal(err)
+	}
+	done := readStore(t)
+	if len(done) != 2 || done[0].Waiting != nil || len(done[0].Comments) != 2 {
+		t.Fatalf("done left %d tasks, waiting %v, %d comments", len(done), done[0].Waiting, len(done[0].Comments))
+	}
+
+	clock = fixedClock(testNow.Add(time.Minute))
+	if _, _, err := runCommand(t, "done", "--undo-last"); err != nil {
+		t.Fatal(err)
+	}
+	after := readStore(t)
+	if len(after) != 1 {
+		t.Fatalf("undo left %d tasks, want the next occurrence removed", len(after))
+	}
+	got := after[0]
+	if len(got.History) <= len(before.History) {
+		t.Errorf("undo left history %v", got.History)
+	}
+	got.History = before.History
+	if !reflect.DeepEqual(got, before) {
+		t.Errorf("after done --undo-last:\n%+v\nwant the task before done:\n%+v", got, before)
+	}
+}